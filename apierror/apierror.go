@@ -0,0 +1,143 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Error is a request the provider answered with a non-2xx status.
+type Error struct {
+	Provider   string
+	Status     int
+	Code       string
+	Type       string
+	Message    string
+	RequestID  string
+	RetryAfter string
+	// RequestTokens is the size of the request as counted locally, used when
+	// the provider does not say how long the context was.
+	RequestTokens int
+}
+
+// contextTokens finds the token count in OpenAI's context length message,
+// "... your messages resulted in 9000 tokens ...".
+var contextTokens = regexp.MustCompile(`resulted in (\d+) tokens`)
+
+// requestIDHeaders are the headers OpenAI and Azure send the request ID in.
+var requestIDHeaders = []string{"x-request-id", "apim-request-id", "x-ms-request-id"}
+
+// Check returns nil for a 2xx response, and otherwise reads the error body of
+// resp into an *Error.
+func Check(provider string, resp *http.Response, requestTokens int) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return FromResponse(provider, resp, requestTokens)
+}
+
+// FromResponse reads the OpenAI or Azure error body of resp into an *Error.
+func FromResponse(provider string, resp *http.Response, requestTokens int) *Error {
+	e := &Error{Provider: provider, Status: resp.StatusCode, RequestTokens: requestTokens}
+	for _, name := range requestIDHeaders {
+		if id := resp.Header.Get(name); id != "" {
+			e.RequestID = id
+			break
+		}
+	}
+	e.RetryAfter = resp.Header.Get("Retry-After")
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var parsed struct {
+		Error struct {
+			Code    interface{} `json:"code"`
+			Type    string      `json:"type"`
+			Message string      `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil && parsed.Error.Message != "" {
+		e.Message = parsed.Error.Message
+		e.Type = parsed.Error.Type
+		if parsed.Error.Code != nil {
+			e.Code = fmt.Sprint(parsed.Error.Code)
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Code == "" {
+		e.Code = resp.Header.Get("x-ms-error-code")
+	}
+	return e
+}
+
+// FromAzure turns the error of an Azure SDK call into an *Error when the
+// service answered with a non-2xx status, other errors are returned as is.
+func FromAzure(err error, requestTokens int) error {
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) || responseErr.RawResponse == nil {
+		return err
+	}
+	e := FromResponse("azure", responseErr.RawResponse, requestTokens)
+	if e.Code == "" {
+		e.Code = responseErr.ErrorCode
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	var summary string
+	switch {
+	case e.Status == http.StatusUnauthorized:
+		summary = "invalid API key, check it with `terminalgpt --config`"
+		if e.Provider != "azure" {
+			summary += " or OPENAI_SECRET_KEY"
+		}
+	case e.Status == http.StatusForbidden:
+		summary = "access denied, the key has no permission for this model or resource"
+	case e.Code == "context_length_exceeded":
+		tokens := e.RequestTokens
+		if match := contextTokens.FindStringSubmatch(e.Message); match != nil {
+			fmt.Sscan(match[1], &tokens)
+		}
+		summary = fmt.Sprintf("context length exceeded with %d tokens, shorten the prompt, lower max_tokens or clear the history with --clear", tokens)
+	case e.Code == "model_not_found" || e.Code == "DeploymentNotFound" || e.Status == http.StatusNotFound:
+		summary = "model not found, see `terminalgpt models` for the available ones"
+		if e.Provider == "azure" {
+			summary = "deployment not found, see `terminalgpt models` for the deployments of the resource"
+		}
+	case e.Code == "insufficient_quota":
+		summary = "quota exceeded, check the plan and billing of the account"
+	case e.Status == http.StatusTooManyRequests:
+		summary = "rate limited"
+		if e.RetryAfter != "" {
+			summary += ", retry after " + e.RetryAfter + "s"
+		}
+	case e.Status >= 500:
+		summary = "the provider had a server error, try again later"
+	default:
+		summary = "request rejected"
+	}
+
+	details := []string{fmt.Sprintf("HTTP %d", e.Status)}
+	if e.Message != "" {
+		details = append(details, e.Message)
+	}
+	if e.RequestID != "" {
+		details = append(details, "request ID "+e.RequestID)
+	}
+	return fmt.Sprintf("%s (%s)", summary, strings.Join(details, "; "))
+}
+
+// Temporary reports whether the request may succeed when repeated later, for
+// rate limits and server errors.
+func (e *Error) Temporary() bool {
+	if e.Code == "insufficient_quota" {
+		return false
+	}
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
@@ -0,0 +1,36 @@
+package appdir
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Dir is where terminalgpt keeps its config, history and caches:
+// ~/.terminalgpt, or %APPDATA%\terminalgpt on Windows unless a
+// ~/.terminalgpt from an earlier version exists.
+var Dir = dir()
+
+// Path returns the path of name in Dir.
+func Path(name string) string {
+	return filepath.Join(Dir, name)
+}
+
+func dir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.Getenv("HOME")
+	}
+	legacy := filepath.Join(home, ".terminalgpt")
+	if runtime.GOOS != "windows" {
+		return legacy
+	}
+
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	if appData := os.Getenv("APPDATA"); appData != "" {
+		return filepath.Join(appData, "terminalgpt")
+	}
+	return legacy
+}
@@ -0,0 +1,62 @@
+package ask
+
+import (
+	"context"
+	"fmt"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/render"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const systemMessage = "You answer quick command-line questions like a man page or tldr would. Give the command or the one-line answer first, then at most a short example or two. No greetings, no headings, no explanations unless asked. Prefer commands that work on %s with %s."
+
+// maxResponseTokens keeps the answers short.
+const maxResponseTokens = 400
+
+// Run answers question tersely, without reading or writing the history, and
+// writes only the answer to w as it arrives.
+func Run(cfg *config.Config, question string, w io.Writer) error {
+	askCfg := *cfg
+	askCfg.History = false
+	askCfg.SystemMessage = fmt.Sprintf(systemMessage, platform(), shell())
+	if askCfg.MaxResponseTokens <= 0 || askCfg.MaxResponseTokens > maxResponseTokens {
+		askCfg.MaxResponseTokens = maxResponseTokens
+	}
+
+	// the answer goes out as plain text, without the label, colors and status
+	endsWithNewline := true
+	ctx := render.WithSink(context.Background(), func(text string) {
+		io.WriteString(w, text)
+		endsWithNewline = strings.HasSuffix(text, "\n")
+	})
+	_, _, _, _, _, err := common.GenerateCompletionContext(ctx, &askCfg, question)
+	if !endsWithNewline {
+		io.WriteString(w, "\n")
+	}
+	return err
+}
+
+func platform() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "macOS"
+	case "windows":
+		return "Windows"
+	}
+	return strings.ToUpper(runtime.GOOS[:1]) + runtime.GOOS[1:]
+}
+
+func shell() string {
+	if sh := os.Getenv("SHELL"); sh != "" {
+		return filepath.Base(sh)
+	}
+	if runtime.GOOS == "windows" {
+		return "PowerShell"
+	}
+	return "sh"
+}
@@ -4,33 +4,21 @@ import (
 	"context"
 	"github.com/Azure/azure-sdk-for-go/sdk/ai/azopenai"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/rojolang/terminalgpt/apierror"
+	"github.com/rojolang/terminalgpt/deadline"
 	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/models"
+	"github.com/rojolang/terminalgpt/render"
 	"github.com/sirupsen/logrus"
 	"io"
 	"strings"
-	"time"
 )
 
 const LanguageModel = "gpt-4"
 
-// Add a function to detect code blocks and color them yellow
-func colorCodeBlocks(text string) string {
-	languages := []string{"1c", "abnf", "accesslog", "actionscript", "ada", "angelscript", "apache", "applescript", "arcade", "arduino", "armasm", "asciidoc", "aspectj", "autohotkey", "autoit", "avrasm", "awk", "axapta", "bash", "basic", "bnf", "brainfuck", "c", "cal", "capnproto", "ceylon", "clean", "clojure-repl", "clojure", "cmake", "coffeescript", "coq", "cos", "cpp", "crmsh", "crystal", "csharp", "csp", "css", "d", "dart", "delphi", "diff", "django", "dns", "dockerfile", "dos", "dsconfig", "dts", "dust", "ebnf", "elixir", "elm", "erb", "erlang-repl", "erlang", "excel", "fix", "flix", "fortran", "fsharp", "gams", "gauss", "gcode", "gherkin", "glsl", "gml", "go", "golo", "html", "gradle", "graphql", "groovy", "haml", "handlebars", "haskell", "haxe", "hsp", "http", "hy", "inform7", "ini", "irpf90", "isbl", "java", "javascript", "jboss-cli", "json", "julia-repl", "julia", "kotlin", "lasso", "latex", "ldif", "leaf", "less", "lisp", "livecodeserver", "livescript", "llvm", "lsl", "lua", "makefile", "markdown", "mathematica", "matlab", "maxima", "mel", "mercury", "mipsasm", "mizar", "mojolicious", "monkey", "moonscript", "n1ql", "nestedtext", "nginx", "nim", "nix", "node-repl", "nsis", "objectivec", "ocaml", "openscad", "oxygene", "parser3", "perl", "pf", "pgsql", "php-template", "php", "plaintext", "pony", "powershell", "processing", "profile", "prolog", "properties", "protobuf", "puppet", "purebasic", "python-repl", "python", "q", "qml", "r", "reasonml", "rib", "roboconf", "routeros", "rsl", "ruby", "ruleslanguage", "rust", "sas", "scala", "scheme", "scilab", "scss", "shell", "smali", "smalltalk", "sml", "sqf", "sql", "stan", "stata", "step21", "stylus", "subunit", "swift", "taggerscript", "tap", "tcl", "thrift", "tp", "twig", "typescript", "vala", "vbnet", "vbscript-html", "vbscript", "verilog", "vhdl", "vim", "wasm", "wren", "x86asm", "xl", "xml", "xquery", "yaml", "zephir"}
-	yellow := "\033[33m"
-	reset := "\033[0m"
-
-	for _, lang := range languages {
-		prefix := "```" + lang
-		if strings.HasPrefix(text, prefix) {
-			text = strings.TrimPrefix(text, prefix)
-			text = strings.TrimSuffix(text, "```")
-			return yellow + text + reset
-		}
-	}
-	return text
-}
-
-func GenerateCompletion(userMessage, systemMessage, azureURL, azureAuthKey, modelName string, maxTokens int32, topP, temperature, frequencyPenalty, presencePenalty float32, timeout time.Duration, history []helpers.HistoryEntry) (string, int, int, int, int, error) {
+func GenerateCompletion(ctx context.Context, userMessage, systemMessage, azureURL, azureAuthKey, modelName string, maxTokens int32, topP, temperature, frequencyPenalty, presencePenalty float32, history []helpers.HistoryEntry, extraBody map[string]interface{}, headers map[string]string) (string, int, int, int, int, error) {
+	deadline.Enter(ctx, "building the request")
 	userMessageTokens, err := helpers.CountTokens(userMessage, LanguageModel)
 	if err != nil {
 		return "", 0, 0, 0, 0, err
@@ -49,7 +37,6 @@ func GenerateCompletion(userMessage, systemMessage, azureURL, azureAuthKey, mode
 		}
 		historyTokens += count
 	}
-	ctx := context.Background()
 
 	keyCredential, err := azopenai.NewKeyCredential(azureAuthKey)
 	if err != nil {
@@ -57,45 +44,39 @@ func GenerateCompletion(userMessage, systemMessage, azureURL, azureAuthKey, mode
 		return "", 0, 0, 0, 0, err
 	}
 
-	client, err := azopenai.NewClientWithKeyCredential(azureURL, keyCredential, nil)
+	client, err := azopenai.NewClientWithKeyCredential(azureURL, keyCredential, clientOptions(reasoningBody(extraBody, modelName, maxTokens), headers))
 	if err != nil {
 		logrus.WithError(err).Error("Failed to create client with key credential")
 		return "", 0, 0, 0, 0, err
 	}
 
-	messages := []azopenai.ChatMessage{
-		{Role: to.Ptr(azopenai.ChatRoleSystem), Content: to.Ptr(systemMessage)},
-		{Role: to.Ptr(azopenai.ChatRoleUser), Content: to.Ptr(userMessage)},
-	}
-
-	for _, entry := range history {
-		messages = append([]azopenai.ChatMessage{
-			{Role: to.Ptr(azopenai.ChatRole(entry.Role)), Content: to.Ptr(entry.Content)},
-		}, messages...)
-	}
-
-	resp, err := client.GetChatCompletionsStream(ctx, azopenai.ChatCompletionsOptions{
-		Messages:         messages,
-		N:                to.Ptr[int32](1),
-		Deployment:       modelName,
-		Temperature:      to.Ptr(temperature),
-		TopP:             to.Ptr(topP),
-		MaxTokens:        to.Ptr(maxTokens),
-		FrequencyPenalty: to.Ptr(frequencyPenalty),
-		PresencePenalty:  to.Ptr(presencePenalty),
-	}, nil)
+	deadline.Enter(ctx, "waiting for the provider to answer")
+	resp, err := client.GetChatCompletionsStream(ctx, chatOptions(buildMessages(userMessage, systemMessage, history), modelName, 1, maxTokens, topP, temperature, frequencyPenalty, presencePenalty), nil)
 	if err != nil {
-		logrus.WithError(err).Error("Failed to get chat completions stream")
+		err = apierror.FromAzure(err, userMessageTokens+systemMessageTokens+historyTokens)
+		if _, ok := err.(*apierror.Error); !ok {
+			logrus.WithError(err).Error("Failed to get chat completions stream")
+		}
 		return "", 0, 0, 0, 0, err
 	}
 	defer resp.ChatCompletionsStream.Close()
 
+	// every delta is counted with the same tokenizer
+	countTokens, err := helpers.LocalTokenizer(LanguageModel)
+	if err != nil {
+		countTokens = func(text string) int {
+			return helpers.EstimateTokens(text, LanguageModel)
+		}
+	}
+
 	responseTokens := 0
+	var assistantMsg strings.Builder
+	out := render.New(ctx)
+	defer out.Close()
 
+	deadline.Enter(ctx, "streaming the response")
 	for {
-		_, cancel := context.WithTimeout(ctx, timeout)
 		chatCompletions, err := resp.ChatCompletionsStream.Read()
-		cancel()
 		if err == io.EOF {
 			break
 		}
@@ -105,6 +86,9 @@ func GenerateCompletion(userMessage, systemMessage, azureURL, azureAuthKey, mode
 		}
 
 		for _, choice := range chatCompletions.Choices {
+			if choice.FinishReason != nil {
+				helpers.SetFinishReason(string(*choice.FinishReason))
+			}
 			text := ""
 			if choice.Delta.Content != nil {
 				text = *choice.Delta.Content
@@ -113,17 +97,131 @@ func GenerateCompletion(userMessage, systemMessage, azureURL, azureAuthKey, mode
 				continue
 			}
 
-			// Color the code blocks if they match any of the given languages
-			coloredText := colorCodeBlocks(text)
-			print(coloredText)
+			assistantMsg.WriteString(text)
 
-			tokens, err := helpers.CountTokens(text, LanguageModel)
-			if err != nil {
-				return "", 0, 0, 0, 0, err
-			}
+			tokens := countTokens(text)
 			responseTokens += tokens
+			out.Write(text, tokens)
 		}
 	}
 
-	return "", userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+	return assistantMsg.String(), userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+}
+
+func buildMessages(userMessage, systemMessage string, history []helpers.HistoryEntry) []azopenai.ChatMessage {
+	messages := []azopenai.ChatMessage{
+		{Role: to.Ptr(azopenai.ChatRoleSystem), Content: to.Ptr(systemMessage)},
+	}
+
+	// history goes between the system message and the new prompt, oldest first
+	for _, entry := range history {
+		messages = append(messages, azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRole(entry.Role)), Content: to.Ptr(entry.Content)})
+	}
+
+	return append(messages, azopenai.ChatMessage{Role: to.Ptr(azopenai.ChatRoleUser), Content: to.Ptr(userMessage)})
+}
+
+// chatOptions are the options of a chat completion request. Reasoning models
+// get no sampling parameters and no max_tokens, see reasoningBody.
+func chatOptions(messages []azopenai.ChatMessage, deployment string, n, maxTokens int32, topP, temperature, frequencyPenalty, presencePenalty float32) azopenai.ChatCompletionsOptions {
+	options := azopenai.ChatCompletionsOptions{
+		Messages:   messages,
+		N:          to.Ptr(n),
+		Deployment: deployment,
+	}
+	if models.IsReasoning(deployment) {
+		return options
+	}
+	options.Temperature = to.Ptr(temperature)
+	options.TopP = to.Ptr(topP)
+	options.MaxTokens = to.Ptr(maxTokens)
+	options.FrequencyPenalty = to.Ptr(frequencyPenalty)
+	options.PresencePenalty = to.Ptr(presencePenalty)
+	return options
+}
+
+// reasoningBody adds max_completion_tokens, which the SDK has no option for,
+// to the extra body of reasoning models.
+func reasoningBody(extraBody map[string]interface{}, deployment string, maxTokens int32) map[string]interface{} {
+	if !models.IsReasoning(deployment) {
+		return extraBody
+	}
+	fields := map[string]interface{}{"max_completion_tokens": maxTokens}
+	for name, value := range extraBody {
+		fields[name] = value
+	}
+	return fields
+}
+
+// GenerateVariants requests n alternative completions in a single non-streamed request.
+func GenerateVariants(ctx context.Context, userMessage, systemMessage, azureURL, azureAuthKey, modelName string, maxTokens int32, topP, temperature, frequencyPenalty, presencePenalty float32, n int32, history []helpers.HistoryEntry, extraBody map[string]interface{}, headers map[string]string) ([]string, error) {
+	keyCredential, err := azopenai.NewKeyCredential(azureAuthKey)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create key credential")
+		return nil, err
+	}
+
+	client, err := azopenai.NewClientWithKeyCredential(azureURL, keyCredential, clientOptions(reasoningBody(extraBody, modelName, maxTokens), headers))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create client with key credential")
+		return nil, err
+	}
+
+	deadline.Enter(ctx, "waiting for the provider to answer")
+	resp, err := client.GetChatCompletions(ctx, chatOptions(buildMessages(userMessage, systemMessage, history), modelName, n, maxTokens, topP, temperature, frequencyPenalty, presencePenalty), nil)
+	if err != nil {
+		err = apierror.FromAzure(err, 0)
+		if _, ok := err.(*apierror.Error); !ok {
+			logrus.WithError(err).Error("Failed to get chat completions")
+		}
+		return nil, err
+	}
+
+	variants := []string{}
+	for _, choice := range resp.Choices {
+		if choice.Message != nil && choice.Message.Content != nil {
+			variants = append(variants, *choice.Message.Content)
+		}
+	}
+	return variants, nil
+}
+
+// GetEmbeddings returns the embedding vectors of texts from an Azure embeddings deployment.
+func GetEmbeddings(azureURL, azureAuthKey, deployment string, texts []string, headers map[string]string) ([][]float32, error) {
+	keyCredential, err := azopenai.NewKeyCredential(azureAuthKey)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create key credential")
+		return nil, err
+	}
+
+	// no rate limit policy, embeddings have their own limits
+	options := &azopenai.ClientOptions{}
+	options.Transport = httpclient.Client(0)
+	options.PerCallPolicies = append(options.PerCallPolicies, headersPolicy{headers: headers})
+	client, err := azopenai.NewClientWithKeyCredential(azureURL, keyCredential, options)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create client with key credential")
+		return nil, err
+	}
+
+	resp, err := client.GetEmbeddings(context.Background(), azopenai.EmbeddingsOptions{
+		Input:      texts,
+		Deployment: deployment,
+	}, nil)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get embeddings")
+		return nil, err
+	}
+
+	vectors := make([][]float32, len(texts))
+	for i, item := range resp.Data {
+		index := i
+		if item.Index != nil {
+			index = int(*item.Index)
+		}
+		if index < len(vectors) {
+			vectors[index] = item.Embedding
+		}
+	}
+	return vectors, nil
 }
@@ -0,0 +1,72 @@
+package azure
+
+import (
+	"context"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/mockapi"
+	"github.com/rojolang/terminalgpt/render"
+	"strings"
+	"testing"
+)
+
+func TestGenerateCompletionStreams(t *testing.T) {
+	server := mockapi.New("Use tar --zstd to unpack it.")
+	defer server.Close()
+
+	var shown strings.Builder
+	ctx := render.WithSink(context.Background(), func(text string) { shown.WriteString(text) })
+	history := []helpers.HistoryEntry{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "Hello."}}
+	response, userTokens, systemTokens, responseTokens, historyTokens, err := GenerateCompletion(ctx, "How do I unpack a .tar.zst file?", "You are terse.", server.URL, "test-key", "my-deployment", 500, 1, 0.5, 0, 0, history, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "Use tar --zstd to unpack it." {
+		t.Errorf("got response %q", response)
+	}
+	if shown.String() != response {
+		t.Errorf("streamed %q, want the response", shown.String())
+	}
+	if userTokens == 0 || systemTokens == 0 || responseTokens == 0 || historyTokens == 0 {
+		t.Errorf("got %d user, %d system, %d response and %d history tokens, want them counted", userTokens, systemTokens, responseTokens, historyTokens)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	if !strings.Contains(requests[0].Path, "/deployments/my-deployment/") {
+		t.Errorf("got path %s, want the deployment's", requests[0].Path)
+	}
+	if requests[0].Body["stream"] != true {
+		t.Errorf("got stream %v", requests[0].Body["stream"])
+	}
+	messages, _ := requests[0].Body["messages"].([]interface{})
+	if len(messages) != 4 {
+		t.Errorf("got %d messages, want the system message, the history and the prompt", len(messages))
+	}
+}
+
+func TestGenerateCompletionAPIError(t *testing.T) {
+	server := mockapi.New()
+	defer server.Close()
+	server.Fail(401, "Incorrect API key provided")
+
+	ctx := render.WithSink(context.Background(), func(string) {})
+	_, _, _, _, _, err := GenerateCompletion(ctx, "hello", "", server.URL, "test-key", "my-deployment", 500, 1, 0.5, 0, 0, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Incorrect API key provided") {
+		t.Errorf("got error %v, want the API's message", err)
+	}
+}
+
+func TestGenerateVariants(t *testing.T) {
+	server := mockapi.New("first", "second")
+	defer server.Close()
+
+	variants, err := GenerateVariants(context.Background(), "hello", "You are terse.", server.URL, "test-key", "my-deployment", 500, 1, 0.5, 0, 0, 2, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(variants, ",") != "first,second" {
+		t.Errorf("got variants %q", variants)
+	}
+}
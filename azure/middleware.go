@@ -0,0 +1,77 @@
+package azure
+
+import (
+	"bytes"
+	"github.com/Azure/azure-sdk-for-go/sdk/ai/azopenai"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/ratelimit"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// extraBodyPolicy merges config-defined fields into chat completion request
+// bodies, for features the SDK has no options for.
+type extraBodyPolicy struct {
+	fields map[string]interface{}
+}
+
+func (p extraBodyPolicy) Do(req *policy.Request) (*http.Response, error) {
+	raw := req.Raw()
+	if raw.Method != http.MethodPost || !strings.Contains(raw.URL.Path, "/chat/completions") || req.Body() == nil {
+		return req.Next()
+	}
+
+	body, err := io.ReadAll(req.Body())
+	if err != nil {
+		return nil, err
+	}
+	merged, err := helpers.MergeJSON(body, p.fields)
+	if err != nil {
+		return nil, err
+	}
+	err = req.SetBody(streaming.NopCloser(bytes.NewReader(merged)), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	return req.Next()
+}
+
+// rateLimitPolicy records the rate limit headers of every response.
+type rateLimitPolicy struct{}
+
+func (rateLimitPolicy) Do(req *policy.Request) (*http.Response, error) {
+	resp, err := req.Next()
+	if resp != nil {
+		ratelimit.Record("azure", resp.Header)
+	}
+	return resp, err
+}
+
+// headersPolicy adds config-defined headers to every request.
+type headersPolicy struct {
+	headers map[string]string
+}
+
+func (p headersPolicy) Do(req *policy.Request) (*http.Response, error) {
+	for name, value := range p.headers {
+		req.Raw().Header.Set(name, value)
+	}
+	return req.Next()
+}
+
+func clientOptions(extraBody map[string]interface{}, headers map[string]string) *azopenai.ClientOptions {
+	options := &azopenai.ClientOptions{}
+	options.Transport = httpclient.APIClient()
+	options.PerRetryPolicies = append(options.PerRetryPolicies, rateLimitPolicy{})
+	if len(headers) > 0 {
+		options.PerCallPolicies = append(options.PerCallPolicies, headersPolicy{headers: headers})
+	}
+	if len(extraBody) > 0 {
+		options.PerCallPolicies = append(options.PerCallPolicies, extraBodyPolicy{fields: extraBody})
+	}
+	return options
+}
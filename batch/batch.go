@@ -0,0 +1,208 @@
+package batch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rojolang/terminalgpt/apierror"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/render"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLineBytes limits one line of the prompts file.
+const maxLineBytes = 16 * 1024 * 1024
+
+// maxBackoff caps the doubling wait between the retries of a request.
+const maxBackoff = 60 * time.Second
+
+// Options configure a batch run.
+type Options struct {
+	// Concurrency is how many prompts are asked at once.
+	Concurrency int
+	// Retries is how often a prompt is repeated after a rate limit, a
+	// server error or a network failure.
+	Retries int
+	// Timeout limits each attempt unless it is zero.
+	Timeout time.Duration
+	// Progress is called after every prompt with its result.
+	Progress func(Result)
+}
+
+// Prompt is one line of the prompts file, either a JSON string or an object.
+type Prompt struct {
+	ID     string `json:"id,omitempty"`
+	Prompt string `json:"prompt"`
+	// System replaces the configured system message for this prompt.
+	System string `json:"system,omitempty"`
+}
+
+// Result is one line of the results file.
+type Result struct {
+	Line           int    `json:"line"`
+	ID             string `json:"id,omitempty"`
+	Response       string `json:"response,omitempty"`
+	Model          string `json:"model,omitempty"`
+	PromptTokens   int    `json:"prompt_tokens,omitempty"`
+	ResponseTokens int    `json:"response_tokens,omitempty"`
+	LatencyMs      int64  `json:"latency_ms"`
+	Attempts       int    `json:"attempts"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Run reads prompts from r line by line and asks up to Concurrency of them at
+// once, without history. The results are written to w as JSON lines in the
+// order they finish, each naming the line of its prompt. Blank lines are
+// skipped. It returns the number of prompts and of failed ones.
+func Run(cfg *config.Config, r io.Reader, w io.Writer, opts Options) (int, int, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		writeErr error
+		total    int
+		failed   int
+		wg       sync.WaitGroup
+	)
+	slots := make(chan struct{}, opts.Concurrency)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		total++
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(line int, text string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			prompt, err := parse(text)
+			result := Result{Line: line, ID: prompt.ID}
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result = ask(cfg, prompt, opts)
+				result.Line = line
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if result.Error != "" {
+				failed++
+			}
+			if err := encoder.Encode(result); err != nil && writeErr == nil {
+				writeErr = fmt.Errorf("failed to write result: %w", err)
+			}
+			if opts.Progress != nil {
+				opts.Progress(result)
+			}
+		}(line, text)
+	}
+	wg.Wait()
+
+	if err := scanner.Err(); err != nil {
+		return total, failed, fmt.Errorf("failed to read prompts after line %d: %w", line, err)
+	}
+	return total, failed, writeErr
+}
+
+func parse(text string) (Prompt, error) {
+	var prompt Prompt
+	if strings.HasPrefix(text, `"`) {
+		err := json.Unmarshal([]byte(text), &prompt.Prompt)
+		if err != nil {
+			return prompt, fmt.Errorf("invalid prompt: %w", err)
+		}
+	} else if err := json.Unmarshal([]byte(text), &prompt); err != nil {
+		return prompt, fmt.Errorf("invalid prompt, expected a JSON string or an object with a prompt: %w", err)
+	}
+	if strings.TrimSpace(prompt.Prompt) == "" {
+		return prompt, fmt.Errorf("the prompt is empty")
+	}
+	return prompt, nil
+}
+
+// ask answers prompt, repeating it after temporary failures with a growing
+// pause or the one the provider asks for.
+func ask(cfg *config.Config, prompt Prompt, opts Options) Result {
+	promptCfg := *cfg
+	promptCfg.History = false
+	if prompt.System != "" {
+		promptCfg.SystemMessage = prompt.System
+	}
+	result := Result{ID: prompt.ID, Model: cfg.ModelName}
+
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		result.Attempts = attempt + 1
+		response, promptTokens, responseTokens, err := complete(&promptCfg, prompt.Prompt, opts.Timeout)
+		if err == nil {
+			result.Response = response
+			result.PromptTokens = promptTokens
+			result.ResponseTokens = responseTokens
+			result.Error = ""
+			break
+		}
+		result.Error = err.Error()
+		if attempt == opts.Retries || !temporary(err) {
+			break
+		}
+		time.Sleep(backoff(err, attempt))
+	}
+	result.LatencyMs = time.Since(start).Milliseconds()
+	return result
+}
+
+// complete asks for the answer without printing it, and returns it with the
+// tokens of the prompt including the system message and of the response.
+func complete(cfg *config.Config, message string, timeout time.Duration) (string, int, int, error) {
+	ctx, cancel := deadline.New(timeout)
+	defer cancel()
+	ctx = render.WithSink(ctx, func(string) {})
+	response, userMessageTokens, systemMessageTokens, responseTokens, _, err := common.GenerateCompletionContext(ctx, cfg, message)
+	return response, userMessageTokens + systemMessageTokens, responseTokens, err
+}
+
+// temporary reports whether err may pass when the prompt is repeated. Errors
+// the provider did not answer with, like timeouts, are assumed to.
+func temporary(err error) bool {
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
+
+func backoff(err error, attempt int) time.Duration {
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		if seconds, parseErr := strconv.Atoi(apiErr.RetryAfter); parseErr == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	// from 64s on the shift is over the cap, and far enough on it overflows
+	if attempt >= 6 {
+		return maxBackoff
+	}
+	return time.Second << attempt
+}
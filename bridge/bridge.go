@@ -0,0 +1,140 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var BridgeDir = appdir.Path("bridge")
+
+// Message is an incoming chat message relayed to the provider.
+type Message struct {
+	ID       string
+	ThreadID string
+	Author   string
+	Text     string
+}
+
+// Platform is a chat service the bridge can poll and reply to.
+type Platform interface {
+	Name() string
+	Connect() error
+	Poll() ([]Message, error)
+	Reply(msg Message, text string) error
+}
+
+type Options struct {
+	Platform     string
+	Channel      string
+	Token        string
+	PollInterval time.Duration
+}
+
+func New(opts Options) (Platform, error) {
+	switch opts.Platform {
+	case "slack":
+		if opts.Token == "" {
+			opts.Token = os.Getenv("SLACK_BOT_TOKEN")
+		}
+		if opts.Token == "" {
+			return nil, fmt.Errorf("missing Slack bot token, set SLACK_BOT_TOKEN or pass --token")
+		}
+		return newSlack(opts.Token, opts.Channel), nil
+	case "discord":
+		if opts.Token == "" {
+			opts.Token = os.Getenv("DISCORD_BOT_TOKEN")
+		}
+		if opts.Token == "" {
+			return nil, fmt.Errorf("missing Discord bot token, set DISCORD_BOT_TOKEN or pass --token")
+		}
+		return newDiscord(opts.Token, opts.Channel), nil
+	}
+	return nil, fmt.Errorf("unknown bridge platform %q (expected slack or discord)", opts.Platform)
+}
+
+// Run connects to the platform and relays every new message to the configured
+// provider, keeping a separate history file per thread.
+func Run(cfg *config.Config, opts Options) error {
+	if opts.Channel == "" {
+		return fmt.Errorf("a channel is required, pass --channel")
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 3 * time.Second
+	}
+
+	platform, err := New(opts)
+	if err != nil {
+		return err
+	}
+
+	err = platform.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", platform.Name(), err)
+	}
+
+	err = os.MkdirAll(BridgeDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create bridge directory: %w", err)
+	}
+
+	color.HiYellow("Bridging %s channel %s to %s (%s)\n", platform.Name(), opts.Channel, cfg.AIProvider, cfg.ModelName)
+
+	for {
+		messages, err := platform.Poll()
+		if err != nil {
+			color.Red("Failed to poll %s: %v\n", platform.Name(), err)
+		}
+
+		for _, msg := range messages {
+			err := relay(cfg, platform, msg)
+			if err != nil {
+				color.Red("Failed to relay message %s: %v\n", msg.ID, err)
+			}
+		}
+
+		time.Sleep(opts.PollInterval)
+	}
+}
+
+func relay(cfg *config.Config, platform Platform, msg Message) error {
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		return nil
+	}
+
+	// every thread gets its own conversation history
+	historyFile := filepath.Join(BridgeDir, platform.Name()+"-"+sanitize(msg.ThreadID)+".jsonl")
+	globalHistoryFile := config.HistoryFile
+	config.HistoryFile = historyFile
+	defer func() { config.HistoryFile = globalHistoryFile }()
+
+	fmt.Printf("\n[%s] %s: %s\n", platform.Name(), msg.Author, text)
+
+	response, _, _, _, _, err := common.GenerateCompletion(cfg, text)
+	if err != nil {
+		replyErr := platform.Reply(msg, fmt.Sprintf("Sorry, the request failed: %v", err))
+		if replyErr != nil {
+			return replyErr
+		}
+		return err
+	}
+	fmt.Println()
+
+	return platform.Reply(msg, response)
+}
+
+func sanitize(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, id)
+}
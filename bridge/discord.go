@@ -0,0 +1,178 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	discordAPIURL     = "https://discord.com/api/v10"
+	discordMaxMessage = 2000
+)
+
+type discord struct {
+	token     string
+	channelID string
+	botUserID string
+	lastSeen  map[string]string // channel or thread id => last message id
+	client    *http.Client
+}
+
+type discordMessage struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	Author  struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Bot      bool   `json:"bot"`
+	} `json:"author"`
+}
+
+func newDiscord(token, channel string) *discord {
+	return &discord{
+		token:     token,
+		channelID: channel,
+		lastSeen:  make(map[string]string),
+		client:    httpclient.Client(30 * time.Second),
+	}
+}
+
+func (d *discord) Name() string {
+	return "discord"
+}
+
+func (d *discord) Connect() error {
+	var me struct {
+		ID string `json:"id"`
+	}
+	err := d.call("GET", "/users/@me", nil, &me)
+	if err != nil {
+		return err
+	}
+	d.botUserID = me.ID
+
+	if _, err := strconv.ParseUint(d.channelID, 10, 64); err != nil {
+		return fmt.Errorf("discord channels must be given by id, got %q", d.channelID)
+	}
+
+	// only relay messages posted after the bridge started
+	d.lastSeen[d.channelID] = snowflakeAt(time.Now())
+	return nil
+}
+
+func (d *discord) Poll() ([]Message, error) {
+	messages := []Message{}
+
+	for channelID, after := range d.lastSeen {
+		var batch []discordMessage
+		err := d.call("GET", fmt.Sprintf("/channels/%s/messages?after=%s&limit=50", channelID, after), nil, &batch)
+		if err != nil {
+			return messages, err
+		}
+
+		// discord returns the newest message first
+		for i := len(batch) - 1; i >= 0; i-- {
+			m := batch[i]
+			d.lastSeen[channelID] = m.ID
+			if m.Author.Bot || m.Author.ID == d.botUserID {
+				continue
+			}
+			// a thread started from a message shares the message's id
+			threadID := channelID
+			if channelID == d.channelID {
+				threadID = m.ID
+			}
+			messages = append(messages, Message{ID: m.ID, ThreadID: threadID, Author: m.Author.Username, Text: m.Content})
+		}
+	}
+
+	return messages, nil
+}
+
+func (d *discord) Reply(msg Message, text string) error {
+	threadID := msg.ThreadID
+	if threadID == msg.ID {
+		// start a thread on the original message so follow-ups share history
+		name := msg.Text
+		if len(name) > 90 {
+			name = name[:90]
+		}
+		var thread struct {
+			ID string `json:"id"`
+		}
+		err := d.call("POST", fmt.Sprintf("/channels/%s/messages/%s/threads", d.channelID, msg.ID), map[string]string{"name": name}, &thread)
+		if err != nil {
+			return err
+		}
+		threadID = thread.ID
+	}
+
+	for _, chunk := range splitMessage(text, discordMaxMessage) {
+		var posted discordMessage
+		err := d.call("POST", fmt.Sprintf("/channels/%s/messages", threadID), map[string]string{"content": chunk}, &posted)
+		if err != nil {
+			return err
+		}
+		d.lastSeen[threadID] = posted.ID
+	}
+
+	return nil
+}
+
+func (d *discord) call(method, endpoint string, body interface{}, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, discordAPIURL+endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bot "+d.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("discord request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("discord %s %s failed with status %d: %s", method, endpoint, resp.StatusCode, string(data))
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// snowflakeAt returns a discord snowflake id for the given time.
+func snowflakeAt(t time.Time) string {
+	const discordEpoch = 1420070400000
+	return strconv.FormatUint(uint64(t.UnixMilli()-discordEpoch)<<22, 10)
+}
+
+func splitMessage(text string, size int) []string {
+	runes := []rune(text)
+	chunks := []string{}
+	for len(runes) > size {
+		chunks = append(chunks, string(runes[:size]))
+		runes = runes[size:]
+	}
+	return append(chunks, string(runes))
+}
@@ -0,0 +1,226 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const slackAPIURL = "https://slack.com/api/"
+
+type slack struct {
+	token     string
+	channel   string
+	channelID string
+	botUserID string
+	lastTS    string
+	threads   map[string]string // thread ts => last seen reply ts
+	client    *http.Client
+}
+
+type slackMessage struct {
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Subtype  string `json:"subtype"`
+	Text     string `json:"text"`
+}
+
+func newSlack(token, channel string) *slack {
+	return &slack{
+		token:   token,
+		channel: channel,
+		threads: make(map[string]string),
+		client:  httpclient.Client(30 * time.Second),
+	}
+}
+
+func (s *slack) Name() string {
+	return "slack"
+}
+
+func (s *slack) Connect() error {
+	var auth struct {
+		UserID string `json:"user_id"`
+	}
+	err := s.call("GET", "auth.test", nil, &auth)
+	if err != nil {
+		return err
+	}
+	s.botUserID = auth.UserID
+
+	s.channelID, err = s.resolveChannel(s.channel)
+	if err != nil {
+		return err
+	}
+
+	// only relay messages posted after the bridge started
+	s.lastTS = fmt.Sprintf("%d.000000", time.Now().Unix())
+	return nil
+}
+
+func (s *slack) resolveChannel(channel string) (string, error) {
+	if !strings.HasPrefix(channel, "#") {
+		return channel, nil
+	}
+	name := strings.TrimPrefix(channel, "#")
+
+	cursor := ""
+	for {
+		params := url.Values{"limit": {"1000"}, "types": {"public_channel,private_channel"}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		var list struct {
+			Channels []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"channels"`
+			Metadata struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"response_metadata"`
+		}
+		err := s.call("GET", "conversations.list?"+params.Encode(), nil, &list)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range list.Channels {
+			if c.Name == name {
+				return c.ID, nil
+			}
+		}
+		if list.Metadata.NextCursor == "" {
+			return "", fmt.Errorf("channel %s not found or the bot is not a member", channel)
+		}
+		cursor = list.Metadata.NextCursor
+	}
+}
+
+func (s *slack) Poll() ([]Message, error) {
+	messages := []Message{}
+
+	var history struct {
+		Messages []slackMessage `json:"messages"`
+	}
+	params := url.Values{"channel": {s.channelID}, "oldest": {s.lastTS}}
+	err := s.call("GET", "conversations.history?"+params.Encode(), nil, &history)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range sortSlack(history.Messages) {
+		s.lastTS = m.TS
+		if !s.relayable(m) {
+			continue
+		}
+		s.threads[m.TS] = m.TS
+		messages = append(messages, Message{ID: m.TS, ThreadID: m.TS, Author: m.User, Text: m.Text})
+	}
+
+	for threadTS, lastReply := range s.threads {
+		var replies struct {
+			Messages []slackMessage `json:"messages"`
+		}
+		params := url.Values{"channel": {s.channelID}, "ts": {threadTS}, "oldest": {lastReply}}
+		err := s.call("GET", "conversations.replies?"+params.Encode(), nil, &replies)
+		if err != nil {
+			return messages, err
+		}
+		for _, m := range sortSlack(replies.Messages) {
+			if m.TS <= lastReply || m.TS == threadTS {
+				continue
+			}
+			s.threads[threadTS] = m.TS
+			if !s.relayable(m) {
+				continue
+			}
+			messages = append(messages, Message{ID: m.TS, ThreadID: threadTS, Author: m.User, Text: m.Text})
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *slack) relayable(m slackMessage) bool {
+	return m.BotID == "" && m.Subtype == "" && m.User != s.botUserID
+}
+
+func (s *slack) Reply(msg Message, text string) error {
+	body := map[string]string{
+		"channel":   s.channelID,
+		"thread_ts": msg.ThreadID,
+		"text":      text,
+	}
+	var posted struct {
+		TS string `json:"ts"`
+	}
+	err := s.call("POST", "chat.postMessage", body, &posted)
+	if err != nil {
+		return err
+	}
+	// don't relay our own reply on the next poll
+	if posted.TS > s.threads[msg.ThreadID] {
+		s.threads[msg.ThreadID] = posted.TS
+	}
+	return nil
+}
+
+func (s *slack) call(method, endpoint string, body interface{}, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, slackAPIURL+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("slack %s request failed: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	var raw json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("failed to decode slack response: %w", err)
+	}
+
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	err = json.Unmarshal(raw, &status)
+	if err != nil {
+		return err
+	}
+	if !status.OK {
+		return fmt.Errorf("slack %s failed: %s", strings.SplitN(endpoint, "?", 2)[0], status.Error)
+	}
+
+	return json.Unmarshal(raw, out)
+}
+
+func sortSlack(messages []slackMessage) []slackMessage {
+	sort.Slice(messages, func(i, j int) bool { return messages[i].TS < messages[j].TS })
+	return messages
+}
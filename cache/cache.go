@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var CacheDir = appdir.Path("cache")
+
+const DefaultTTL = 24 * time.Hour
+
+type Entry struct {
+	Created             time.Time `json:"created"`
+	Response            string    `json:"response"`
+	UserMessageTokens   int       `json:"user_message_tokens"`
+	SystemMessageTokens int       `json:"system_message_tokens"`
+	ResponseTokens      int       `json:"response_tokens"`
+	HistoryTokens       int       `json:"history_tokens"`
+}
+
+// Key hashes everything that influences a completion: provider, model,
+// sampling parameters, system message, the history window and the prompt.
+func Key(cfg *config.Config, history []helpers.HistoryEntry, userMessage string) string {
+	keyData, _ := json.Marshal(struct {
+		Provider         string
+		AzureURL         string
+		BaseURL          string
+		Model            string
+		Temperature      float64
+		TopP             float64
+		FrequencyPenalty float64
+		PresencePenalty  float64
+		MaxTokens        int
+		MaxTotalTokens   int
+		SystemMessage    string
+		ExtraBody        map[string]interface{}
+		History          []helpers.HistoryEntry
+		Prompt           string
+	}{
+		cfg.AIProvider, cfg.AzureURL, cfg.BaseURL, cfg.ModelName, cfg.Temperature, cfg.TopP, cfg.FrequencyPenalty, cfg.PresencePenalty,
+		cfg.MaxResponseTokens, cfg.MaxTotalTokens, cfg.SystemMessage, config.RequestFields(cfg, cfg.AIProvider), history, userMessage,
+	})
+
+	sum := sha256.Sum256(keyData)
+	return hex.EncodeToString(sum[:])
+}
+
+// TTL returns the configured time to live of cache entries.
+func TTL(cfg *config.Config) time.Duration {
+	if cfg.CacheTTLMinutes <= 0 {
+		return DefaultTTL
+	}
+	return time.Duration(cfg.CacheTTLMinutes) * time.Minute
+}
+
+// Get returns the cached entry for key if it exists and is younger than ttl.
+func Get(key string, ttl time.Duration) (Entry, bool) {
+	var entry Entry
+	data, err := ioutil.ReadFile(path(key))
+	if err != nil {
+		return entry, false
+	}
+	data, err = vault.Open(bytes.TrimSpace(data))
+	if err == nil {
+		err = json.Unmarshal(data, &entry)
+	}
+	if err != nil || time.Since(entry.Created) > ttl {
+		os.Remove(path(key))
+		return entry, false
+	}
+	return entry, true
+}
+
+// Put stores entry under key, readable only by the user and encrypted like the
+// history the responses come from.
+func Put(key string, entry Entry) error {
+	err := os.MkdirAll(CacheDir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	// tighten a directory created by earlier versions
+	os.Chmod(CacheDir, 0700)
+
+	entry.Created = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data, err = vault.Seal(data)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path(key), append(data, '\n'), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path(key), 0600)
+}
+
+// Prune removes every expired entry from the cache directory.
+func Prune(ttl time.Duration) {
+	files, err := ioutil.ReadDir(CacheDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if time.Since(file.ModTime()) > ttl {
+			os.Remove(filepath.Join(CacheDir, file.Name()))
+		}
+	}
+}
+
+// Rewrite encrypts every cache entry, or decrypts it when encrypt is false,
+// and returns how many entries changed.
+func Rewrite(encrypt bool) (int, error) {
+	files, err := filepath.Glob(filepath.Join(CacheDir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, file := range files {
+		n, err := vault.RewriteFile(file, encrypt)
+		if err != nil {
+			return changed, err
+		}
+		changed += n
+	}
+	return changed, nil
+}
+
+func path(key string) string {
+	return filepath.Join(CacheDir, key+".json")
+}
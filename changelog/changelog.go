@@ -0,0 +1,282 @@
+package changelog
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/termcap"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	mapSystemMessage = "You write release notes. Summarize the given git commits into bullet points grouped under the Keep a Changelog headings (Added, Changed, Deprecated, Removed, Fixed, Security). Only use headings that have entries, merge related commits, skip pure refactors/chores unless user-visible, and answer with markdown only."
+
+	reduceSystemMessage = "You write release notes. Merge the given partial release notes into a single list grouped under the Keep a Changelog headings (### Added, ### Changed, ### Deprecated, ### Removed, ### Fixed, ### Security) in that order. Remove duplicates, only keep headings that have entries, and answer with markdown only, without a version heading."
+
+	// diffs larger than this many tokens are reduced to their stat summary
+	maxDiffTokens = 1500
+
+	// merging passes before giving up on summaries that don't fit one request
+	maxReduceDepth = 5
+
+	changelogHeader = "# Changelog\n\nAll notable changes to this project will be documented in this file.\n\nThe format is based on [Keep a Changelog](https://keepachangelog.com/en/1.1.0/).\n"
+)
+
+type Options struct {
+	From             string
+	To               string
+	Version          string
+	Output           string
+	WorkingDirectory string
+	Yes              bool
+}
+
+type commit struct {
+	Hash    string
+	Subject string
+	Body    string
+	Diff    string
+}
+
+// Run collects the commits between two refs, summarizes them with the
+// configured provider and writes the result to the changelog after a preview.
+func Run(cfg *config.Config, opts Options) error {
+	if opts.From == "" {
+		return fmt.Errorf("--from is required")
+	}
+	if opts.To == "" {
+		opts.To = "HEAD"
+	}
+	if opts.Version == "" {
+		opts.Version = opts.To
+		if opts.To == "HEAD" {
+			opts.Version = "Unreleased"
+		}
+	}
+	if opts.Output == "" {
+		opts.Output = filepath.Join(opts.WorkingDirectory, "CHANGELOG.md")
+	}
+
+	commits, err := collectCommits(opts)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("no commits between %s and %s", opts.From, opts.To)
+	}
+
+	// changelog calls are one-off requests, they should neither read nor pollute history
+	runCfg := *cfg
+	runCfg.History = false
+	budget := runCfg.MaxTotalTokens - runCfg.MaxResponseTokens - 500
+
+	chunks, err := chunkCommits(commits, budget, runCfg.ModelName)
+	if err != nil {
+		return err
+	}
+
+	summaries := []string{}
+	for i, chunk := range chunks {
+		fmt.Printf("\nSummarizing commits (%d/%d):\n", i+1, len(chunks))
+		runCfg.SystemMessage = mapSystemMessage
+		summary, _, _, _, _, err := common.GenerateCompletion(&runCfg, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to summarize commits: %w", err)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	notes, err := reduce(&runCfg, summaries, budget, 0)
+	if err != nil {
+		return err
+	}
+
+	section := fmt.Sprintf("## [%s] - %s\n\n%s\n", opts.Version, time.Now().Format("2006-01-02"), strings.TrimSpace(notes))
+
+	fmt.Printf("\n\n===== %s =====\n\n%s\n", opts.Output, section)
+	if !opts.Yes && !confirm(fmt.Sprintf("Write these release notes to %s? [y/N]: ", opts.Output)) {
+		fmt.Println("Nothing written.")
+		return nil
+	}
+
+	return writeChangelog(opts.Output, section)
+}
+
+func collectCommits(opts Options) ([]commit, error) {
+	out, err := git(opts.WorkingDirectory, "log", "--no-merges", "--format=%h%x1f%s%x1f%b%x1e", opts.From+".."+opts.To)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []commit{}
+	for _, record := range strings.Split(out, "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x1f")
+		if len(fields) < 2 {
+			continue
+		}
+		c := commit{Hash: fields[0], Subject: fields[1]}
+		if len(fields) > 2 {
+			c.Body = strings.TrimSpace(fields[2])
+		}
+
+		diff, err := significantDiff(opts.WorkingDirectory, c.Hash)
+		if err != nil {
+			return nil, err
+		}
+		c.Diff = diff
+
+		commits = append(commits, c)
+	}
+
+	return commits, nil
+}
+
+// significantDiff returns the full patch of small commits and only the stat
+// summary of large ones, so big generated or vendored changes don't eat the budget.
+func significantDiff(dir, hash string) (string, error) {
+	patch, err := git(dir, "show", "--format=", "--no-color", hash)
+	if err != nil {
+		return "", err
+	}
+
+	tokens, err := helpers.CountTokens(patch, "gpt-4")
+	if err == nil && tokens <= maxDiffTokens {
+		return patch, nil
+	}
+
+	return git(dir, "show", "--format=", "--stat", "--no-color", hash)
+}
+
+func chunkCommits(commits []commit, budget int, modelName string) ([]string, error) {
+	chunks := []string{}
+	current := ""
+	currentTokens := 0
+
+	for _, c := range commits {
+		text := fmt.Sprintf("commit %s: %s\n%s\n%s\n\n", c.Hash, c.Subject, c.Body, c.Diff)
+		tokens, err := helpers.CountTokens(text, modelName)
+		if err != nil {
+			return nil, err
+		}
+
+		// fall back to the commit message alone if even the stat is too large
+		if tokens > budget {
+			text = fmt.Sprintf("commit %s: %s\n%s\n\n", c.Hash, c.Subject, c.Body)
+			tokens, err = helpers.CountTokens(text, modelName)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if currentTokens+tokens > budget && current != "" {
+			chunks = append(chunks, current)
+			current = ""
+			currentTokens = 0
+		}
+		current += text
+		currentTokens += tokens
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+
+	return chunks, nil
+}
+
+// reduce merges partial summaries, recursing while they don't fit one request.
+// It fails when no two summaries fit one request together, so a pass wouldn't
+// reduce their number, or after maxReduceDepth passes.
+func reduce(cfg *config.Config, summaries []string, budget, depth int) (string, error) {
+	if depth >= maxReduceDepth {
+		return "", fmt.Errorf("failed to merge release notes: %d summaries left after %d passes, use a smaller range", len(summaries), depth)
+	}
+	cfg.SystemMessage = reduceSystemMessage
+
+	groups := [][]string{{}}
+	groupTokens := 0
+	for _, summary := range summaries {
+		tokens, err := helpers.CountTokens(summary, cfg.ModelName)
+		if err != nil {
+			return "", err
+		}
+		last := len(groups) - 1
+		if groupTokens+tokens > budget && len(groups[last]) > 0 {
+			groups = append(groups, []string{})
+			last++
+			groupTokens = 0
+		}
+		groups[last] = append(groups[last], summary)
+		groupTokens += tokens
+	}
+	if len(summaries) > 1 && len(groups) == len(summaries) {
+		return "", fmt.Errorf("failed to merge release notes: none of the %d summaries fit a request together, use a smaller range", len(summaries))
+	}
+
+	merged := []string{}
+	for i, group := range groups {
+		fmt.Printf("\n\nMerging release notes (%d/%d):\n", i+1, len(groups))
+		notes, _, _, _, _, err := common.GenerateCompletion(cfg, strings.Join(group, "\n\n---\n\n"))
+		if err != nil {
+			return "", fmt.Errorf("failed to merge release notes: %w", err)
+		}
+		merged = append(merged, notes)
+	}
+
+	if len(merged) == 1 {
+		return merged[0], nil
+	}
+	return reduce(cfg, merged, budget, depth+1)
+}
+
+func writeChangelog(path, section string) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	content := string(existing)
+	if content == "" {
+		content = changelogHeader + "\n" + section
+	} else if idx := strings.Index(content, "\n## "); idx >= 0 {
+		// newest release goes above the previous ones
+		content = content[:idx+1] + section + "\n" + content[idx+1:]
+	} else {
+		content = strings.TrimRight(content, "\n") + "\n\n" + section
+	}
+
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	absPath, _ := filepath.Abs(path)
+	fmt.Printf("Release notes written to %s\n", termcap.FileLink(absPath, path))
+	return nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return string(out), nil
+}
+
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
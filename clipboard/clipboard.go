@@ -0,0 +1,84 @@
+package clipboard
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/rojolang/terminalgpt/termcap"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Read returns the contents of the system clipboard.
+func Read() (string, error) {
+	return read(false)
+}
+
+// ReadSelection returns the primary selection on X11/Wayland, and the
+// clipboard on systems without one.
+func ReadSelection() (string, error) {
+	return read(true)
+}
+
+// Write replaces the contents of the system clipboard with text. Without a
+// clipboard tool it falls back to the OSC 52 escape sequence, which many
+// terminals honour even over ssh.
+func Write(text string) error {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"powershell", "-NoProfile", "-Command", "[Console]::In.ReadToEnd() | Set-Clipboard"}, {"clip"}}
+	default:
+		candidates = [][]string{{"wl-copy"}, {"xclip", "-i", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}}
+	}
+
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(candidate[0], candidate[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err == nil {
+			return nil
+		}
+	}
+
+	if termcap.Get().TTY {
+		fmt.Fprintf(os.Stdout, "\033]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+		return nil
+	}
+
+	return fmt.Errorf("no clipboard tool available to write the clipboard")
+}
+
+func read(selection bool) (string, error) {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbpaste"}}
+	case "windows":
+		candidates = [][]string{{"powershell", "-NoProfile", "-Command", "Get-Clipboard"}}
+	default:
+		if selection {
+			candidates = [][]string{{"wl-paste", "--primary", "--no-newline"}, {"xclip", "-o", "-selection", "primary"}, {"xsel", "--primary", "--output"}}
+		} else {
+			candidates = [][]string{{"wl-paste", "--no-newline"}, {"xclip", "-o", "-selection", "clipboard"}, {"xsel", "--clipboard", "--output"}}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(candidate[0], candidate[1:]...).Output()
+		if err != nil {
+			continue
+		}
+		return string(out), nil
+	}
+
+	return "", fmt.Errorf("no clipboard tool available to read the clipboard")
+}
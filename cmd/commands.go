@@ -0,0 +1,1221 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/ask"
+	"github.com/rojolang/terminalgpt/batch"
+	"github.com/rojolang/terminalgpt/bridge"
+	"github.com/rojolang/terminalgpt/cache"
+	"github.com/rojolang/terminalgpt/changelog"
+	"github.com/rojolang/terminalgpt/compress"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/doctor"
+	"github.com/rojolang/terminalgpt/duel"
+	"github.com/rojolang/terminalgpt/explain"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/input"
+	"github.com/rojolang/terminalgpt/jobs"
+	"github.com/rojolang/terminalgpt/kb"
+	"github.com/rojolang/terminalgpt/models"
+	"github.com/rojolang/terminalgpt/pipe"
+	"github.com/rojolang/terminalgpt/ratelimit"
+	"github.com/rojolang/terminalgpt/replay"
+	"github.com/rojolang/terminalgpt/review"
+	"github.com/rojolang/terminalgpt/sessions"
+	"github.com/rojolang/terminalgpt/stats"
+	"github.com/rojolang/terminalgpt/testfix"
+	"github.com/rojolang/terminalgpt/trash"
+	"github.com/rojolang/terminalgpt/update"
+	"github.com/rojolang/terminalgpt/usage"
+	"github.com/rojolang/terminalgpt/vault"
+	"github.com/rojolang/terminalgpt/version"
+	"github.com/rojolang/terminalgpt/watch"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subcommands are run as `terminalgpt <name> [args]` instead of the interactive prompt
+var subcommands = map[string]func(cfg *config.Config, args []string) error{
+	"ask":             runAsk,
+	"batch":           runBatch,
+	"bridge":          runBridge,
+	"changelog":       runChangelog,
+	"compress-prompt": runCompressPrompt,
+	"cron":            runCron,
+	"doctor":          runDoctor,
+	"duel":            runDuel,
+	"explain-pane":    runExplainPane,
+	"fix-tests":       runFixTests,
+	"history":         runHistory,
+	"import-handoff":  runImportHandoff,
+	"kb":              runKB,
+	"models":          runModels,
+	"replay":          runReplay,
+	"review":          runReview,
+	"run":             runExplain,
+	"sessions":        runSessions,
+	"stats":           runStats,
+	"tokens":          runTokens,
+	"trash":           runTrash,
+	"update":          runUpdate,
+	"users":           runUsers,
+	"warm":            runWarm,
+	"watch":           runWatch,
+}
+
+func runAsk(cfg *config.Config, args []string) error {
+	question := strings.TrimSpace(strings.Join(args, " "))
+	if question == "" {
+		return fmt.Errorf("usage: terminalgpt ask <question>, e.g. terminalgpt ask how do I untar a .tar.zst")
+	}
+	return ask.Run(cfg, question, os.Stdout)
+}
+
+func runBatch(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: terminalgpt batch <prompts.jsonl|-> [--out results.jsonl] [--concurrency n] [--retries n] [--timeout d]")
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	out := fs.String("out", "", "File to write the results to (default: stdout)")
+	concurrency := fs.Int("concurrency", 4, "How many prompts to ask at once")
+	retries := fs.Int("retries", 3, "How often to repeat a prompt after a rate limit, server error or timeout")
+	timeout := fs.Duration("timeout", 0, "Limit each attempt, e.g. 2m")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		return usage
+	}
+
+	in := os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	w := os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	gray := color.New(color.FgHiBlack)
+	done := 0
+	total, failed, err := batch.Run(cfg, in, w, batch.Options{
+		Concurrency: *concurrency,
+		Retries:     *retries,
+		Timeout:     *timeout,
+		Progress: func(r batch.Result) {
+			done++
+			switch {
+			case r.Attempts == 0:
+				color.New(color.FgRed).Fprintf(os.Stderr, "line %d skipped: %s\n", r.Line, r.Error)
+				return
+			case r.Error != "":
+				color.New(color.FgRed).Fprintf(os.Stderr, "line %d failed after %d attempts: %s\n", r.Line, r.Attempts, r.Error)
+				return
+			}
+			gray.Fprintf(os.Stderr, "line %d done in %s (%d finished)\n", r.Line, stats.Duration(time.Duration(r.LatencyMs)*time.Millisecond), done)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d prompts failed", failed, total)
+	}
+	gray.Fprintf(os.Stderr, "All %d prompts answered\n", total)
+	return nil
+}
+
+func runBridge(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: terminalgpt bridge slack|discord --channel <channel>")
+	}
+
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	channel := fs.String("channel", "", "Channel to relay (#name or id for slack, id for discord)")
+	token := fs.String("token", "", "Bot token (default: SLACK_BOT_TOKEN or DISCORD_BOT_TOKEN)")
+	interval := fs.Duration("interval", 3*time.Second, "How often to poll for new messages")
+	fs.Parse(args[1:])
+
+	return bridge.Run(cfg, bridge.Options{
+		Platform:     args[0],
+		Channel:      *channel,
+		Token:        *token,
+		PollInterval: *interval,
+	})
+}
+
+func runChangelog(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("changelog", flag.ExitOnError)
+	from := fs.String("from", "", "Git ref to start from (exclusive), e.g. v1.2.0")
+	to := fs.String("to", "HEAD", "Git ref to end at (inclusive)")
+	version := fs.String("version", "", "Version heading for the release notes (default: --to, or Unreleased for HEAD)")
+	output := fs.String("output", "", "Changelog file to update (default: CHANGELOG.md in --dir)")
+	dir := fs.String("dir", "", "Repository directory (default: current directory)")
+	yes := fs.Bool("yes", false, "Write without asking for confirmation")
+	fs.Parse(args)
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	return changelog.Run(cfg, changelog.Options{
+		From:             *from,
+		To:               *to,
+		Version:          *version,
+		Output:           *output,
+		WorkingDirectory: *dir,
+		Yes:              *yes,
+	})
+}
+
+func runExplain(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory to run the command in (default: current directory)")
+	files := fs.Bool("files", true, "Also send the files the output points at, e.g. from compiler errors and stack traces")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: terminalgpt run [--dir path] [--files=false] -- <command> [args]")
+	}
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	code, err := explain.Run(cfg, explain.Options{Command: fs.Args(), WorkingDirectory: *dir, Files: *files})
+	if err != nil {
+		return err
+	}
+	// scripts see the status of the command
+	if code != 0 {
+		os.Exit(code)
+	}
+	return nil
+}
+
+func runExplainPane(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("explain-pane", flag.ExitOnError)
+	target := fs.String("target", "", "tmux pane to capture, e.g. {last} or %3 (default: the current pane)")
+	lines := fs.Int("lines", explain.DefaultPaneLines, "Lines of scrollback to capture")
+	tokens := fs.Int("tokens", explain.DefaultPaneTokens, "Most tokens of scrollback to send, the end is kept")
+	fs.Parse(args)
+
+	return explain.Pane(cfg, explain.PaneOptions{
+		Target:   *target,
+		Lines:    *lines,
+		Tokens:   *tokens,
+		Question: strings.Join(fs.Args(), " "),
+	})
+}
+
+func runFixTests(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("fix-tests", flag.ExitOnError)
+	dir := fs.String("dir", "", "Go module directory to test (default: current directory)")
+	iterations := fs.Int("max-iterations", testfix.DefaultIterations, "How many fixes to try before giving up")
+	timeout := fs.Duration("timeout", 0, "Limit each go test run, e.g. 5m")
+	yes := fs.Bool("yes", false, "Apply every fix without asking for confirmation")
+	fs.Parse(args)
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	return testfix.Run(cfg, testfix.Options{
+		WorkingDirectory: *dir,
+		Packages:         fs.Args(),
+		MaxIterations:    *iterations,
+		Timeout:          *timeout,
+		Yes:              *yes,
+	})
+}
+
+func runCompressPrompt(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("compress-prompt", flag.ExitOnError)
+	mode := fs.String("mode", "", "Compress the system message of this mode instead of the global one")
+	yes := fs.Bool("yes", false, "Save the result without asking for confirmation")
+	fs.Parse(args)
+
+	// the result is saved to the global config, so start from that and not
+	// from the config with project overrides applied
+	globalCfg, err := config.LoadConfig(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	original := globalCfg.SystemMessage
+	if *mode != "" {
+		m, ok := globalCfg.Modes[*mode]
+		if !ok {
+			return fmt.Errorf("unknown mode %q", *mode)
+		}
+		original = m.SystemMessage
+	}
+
+	compressed, err := compress.Prompt(cfg, original)
+	if err != nil {
+		return err
+	}
+
+	before, err := helpers.CountTokens(original, cfg.ModelName)
+	if err != nil {
+		return err
+	}
+	after, err := helpers.CountTokens(compressed, cfg.ModelName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n\n", compressed)
+	fmt.Printf("%d -> %d tokens (%.0f%% shorter)\n", before, after, 100*float64(before-after)/float64(before))
+	if after >= before {
+		fmt.Println("The rewrite is not shorter, nothing to save.")
+		return nil
+	}
+
+	if !*yes {
+		fmt.Print("Save it to the config? [y/N]: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Not saved.")
+			return nil
+		}
+	}
+
+	if *mode != "" {
+		m := globalCfg.Modes[*mode]
+		m.SystemMessage = compressed
+		globalCfg.Modes[*mode] = m
+	} else {
+		globalCfg.SystemMessage = compressed
+	}
+	err = config.SaveConfig(globalCfg)
+	if err != nil {
+		return err
+	}
+	color.Green("Saved the compressed system message.\n")
+	return nil
+}
+
+func runReview(cfg *config.Config, args []string) error {
+	// the range comes first, without it the uncommitted changes are reviewed
+	diffRange := "HEAD"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		diffRange, args = args[0], args[1:]
+	}
+
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	format := fs.String("format", "markdown", "Report format: "+strings.Join(review.Formats, ", "))
+	output := fs.String("output", "", "File to write the report to (default: stdout)")
+	dir := fs.String("dir", "", "Repository directory (default: current directory)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: terminalgpt review [range] [--format %s] [--output file] [--dir path]", strings.Join(review.Formats, "|"))
+	}
+	if !review.IsFormat(*format) {
+		return fmt.Errorf("unknown format %q, expected one of %s", *format, strings.Join(review.Formats, ", "))
+	}
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	findings, err := review.Run(cfg, review.Options{Range: diffRange, WorkingDirectory: *dir})
+	if err != nil {
+		return err
+	}
+	report, err := review.Format(findings, *format, diffRange)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		fmt.Print(string(report))
+		if !strings.HasSuffix(string(report), "\n") {
+			fmt.Println()
+		}
+		return nil
+	}
+	err = os.WriteFile(*output, report, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write the report: %w", err)
+	}
+	color.Green("Wrote %d findings to %s\n", len(findings), *output)
+	return nil
+}
+
+func runSessions(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: terminalgpt sessions export-openai [--out file] | import-openai <file|-> [--append]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("sessions "+args[0], flag.ExitOnError)
+	historyFile := fs.String("history", config.HistoryFile, "History file to export from or import into")
+
+	switch args[0] {
+	case "export-openai":
+		out := fs.String("out", "", "File to write the messages to (default: stdout)")
+		fs.Parse(args[1:])
+
+		w := os.Stdout
+		if *out != "" {
+			file, err := os.Create(*out)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			w = file
+		}
+
+		count, err := sessions.ExportOpenAI(*historyFile, w)
+		if err != nil {
+			return err
+		}
+		if *out != "" {
+			fmt.Printf("Exported %d messages to %s\n", count, *out)
+		}
+		return nil
+	case "import-openai":
+		appendFlag := fs.Bool("append", false, "Append to the existing history instead of replacing it")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return usage
+		}
+
+		in := os.Stdin
+		if fs.Arg(0) != "-" {
+			file, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+
+		count, err := sessions.ImportOpenAI(in, *historyFile, *appendFlag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d messages into %s\n", count, *historyFile)
+		return nil
+	}
+
+	return usage
+}
+
+func runHistory(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: terminalgpt history search <query> [--context n] [--limit n] [--open n] | encrypt | decrypt")
+	if len(args) == 1 && (args[0] == "encrypt" || args[0] == "decrypt") {
+		return rewriteHistory(cfg, args[0] == "encrypt")
+	}
+	if len(args) < 2 || args[0] != "search" {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("history search", flag.ExitOnError)
+	context := fs.Int("context", 1, "Number of messages to show before and after each match")
+	limit := fs.Int("limit", 20, "Maximum number of matches to show")
+	open := fs.Int("open", 0, "Continue the session of this match instead of asking")
+	// allow the query before the flags
+	query := ""
+	if !strings.HasPrefix(args[1], "-") {
+		query = args[1]
+		fs.Parse(args[2:])
+	} else {
+		fs.Parse(args[1:])
+		query = strings.Join(fs.Args(), " ")
+	}
+	if query == "" {
+		return usage
+	}
+
+	matches, err := sessions.Search(query, *context)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		fmt.Printf("No messages contain %q\n", query)
+		return nil
+	}
+	if len(matches) > *limit {
+		fmt.Printf("Showing the newest %d of %d matches\n", *limit, len(matches))
+		matches = matches[:*limit]
+	}
+
+	grey := color.New(color.FgHiBlack)
+	for i, match := range matches {
+		when := "unknown time"
+		if !match.Time().IsZero() {
+			when = match.Time().Format("2006-01-02 15:04")
+		}
+		fmt.Println()
+		color.New(color.FgHiYellow).Printf("[%d] %s  %s\n", i+1, match.Session, when)
+		for _, entry := range match.Before {
+			grey.Printf("    %s: %s\n", entry.Role, sessions.Snippet(entry.Content, "", 80))
+		}
+		fmt.Printf("    %s: %s\n", match.Entry.Role, sessions.Snippet(match.Entry.Content, query, 80))
+		for _, entry := range match.After {
+			grey.Printf("    %s: %s\n", entry.Role, sessions.Snippet(entry.Content, "", 80))
+		}
+	}
+	fmt.Println()
+
+	choice := *open
+	if choice == 0 && !pipe.IsPiped() {
+		fmt.Print("Number of the match whose session to continue, or enter to quit: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return nil
+		}
+		choice, err = strconv.Atoi(answer)
+		if err != nil {
+			return fmt.Errorf("invalid match number %q", answer)
+		}
+	}
+	if choice == 0 {
+		return nil
+	}
+	if choice < 1 || choice > len(matches) {
+		return fmt.Errorf("there is no match %d", choice)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, "--session", matches[choice-1].Session)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// rewriteHistory encrypts or decrypts the history of every session and bridge
+// thread, its archives, the history kept in the trash, the prompts typed at
+// the chat prompt, the session summaries and the cached responses. Nothing
+// sealed may be left when decrypt forgets the key.
+func rewriteHistory(cfg *config.Config, encrypt bool) error {
+	if encrypt && !vault.Enabled() {
+		return fmt.Errorf("history_encryption is off, set it to %s or %s first (option 65 of terminalgpt --config)", vault.ModeKeychain, vault.ModePassphrase)
+	}
+	if keyMode := vault.KeyMode(); encrypt && keyMode != "" && keyMode != cfg.HistoryEncryption {
+		color.Yellow("The history already has a %s key, which is kept. Run terminalgpt history decrypt first to switch to %s.\n", keyMode, cfg.HistoryEncryption)
+	}
+
+	historyFiles, err := sessions.HistoryFiles()
+	if err != nil {
+		return err
+	}
+	threads, _ := filepath.Glob(filepath.Join(bridge.BridgeDir, "*.jsonl"))
+	historyFiles = append(historyFiles, threads...)
+	lines, files := 0, 0
+	for _, historyFile := range historyFiles {
+		archives, _ := filepath.Glob(historyFile + ".[0-9]")
+		for _, file := range append([]string{historyFile}, archives...) {
+			n, err := helpers.RewriteHistory(file, encrypt)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				lines += n
+				files++
+			}
+		}
+		for _, file := range []string{sessions.MetaFile(historyFile), helpers.PinsFile(historyFile)} {
+			n, err := vault.RewriteFile(file, encrypt)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				lines += n
+				files++
+			}
+		}
+	}
+	for _, file := range []string{input.HistoryFile, sessions.SummariesFile} {
+		n, err := vault.RewriteFile(file, encrypt)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			lines += n
+			files++
+		}
+	}
+	// removed exchanges and replaced histories, the trash also holds other files
+	items, err := trash.List()
+	if err != nil {
+		return fmt.Errorf("failed to rewrite the trash: %w", err)
+	}
+	for _, item := range items {
+		if !strings.HasSuffix(item.OriginalPath, ".jsonl") {
+			continue
+		}
+		n, err := vault.RewriteFile(trash.DataFile(item.ID), encrypt)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			lines += n
+			files++
+		}
+	}
+	// cache entries are one line each
+	n, err := cache.Rewrite(encrypt)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite the cache: %w", err)
+	}
+	lines += n
+	files += n
+
+	if encrypt {
+		fmt.Printf("Encrypted %d lines in %d files.\n", lines, files)
+		return nil
+	}
+	fmt.Printf("Decrypted %d lines in %d files.\n", lines, files)
+	err = vault.ForgetKey()
+	if err != nil {
+		return fmt.Errorf("failed to remove the history key: %w", err)
+	}
+	if vault.Enabled() {
+		color.Yellow("history_encryption is still %s, new history is encrypted with a new key.\n", cfg.HistoryEncryption)
+	}
+	return nil
+}
+
+func runImportHandoff(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("import-handoff", flag.ExitOnError)
+	session := fs.String("session", "", "Session to import into (default: the session the handoff came from)")
+	applyConfig := fs.Bool("apply-config", false, "Also use the settings of the handoff, keeping your own keys")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: terminalgpt import-handoff <file> [--session name] [--apply-config]")
+	}
+
+	handoff, err := sessions.ReadHandoff(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	name := *session
+	if name == "" {
+		name = handoff.Session
+	}
+	if name == "" {
+		name = sessions.GlobalSession
+	}
+	if name != sessions.GlobalSession {
+		err = sessions.Use(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = sessions.ImportHandoff(handoff, config.HistoryFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d messages into %s\n", len(handoff.History), config.HistoryFile)
+
+	if *applyConfig {
+		err = sessions.ApplyHandoffConfig(handoff)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Now using the settings of the handoff (%s, %s)\n", handoff.Config.AIProvider, handoff.Config.ModelName)
+	} else if handoff.Config.AIProvider != cfg.AIProvider || handoff.Config.ModelName != cfg.ModelName {
+		color.Yellow("The handoff used %s %s, you are on %s %s. Pass --apply-config to switch.\n", handoff.Config.AIProvider, handoff.Config.ModelName, cfg.AIProvider, cfg.ModelName)
+	}
+
+	continueArgs := []string{"terminalgpt", "--session", name}
+	if handoff.Mode != "" {
+		continueArgs = append(continueArgs, "--mode", handoff.Mode)
+	}
+	fmt.Printf("Continue with: %s\n", strings.Join(continueArgs, " "))
+	return nil
+}
+
+func runDoctor(cfg *config.Config, args []string) error {
+	checks := doctor.Run(cfg)
+	doctor.Print(os.Stdout, checks)
+	if failed := doctor.Failed(checks); failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func runCron(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: terminalgpt cron add \"prompt\" (--at HH:MM | --every interval) [--command cmd] [--output file] [--notify] [--model name] | list | remove <id> | run <id> | daemon")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("cron "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "add":
+		at := fs.String("at", "", "Time of day to run the job every day, like 17:30")
+		every := fs.String("every", "", "Interval to run the job at instead, like 30m or 6h")
+		command := fs.String("command", "", "Shell command run in the current directory whose output is sent with the prompt, like \"git log --since=midnight\"")
+		output := fs.String("output", "", "File to append the answers to (default: ~/.terminalgpt/jobs/<id>.md)")
+		notify := fs.Bool("notify", false, "Also show the answers as desktop notifications")
+		model := fs.String("model", "", "Model to ask instead of the configured one")
+		prompt := strings.Join(parseInterspersed(fs, args[1:]), " ")
+
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if *output != "" && !filepath.IsAbs(*output) {
+			*output = filepath.Join(dir, *output)
+		}
+		job, err := jobs.Add(jobs.Job{Prompt: prompt, At: *at, Every: *every, Command: *command, Dir: dir, Model: *model, Output: *output, Notify: *notify})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added job %s, running %s, next at %s. Answers go to %s.\n", job.ID, job.Schedule(), job.Next().Format("2006-01-02 15:04"), job.Output)
+		fmt.Println("Jobs only run while `terminalgpt cron daemon` does.")
+		return nil
+	case "list":
+		list, err := jobs.List()
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			fmt.Println("No jobs, add one with terminalgpt cron add.")
+			return nil
+		}
+		for _, job := range list {
+			fmt.Printf("%-3s %-16s next %s  %s\n", job.ID, job.Schedule(), job.Next().Format("2006-01-02 15:04"), job.Prompt)
+			if job.Command != "" {
+				color.New(color.FgHiBlack).Printf("    with the output of %s in %s\n", job.Command, job.Dir)
+			}
+			if job.LastError != "" {
+				color.Red("    last run failed: %s\n", job.LastError)
+			}
+		}
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+		err := jobs.Remove(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed job %s\n", args[1])
+		return nil
+	case "run":
+		if len(args) != 2 {
+			return usage
+		}
+		job, err := jobs.Load(args[1])
+		if err != nil {
+			return err
+		}
+		answer, err := jobs.Run(cfg, job)
+		if err != nil {
+			return err
+		}
+		fmt.Println(answer)
+		return nil
+	case "daemon":
+		fs.Parse(args[1:])
+		color.New(color.FgHiBlack).Printf("Running due jobs from %s, press Ctrl-C to stop.\n", jobs.JobsDir)
+		return jobs.Daemon(cfg, func(format string, a ...interface{}) {
+			fmt.Printf(time.Now().Format("2006-01-02 15:04:05 ")+format, a...)
+		})
+	}
+
+	return usage
+}
+
+// parseInterspersed parses the flags of args wherever they are, so they may
+// follow the arguments, and returns the arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func runDuel(cfg *config.Config, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: terminalgpt duel <persona> <persona> --topic \"...\" [--rounds n]")
+	}
+
+	fs := flag.NewFlagSet("duel", flag.ExitOnError)
+	topic := fs.String("topic", "", "What the personas should discuss")
+	rounds := fs.Int("rounds", 3, "Number of rounds, each persona speaks once per round")
+	fs.Parse(args[2:])
+	if *topic == "" {
+		return fmt.Errorf("--topic is required")
+	}
+
+	return duel.Run(cfg, duel.Options{
+		First:  args[0],
+		Second: args[1],
+		Topic:  *topic,
+		Rounds: *rounds,
+	}, bufio.NewReader(os.Stdin))
+}
+
+func runKB(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: terminalgpt kb add <path>... [--name name] [--chunk-tokens n] | list | remove <name>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("kb "+args[0], flag.ExitOnError)
+
+	switch args[0] {
+	case "add":
+		name := fs.String("name", kb.DefaultName, "Knowledge base to add the files to")
+		chunkTokens := fs.Int("chunk-tokens", kb.DefaultChunkTokens, "Approximate size of each chunk in tokens")
+		fs.Parse(args[1:])
+		if fs.NArg() == 0 {
+			return usage
+		}
+
+		files, chunks, err := kb.Add(cfg, *name, fs.Args(), *chunkTokens)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Indexed %d chunks from %d files into %s\n", chunks, files, *name)
+		return nil
+	case "list":
+		names, err := kb.List()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			index, err := kb.Load(name)
+			if err != nil {
+				return err
+			}
+			sources := make(map[string]bool)
+			for _, chunk := range index.Chunks {
+				sources[chunk.Source] = true
+			}
+			fmt.Printf("%s\t%d files\t%d chunks\t%s\n", name, len(sources), len(index.Chunks), index.Model)
+		}
+		return nil
+	case "remove":
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return usage
+		}
+		return kb.Remove(fs.Arg(0))
+	}
+
+	return usage
+}
+
+func runModels(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("models", flag.ExitOnError)
+	provider := fs.String("provider", cfg.AIProvider, "Provider to list the models of: gpt, azure or ollama")
+	refresh := fs.Bool("refresh", false, "Fetch the list again instead of using the cached one")
+	fs.Parse(args)
+
+	cfg.AIProvider = *provider
+	names, err := models.List(config.ModelProvider(cfg), *refresh)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if name == cfg.ModelName {
+			color.Green("%s (configured)\n", name)
+			continue
+		}
+		fmt.Println(name)
+	}
+
+	err = models.Validate(config.ModelProvider(cfg), cfg.ModelName)
+	if err != nil {
+		color.Yellow("The configured model: %v\n", err)
+	}
+	return nil
+}
+
+func runReplay(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	session := fs.String("session", "", "Session to replay, global for the global history")
+	model := fs.String("model", "", "Model to answer with, optionally prefixed with its provider, e.g. ollama:llama3")
+	as := fs.String("as", "", "Session to save the replay to (default: <session>+<model>)")
+	fs.Parse(args)
+	if *session == "" || *model == "" {
+		return fmt.Errorf("usage: terminalgpt replay --session <name> --model [provider:]<model> [--as name]")
+	}
+
+	provider, name := cfg.AIProvider, *model
+	if prefix, _, ok := strings.Cut(*model, ":"); ok && config.IsBackend(prefix) {
+		var err error
+		provider, name, err = config.ParseBackend(*model, "")
+		if err != nil {
+			return err
+		}
+	}
+	target := *as
+	if target == "" {
+		target = replay.TargetName(*session, name)
+	}
+
+	return replay.Run(cfg, replay.Options{
+		Session:  *session,
+		Provider: provider,
+		Model:    name,
+		Target:   target,
+	})
+}
+
+func runStats(cfg *config.Config, args []string) error {
+	if len(args) != 1 || args[0] != "limits" {
+		return fmt.Errorf("usage: terminalgpt stats limits")
+	}
+
+	all := ratelimit.All()
+	if len(all) == 0 {
+		fmt.Println("No rate limits recorded yet, they are read from the headers of the next response.")
+		return nil
+	}
+	for provider, limits := range all {
+		fmt.Printf("%-6s %s\n", provider, limits)
+	}
+	return nil
+}
+
+func runWarm(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	export := fs.String("export", "", "Also write the embedded tokenizer files to this directory, e.g. to use as tokenizer_dir")
+	fs.Parse(args)
+
+	if *export != "" {
+		err := helpers.ExportTokenizers(*export)
+		if err != nil {
+			return fmt.Errorf("failed to export tokenizers: %w", err)
+		}
+		fmt.Printf("Exported tokenizers to %s\n", *export)
+	}
+
+	failed := 0
+	for _, encoding := range helpers.Encodings {
+		start := time.Now()
+		err := helpers.ValidateEncoding(encoding)
+		if err != nil {
+			failed++
+			color.Red("%-12s FAILED (%s): %v\n", encoding, helpers.TokenizerSource(cfg, encoding), err)
+			continue
+		}
+		fmt.Printf("%-12s ok (%s, %s)\n", encoding, helpers.TokenizerSource(cfg, encoding), time.Since(start).Round(time.Millisecond))
+	}
+
+	tokens, err := helpers.CountTokens("terminalgpt warm", cfg.ModelName)
+	if err != nil {
+		failed++
+		color.Red("Token counting for %s failed: %v\n", cfg.ModelName, err)
+	} else {
+		fmt.Printf("Token counting for %s ok (%d tokens in the probe)\n", cfg.ModelName, tokens)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+func runWatch(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	glob := fs.String("glob", "**/*", "Files to watch, e.g. \"**/*.go\"")
+	template := fs.String("template", "", "Template to run on every saved file")
+	dir := fs.String("dir", "", "Directory to watch (default: current directory)")
+	interval := fs.Duration("interval", watch.DefaultInterval, "How often to check for saved files")
+	fs.Parse(args)
+	if *template == "" {
+		return fmt.Errorf("usage: terminalgpt watch [--glob pattern] [--dir path] --template name [key=value ...]")
+	}
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	return watch.Run(cfg, watch.Options{
+		Dir:      *dir,
+		Glob:     *glob,
+		Template: *template,
+		Vars:     fs.Args(),
+		Interval: *interval,
+	})
+}
+
+func runTrash(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: terminalgpt trash list | restore <id> | empty")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "list":
+		items, err := trash.List()
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			fmt.Println("The trash is empty.")
+			return nil
+		}
+		retention := trash.Retention(cfg.TrashRetentionDays)
+		for _, item := range items {
+			expires := item.Created.Add(retention).Format("2006-01-02")
+			fmt.Printf("%s  %s  (%s, deleted for good after %s)\n", item.ID, item.Description, item.OriginalPath, expires)
+		}
+		return nil
+	case "restore":
+		if len(args) != 2 {
+			return usage
+		}
+		item, err := trash.Restore(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s to %s\n", item.Description, item.OriginalPath)
+		return nil
+	case "empty":
+		return trash.Empty()
+	}
+
+	return usage
+}
+
+func runUpdate(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	checkOnly := fs.Bool("check-only", false, "Only report whether a newer version is available")
+	force := fs.Bool("force", false, "Install the latest release even over a development build or the same version")
+	fs.Parse(args)
+
+	current := version.Get().Version
+	release, err := update.Latest()
+	if err != nil {
+		return err
+	}
+	// builds from a checkout have no release version, only a pseudo-version
+	// like v0.0.0-20240102150405-abcdef123456+dirty
+	dev := current == "dev" || strings.HasPrefix(current, "v0.0.0-") || strings.Contains(current, "+dirty")
+	if !dev && !update.Newer(current, release.Tag) {
+		fmt.Printf("terminalgpt %s is the latest version.\n", current)
+		if !*force || *checkOnly {
+			return nil
+		}
+	} else {
+		fmt.Printf("terminalgpt %s is available (you have %s): %s\n", release.Tag, current, release.URL)
+	}
+	if *checkOnly {
+		return nil
+	}
+	if dev && !*force {
+		return fmt.Errorf("this is a development build, install the release with --force")
+	}
+
+	asset, ok := release.Binary(runtime.GOOS, runtime.GOARCH)
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", release.Tag, runtime.GOOS, runtime.GOARCH)
+	}
+	checksum, err := release.Checksum(asset)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Downloading %s (%.1f MB)...\n", asset.Name, float64(asset.Size)/(1<<20))
+	binary, err := update.Download(asset, checksum)
+	if err != nil {
+		return err
+	}
+	path, err := update.Install(binary)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s to %s.\n", path, release.Tag)
+	return nil
+}
+
+func runUsers(cfg *config.Config, args []string) error {
+	usageErr := fmt.Errorf("usage: terminalgpt users add <name> [--provider gpt|azure] | list | remove <name> | usage [--days n] [--user name]")
+	if len(args) == 0 {
+		return usageErr
+	}
+
+	fs := flag.NewFlagSet("users "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "add":
+		provider := fs.String("provider", "gpt", "Provider the key is for, gpt or azure")
+		names := parseInterspersed(fs, args[1:])
+		if len(names) != 1 {
+			return usageErr
+		}
+		key, err := readKey(names[0], *provider)
+		if err != nil {
+			return err
+		}
+		where, err := config.AddUser(names[0], *provider, key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Stored the %s key of %s in %s. Use it with terminalgpt --as %s.\n", *provider, names[0], where, names[0])
+		return nil
+	case "list":
+		if len(cfg.Users) == 0 {
+			fmt.Println("No users, add one with terminalgpt users add <name>.")
+			return nil
+		}
+		for _, name := range cfg.Users {
+			keys := config.UserKeys(name)
+			line := fmt.Sprintf("%-16s keys: %s", name, strings.Join(keys, ", "))
+			if len(keys) == 0 {
+				line = fmt.Sprintf("%-16s no keys", name)
+			}
+			if name == cfg.ActiveUser {
+				line += " (active)"
+			}
+			fmt.Println(line)
+		}
+		return nil
+	case "remove":
+		if len(args) != 2 {
+			return usageErr
+		}
+		err := config.RemoveUser(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s and their keys, their usage is kept.\n", args[1])
+		return nil
+	case "usage":
+		days := fs.Int("days", 30, "Only count the requests of the last n days, 0 for all")
+		only := fs.String("user", "", "Only count the requests of this user")
+		fs.Parse(args[1:])
+		return printUsage(*days, *only)
+	}
+
+	return usageErr
+}
+
+// readKey reads the API key of a user from the terminal without echoing it,
+// or from stdin when it is piped.
+func readKey(name, provider string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the key: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	fmt.Fprintf(os.Stderr, "%s API key of %s: ", provider, name)
+	key, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the key: %w", err)
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// printUsage prints the requests, tokens and cost per user and model.
+func printUsage(days int, only string) error {
+	since := time.Time{}
+	if days > 0 {
+		since = time.Now().AddDate(0, 0, -days)
+	}
+	records, err := usage.Read(since)
+	if err != nil {
+		return err
+	}
+
+	type row struct{ user, model string }
+	totals := map[row]*usage.Totals{}
+	all := usage.Totals{}
+	for _, record := range records {
+		if only != "" && record.User != only {
+			continue
+		}
+		key := row{record.User, record.Model}
+		if totals[key] == nil {
+			totals[key] = &usage.Totals{}
+		}
+		totals[key].Add(record)
+		all.Add(record)
+	}
+	if all.Requests == 0 {
+		fmt.Println("No usage recorded for that period.")
+		return nil
+	}
+	rows := []row{}
+	for key := range totals {
+		rows = append(rows, key)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].user != rows[j].user {
+			return rows[i].user < rows[j].user
+		}
+		return rows[i].model < rows[j].model
+	})
+
+	cost := func(t *usage.Totals) string {
+		if t.Unpriced > 0 {
+			return fmt.Sprintf("$%.4f*", t.Cost)
+		}
+		return fmt.Sprintf("$%.4f", t.Cost)
+	}
+	fmt.Printf("%-16s %-24s %8s %12s %12s %11s\n", "USER", "MODEL", "REQUESTS", "PROMPT", "RESPONSE", "COST")
+	for _, key := range rows {
+		t := totals[key]
+		fmt.Printf("%-16s %-24s %8d %12d %12d %11s\n", key.user, key.model, t.Requests, t.PromptTokens, t.ResponseTokens, cost(t))
+	}
+	fmt.Printf("%-16s %-24s %8d %12d %12d %11s\n", "total", "", all.Requests, all.PromptTokens, all.ResponseTokens, cost(&all))
+	if all.Unpriced > 0 {
+		color.New(color.FgHiBlack).Println("* without the requests to models of unknown price")
+	}
+	return nil
+}
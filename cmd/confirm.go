@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfirmTokens is the prompt size that needs a confirmation when
+// confirm_tokens is not set.
+const defaultConfirmTokens = 20000
+
+// attachment is a piece of context added to a prompt, e.g. an injected file
+// or the piped input.
+type attachment struct {
+	name  string
+	bytes int64
+}
+
+// fileAttachments returns the injected files at paths with their sizes, named
+// relative to workingDirectory.
+func fileAttachments(paths []string, workingDirectory string) []attachment {
+	attachments := []attachment{}
+	for _, path := range paths {
+		name := path
+		if rel, err := filepath.Rel(workingDirectory, path); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		var size int64
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+		attachments = append(attachments, attachment{name: name, bytes: size})
+	}
+	return attachments
+}
+
+// confirmTokens returns the prompt size over which sending needs a
+// confirmation, or 0 when it never does.
+func confirmTokens(cfg *config.Config) int {
+	switch {
+	case cfg.ConfirmTokens < 0:
+		return 0
+	case cfg.ConfirmTokens == 0:
+		return defaultConfirmTokens
+	}
+	return cfg.ConfirmTokens
+}
+
+// confirmSend asks whether to send a completion of message when its request
+// is over confirm_tokens, after showing what it is made of and what it may
+// cost. The answer is read from reader, or from the terminal when reader is
+// nil because stdin is piped.
+func confirmSend(cfg *config.Config, message string, attachments []attachment, reader *bufio.Reader) (bool, error) {
+	threshold := confirmTokens(cfg)
+	// the history is trimmed to the budget and no token is shorter than a byte
+	if threshold == 0 || cfg.MaxTotalTokens-cfg.MaxResponseTokens <= threshold {
+		return true, nil
+	}
+	if !cfg.History && len(cfg.SystemMessage)+len(message) <= threshold {
+		return true, nil
+	}
+
+	// plugins and scrubbing run once, when the request is sent
+	estimateCfg := *cfg
+	estimateCfg.Plugins = nil
+	estimateCfg.ScrubSecrets = false
+	request, err := common.BuildRequest(&estimateCfg, message)
+	if err != nil {
+		return false, err
+	}
+	total, err := helpers.CountMessageTokens(request.Messages, cfg.ModelName)
+	if err != nil {
+		return false, err
+	}
+	if total <= threshold {
+		return true, nil
+	}
+
+	roles := map[string]int{}
+	for _, entry := range request.Messages[:len(request.Messages)-1] {
+		tokens, err := helpers.CountEntryTokens(entry, cfg.ModelName)
+		if err != nil {
+			return false, err
+		}
+		roles[entry.Role] += tokens
+	}
+
+	bold := color.New(color.Bold)
+	color.New(color.FgYellow).Fprintf(os.Stderr, "\nThis request has %d tokens, over the %d of confirm_tokens.\n", total, threshold)
+	for _, a := range attachments {
+		fmt.Fprintf(os.Stderr, "  %-40s %14s\n", a.name, formatBytes(a.bytes))
+	}
+	history := roles["user"] + roles["assistant"]
+	fmt.Fprintf(os.Stderr, "  %-40s %7d tokens\n", "system message", roles["system"])
+	fmt.Fprintf(os.Stderr, "  %-40s %7d tokens\n", "history", history)
+	fmt.Fprintf(os.Stderr, "  %-40s %7d tokens\n", "prompt", total-roles["system"]-history)
+	if cost, ok := helpers.Cost(cfg.ModelName, total, cfg.MaxResponseTokens); ok {
+		bold.Fprintf(os.Stderr, "Estimated cost: up to $%.4f with %s\n", cost, cfg.ModelName)
+	} else {
+		bold.Fprintf(os.Stderr, "Estimated cost: unknown for %s\n", cfg.ModelName)
+	}
+
+	if reader == nil {
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return false, fmt.Errorf("no terminal to confirm on, pass --yes to send it or raise confirm_tokens with --config")
+		}
+		defer tty.Close()
+		reader = bufio.NewReader(tty)
+	}
+	return askYesNo(reader, "Send it?"), nil
+}
+
+// formatBytes returns size in B, KB or MB.
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
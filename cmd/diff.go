@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/worddiff"
+)
+
+// printResponseDiff shows what changed from the previous response to the
+// regenerated one, word by word.
+func printResponseDiff(previous, response string) {
+	parts := worddiff.Diff(previous, response)
+	removed, added := worddiff.Count(parts)
+	orange := color.New(color.FgHiYellow)
+	if removed == 0 && added == 0 {
+		orange.Println("The new response has the same words as the previous one.")
+		return
+	}
+	orange.Printf("Changes from the previous response, %d words removed and %d added:\n", removed, added)
+	fmt.Printf("%s\n\n", worddiff.Format(parts))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/cache"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"strings"
+)
+
+// previewLength is how much of each message the dry run shows.
+const previewLength = 72
+
+// printDryRun shows the request a completion of message would send: every
+// message with its tokens, the estimated cost and the JSON payload.
+func printDryRun(cfg *config.Config, message string) error {
+	request, err := common.BuildRequest(cfg, message)
+	if err != nil {
+		return err
+	}
+
+	gray := color.New(color.FgHiBlack)
+	bold := color.New(color.Bold)
+	gray.Printf("Dry run, nothing is sent to %s %s.\n\n", cfg.AIProvider, cfg.ModelName)
+
+	bold.Printf("%3s  %-9s  %6s  %s\n", "#", "role", "tokens", "content")
+	for i, entry := range request.Messages {
+		tokens, err := helpers.CountEntryTokens(entry, cfg.ModelName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%3d  %-9s  %6d  %s\n", i+1, entry.Role, tokens, preview(entry.Content))
+	}
+
+	total, err := helpers.CountMessageTokens(request.Messages, cfg.ModelName)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%3s  %-9s  %6d  of %d for the prompt, the response may use %d more\n", "", "total", total, cfg.MaxTotalTokens-cfg.MaxResponseTokens, cfg.MaxResponseTokens)
+
+	if cost, ok := helpers.Cost(cfg.ModelName, total, cfg.MaxResponseTokens); ok {
+		fmt.Printf("\nEstimated cost: up to $%.4f\n", cost)
+	} else {
+		fmt.Printf("\nEstimated cost: unknown for %s\n", cfg.ModelName)
+	}
+	if cfg.Cache {
+		history := []helpers.HistoryEntry{}
+		if cfg.History {
+			history, _ = helpers.LoadHistory(config.HistoryFile)
+		}
+		if _, ok := cache.Get(cache.Key(cfg, history, message), cache.TTL(cfg)); ok {
+			fmt.Println("The response cache has an answer, the request would not be sent.")
+		}
+	}
+
+	var payload bytes.Buffer
+	if err := json.Indent(&payload, request.Payload, "", "  "); err != nil {
+		payload.Reset()
+		payload.Write(request.Payload)
+	}
+	bold.Println("\nPayload:")
+	fmt.Println(payload.String())
+	return nil
+}
+
+// preview returns the start of content on one line.
+func preview(content string) string {
+	runes := []rune(strings.Join(strings.Fields(content), " "))
+	if len(runes) > previewLength {
+		return string(runes[:previewLength-3]) + "..."
+	}
+	return string(runes)
+}
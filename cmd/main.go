@@ -4,16 +4,90 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/cache"
+	"github.com/rojolang/terminalgpt/clipboard"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"github.com/rojolang/terminalgpt/codeindex"
 	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/compare"
+	"github.com/rojolang/terminalgpt/compress"
 	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/debuglog"
+	"github.com/rojolang/terminalgpt/envschema"
+	"github.com/rojolang/terminalgpt/execute"
+	"github.com/rojolang/terminalgpt/fixes"
 	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/injector"
+	"github.com/rojolang/terminalgpt/input"
+	"github.com/rojolang/terminalgpt/kb"
+	"github.com/rojolang/terminalgpt/patch"
+	"github.com/rojolang/terminalgpt/pipe"
+	"github.com/rojolang/terminalgpt/popup"
+	"github.com/rojolang/terminalgpt/save"
+	"github.com/rojolang/terminalgpt/schema"
+	"github.com/rojolang/terminalgpt/sessions"
+	"github.com/rojolang/terminalgpt/stats"
+	"github.com/rojolang/terminalgpt/suggest"
+	"github.com/rojolang/terminalgpt/templates"
+	"github.com/rojolang/terminalgpt/termcap"
+	"github.com/rojolang/terminalgpt/trash"
+	"github.com/rojolang/terminalgpt/variants"
+	"github.com/rojolang/terminalgpt/webpage"
+	"github.com/rojolang/terminalgpt/websearch"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 func main() {
-	configFlag, clearFlag, runMode, workingDirectory := helpers.HandleFlags()
+	// detect once up front so colors are disabled everywhere on plain terminals
+	caps := termcap.Get()
+
+	// arrow keys and Emacs editing for the config prompts too
+	config.ReadAnswer = func(reader *bufio.Reader) (string, error) {
+		return input.ReadLine(reader, "")
+	}
+
+	// --as before a subcommand, like terminalgpt --as alice ask
+	if len(os.Args) > 3 && os.Args[1] == "--as" {
+		if _, ok := subcommands[os.Args[3]]; ok {
+			os.Setenv(config.EnvPrefix+"ACTIVE_USER", os.Args[2])
+			os.Args = append(os.Args[:1], os.Args[3:]...)
+		}
+	}
+
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if os.Args[1] == "users" {
+				// managing the users works before the active one is added
+				os.Unsetenv(config.EnvPrefix + "ACTIVE_USER")
+			}
+			noConfigure := false
+			err := run(helpers.LoadConfig(&noConfigure, ""), os.Args[2:])
+			if err != nil {
+				color.Red("%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	flags := helpers.HandleFlags()
+	err := termcap.SetColorMode(*flags.Color)
+	if err != nil {
+		color.Red("%v\n", err)
+		os.Exit(1)
+	}
+	if *flags.Version {
+		printVersion(*flags.WorkingDirectory)
+		return
+	}
+	configFlag, clearFlag, runMode, workingDirectory := flags.Config, flags.Clear, flags.RunMode, flags.WorkingDirectory
 
 	// if working directory is empty then set it to the current directory
 	if *workingDirectory == "" {
@@ -24,15 +98,216 @@ func main() {
 		*workingDirectory = wd
 	}
 
-	cfg := helpers.LoadConfig(configFlag)
+	// picked up with the other TERMINALGPT_* overrides
+	if *flags.As != "" {
+		os.Setenv(config.EnvPrefix+"ACTIVE_USER", *flags.As)
+	}
+	cfg := helpers.LoadConfig(configFlag, *workingDirectory)
+	if *flags.Verbose {
+		debuglog.SetVerbose()
+	}
+
+	if *runMode == "" {
+		*runMode = cfg.DefaultMode
+	}
+
+	if *flags.Popup != "" {
+		cfg.Popup = *flags.Popup
+	}
+
+	if *flags.NoCache {
+		cfg.Cache = false
+	}
+	if cfg.Cache {
+		cache.Prune(cache.TTL(cfg))
+	}
+	trash.Prune(trash.Retention(cfg.TrashRetentionDays))
+
+	if *flags.Format != "" && !fixes.IsFormat(*flags.Format) {
+		color.Red("Unknown --format %q, expected one of %s\n", *flags.Format, strings.Join(fixes.Formats, ", "))
+		os.Exit(1)
+	}
+
+	var answerSchema *schema.Schema
+	if *flags.Schema != "" {
+		if *flags.Format != "" {
+			color.Red("--schema and --format cannot be used together\n")
+			os.Exit(1)
+		}
+		answerSchema, err = schema.Load(*flags.Schema)
+		if err != nil {
+			color.Red("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var compareTargets []compare.Target
+	if *flags.Compare != "" {
+		if *flags.Format != "" || answerSchema != nil {
+			color.Red("--compare cannot be used with --format or --schema\n")
+			os.Exit(1)
+		}
+		compareTargets, err = compare.Parse(*flags.Compare, cfg.AIProvider)
+		if err != nil {
+			color.Red("%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *flags.Output != "" {
+		mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if *flags.Append {
+			mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		outputFile, err := os.OpenFile(*flags.Output, mode, 0644)
+		if err != nil {
+			color.Red("Failed to open the output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer outputFile.Close()
+		helpers.SetStreamOutput(outputFile)
+	}
+
+	if *flags.Prune {
+		err := pruneHistory(*flags.DryRun)
+		if err != nil {
+			color.Red("Failed to prune history: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *flags.ListSessions {
+		err := listSessions()
+		if err != nil {
+			color.Red("Failed to list the conversations: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	session := *flags.Session
+	if session == "" && cfg.AutoSession {
+		session = sessions.Name(*workingDirectory)
+	}
+	if session != "" && session != sessions.GlobalSession {
+		err := sessions.Use(session)
+		if err != nil {
+			color.Red("Failed to open session %s: %v\n", session, err)
+			os.Exit(1)
+		}
+		if !pipe.IsPiped() {
+			color.New(color.FgHiBlack).Printf("Session: %s\n", session)
+		}
+	}
+
+	if result, err := helpers.PruneHistory(config.HistoryFile, false); err != nil {
+		color.Red("Failed to prune history: %v\n", err)
+	} else if result.Removed > 0 && !pipe.IsPiped() {
+		color.New(color.FgHiBlack).Printf("Pruned %s\n", result)
+	}
+
+	if !pipe.IsPiped() && len(cfg.Sources) > 1 {
+		color.New(color.FgHiBlack).Printf("Config: %s\n", strings.Join(cfg.Sources, " < "))
+	}
+
+	if cfg.CompressPrompts {
+		compress.Apply(cfg, *runMode)
+	}
 
 	helpers.HandleRunMode(runMode, workingDirectory, cfg)
 
 	helpers.HandleClearFlag(clearFlag)
+	if *clearFlag {
+		sessions.RemoveMeta(config.HistoryFile)
+	}
 
 	reader := bufio.NewReader(os.Stdin)
 
+	// Tab completes these and the files of the project
+	input.Commands = []string{"--config", "--model", "--temp", "--system", "--show", "--clear", "--undo", "--pin", "--pins", "--template", "--exec", "--run", "--save", "--save-all", "--copy", "--diff", "--expand", "--speak", "--handoff", "--suggest", "--exit", "--quit"}
+	input.Files = func() []string {
+		index, err := codeindex.Open(*workingDirectory)
+		if err != nil {
+			return nil
+		}
+		return index.Paths()
+	}
+
+	// a template passed on the command line is sent as the first prompt
+	pendingMessage := ""
+	if *flags.Template != "" {
+		rendered, err := templates.Render(*flags.Template, flags.Args, *workingDirectory)
+		if err != nil {
+			color.Red("Failed to render template: %v\n", err)
+			os.Exit(1)
+		}
+		pendingMessage = rendered
+	}
+
+	if pipe.IsPiped() {
+		question := pendingMessage
+		if question == "" {
+			question = strings.Join(flags.Args, " ")
+		}
+		err := runPiped(cfg, question, *flags.Format, *flags.Timeout, *flags.Speak, answerSchema, compareTargets, *flags.DryRun, *flags.Yes)
+		if err != nil {
+			color.Red("%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// temperature override for the next request only, negative means use the config
+	requestTemperature := -1.0
+	// number of variants to request for the next prompt, 0 means a normal streamed reply
+	variantCount := 0
+	// the most recent assistant reply, used by commands that act on it
+	lastResponse := helpers.LastAssistantMessage(config.HistoryFile)
+	// whether --speak has saved audio yet, later responses are appended
+	spoken := false
+	// what happened in this session, printed on exit
+	summary := sessions.NewSummary(*workingDirectory)
+	// whether the conversation has a title, it is named after its first exchange
+	named := !cfg.History || cfg.TitleModel == sessions.TitleModelOff
+	if !named {
+		meta, err := sessions.LoadMeta(config.HistoryFile)
+		named = err != nil || meta.Title != ""
+	}
+	var naming sync.WaitGroup
+	// settings changed by --model, --temp and --system, shown by --show
+	changedSettings := map[string]bool{}
+	// clipboard content to add to the next prompt, from --paste
+	pasted := ""
+	// the response being regenerated, and the last two for --diff
+	regeneratedFrom := ""
+	// the prompt whose last exchange the next answer replaces
+	replacing := ""
+	var lastDiff [2]string
+	if *flags.Paste {
+		content, err := clipboard.Read()
+		if err != nil {
+			color.Red("Failed to read the clipboard: %v\n", err)
+			os.Exit(1)
+		}
+		pasted = content
+	}
+
+	if *flags.Regen {
+		if cfg.LastUserMessage == "" {
+			color.Red("Nothing to regenerate.\n")
+			os.Exit(1)
+		}
+		replacing = replacedMessage(cfg)
+		pendingMessage = cfg.LastUserMessage
+		requestTemperature = *flags.RegenTemperature
+		regeneratedFrom = lastResponse
+	}
+
 	for {
+		// the response the prompt of this iteration regenerates, if any
+		diffBase := regeneratedFrom
+		regeneratedFrom = ""
 		pink := color.New(color.FgHiMagenta)
 		orange := color.New(color.FgHiYellow)
 		orange.Printf("Working Directory: %s\n", *workingDirectory)
@@ -40,11 +315,22 @@ func main() {
 		if *runMode != "" {
 			orange.Printf("Run Mode: %s\n", *runMode)
 		}
-		pink.Printf("--config, --clear, --exit, or...  type a prompt (note: *.php will auto inject file content): ")
-		userMessage, _ := reader.ReadString('\n')
-		userMessage = strings.TrimSpace(userMessage)
+		var userMessage string
+		if pendingMessage != "" {
+			userMessage = pendingMessage
+			pendingMessage = ""
+		} else {
+			var err error
+			userMessage, err = input.ReadPrompt(reader, "--config, --model <name>, --temp <t>, --system <text>, --show, --clear, --undo, --pin [text], --pins [remove n], --template, --exec [n], --run [n], --save <n> [path], --save-all [dir], --copy [code], --diff, --expand, --speak, --handoff [path], r [temp], n [count], --exit, or...  type a prompt (note: mentioned files with the inject_extensions or the mode's extensions are injected): ", pink, cfg)
+			if err == input.ErrInterrupted || (err == io.EOF && userMessage == "") {
+				break
+			}
 
-		fmt.Print("\033[1A\033[2K")
+			// clear the echoed prompt line, only possible on a real terminal
+			if caps.TTY {
+				fmt.Print("\033[1A\033[2K")
+			}
+		}
 
 		if userMessage == "" {
 			userMessage = cfg.LastUserMessage
@@ -63,7 +349,280 @@ func main() {
 			if err != nil {
 				continue
 			}
+			sources, err := config.ApplyOverrides(&tempCfg, *workingDirectory)
+			if err != nil {
+				color.Red("Failed to apply config overrides: %v\n", err)
+			}
+			tempCfg.Sources = append([]string{config.ConfigFile}, sources...)
 			cfg = &tempCfg
+			helpers.SetHistoryLimits(cfg)
+			helpers.SetTokenCounter(cfg)
+			helpers.SetTokenizerDir(cfg)
+			changedSettings = map[string]bool{}
+			continue
+		}
+
+		if handled, err := applySetting(cfg, userMessage, changedSettings); handled {
+			if err != nil {
+				color.Red("%v\n", err)
+			}
+			continue
+		}
+
+		if userMessage == "--show" {
+			showSettings(cfg, *runMode, session, changedSettings)
+			continue
+		}
+
+		if strings.HasPrefix(userMessage, "--template") {
+			args := strings.Fields(userMessage)[1:]
+			if len(args) == 0 {
+				names, err := templates.List()
+				if err != nil {
+					color.Red("Failed to list templates: %v\n", err)
+					continue
+				}
+				orange.Printf("Templates in %s: %s\n", config.TemplatesDir, strings.Join(names, ", "))
+				continue
+			}
+			rendered, err := templates.Render(args[0], args[1:], *workingDirectory)
+			if err != nil {
+				color.Red("Failed to render template: %v\n", err)
+				continue
+			}
+			pendingMessage = rendered
+			continue
+		}
+
+		if command, value, ok := parseRegen(userMessage); ok {
+			if cfg.LastUserMessage == "" {
+				color.Red("Nothing to regenerate.\n")
+				continue
+			}
+
+			if command == "r" {
+				requestTemperature = value
+				regeneratedFrom = lastResponse
+			} else {
+				variantCount = 3
+				if value >= 0 {
+					if value < 2 {
+						color.Red("Invalid variant count %v, expected a number of at least 2\n", value)
+						continue
+					}
+					variantCount = int(value)
+				}
+			}
+
+			// the new answer replaces the previous one once it is accepted
+			replacing = replacedMessage(cfg)
+			pendingMessage = cfg.LastUserMessage
+			continue
+		}
+
+		if userMessage == "--exec" || strings.HasPrefix(userMessage, "--exec ") {
+			index := 0
+			if args := strings.Fields(userMessage)[1:]; len(args) > 0 {
+				var err error
+				index, err = strconv.Atoi(args[0])
+				if err != nil || index < 1 {
+					color.Red("Invalid command number %q\n", args[0])
+					continue
+				}
+			}
+			err := execute.Offer(lastResponse, *workingDirectory, reader, index, *flags.Timeout)
+			if err != nil {
+				color.Red("%v\n", err)
+			}
+			continue
+		}
+
+		if userMessage == "--run" || strings.HasPrefix(userMessage, "--run ") {
+			index := 0
+			if args := strings.Fields(userMessage)[1:]; len(args) > 0 {
+				var err error
+				index, err = strconv.Atoi(args[0])
+				if err != nil || index < 1 {
+					color.Red("Invalid code block number %q\n", args[0])
+					continue
+				}
+			}
+			fix, err := runSnippet(lastResponse, index, *flags.Timeout, reader)
+			if err != nil {
+				color.Red("%v\n", err)
+				continue
+			}
+			pendingMessage = fix
+			continue
+		}
+
+		if userMessage == "--save-all" || strings.HasPrefix(userMessage, "--save-all ") {
+			dir := "."
+			if args := strings.Fields(userMessage)[1:]; len(args) > 0 {
+				dir = args[0]
+			}
+			written, err := save.All(lastResponse, *workingDirectory, reader, dir)
+			if err != nil {
+				color.Red("%v\n", err)
+			}
+			summary.AddFiles(written...)
+			continue
+		}
+
+		if userMessage == "--save" || strings.HasPrefix(userMessage, "--save ") {
+			args := strings.Fields(userMessage)[1:]
+			if len(args) == 0 {
+				color.Red("Usage: --save <n> [path]\n")
+				continue
+			}
+			index, err := strconv.Atoi(args[0])
+			if err != nil || index < 1 {
+				color.Red("Invalid code block number %q\n", args[0])
+				continue
+			}
+			path := ""
+			if len(args) > 1 {
+				path = args[1]
+			}
+			written, err := save.Block(lastResponse, *workingDirectory, reader, index, path)
+			if err != nil {
+				color.Red("%v\n", err)
+				continue
+			}
+			if written != "" {
+				summary.AddFiles(written)
+			}
+			continue
+		}
+
+		if userMessage == "--suggest" || strings.HasPrefix(userMessage, "--suggest ") {
+			args := strings.Fields(userMessage)[1:]
+			if len(args) < 2 {
+				color.Red("Usage: --suggest <file> <instruction>\n")
+				continue
+			}
+			instruction := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(userMessage, "--suggest"), " "+args[0]))
+			instruction = strings.Trim(instruction, "\"'")
+			changed, err := suggest.Run(cfg, args[0], instruction, *workingDirectory, reader)
+			if err != nil {
+				color.Red("%v\n", err)
+				continue
+			}
+			if changed != "" {
+				summary.AddFiles(changed)
+			}
+			continue
+		}
+
+		if userMessage == "--diff" {
+			if lastDiff[0] == "" {
+				color.Red("No response has been regenerated yet.\n")
+				continue
+			}
+			printResponseDiff(lastDiff[0], lastDiff[1])
+			continue
+		}
+
+		if userMessage == "--copy" || strings.HasPrefix(userMessage, "--copy ") {
+			if lastResponse == "" {
+				color.Red("There is no response to copy yet.\n")
+				continue
+			}
+			text := lastResponse
+			what := "the last response"
+			if args := strings.Fields(userMessage)[1:]; len(args) > 0 && args[0] == "code" {
+				blocks := codeblocks.Extract(lastResponse)
+				if len(blocks) == 0 {
+					color.Red("The last response has no code blocks.\n")
+					continue
+				}
+				code := []string{}
+				for _, block := range blocks {
+					code = append(code, block.Code)
+				}
+				text = strings.Join(code, "\n\n")
+				what = fmt.Sprintf("%d code block(s)", len(blocks))
+			}
+			err := clipboard.Write(text)
+			if err != nil {
+				color.Red("Failed to copy: %v\n", err)
+				continue
+			}
+			orange.Printf("Copied %s to the clipboard.\n", what)
+			continue
+		}
+
+		if userMessage == "--undo" {
+			err := helpers.RemoveLastExchange(config.HistoryFile)
+			if err != nil {
+				color.Red("Nothing to undo: %v\n", err)
+				continue
+			}
+			lastResponse = helpers.LastAssistantMessage(config.HistoryFile)
+			orange.Printf("Removed the last exchange from the history, `terminalgpt trash list` shows it.\n")
+			continue
+		}
+
+		if userMessage == "--pin" || strings.HasPrefix(userMessage, "--pin ") {
+			pin, err := pinContext(cfg, strings.TrimSpace(strings.TrimPrefix(userMessage, "--pin")))
+			if err != nil {
+				color.Red("Failed to pin: %v\n", err)
+				continue
+			}
+			orange.Printf("Pinned as %d, it is sent with every prompt of this conversation. --pins lists the pins.\n", pin.ID)
+			continue
+		}
+
+		if userMessage == "--pins" || strings.HasPrefix(userMessage, "--pins ") {
+			err := managePins(cfg, strings.Fields(strings.TrimPrefix(userMessage, "--pins")))
+			if err != nil {
+				color.Red("%v\n", err)
+			}
+			continue
+		}
+
+		if userMessage == "--expand" {
+			if lastResponse == "" {
+				color.Red("There is no response to expand yet.\n")
+				continue
+			}
+			fmt.Printf("%s\n\n", color.New(color.FgBlue).Sprint(lastResponse))
+			continue
+		}
+
+		if userMessage == "--speak" {
+			if lastResponse == "" {
+				color.Red("There is no response to read out yet.\n")
+				continue
+			}
+			err := speak(cfg, lastResponse, *flags.Speak, spoken)
+			if err != nil {
+				color.Red("Failed to read out the response: %v\n", err)
+				continue
+			}
+			spoken = true
+			continue
+		}
+
+		if userMessage == "--handoff" || strings.HasPrefix(userMessage, "--handoff ") {
+			name := session
+			if name == "" {
+				name = sessions.GlobalSession
+			}
+			path := strings.TrimSuffix(filepath.Base(sessions.HistoryFile(name)), ".jsonl") + ".handoff.json"
+			if args := strings.Fields(userMessage)[1:]; len(args) > 0 {
+				path = args[0]
+			}
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(*workingDirectory, path)
+			}
+			handoff, err := sessions.WriteHandoff(path, cfg, name, *runMode, config.HistoryFile)
+			if err != nil {
+				color.Red("Failed to write the handoff: %v\n", err)
+				continue
+			}
+			summary.AddFiles(path)
+			orange.Printf("Wrote %d messages to %s, continue elsewhere with: terminalgpt import-handoff %s\n", len(handoff.History), path, filepath.Base(path))
 			continue
 		}
 
@@ -72,23 +631,216 @@ func main() {
 			if err != nil {
 				continue
 			}
+			sessions.RemoveMeta(config.HistoryFile)
+			named = !cfg.History || cfg.TitleModel == sessions.TitleModelOff
 			continue
 		}
 
 		cfg.LastUserMessage = userMessage
-		config.SaveConfig(*cfg)
+		config.SaveLastUserMessage(userMessage)
+
+		if pasted != "" {
+			userMessage = userMessage + "\n\nMy clipboard contains:\n==\n" + pasted + "\n==\n"
+			pasted = ""
+		}
+
+		// everything from here to the end of the response shares the --timeout
+		ctx, cancel := deadline.New(*flags.Timeout)
+
+		prepared := userMessage
+		var injected []string
+		err := deadline.Run(ctx, "reading files", func() error {
+			prepared, injected = injector.Inject(prepared, *workingDirectory, injector.ForMode(cfg, *runMode))
+			if *flags.EnvSchema {
+				prepared = envschema.Inject(prepared, *workingDirectory)
+			}
+			return nil
+		})
+		if err != nil {
+			cancel()
+			color.Red("%v\n", err)
+			continue
+		}
+		userMessage = prepared
+		summary.AddFiles(injected...)
 
-		if *runMode == "laravel" {
-			userMessage = helpers.HandleLaravelMode(userMessage, *workingDirectory)
-		} else if *runMode == "go" {
-			userMessage = helpers.HandleGoMode(userMessage, *workingDirectory)
+		var searchResults []websearch.Result
+		if query, ok := websearch.Query(userMessage); ok {
+			err := deadline.Run(ctx, "searching the web", func() error {
+				if cfg.WebSearch == "" {
+					return fmt.Errorf("web search is off, choose a search API with --config")
+				}
+				withResults, results, err := websearch.Inject(cfg, query)
+				prepared, searchResults = withResults, results
+				return err
+			})
+			if err != nil {
+				cancel()
+				color.Red("Web search failed: %v\n", err)
+				continue
+			}
+			userMessage = prepared
+		} else if cfg.FetchURLs {
+			err := deadline.Run(ctx, "fetching URLs", func() error {
+				withPages, pages, failed := webpage.Inject(prepared, cfg.FetchURLTokens, cfg.ModelName)
+				for _, err := range failed {
+					color.Red("Not adding a page: %v\n", err)
+				}
+				for _, page := range pages {
+					color.New(color.FgHiBlack).Printf("Added %s\n", page.URL)
+				}
+				prepared = withPages
+				return nil
+			})
+			if err != nil {
+				cancel()
+				color.Red("%v\n", err)
+				continue
+			}
+			userMessage = prepared
 		}
 
+		if *flags.KB != "" {
+			err := deadline.Run(ctx, "searching the knowledge base", func() error {
+				withKB, err := kb.Inject(cfg, *flags.KB, prepared, *flags.KBTopK)
+				prepared = withKB
+				return err
+			})
+			if err != nil {
+				color.Red("Failed to search knowledge base %s: %v\n", *flags.KB, err)
+			} else {
+				userMessage = prepared
+			}
+		}
+
+		// settings for this prompt only
+		tempCfg := *cfg
+		tempCfg.Prompt = cfg.LastUserMessage
+		tempCfg.Replacing = replacing
+		replacing = ""
+		if requestTemperature >= 0 {
+			tempCfg.Temperature = requestTemperature
+			requestTemperature = -1
+		}
+		if *flags.Format != "" {
+			tempCfg.SystemMessage += fixes.Instructions
+		}
+		requestCfg := &tempCfg
+
 		fmt.Printf("Prompt: %s\n", userMessage)
+
+		if *flags.DryRun {
+			cancel()
+			dryRunCfg := requestCfg
+			if answerSchema != nil {
+				dryRunCfg = answerSchema.Apply(requestCfg)
+				dryRunCfg.History = false
+			}
+			err := printDryRun(dryRunCfg, userMessage)
+			if err != nil {
+				color.Red("%v\n", err)
+			}
+			continue
+		}
+
+		if !*flags.Yes {
+			send, err := confirmSend(requestCfg, userMessage, fileAttachments(injected, *workingDirectory), reader)
+			if err != nil || !send {
+				cancel()
+				if err != nil {
+					color.Red("%v\n", err)
+				} else {
+					fmt.Println("Not sent.")
+				}
+				continue
+			}
+		}
+
+		if variantCount > 0 {
+			count := variantCount
+			variantCount = 0
+
+			generated, err := common.GenerateVariantsContext(ctx, requestCfg, userMessage, count)
+			cancel()
+			if err != nil {
+				color.Red("%v\n", err)
+				continue
+			}
+			if len(generated) == 0 {
+				color.Red("The provider returned no variants.\n")
+				continue
+			}
+
+			variants.Show(generated)
+			choice := variants.Pick(reader, len(generated))
+			if choice >= 0 {
+				lastResponse = generated[choice]
+				summary.AddExchange(requestCfg.ModelName, 0, 0)
+			}
+			if choice >= 0 && cfg.History {
+				err = common.SaveExchange(requestCfg, userMessage, generated[choice])
+				if err != nil {
+					color.Red("Failed to save history: %v\n", err)
+				}
+			}
+			continue
+		}
+
+		if answerSchema != nil {
+			validated, err := answerWithSchema(ctx, requestCfg, userMessage, answerSchema)
+			cancel()
+			if err != nil {
+				color.Red("%v\n", err)
+				continue
+			}
+			fmt.Printf("%s\n\n", validated)
+			lastResponse = validated
+			summary.AddExchange(requestCfg.ModelName, 0, 0)
+			continue
+		}
+
+		if len(compareTargets) > 0 {
+			cancel()
+			results := compare.Run(requestCfg, userMessage, compareTargets, *flags.Timeout)
+			fmt.Println()
+			compare.Table(os.Stdout, results)
+			fmt.Println()
+			// commands such as --copy act on the first answer that arrived whole
+			answered := false
+			for _, result := range results {
+				if result.Err != nil {
+					continue
+				}
+				if !answered {
+					lastResponse = result.Response
+					answered = true
+				}
+				summary.AddExchange(result.Target.Model, result.Stats.PromptTokens+result.Stats.SystemTokens, result.Stats.ResponseTokens)
+			}
+			continue
+		}
+
 		fmt.Print("Response: ")
 
-		response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, err := common.GenerateCompletion(cfg, userMessage)
+		var session *popup.Session
+		if cfg.Popup != "" {
+			var err error
+			session, err = popup.Start(cfg.Popup)
+			if err != nil {
+				color.Red("Failed to open popup, showing the response inline: %v\n", err)
+			}
+		}
+
+		if cfg.CollapseRepeats {
+			helpers.CollapseRepeats(lastResponse)
+		}
+
+		response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, err := common.GenerateCompletionContext(ctx, requestCfg, userMessage)
+		if session != nil {
+			session.Finish()
+		}
 		if err != nil {
+			cancel()
 			// print the error in red
 			red := color.New(color.FgRed).SprintFunc()
 			fmt.Printf("%s\n", red(err))
@@ -96,42 +848,136 @@ func main() {
 			continue
 		}
 
-		totalTokens := responseTokens + userMessageTokens + systemMessageTokens + historyTokens
+		completionStats := stats.Collect(requestCfg.AIProvider, requestCfg.ModelName, userMessageTokens, systemMessageTokens, responseTokens, historyTokens)
+		completionStats.Seed = requestCfg.Seed
 
-		fmt.Printf("\n📥 %d | 📋 %d | ⌨️ %d | 📜 %d\n", responseTokens, totalTokens, userMessageTokens, historyTokens)
+		if len(searchResults) > 0 {
+			color.New(color.FgHiBlack).Printf("\n\n%s", websearch.Sources(searchResults))
+		}
 
-		err = helpers.AppendHistory(helpers.HistoryEntry{
-			Role:    "user",
-			Content: userMessage,
-		}, config.HistoryFile)
-		if err != nil {
-			continue
+		// keep responses apart in the --output file
+		helpers.StreamChunk("\n\n")
+
+		if *flags.Format != "" {
+			fmt.Println()
+			err := deadline.Run(ctx, "formatting the findings", func() error {
+				return printFixes(response, *flags.Format)
+			})
+			if err != nil {
+				color.Red("%v\n", err)
+			}
 		}
+		cancel()
 
-		err = helpers.AppendHistory(helpers.HistoryEntry{
-			Role:    "assistant",
-			Content: response,
-		}, config.HistoryFile)
-		if err != nil {
-			continue
+		lastResponse = response
+		summary.AddExchange(completionStats.Model, userMessageTokens+systemMessageTokens+historyTokens, responseTokens)
+
+		if !named && requestCfg.History {
+			named = true
+			naming.Add(1)
+			go func(cfg config.Config, historyFile string) {
+				defer naming.Done()
+				nameConversation(&cfg, historyFile)
+			}(*cfg, config.HistoryFile)
 		}
 
-		history, err := helpers.GetHistory(config.HistoryFile)
-		if err != nil {
-			continue
+		if diffBase != "" {
+			lastDiff = [2]string{diffBase, response}
+			if *flags.Diff {
+				fmt.Println()
+				printResponseDiff(diffBase, response)
+			}
 		}
-		entries := len(history)
 
-		historyTokens = 0
-		for _, entry := range history {
-			tokenCount, err := helpers.CountTokens(entry.Content, "gpt-4")
+		if mode, ok := cfg.Modes[*runMode]; ok && mode.ApplyDiffs {
+			changed, err := patch.Offer(response, *workingDirectory, reader)
 			if err != nil {
-				fmt.Println("Error counting tokens:", err)
-				continue
+				color.Red("Failed to apply the changes: %v\n", err)
 			}
-			historyTokens += tokenCount
+			summary.AddFiles(changed...)
+		}
+
+		if cfg.PrintStats {
+			if history, err := helpers.GetHistory(config.HistoryFile); err == nil {
+				completionStats.HistoryEntries = len(history)
+			}
+			fmt.Printf("\n%s\n\n", stats.Render(cfg.StatsFormat, completionStats))
+		}
+
+		if cfg.Speak || *flags.Speak != "" {
+			fmt.Println()
+			err := speak(cfg, response, *flags.Speak, spoken)
+			if err != nil {
+				color.Red("Failed to read out the response: %v\n", err)
+			} else {
+				spoken = true
+			}
+		}
+
+	}
+
+	naming.Wait()
+	if summary.Exchanges > 0 {
+		summary.Print(os.Stdout)
+		err := sessions.SaveSummary(summary)
+		if err != nil {
+			color.Red("Failed to save the session summary: %v\n", err)
 		}
-		fmt.Printf("History Length: %d, History Tokens: %d\n\n", entries, historyTokens)
+	}
+}
+
+// pruneHistory applies the retention policies to the global history and every
+// session, or only reports what they would remove with dryRun.
+func pruneHistory(dryRun bool) error {
+	if !helpers.RetentionEnabled() {
+		return fmt.Errorf("no retention policy is set, configure history_keep_days, history_keep_entries or history_keep_tokens")
+	}
+
+	files, err := sessions.HistoryFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		result, err := helpers.PruneHistory(file, dryRun)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		switch {
+		case result.Removed == 0:
+			fmt.Println(result)
+		case dryRun:
+			fmt.Printf("Would prune %s\n", result)
+		default:
+			fmt.Printf("Pruned %s\n", result)
+		}
+	}
+	return nil
+}
+
+// parseRegen reads r [temp] and n [count]. The argument, -1 when there is none,
+// has to be a number, so prompts like "r is a language" are sent as prompts.
+func parseRegen(userMessage string) (string, float64, bool) {
+	fields := strings.Fields(userMessage)
+	if len(fields) == 0 || len(fields) > 2 || (fields[0] != "r" && fields[0] != "n") {
+		return "", 0, false
+	}
+	if len(fields) == 1 {
+		return fields[0], -1, true
+	}
+	if fields[0] == "n" {
+		count, err := strconv.Atoi(fields[1])
+		return fields[0], float64(count), err == nil
+	}
+	temperature, err := strconv.ParseFloat(fields[1], 64)
+	return fields[0], temperature, err == nil && temperature >= 0
+}
 
+// replacedMessage returns the last prompt when the history ends with its
+// answer, which the regenerated one replaces. After a failed request the last
+// exchange is another prompt's and stays.
+func replacedMessage(cfg *config.Config) string {
+	if cfg.History && helpers.IsLastExchange(config.HistoryFile, cfg.LastUserMessage) {
+		return cfg.LastUserMessage
 	}
+	return ""
 }
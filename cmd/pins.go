@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"strconv"
+	"strings"
+)
+
+// pinContext pins snippet, or the last exchange when it is empty, to the
+// current conversation.
+func pinContext(cfg *config.Config, snippet string) (helpers.Pin, error) {
+	if !cfg.History {
+		return helpers.Pin{}, fmt.Errorf("the history is off, so there is no conversation to pin to")
+	}
+	if snippet == "" {
+		return helpers.PinLastExchange(config.HistoryFile)
+	}
+	return helpers.PinSnippet(config.HistoryFile, snippet, cfg.ModelName)
+}
+
+// managePins lists the pins of the current conversation, or removes one with
+// "remove <id>" or all of them with "clear".
+func managePins(cfg *config.Config, args []string) error {
+	usage := fmt.Errorf("usage: --pins [remove <id> | clear]")
+	pins, err := helpers.LoadPins(config.HistoryFile)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		if len(pins) == 0 {
+			fmt.Println("Nothing is pinned, --pin pins the last exchange and --pin <text> a snippet.")
+			return nil
+		}
+		total := 0
+		for _, pin := range pins {
+			tokens := 0
+			for _, entry := range pin.Entries {
+				n, err := helpers.CountEntryTokens(entry, cfg.ModelName)
+				if err != nil {
+					return err
+				}
+				tokens += n
+			}
+			total += tokens
+			kind := "snippet "
+			if len(pin.Entries) > 1 {
+				kind = "exchange"
+			}
+			fmt.Printf("%-3d %s  %s\n", pin.ID, kind, firstLine(pin.Entries[0].Content))
+			color.New(color.FgHiBlack).Printf("    %d tokens, pinned %s\n", tokens, pin.Created.Format("2006-01-02 15:04"))
+		}
+		color.New(color.FgHiBlack).Printf("%d tokens of pins are sent with every prompt.\n", total)
+		return nil
+	}
+
+	switch args[0] {
+	case "remove", "rm":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return usage
+		}
+		err = helpers.RemovePin(config.HistoryFile, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Unpinned %d\n", id)
+		return nil
+	case "clear":
+		for _, pin := range pins {
+			err := helpers.RemovePin(config.HistoryFile, pin.ID)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Unpinned %d pins\n", len(pins))
+		return nil
+	}
+	return usage
+}
+
+// firstLine shortens text to its first line for a listing.
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if runes := []rune(line); len(runes) > 70 {
+		line = string(runes[:70]) + "..."
+	}
+	return line
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/compare"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/fixes"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/pipe"
+	"github.com/rojolang/terminalgpt/schema"
+	"github.com/rojolang/terminalgpt/webpage"
+	"github.com/rojolang/terminalgpt/websearch"
+	"os"
+	"strings"
+	"time"
+)
+
+// runPiped answers a single prompt made of the question and the data piped to
+// stdin, e.g. `cat error.log | terminalgpt "why is this failing"`, instead of
+// starting the interactive loop. The whole run is limited to timeout unless
+// it is zero. The answer is read out loud with speak on, or its audio saved
+// to speakPath. With answerSchema only the validated JSON is printed, with
+// compareTargets every target answers and their stats are compared. With
+// dryRun the request is only shown, with yes requests over confirm_tokens are
+// sent without asking.
+func runPiped(cfg *config.Config, question string, format string, timeout time.Duration, speakPath string, answerSchema *schema.Schema, compareTargets []compare.Target, dryRun bool, yes bool) error {
+	ctx, cancel := deadline.New(timeout)
+	defer cancel()
+
+	var data string
+	err := deadline.Run(ctx, "reading stdin", func() error {
+		var err error
+		data, err = pipe.Read()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var searchResults []websearch.Result
+	if query, ok := websearch.Query(question); ok {
+		err := deadline.Run(ctx, "searching the web", func() error {
+			if cfg.WebSearch == "" {
+				return fmt.Errorf("web search is off, choose a search API with --config")
+			}
+			withResults, results, err := websearch.Inject(cfg, query)
+			question, searchResults = withResults, results
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("web search failed: %w", err)
+		}
+	} else if cfg.FetchURLs {
+		err := deadline.Run(ctx, "fetching URLs", func() error {
+			withPages, _, failed := webpage.Inject(question, cfg.FetchURLTokens, cfg.ModelName)
+			for _, err := range failed {
+				color.New(color.FgRed).Fprintf(os.Stderr, "Not adding a page: %v\n", err)
+			}
+			question = withPages
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fitted, omitted := pipe.Fit(data, pipe.Budget(cfg, question), cfg.ModelName)
+	if omitted > 0 {
+		color.New(color.FgHiBlack).Fprintf(os.Stderr, "Input is over the token budget, omitted %d lines from the middle.\n", omitted)
+	}
+
+	message := pipe.Prompt(question, fitted)
+	if strings.TrimSpace(message) == "" {
+		return fmt.Errorf("nothing to send, pipe some input or pass a prompt")
+	}
+
+	if dryRun {
+		if answerSchema != nil {
+			cfg = answerSchema.Apply(cfg)
+			cfg.History = false
+		}
+		return printDryRun(cfg, message)
+	}
+
+	if !yes {
+		send, err := confirmSend(cfg, message, []attachment{{name: "stdin", bytes: int64(len(data))}}, nil)
+		if err != nil {
+			return err
+		}
+		if !send {
+			return fmt.Errorf("not sent")
+		}
+	}
+
+	if answerSchema != nil {
+		validated, err := answerWithSchema(ctx, cfg, message, answerSchema)
+		if err != nil {
+			return err
+		}
+		fmt.Println(validated)
+		return nil
+	}
+
+	if len(compareTargets) > 0 {
+		cancel()
+		results := compare.Run(cfg, message, compareTargets, timeout)
+		fmt.Println()
+		compare.Table(os.Stdout, results)
+		for _, result := range results {
+			if result.Err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("none of the models answered")
+	}
+
+	if format == "" {
+		response, _, _, _, _, err := common.GenerateCompletionContext(ctx, cfg, message)
+		fmt.Println()
+		if err == nil && len(searchResults) > 0 {
+			fmt.Printf("\n%s", websearch.Sources(searchResults))
+		}
+		helpers.StreamChunk("\n")
+		if err == nil && (cfg.Speak || speakPath != "") {
+			err = speak(cfg, response, speakPath, false)
+		}
+		return err
+	}
+
+	// stdout only gets the findings, the streamed answer goes to stderr
+	fixesCfg := *cfg
+	fixesCfg.SystemMessage += fixes.Instructions
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	response, _, _, _, _, err := common.GenerateCompletionContext(ctx, &fixesCfg, message)
+	fmt.Println()
+	os.Stdout = stdout
+	if err != nil {
+		return err
+	}
+	return printFixes(response, format)
+}
+
+// printFixes parses the findings in response and prints them in format.
+func printFixes(response string, format string) error {
+	found, err := fixes.Parse(response)
+	if err != nil {
+		return err
+	}
+	data, err := fixes.Format(found, format)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/sandbox"
+	"os"
+	"strings"
+	"time"
+)
+
+// runSnippet runs a Go or Python block of response in a sandbox once the user
+// confirms it, the last one or the index-th when index is > 0, and shows its
+// output. When it fails and the user wants a fix, the prompt asking for it is
+// returned.
+func runSnippet(response string, index int, timeout time.Duration, reader *bufio.Reader) (string, error) {
+	block, err := sandbox.Pick(response, index)
+	if err != nil {
+		return "", err
+	}
+
+	yellow := color.New(color.FgHiYellow)
+	yellow.Printf("\n%s code:\n", block.Lang)
+	fmt.Println(block.Code)
+	if !askYesNo(reader, "Run it in a temporary directory?") {
+		fmt.Println("Skipped.")
+		return "", nil
+	}
+
+	color.New(color.FgHiBlack).Println("Running...")
+	result, err := sandbox.Run(block, timeout)
+	if err != nil {
+		return "", err
+	}
+
+	if result.Stdout != "" {
+		fmt.Print(result.Stdout)
+		if !strings.HasSuffix(result.Stdout, "\n") {
+			fmt.Println()
+		}
+	}
+	if result.Stderr != "" {
+		color.New(color.FgRed).Fprint(os.Stderr, result.Stderr)
+		if !strings.HasSuffix(result.Stderr, "\n") {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+
+	took := result.Duration.Round(time.Millisecond)
+	switch {
+	case result.TimedOut:
+		color.Red("Stopped after %s.\n", took)
+	case result.Failed():
+		color.Red("Exited with status %d after %s.\n", result.ExitCode, took)
+	default:
+		color.Green("Exited with status 0 after %s.\n", took)
+		return "", nil
+	}
+
+	if !askYesNo(reader, "Send the error to the model for a fixed version?") {
+		return "", nil
+	}
+	return sandbox.FixPrompt(block, result), nil
+}
+
+// askYesNo asks question and reports whether the answer was yes.
+func askYesNo(reader *bufio.Reader, question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
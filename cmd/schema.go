@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/schema"
+	"os"
+	"strings"
+)
+
+// answerWithSchema asks for message as JSON matching s and returns the
+// validated JSON. Answers that do not match are asked for again with the
+// validation errors. The streamed answers go to stderr so stdout only gets
+// the JSON, and only the validated answer is saved to the history.
+func answerWithSchema(ctx context.Context, cfg *config.Config, message string, s *schema.Schema) (string, error) {
+	schemaCfg := s.Apply(cfg)
+	schemaCfg.History = false
+
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = stdout }()
+
+	prompt := message
+	for attempt := 0; ; attempt++ {
+		response, _, _, _, _, err := common.GenerateCompletionContext(ctx, schemaCfg, prompt)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+
+		validated, errs := s.Check(response)
+		if len(errs) == 0 {
+			if cfg.History {
+				err := common.SaveExchange(cfg, message, validated)
+				if err != nil {
+					return validated, fmt.Errorf("failed to save history: %w", err)
+				}
+			}
+			return validated, nil
+		}
+		if attempt == schema.MaxRetries {
+			return "", fmt.Errorf("the answer does not match the schema after %d attempts:\n- %s", attempt+1, strings.Join(errs, "\n- "))
+		}
+		color.New(color.FgHiBlack).Fprintf(os.Stderr, "The answer does not match the schema, asking again:\n- %s\n", strings.Join(errs, "\n- "))
+		prompt = schema.Correction(message, response, errs)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/termcap"
+	"strconv"
+	"strings"
+)
+
+// applySetting handles the --model, --temp and --system prompt commands,
+// which change cfg for the rest of the session without saving it. It reports
+// whether userMessage was one of them; changed records the settings that
+// differ from the config file for --show.
+func applySetting(cfg *config.Config, userMessage string, changed map[string]bool) (bool, error) {
+	command, value, _ := strings.Cut(userMessage, " ")
+	value = strings.TrimSpace(value)
+
+	switch command {
+	case "--model":
+		if value == "" {
+			fmt.Printf("model: %s\n", cfg.ModelName)
+			return true, nil
+		}
+		cfg.ModelName = value
+		changed["model"] = true
+		color.New(color.FgHiBlack).Printf("Using model %s for this session\n", value)
+
+	case "--temp":
+		if value == "" {
+			fmt.Printf("temperature: %g\n", cfg.Temperature)
+			return true, nil
+		}
+		temperature, err := strconv.ParseFloat(value, 64)
+		if err != nil || temperature < 0 || temperature > 2 {
+			return true, fmt.Errorf("invalid temperature %q, expected a number between 0 and 2", value)
+		}
+		cfg.Temperature = temperature
+		changed["temperature"] = true
+		color.New(color.FgHiBlack).Printf("Using temperature %g for this session\n", temperature)
+
+	case "--system":
+		if value == "" {
+			fmt.Printf("system_message: %s\n", cfg.SystemMessage)
+			return true, nil
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) > 1 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		cfg.SystemMessage = value
+		changed["system_message"] = true
+		color.New(color.FgHiBlack).Println("Using the new system message for this session")
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// showSettings prints the settings the next request is sent with, marking
+// the ones changed by --model, --temp or --system.
+func showSettings(cfg *config.Config, runMode, session string, changed map[string]bool) {
+	gray := color.New(color.FgHiBlack)
+	line := func(name, value string) {
+		fmt.Printf("%-18s %s", name+":", value)
+		if changed[name] {
+			gray.Print(" (this session)")
+		}
+		fmt.Println()
+	}
+
+	line("ai_provider", cfg.AIProvider)
+	line("model", cfg.ModelName)
+	if cfg.AIProvider == "azure" {
+		line("azure_url", cfg.AzureURL)
+	} else {
+		line("base_url", config.OpenAIURL(cfg, ""))
+	}
+	line("temperature", strconv.FormatFloat(cfg.Temperature, 'g', -1, 64))
+	line("top_p", strconv.FormatFloat(cfg.TopP, 'g', -1, 64))
+	line("max_tokens", strconv.Itoa(cfg.MaxResponseTokens))
+	line("max_total_tokens", strconv.Itoa(cfg.MaxTotalTokens))
+	line("frequency_penalty", strconv.FormatFloat(cfg.FrequencyPenalty, 'g', -1, 64))
+	line("presence_penalty", strconv.FormatFloat(cfg.PresencePenalty, 'g', -1, 64))
+	line("stream", strconv.FormatBool(cfg.Stream))
+	line("history", strconv.FormatBool(cfg.History))
+	if runMode != "" {
+		line("run mode", runMode)
+	}
+	if session != "" {
+		line("session", session)
+	}
+
+	// the first line of the system message, cut to the terminal width
+	system := strings.TrimSpace(cfg.SystemMessage)
+	if first, _, found := strings.Cut(system, "\n"); found {
+		system = first + " ..."
+	}
+	if width := termcap.Width() - 20; width > 10 && len([]rune(system)) > width {
+		system = string([]rune(system)[:width-4]) + " ..."
+	}
+	line("system_message", system)
+
+	if len(cfg.Sources) > 0 {
+		gray.Printf("Config: %s\n", strings.Join(cfg.Sources, " < "))
+	}
+}
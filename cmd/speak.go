@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/speech"
+)
+
+// speak reads response out loud or, when path is set, saves its audio there.
+// appendAudio adds to the file instead, for the later responses of a session.
+func speak(cfg *config.Config, response string, path string, appendAudio bool) error {
+	gray := color.New(color.FgHiBlack)
+	if path == "" {
+		gray.Println("Reading the response out loud...")
+	}
+
+	audio, err := speech.Synthesize(cfg, response)
+	if err != nil {
+		return err
+	}
+
+	if path != "" {
+		err := speech.Save(path, audio, appendAudio)
+		if err != nil {
+			return err
+		}
+		gray.Printf("Saved the spoken response to %s\n", path)
+		return nil
+	}
+	err = speech.Play(audio)
+	if err != nil {
+		return fmt.Errorf("failed to play the response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/debuglog"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/sessions"
+	"os"
+	"sort"
+	"time"
+)
+
+// titleTimeout limits naming a conversation, which the exit waits for.
+const titleTimeout = 30 * time.Second
+
+// nameConversation names the conversation in historyFile after its first
+// exchange. It runs next to the prompt, so failures only go to the debug log.
+func nameConversation(cfg *config.Config, historyFile string) {
+	history, err := helpers.LoadHistory(historyFile)
+	if err != nil {
+		debuglog.Log("title", map[string]interface{}{"history_file": historyFile, "error": err.Error()})
+		return
+	}
+	userMessage, response := "", ""
+	for _, entry := range history {
+		if entry.Role == "user" && userMessage == "" {
+			userMessage = entry.Content
+		} else if entry.Role == "assistant" && userMessage != "" {
+			response = entry.Content
+			break
+		}
+	}
+	if response == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), titleTimeout)
+	defer cancel()
+	title, err := sessions.NameConversation(ctx, cfg, historyFile, userMessage, response)
+	fields := map[string]interface{}{"history_file": historyFile, "title": title}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	debuglog.Log("title", fields)
+}
+
+// listSessions prints the conversations, most recent first, by their title,
+// or by their session name until they have one.
+func listSessions() error {
+	files, err := sessions.HistoryFiles()
+	if err != nil {
+		return err
+	}
+
+	type conversation struct {
+		title, name string
+		messages    int
+		updated     time.Time
+	}
+	conversations := []conversation{}
+	width := 0
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		messages, err := helpers.CountEntries(file)
+		if err != nil || messages == 0 {
+			continue
+		}
+		c := conversation{name: sessions.NameOf(file), messages: messages, updated: info.ModTime()}
+		if meta, err := sessions.LoadMeta(file); err == nil {
+			c.title = meta.Title
+		}
+		if n := len([]rune(c.title)); n > width {
+			width = n
+		}
+		if n := len([]rune(c.name)); c.title == "" && n > width {
+			width = n
+		}
+		conversations = append(conversations, c)
+	}
+	if len(conversations) == 0 {
+		fmt.Println("No conversations yet.")
+		return nil
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].updated.After(conversations[j].updated)
+	})
+	gray := color.New(color.FgHiBlack)
+	for _, c := range conversations {
+		if c.title == "" {
+			fmt.Printf("%-*s  ", width, c.name)
+			gray.Printf("%d messages, %s\n", c.messages, c.updated.Format("2006-01-02 15:04"))
+			continue
+		}
+		fmt.Printf("%-*s  ", width, c.title)
+		gray.Printf("%s, %d messages, %s\n", c.name, c.messages, c.updated.Format("2006-01-02 15:04"))
+	}
+	gray.Println("Continue one with terminalgpt --session <name>.")
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tokenInput is a file or stdin whose tokens are counted.
+type tokenInput struct {
+	name string
+	text string
+}
+
+func runTokens(cfg *config.Config, args []string) error {
+	fs := flag.NewFlagSet("tokens", flag.ExitOnError)
+	model := fs.String("model", cfg.ModelName, "Model whose encoding, chat format and context to use")
+	fs.Parse(args)
+
+	names := fs.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	inputs := []tokenInput{}
+	for _, name := range names {
+		var data []byte
+		var err error
+		if name == "-" {
+			data, err = io.ReadAll(os.Stdin)
+			name = "stdin"
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		inputs = append(inputs, tokenInput{name: name, text: string(data)})
+	}
+
+	modelEncoding := helpers.EncodingName(*model)
+	gray := color.New(color.FgHiBlack)
+
+	// with several inputs every one gets a line in the model's encoding
+	texts := []string{}
+	for _, input := range inputs {
+		texts = append(texts, input.text)
+	}
+	content := strings.Join(texts, "\n\n")
+	if len(inputs) > 1 {
+		for _, input := range inputs {
+			tokens, _ := countEncodingTokens(input.text, modelEncoding, *model)
+			fmt.Printf("%-30s %10d bytes %7d lines %8s tokens\n", input.name, len(input.text), countLines(input.text), tokens)
+		}
+		fmt.Println()
+	} else {
+		fmt.Printf("%s: %d bytes, %d lines\n\n", inputs[0].name, len(content), countLines(content))
+	}
+
+	fmt.Printf("%-12s %8s\n", "Encoding", "Tokens")
+	contentTokens := 0
+	for _, encoding := range helpers.Encodings {
+		tokens, n := countEncodingTokens(content, encoding, *model)
+		fmt.Printf("%-12s %8s", encoding, tokens)
+		if encoding == modelEncoding {
+			contentTokens = n
+			gray.Printf("  %s", *model)
+			if !helpers.HasLocalEncoding(*model) {
+				gray.Printf(" (approximation)")
+			}
+		}
+		fmt.Println()
+	}
+	if helpers.Estimating() != nil {
+		gray.Println("~ marks estimates")
+	}
+	fmt.Println()
+
+	message := []helpers.HistoryEntry{{Role: "user", Content: content}}
+	messageTokens, err := helpers.CountMessageTokens(message, *model)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("As a user message to %s: %d tokens, %d of them the chat format\n", *model, messageTokens, messageTokens-contentTokens)
+
+	if cfg.SystemMessage != "" {
+		message = append([]helpers.HistoryEntry{{Role: "system", Content: cfg.SystemMessage}}, message...)
+		messageTokens, err = helpers.CountMessageTokens(message, *model)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("With the system message: %d tokens\n", messageTokens)
+	}
+
+	budget := cfg.MaxTotalTokens - cfg.MaxResponseTokens
+	if budget <= 0 {
+		return nil
+	}
+	usage := fmt.Sprintf("Uses %.1f%% of the %d prompt tokens left by max_total_tokens %d and max_tokens %d\n", float64(messageTokens)*100/float64(budget), budget, cfg.MaxTotalTokens, cfg.MaxResponseTokens)
+	switch {
+	case messageTokens > budget:
+		color.New(color.FgRed).Print(usage + "It does not fit, send less of it or raise max_total_tokens.\n")
+	case messageTokens > budget*3/4:
+		color.New(color.FgYellow).Print(usage + "Little room is left for history.\n")
+	default:
+		fmt.Print(usage)
+	}
+	return nil
+}
+
+// countEncodingTokens counts the tokens of text in encoding for display, or
+// estimates them for model, marked with ~, when the encoding fails to load.
+func countEncodingTokens(text, encoding, model string) (string, int) {
+	tokens, err := helpers.CountEncodingTokens(text, encoding)
+	if err != nil {
+		tokens = helpers.EstimateTokens(text, model)
+		return "~" + strconv.Itoa(tokens), tokens
+	}
+	return strconv.Itoa(tokens), tokens
+}
+
+// countLines counts the lines of text, including an unterminated last line.
+func countLines(text string) int {
+	n := strings.Count(text, "\n")
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/version"
+	"os"
+	"strings"
+)
+
+// printVersion prints the build and what a bug report needs to know about the
+// setup, without the interactive configuration a missing config would start.
+func printVersion(workingDirectory string) {
+	fmt.Println(version.Get())
+
+	_, err := os.Stat(config.ConfigFile)
+	if os.IsNotExist(err) {
+		fmt.Printf("Config:   %s (not created yet)\n", config.ConfigFile)
+		return
+	}
+	cfg, err := config.LoadConfig(config.ConfigFile)
+	if err != nil {
+		fmt.Printf("Config:   %s (%v)\n", config.ConfigFile, err)
+		return
+	}
+	if workingDirectory == "" {
+		workingDirectory, _ = os.Getwd()
+	}
+	sources, err := config.ApplyOverrides(&cfg, workingDirectory)
+	sources = append([]string{config.ConfigFile}, sources...)
+	fmt.Printf("Config:   %s\n", strings.Join(sources, " < "))
+	if err != nil {
+		fmt.Printf("          overrides failed: %v\n", err)
+	}
+
+	endpoint := config.OpenAIURL(&cfg, "")
+	if cfg.AIProvider == "azure" {
+		endpoint = cfg.AzureURL
+	}
+	fmt.Printf("Provider: %s, model %s at %s\n", cfg.AIProvider, cfg.ModelName, endpoint)
+}
@@ -0,0 +1,95 @@
+package codeblocks
+
+import (
+	"regexp"
+	"strings"
+)
+
+type Block struct {
+	Lang string
+	Code string
+}
+
+// Extract returns the fenced code blocks of a markdown text in order.
+func Extract(text string) []Block {
+	blocks := []Block{}
+	var current *Block
+	var code []string
+	fence := ""
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if current == nil {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				fence = trimmed[:3]
+				current = &Block{Lang: strings.ToLower(strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])))}
+				code = []string{}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			current.Code = strings.Join(code, "\n")
+			blocks = append(blocks, *current)
+			current = nil
+			continue
+		}
+		code = append(code, line)
+	}
+
+	// an unterminated block (e.g. a response cut off at max tokens) still counts
+	if current != nil {
+		current.Code = strings.Join(code, "\n")
+		blocks = append(blocks, *current)
+	}
+
+	return blocks
+}
+
+// IsShell reports whether a block's language tag marks it as a shell script.
+func (b Block) IsShell() bool {
+	switch b.Lang {
+	case "sh", "bash", "shell", "zsh", "console", "shell-session", "fish", "ksh":
+		return true
+	}
+	return false
+}
+
+// extensions maps language tags to file extensions.
+var extensions = map[string]string{
+	"go": ".go", "golang": ".go",
+	"python": ".py", "py": ".py",
+	"javascript": ".js", "js": ".js", "jsx": ".jsx",
+	"typescript": ".ts", "ts": ".ts", "tsx": ".tsx",
+	"sh": ".sh", "bash": ".sh", "shell": ".sh", "zsh": ".zsh", "fish": ".fish",
+	"json": ".json", "yaml": ".yaml", "yml": ".yaml", "toml": ".toml", "xml": ".xml", "ini": ".ini",
+	"html": ".html", "css": ".css", "scss": ".scss",
+	"sql": ".sql", "php": ".php", "ruby": ".rb", "rb": ".rb",
+	"rust": ".rs", "rs": ".rs", "java": ".java", "kotlin": ".kt", "swift": ".swift",
+	"c": ".c", "cpp": ".cpp", "c++": ".cpp", "csharp": ".cs", "cs": ".cs",
+	"lua": ".lua", "perl": ".pl", "r": ".r", "markdown": ".md", "md": ".md",
+	"dockerfile": ".dockerfile", "makefile": ".mk", "blade": ".blade.php", "vue": ".vue",
+	"diff": ".diff", "patch": ".patch", "proto": ".proto", "graphql": ".graphql", "terraform": ".tf", "hcl": ".hcl",
+}
+
+// Extension returns the file extension for the block's language, ".txt" when unknown.
+func (b Block) Extension() string {
+	if ext, ok := extensions[b.Lang]; ok {
+		return ext
+	}
+	return ".txt"
+}
+
+// fileNameComment matches a first line naming the file, such as
+// "// main.go", "# file: app/models.py" or "<!-- index.html -->".
+var fileNameComment = regexp.MustCompile(`^\s*(?://|#|--|/\*|<!--|;)\s*(?:(?i:file(?:name)?|path)\s*:\s*)?([\w./-]+\.[\w]+)\s*(?:\*/|-->)?\s*$`)
+
+// FileName returns the file name the model put in the block's first line, if any.
+func (b Block) FileName() string {
+	firstLine := strings.SplitN(b.Code, "\n", 2)[0]
+	match := fileNameComment.FindStringSubmatch(firstLine)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
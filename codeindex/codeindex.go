@@ -0,0 +1,291 @@
+package codeindex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var IndexDir = appdir.Path("index")
+
+// Entry is a file in the index, Path is relative to the root and slash separated.
+type Entry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Index lists the files of a project directory that are not ignored by git.
+type Index struct {
+	Root  string               `json:"root"`
+	Files map[string]Entry     `json:"files"`
+	Dirs  map[string]time.Time `json:"dirs"`
+}
+
+// Open loads the cached index of root and refreshes it.
+func Open(root string) (*Index, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &Index{Root: root}
+	data, err := ioutil.ReadFile(cachePath(root))
+	if err == nil {
+		json.Unmarshal(data, index)
+	}
+	if index.Root != root || index.Files == nil || index.Dirs == nil {
+		index = &Index{Root: root, Files: make(map[string]Entry), Dirs: make(map[string]time.Time)}
+	}
+
+	changed, err := index.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		index.save()
+	}
+	return index, nil
+}
+
+// Refresh rescans the tree. Directories whose modification time did not change
+// reuse their cached entries instead of stat'ing every file again, so sizes
+// and modification times of files edited in place catch up once their
+// directory changes.
+func (idx *Index) Refresh() (bool, error) {
+	files := make(map[string]Entry)
+	dirs := make(map[string]time.Time)
+
+	err := idx.scan("", nil, files, dirs)
+	if err != nil {
+		return false, err
+	}
+
+	changed := len(files) != len(idx.Files) || len(dirs) != len(idx.Dirs)
+	if !changed {
+		for rel, modTime := range dirs {
+			if !idx.Dirs[rel].Equal(modTime) {
+				changed = true
+				break
+			}
+		}
+	}
+
+	idx.Files = files
+	idx.Dirs = dirs
+	return changed, nil
+}
+
+func (idx *Index) scan(rel string, rules []ignoreRule, files map[string]Entry, dirs map[string]time.Time) error {
+	dir := filepath.Join(idx.Root, filepath.FromSlash(rel))
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	cachedTime, cached := idx.Dirs[rel]
+	unchanged := cached && cachedTime.Equal(info.ModTime())
+	dirs[rel] = info.ModTime()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	rules = append(rules, readIgnoreRules(dir, rel)...)
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == ".git" {
+			continue
+		}
+		child := path.Join(rel, name)
+		if ignored(rules, child, entry.IsDir()) {
+			continue
+		}
+
+		if entry.IsDir() {
+			err := idx.scan(child, rules, files, dirs)
+			if err != nil && !os.IsPermission(err) {
+				return err
+			}
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		if cachedEntry, ok := idx.Files[child]; ok && unchanged {
+			files[child] = cachedEntry
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files[child] = Entry{Path: child, Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}
+	}
+	return nil
+}
+
+// Find resolves a file mention to an absolute path. It tries, in order, an
+// exact relative path, a path suffix such as gpt/gpt.go, an exact file name,
+// a case-insensitive file name and finally a fuzzy match of the characters
+// in order. Ties go to the file closest to the root.
+func (idx *Index) Find(query string) (string, bool) {
+	query = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(query)), "./")
+	if query == "" || query == "." {
+		return "", false
+	}
+
+	if _, ok := idx.Files[query]; ok {
+		return idx.abs(query), true
+	}
+
+	lowerQuery := strings.ToLower(query)
+	matchers := []func(rel string) bool{
+		func(rel string) bool { return strings.HasSuffix(rel, "/"+query) },
+		func(rel string) bool { return path.Base(rel) == query },
+		func(rel string) bool { return strings.EqualFold(path.Base(rel), path.Base(query)) },
+		func(rel string) bool { return strings.HasSuffix(strings.ToLower(rel), "/"+lowerQuery) },
+	}
+	for _, matches := range matchers {
+		if best, ok := idx.closest(matches); ok {
+			return idx.abs(best), true
+		}
+	}
+
+	// fuzzy matches must keep the extension and match within the file name,
+	// so a mention of a missing file does not pull in an unrelated one
+	queryExt := path.Ext(lowerQuery)
+	queryBase := strings.TrimSuffix(path.Base(lowerQuery), queryExt)
+	bestScore := 0
+	best := ""
+	for rel := range idx.Files {
+		lowerRel := strings.ToLower(rel)
+		if path.Ext(lowerRel) != queryExt || fuzzyScore(queryBase, path.Base(lowerRel)) == 0 {
+			continue
+		}
+		score := fuzzyScore(lowerQuery, lowerRel)
+		if score > bestScore || (score == bestScore && score > 0 && closer(rel, best)) {
+			bestScore = score
+			best = rel
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return idx.abs(best), true
+}
+
+// Paths returns the relative paths of all indexed files, sorted.
+func (idx *Index) Paths() []string {
+	paths := make([]string, 0, len(idx.Files))
+	for rel := range idx.Files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (idx *Index) closest(matches func(rel string) bool) (string, bool) {
+	best := ""
+	for rel := range idx.Files {
+		if matches(rel) && (best == "" || closer(rel, best)) {
+			best = rel
+		}
+	}
+	return best, best != ""
+}
+
+func (idx *Index) abs(rel string) string {
+	return filepath.Join(idx.Root, filepath.FromSlash(rel))
+}
+
+func (idx *Index) save() error {
+	err := os.MkdirAll(IndexDir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cachePath(idx.Root), data, 0644)
+}
+
+// closer orders paths by depth, then length, then name, so results are stable.
+func closer(a, b string) bool {
+	if b == "" {
+		return true
+	}
+	depthA, depthB := strings.Count(a, "/"), strings.Count(b, "/")
+	if depthA != depthB {
+		return depthA < depthB
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// fuzzyScore returns 0 when the characters of query do not appear in target in
+// order, and otherwise a higher score for consecutive and file name matches.
+func fuzzyScore(query, target string) int {
+	base := strings.LastIndex(target, "/") + 1
+	score := 1
+	ti := 0
+	previous := -2
+	for _, q := range query {
+		found := strings.IndexRune(target[ti:], q)
+		if found < 0 {
+			return 0
+		}
+		pos := ti + found
+		if pos == previous+1 {
+			score += 3
+		}
+		if pos >= base {
+			score += 2
+		}
+		previous = pos
+		ti = pos + len(string(q))
+	}
+	return score
+}
+
+func cachePath(root string) string {
+	sum := sha256.Sum256([]byte(root))
+	return filepath.Join(IndexDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// FindFile resolves name in the project rooted at dir using the cached index.
+func FindFile(name, dir string) (string, error) {
+	index, err := Open(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to index %s: %w", dir, err)
+	}
+	found, ok := index.Find(name)
+	if !ok {
+		return "", fmt.Errorf("could not find %s in %s", name, dir)
+	}
+	return found, nil
+}
+
+// Scan lists the files under root that are not ignored by git, stat'ing every
+// one of them instead of reusing the cache, so edits in place are seen.
+func Scan(root string) (map[string]Entry, error) {
+	index := &Index{Root: root, Files: make(map[string]Entry), Dirs: make(map[string]time.Time)}
+	_, err := index.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	return index.Files, nil
+}
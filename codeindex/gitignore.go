@@ -0,0 +1,146 @@
+package codeindex
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is one pattern of a .gitignore file.
+type ignoreRule struct {
+	base     string // directory of the .gitignore, relative to the index root
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// readIgnoreRules parses the .gitignore in dir, whose path relative to the
+// index root is rel.
+func readIgnoreRules(dir, rel string) []ignoreRule {
+	file, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text(), rel); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// parseIgnoreRule parses one .gitignore line of the directory base.
+func parseIgnoreRule(line, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, "\\")
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// a slash anywhere but at the end anchors the pattern to the .gitignore directory
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+// MatchPatterns reports whether the slash separated file path rel, or one of
+// its parent directories, matches patterns written like .gitignore lines.
+func MatchPatterns(patterns []string, rel string) bool {
+	rules := []ignoreRule{}
+	for _, pattern := range patterns {
+		if rule, ok := parseIgnoreRule(pattern, ""); ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	segments := strings.Split(rel, "/")
+	for i := 1; i <= len(segments); i++ {
+		if ignored(rules, strings.Join(segments[:i], "/"), i < len(segments)) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchGlob reports whether the slash separated file path rel matches
+// pattern, in which "**" stands for any number of directories. A pattern
+// without a slash, like *.go, matches the file name in every directory.
+func MatchGlob(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "./"), "/"), strings.Split(rel, "/"))
+}
+
+// ignored reports whether the slash separated path rel is excluded by rules,
+// the last matching rule wins like in git.
+func ignored(rules []ignoreRule, rel string, isDir bool) bool {
+	result := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.matches(rel) {
+			result = !rule.negate
+		}
+	}
+	return result
+}
+
+func (r ignoreRule) matches(rel string) bool {
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+
+	if !r.anchored {
+		ok, _ := path.Match(r.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments where "**"
+// stands for any number of segments.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
@@ -1,24 +1,310 @@
 package common
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/fatih/color"
 	"github.com/rojolang/terminalgpt/azure"
+	"github.com/rojolang/terminalgpt/cache"
 	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/debuglog"
 	"github.com/rojolang/terminalgpt/gpt"
 	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/models"
+	"github.com/rojolang/terminalgpt/progress"
+	"github.com/rojolang/terminalgpt/ratelimit"
+	"github.com/rojolang/terminalgpt/relevance"
+	"github.com/rojolang/terminalgpt/render"
+	"github.com/rojolang/terminalgpt/usage"
+	"sync/atomic"
+	"time"
 )
 
+// GenerateCompletion sends userMessage to the configured provider and, when
+// history is enabled, persists the user message and the assistant reply.
 func GenerateCompletion(cfg *config.Config, userMessage string) (string, int, int, int, int, error) {
-	if cfg.AIProvider == "azure" {
+	return GenerateCompletionContext(context.Background(), cfg, userMessage)
+}
+
+// GenerateCompletionContext is GenerateCompletion with a context that can
+// cancel the request or give it a deadline, see the deadline package.
+func GenerateCompletionContext(ctx context.Context, cfg *config.Config, userMessage string) (string, int, int, int, int, error) {
+	cfg, userMessage, err := applyPromptPlugins(ctx, cfg, userMessage)
+	if err != nil {
+		return "", 0, 0, 0, 0, deadline.Wrap(ctx, err)
+	}
+	ctx, userMessage, err = scrubPrompt(ctx, cfg, userMessage)
+	if err != nil {
+		return "", 0, 0, 0, 0, err
+	}
+
+	// requests streaming to a sink run next to others, the terminal is not theirs
+	quiet := render.HasSink(ctx)
+	if !quiet {
+		helpers.StartRequest()
+		progress.Start()
+	}
+	start := time.Now()
+	response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, err := generateWithFallbacks(ctx, cfg, userMessage)
+	if !quiet {
+		helpers.FlushChunks()
+		progress.Stop()
+	}
+	if err == nil {
+		response, err = applyResponsePlugins(ctx, cfg, userMessage, response)
+	}
+	logCompletion(cfg, userMessage, response, start, err, userMessageTokens, systemMessageTokens, responseTokens, historyTokens)
+	if err != nil {
+		return "", 0, 0, 0, 0, deadline.Wrap(ctx, err)
+	}
+
+	// the history keeps the placeholders, the caller gets the secrets back
+	if cfg.History {
+		err = saveExchange(cfg, userMessage, response, userMessageTokens, responseTokens)
+		if err != nil {
+			return restoreSecrets(cfg, response), userMessageTokens, systemMessageTokens, responseTokens, historyTokens, fmt.Errorf("failed to save history: %w", err)
+		}
+	}
+
+	return restoreSecrets(cfg, response), userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+}
+
+// logCompletion writes the parameters, timing and token counts of a
+// completion to the debug log.
+func logCompletion(cfg *config.Config, userMessage, response string, start time.Time, err error, userMessageTokens, systemMessageTokens, responseTokens, historyTokens int) {
+	if !debuglog.Enabled() {
+		return
+	}
+	fields := map[string]interface{}{
+		"provider":          cfg.AIProvider,
+		"model":             cfg.ModelName,
+		"temperature":       cfg.Temperature,
+		"max_tokens":        cfg.MaxResponseTokens,
+		"top_p":             cfg.TopP,
+		"frequency_penalty": cfg.FrequencyPenalty,
+		"presence_penalty":  cfg.PresencePenalty,
+		"stop":              cfg.Stop,
+		"seed":              cfg.Seed,
+		"history":           cfg.History,
+		"cache":             cfg.Cache,
+		"prompt":            debuglog.Text(userMessage),
+		"duration_ms":       time.Since(start).Milliseconds(),
+	}
+	if provider, model := helpers.LastAnswered(); model != "" {
+		fields["answered_by"] = provider + ":" + model
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else {
+		_, _, finishReason := helpers.LastRequest()
+		fields["response"] = debuglog.Text(response)
+		fields["tokens"] = map[string]int{
+			"prompt":   userMessageTokens,
+			"system":   systemMessageTokens,
+			"response": responseTokens,
+			"history":  historyTokens,
+		}
+		if reasoning := helpers.LastReasoningTokens(); reasoning > 0 {
+			fields["reasoning_tokens"] = reasoning
+		}
+		fields["finish_reason"] = finishReason
+	}
+	debuglog.Log("completion", fields)
+}
+
+// SaveExchange appends a user message and the assistant reply to the history
+// file. The exchange replaces the last answer to cfg.Replacing, and keeps
+// cfg.Prompt when the message was made from it.
+func SaveExchange(cfg *config.Config, userMessage, response string) error {
+	return saveExchange(cfg, userMessage, response, 0, 0)
+}
+
+// saveExchange is SaveExchange with the token counts of the completion, zero
+// to count them again.
+func saveExchange(cfg *config.Config, userMessage, response string, userMessageTokens, responseTokens int) error {
+	prompt := cfg.Prompt
+	if prompt == userMessage {
+		prompt = ""
+	}
+	err := helpers.AppendHistory(helpers.HistoryEntry{
+		Role:       "user",
+		Content:    userMessage,
+		Prompt:     prompt,
+		TokenCount: userMessageTokens,
+	}, config.HistoryFile)
+	if err != nil {
+		return err
+	}
+
+	err = helpers.AppendHistory(helpers.HistoryEntry{
+		Role:       "assistant",
+		Content:    response,
+		TokenCount: responseTokens,
+	}, config.HistoryFile)
+	if err != nil || cfg.Replacing == "" {
+		return err
+	}
+	err = helpers.ReplaceExchange(config.HistoryFile, cfg.Replacing)
+	if err != nil {
+		return fmt.Errorf("failed to replace the previous answer: %w", err)
+	}
+	return nil
+}
 
-		// Load the history
-		history, err := helpers.LoadHistory(config.HistoryFile)
+// backend is a provider to ask and the config asking it.
+type backend struct {
+	provider string
+	cfg      *config.Config
+}
+
+// generateWithFallbacks answers with the configured provider and, when it
+// fails or sends no text within fallback_latency_seconds, with the fallbacks
+// in turn. The fallback that answered is recorded for the stats.
+func generateWithFallbacks(ctx context.Context, cfg *config.Config, userMessage string) (string, int, int, int, int, error) {
+	if len(cfg.Fallbacks) == 0 {
+		return generateCached(ctx, cfg, userMessage)
+	}
+
+	backends := []backend{{cfg.AIProvider, cfg}}
+	for _, entry := range cfg.Fallbacks {
+		provider, model, err := config.ParseBackend(entry, cfg.ModelName)
+		if err != nil {
+			return "", 0, 0, 0, 0, fmt.Errorf("invalid fallback: %w", err)
+		}
+		backends = append(backends, backend{provider, config.WithBackend(cfg, provider, model)})
+	}
+
+	latency := time.Duration(cfg.FallbackLatency) * time.Second
+	for i, b := range backends {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		var slow atomic.Bool
+		last := i == len(backends)-1
+		if latency > 0 && !last {
+			timer := time.AfterFunc(latency, func() {
+				slow.Store(true)
+				cancel()
+			})
+			attemptCtx = render.WithFirstText(attemptCtx, func() { timer.Stop() })
+		}
+
+		response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, err := generateCached(attemptCtx, b.cfg, userMessage)
+		cancel()
+		if err == nil {
+			if i > 0 {
+				helpers.SetAnswered(b.provider, b.cfg.ModelName)
+			}
+			return response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+		}
+		if last || ctx.Err() != nil {
+			return "", 0, 0, 0, 0, err
+		}
+
+		reason := err.Error()
+		if slow.Load() {
+			reason = fmt.Sprintf("no answer within %s", latency)
+		}
+		next := backends[i+1]
+		progress.Print(color.New(color.FgHiBlack).Sprintf("\n%s %s failed (%s), trying %s %s\n", b.provider, b.cfg.ModelName, reason, next.provider, next.cfg.ModelName))
+	}
+	return "", 0, 0, 0, 0, fmt.Errorf("no provider to ask")
+}
+
+// generateCached answers identical requests from the on-disk cache when
+// caching is enabled, and stores fresh responses in it.
+func generateCached(ctx context.Context, cfg *config.Config, userMessage string) (string, int, int, int, int, error) {
+	if !cfg.Cache {
+		return generate(ctx, cfg, userMessage)
+	}
+
+	history := []helpers.HistoryEntry{}
+	if cfg.History {
+		var err error
+		history, err = helpers.LoadHistory(config.HistoryFile)
 		if err != nil {
 			return "", 0, 0, 0, 0, fmt.Errorf("failed to load history: %w", err)
 		}
+		history = helpers.WithoutExchange(history, cfg.Replacing)
+		// a changed pin changes the answer like a changed history
+		pinned, err := helpers.PinnedEntries(config.HistoryFile)
+		if err != nil {
+			return "", 0, 0, 0, 0, err
+		}
+		history = append(pinned, history...)
+	}
+
+	key := cache.Key(cfg, history, userMessage)
+	if entry, ok := cache.Get(key, cache.TTL(cfg)); ok {
+		if !render.HasSink(ctx) {
+			progress.Print(color.New(color.FgHiBlack).Sprintf("(cached %s) ", entry.Created.Format("2006-01-02 15:04")))
+		}
+		out := render.New(ctx)
+		out.Write(entry.Response, 0)
+		out.Close()
+		if !render.HasSink(ctx) {
+			helpers.SetFinishReason("cached")
+		}
+		return entry.Response, entry.UserMessageTokens, entry.SystemMessageTokens, entry.ResponseTokens, entry.HistoryTokens, nil
+	}
+
+	response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, err := generate(ctx, cfg, userMessage)
+	if err != nil {
+		return "", 0, 0, 0, 0, err
+	}
+
+	err = cache.Put(key, cache.Entry{
+		Response:            response,
+		UserMessageTokens:   userMessageTokens,
+		SystemMessageTokens: systemMessageTokens,
+		ResponseTokens:      responseTokens,
+		HistoryTokens:       historyTokens,
+	})
+	if err != nil {
+		color.Red("Failed to cache response: %v\n", err)
+	}
+
+	return response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+}
+
+// generate asks the provider of cfg and records the usage of the answer for
+// the active user.
+func generate(ctx context.Context, cfg *config.Config, userMessage string) (string, int, int, int, int, error) {
+	response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, err := request(ctx, cfg, userMessage)
+	if err != nil {
+		return "", 0, 0, 0, 0, err
+	}
+
+	// reasoning tokens are billed as output, but only known for the current request
+	billedTokens := responseTokens
+	if !render.HasSink(ctx) {
+		billedTokens += helpers.LastReasoningTokens()
+	}
+	err = usage.Append(cfg.ActiveUser, cfg.AIProvider, cfg.ModelName, userMessageTokens+systemMessageTokens+historyTokens, billedTokens)
+	if err != nil {
+		color.Red("%v\n", err)
+	}
+
+	return response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+}
+
+func request(ctx context.Context, cfg *config.Config, userMessage string) (string, int, int, int, int, error) {
+	err := deadline.Run(ctx, "waiting for the rate limit", func() error {
+		waitForRateLimit(cfg, userMessage)
+		return nil
+	})
+	if err != nil {
+		return "", 0, 0, 0, 0, err
+	}
+
+	if cfg.AIProvider == "azure" {
+		history, err := azureHistory(cfg, userMessage)
+		if err != nil {
+			return "", 0, 0, 0, 0, err
+		}
 
 		// Pass the history to azure.GenerateCompletion
-		return azure.GenerateCompletion(userMessage, cfg.SystemMessage, cfg.AzureURL, cfg.AzureAuthKey, cfg.ModelName, int32(cfg.MaxResponseTokens), float32(cfg.TopP), float32(cfg.Temperature), float32(cfg.FrequencyPenalty), float32(cfg.PresencePenalty), 20, history)
+		return azure.GenerateCompletion(ctx, userMessage, cfg.SystemMessage, cfg.AzureURL, cfg.AzureAuthKey, cfg.ModelName, int32(cfg.MaxResponseTokens), float32(cfg.TopP), float32(cfg.Temperature), float32(cfg.FrequencyPenalty), float32(cfg.PresencePenalty), history, config.RequestFields(cfg, "azure"), cfg.Headers["azure"])
 	}
 
 	gptInstance, err := gpt.New(cfg)
@@ -26,5 +312,225 @@ func GenerateCompletion(cfg *config.Config, userMessage string) (string, int, in
 		return "", 0, 0, 0, 0, fmt.Errorf("failed to create GPT instance: %w", err)
 	}
 
-	return gptInstance.GenerateCompletion(userMessage)
+	return gptInstance.GenerateCompletion(ctx, userMessage)
+}
+
+// GenerateVariants asks the configured provider for n alternative replies to
+// userMessage. Nothing is saved; the caller decides which variant to keep.
+func GenerateVariants(cfg *config.Config, userMessage string, n int) ([]string, error) {
+	return GenerateVariantsContext(context.Background(), cfg, userMessage, n)
+}
+
+// GenerateVariantsContext is GenerateVariants with a context that can cancel
+// the request or give it a deadline.
+func GenerateVariantsContext(ctx context.Context, cfg *config.Config, userMessage string, n int) ([]string, error) {
+	progress.Start()
+	variants, err := generateVariants(ctx, cfg, userMessage, n)
+	progress.Stop()
+	return variants, deadline.Wrap(ctx, err)
+}
+
+func generateVariants(ctx context.Context, cfg *config.Config, userMessage string, n int) ([]string, error) {
+	cfg, userMessage, err := applyPromptPlugins(ctx, cfg, userMessage)
+	if err != nil {
+		return nil, err
+	}
+	ctx, userMessage, err = scrubPrompt(ctx, cfg, userMessage)
+	if err != nil {
+		return nil, err
+	}
+	variants, promptTokens, err := requestVariants(ctx, cfg, userMessage, n)
+	if err != nil {
+		return nil, err
+	}
+	responseTokens := 0
+	for _, variant := range variants {
+		tokens, _ := helpers.CountTokens(variant, cfg.ModelName)
+		responseTokens += tokens
+	}
+	err = usage.Append(cfg.ActiveUser, cfg.AIProvider, cfg.ModelName, promptTokens, responseTokens)
+	if err != nil {
+		color.Red("%v\n", err)
+	}
+	// shown as they come back, so changing them shows nothing twice
+	ctx = render.WithSink(ctx, func(string) {})
+	for i, variant := range variants {
+		variants[i], err = applyResponsePlugins(ctx, cfg, userMessage, variant)
+		if err != nil {
+			return nil, err
+		}
+		variants[i] = restoreSecrets(cfg, variants[i])
+	}
+	return variants, nil
+}
+
+func requestVariants(ctx context.Context, cfg *config.Config, userMessage string, n int) ([]string, int, error) {
+	err := deadline.Run(ctx, "waiting for the rate limit", func() error {
+		waitForRateLimit(cfg, userMessage)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if cfg.AIProvider == "azure" {
+		history, err := azureHistory(cfg, userMessage)
+		if err != nil {
+			return nil, 0, err
+		}
+		// counted like the prompt of a single answer, Azure bills it once
+		messages := append([]helpers.HistoryEntry{{Role: "system", Content: cfg.SystemMessage}}, history...)
+		promptTokens, _ := helpers.CountMessageTokens(append(messages, helpers.HistoryEntry{Role: "user", Content: userMessage}), cfg.ModelName)
+		variants, err := azure.GenerateVariants(ctx, userMessage, cfg.SystemMessage, cfg.AzureURL, cfg.AzureAuthKey, cfg.ModelName, int32(cfg.MaxResponseTokens), float32(cfg.TopP), float32(cfg.Temperature), float32(cfg.FrequencyPenalty), float32(cfg.PresencePenalty), int32(n), history, config.RequestFields(cfg, "azure"), cfg.Headers["azure"])
+		return variants, promptTokens, err
+	}
+
+	gptInstance, err := gpt.New(cfg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create GPT instance: %w", err)
+	}
+
+	return gptInstance.GenerateVariants(ctx, userMessage, n)
+}
+
+// azureHistory returns the history sent to Azure with userMessage, ranked by
+// relevance when history ranking is on. Azure gets the whole history
+// otherwise, unlike gpt which trims it to the token budget.
+func azureHistory(cfg *config.Config, userMessage string) ([]helpers.HistoryEntry, error) {
+	if !cfg.History {
+		return []helpers.HistoryEntry{}, nil
+	}
+	history, err := helpers.LoadHistory(config.HistoryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history: %w", err)
+	}
+	history = helpers.WithoutExchange(history, cfg.Replacing)
+	pinned, err := helpers.PinnedEntries(config.HistoryFile)
+	if err != nil {
+		return nil, err
+	}
+	history = rankHistory(cfg, helpers.WithoutPinned(history, pinned), userMessage)
+	return append(pinned, history...), nil
+}
+
+// Request is what a completion would send to the provider.
+type Request struct {
+	Messages []helpers.HistoryEntry
+	// Payload is the JSON body. Azure's is built by its SDK, this one has
+	// the same fields.
+	Payload []byte
+}
+
+// BuildRequest returns the request a completion of userMessage would send,
+// history trimming and ranking included, without sending it.
+func BuildRequest(cfg *config.Config, userMessage string) (Request, error) {
+	ctx := context.Background()
+	cfg, userMessage, err := applyPromptPlugins(ctx, cfg, userMessage)
+	if err != nil {
+		return Request{}, err
+	}
+	_, userMessage, err = scrubPrompt(ctx, cfg, userMessage)
+	if err != nil {
+		return Request{}, err
+	}
+
+	if cfg.AIProvider == "azure" {
+		history, err := azureHistory(cfg, userMessage)
+		if err != nil {
+			return Request{}, err
+		}
+		messages := append([]helpers.HistoryEntry{{Role: "system", Content: cfg.SystemMessage}}, history...)
+		messages = append(messages, helpers.HistoryEntry{Role: "user", Content: userMessage})
+
+		body := map[string]interface{}{
+			"messages":          toMessages(messages),
+			"max_tokens":        cfg.MaxResponseTokens,
+			"temperature":       cfg.Temperature,
+			"top_p":             cfg.TopP,
+			"frequency_penalty": cfg.FrequencyPenalty,
+			"presence_penalty":  cfg.PresencePenalty,
+			"n":                 1,
+			"stream":            true,
+		}
+		if models.IsReasoning(cfg.ModelName) {
+			for _, name := range []string{"max_tokens", "temperature", "top_p", "frequency_penalty", "presence_penalty"} {
+				delete(body, name)
+			}
+			body["max_completion_tokens"] = cfg.MaxResponseTokens
+		}
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return Request{}, err
+		}
+		if extra := config.RequestFields(cfg, "azure"); len(extra) > 0 {
+			payload, err = helpers.MergeJSON(payload, extra)
+			if err != nil {
+				return Request{}, fmt.Errorf("failed to add request fields: %w", err)
+			}
+		}
+		return Request{Messages: messages, Payload: payload}, nil
+	}
+
+	gptInstance, err := gpt.New(cfg)
+	if err != nil {
+		return Request{}, fmt.Errorf("failed to create GPT instance: %w", err)
+	}
+	payload, _, _, _, err := gptInstance.CreatePayload(userMessage)
+	if err != nil {
+		return Request{}, err
+	}
+	var body struct {
+		Messages []config.Message `json:"messages"`
+	}
+	err = json.Unmarshal([]byte(payload), &body)
+	if err != nil {
+		return Request{}, fmt.Errorf("failed to read the payload: %w", err)
+	}
+	messages := []helpers.HistoryEntry{}
+	for _, message := range body.Messages {
+		messages = append(messages, helpers.HistoryEntry{Role: message.Role, Content: message.Content})
+	}
+	return Request{Messages: messages, Payload: []byte(payload)}, nil
+}
+
+func toMessages(entries []helpers.HistoryEntry) []config.Message {
+	messages := make([]config.Message, 0, len(entries))
+	for _, entry := range entries {
+		messages = append(messages, config.Message{Role: entry.Role, Content: entry.Content})
+	}
+	return messages
+}
+
+// waitForRateLimit slows down before a request the provider's last reported
+// rate limits would reject. The request is estimated as the prompt, the
+// system message and the full response budget.
+func waitForRateLimit(cfg *config.Config, userMessage string) {
+	tokens, err := helpers.CountTokens(cfg.SystemMessage+userMessage, cfg.ModelName)
+	if err != nil {
+		tokens = len(cfg.SystemMessage+userMessage) / 4
+	}
+	ratelimit.Wait(cfg.AIProvider, tokens+cfg.MaxResponseTokens)
+}
+
+// rankHistory keeps only the exchanges most relevant to userMessage when
+// history ranking is enabled, falling back to the full history on failure.
+func rankHistory(cfg *config.Config, history []helpers.HistoryEntry, userMessage string) []helpers.HistoryEntry {
+	if !cfg.HistoryRanking {
+		return history
+	}
+
+	requestTokens, err := helpers.CountMessageTokens([]helpers.HistoryEntry{
+		{Role: "system", Content: cfg.SystemMessage},
+		{Role: "user", Content: userMessage},
+	}, cfg.ModelName)
+	if err != nil {
+		return history
+	}
+
+	selected, err := relevance.Select(cfg, history, userMessage, cfg.MaxTotalTokens-cfg.MaxResponseTokens-requestTokens)
+	if err != nil {
+		progress.Print(color.RedString("Failed to rank history by relevance, using the full history: %v\n", err))
+		return history
+	}
+	return selected
 }
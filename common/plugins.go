@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/plugins"
+	"github.com/rojolang/terminalgpt/render"
+	"strings"
+)
+
+// applyPromptPlugins runs the prompt plugins on userMessage and returns it
+// with a copy of cfg holding the system message they left.
+func applyPromptPlugins(ctx context.Context, cfg *config.Config, userMessage string) (*config.Config, string, error) {
+	if len(cfg.Plugins) == 0 {
+		return cfg, userMessage, nil
+	}
+	deadline.Enter(ctx, "running the prompt plugins")
+	m, _, err := plugins.Run(ctx, cfg.Plugins, plugins.Message{
+		Hook:     plugins.Prompt,
+		Provider: cfg.AIProvider,
+		Model:    cfg.ModelName,
+		System:   cfg.SystemMessage,
+		Prompt:   userMessage,
+	})
+	if err != nil {
+		return cfg, userMessage, err
+	}
+	if m.System != cfg.SystemMessage {
+		pluginCfg := *cfg
+		pluginCfg.SystemMessage = m.System
+		cfg = &pluginCfg
+	}
+	return cfg, m.Prompt, nil
+}
+
+// applyResponsePlugins runs the response plugins on response. The original
+// was streamed already, so a changed one is shown again unless the text goes
+// to a sink.
+func applyResponsePlugins(ctx context.Context, cfg *config.Config, userMessage, response string) (string, error) {
+	if len(cfg.Plugins) == 0 {
+		return response, nil
+	}
+	deadline.Enter(ctx, "running the response plugins")
+	m, changedBy, err := plugins.Run(ctx, cfg.Plugins, plugins.Message{
+		Hook:     plugins.Response,
+		Provider: cfg.AIProvider,
+		Model:    cfg.ModelName,
+		System:   cfg.SystemMessage,
+		Prompt:   userMessage,
+		Response: response,
+	})
+	if err != nil {
+		return response, err
+	}
+	if len(changedBy) > 0 && !render.HasSink(ctx) {
+		out := render.Labeled(fmt.Sprintf("\nChanged by %s:", strings.Join(changedBy, ", ")))
+		out.Write(restoreSecrets(cfg, m.Response), 0)
+		out.Close()
+	}
+	return m.Response, nil
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"context"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/progress"
+	"github.com/rojolang/terminalgpt/render"
+	"github.com/rojolang/terminalgpt/scrub"
+	"strings"
+	"sync"
+)
+
+// scrubber keeps the placeholders of this run, so an answer can mention the
+// secrets of earlier prompts.
+var (
+	scrubberMu sync.Mutex
+	scrubber   *scrub.Scrubber
+)
+
+func sessionScrubber(cfg *config.Config) (*scrub.Scrubber, error) {
+	scrubberMu.Lock()
+	defer scrubberMu.Unlock()
+	if scrubber == nil {
+		s, err := scrub.New(cfg.ScrubRules)
+		if err != nil {
+			return nil, err
+		}
+		scrubber = s
+	}
+	return scrubber, nil
+}
+
+// scrubPrompt replaces the secrets in userMessage with placeholders when
+// scrub_secrets is on, and returns a context showing the response with the
+// secrets put back.
+func scrubPrompt(ctx context.Context, cfg *config.Config, userMessage string) (context.Context, string, error) {
+	if !cfg.ScrubSecrets {
+		return ctx, userMessage, nil
+	}
+	s, err := sessionScrubber(cfg)
+	if err != nil {
+		return ctx, userMessage, err
+	}
+	scrubbed, found := s.Scrub(userMessage)
+	if len(found) > 0 && !render.HasSink(ctx) {
+		progress.Print(color.New(color.FgHiBlack).Sprintf("Scrubbed from the prompt: %s\n", strings.Join(found, ", ")))
+	}
+	return render.WithRestorer(ctx, s.Restorer()), scrubbed, nil
+}
+
+// restoreSecrets puts the secrets back for the placeholders in text.
+func restoreSecrets(cfg *config.Config, text string) string {
+	if !cfg.ScrubSecrets {
+		return text
+	}
+	s, err := sessionScrubber(cfg)
+	if err != nil {
+		return text
+	}
+	return s.Restore(text)
+}
@@ -0,0 +1,210 @@
+package compare
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/render"
+	"github.com/rojolang/terminalgpt/stats"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target is one model of a comparison and the provider that serves it.
+type Target struct {
+	Provider string
+	Model    string
+	// Label is how the model was given, e.g. "ollama:llama3".
+	Label string
+}
+
+// Parse reads a --compare list of models, each optionally prefixed with its
+// provider, e.g. "gpt-4o,azure:gpt-4,ollama:llama3". Models without a prefix
+// are asked on the configured provider.
+func Parse(list string, provider string) ([]Target, error) {
+	targets := []Target{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target := Target{Provider: provider, Model: entry, Label: entry}
+		if prefix, _, ok := strings.Cut(entry, ":"); ok && config.IsBackend(prefix) {
+			var err error
+			target.Provider, target.Model, err = config.ParseBackend(entry, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) < 2 {
+		return nil, fmt.Errorf("--compare needs at least two models separated by commas, e.g. gpt-4o,ollama:llama3")
+	}
+	return targets, nil
+}
+
+// Config returns a copy of cfg asking the target, without history and
+// without falling back to other providers.
+func (t Target) Config(cfg *config.Config) *config.Config {
+	targetCfg := config.WithBackend(cfg, t.Provider, t.Model)
+	targetCfg.History = false
+	targetCfg.Fallbacks = nil
+	return targetCfg
+}
+
+// Result is how one target answered.
+type Result struct {
+	Target   Target
+	Response string
+	Stats    stats.Stats
+	Err      error
+}
+
+// section collects the streamed text of one target until it is shown.
+type section struct {
+	mu      sync.Mutex
+	chunks  []string
+	done    bool
+	updated chan struct{}
+}
+
+func (s *section) add(text string, done bool) {
+	s.mu.Lock()
+	if text != "" {
+		s.chunks = append(s.chunks, text)
+	}
+	s.done = s.done || done
+	s.mu.Unlock()
+	select {
+	case s.updated <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the chunks after the first shown ones and whether the target is done.
+func (s *section) next(shown int) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunks[shown:], s.done
+}
+
+// Run sends message to every target at once, each request limited to timeout
+// unless it is zero, and shows the answers in labeled sections in the order
+// of the targets. The section on screen streams as its text arrives while the
+// others are collected meanwhile and catch up when their turn comes.
+func Run(cfg *config.Config, message string, targets []Target, timeout time.Duration) []Result {
+	results := make([]Result, len(targets))
+	sections := make([]*section, len(targets))
+	for i := range targets {
+		sections[i] = &section{updated: make(chan struct{}, 1)}
+	}
+
+	for i, target := range targets {
+		go func(i int, target Target) {
+			results[i] = ask(cfg, message, target, timeout, sections[i])
+			sections[i].add("", true)
+		}(i, target)
+	}
+
+	for i, target := range targets {
+		out := render.Labeled(target.Label + ":")
+		shown := 0
+		for {
+			chunks, done := sections[i].next(shown)
+			for _, chunk := range chunks {
+				out.Write(chunk, 0)
+			}
+			shown += len(chunks)
+			if done {
+				break
+			}
+			<-sections[i].updated
+		}
+		out.Close()
+		if err := results[i].Err; err != nil {
+			color.New(color.FgRed).Printf("\n%s: %v", target.Label, err)
+		}
+		fmt.Println()
+	}
+	return results
+}
+
+// ask gets the answer of target, passing the text to s as it streams.
+func ask(cfg *config.Config, message string, target Target, timeout time.Duration, s *section) Result {
+	targetCfg := target.Config(cfg)
+	result := Result{Target: target, Stats: stats.Stats{Model: target.Model}}
+
+	ctx, cancel := deadline.New(timeout)
+	defer cancel()
+
+	start := time.Now()
+	first := time.Time{}
+	ctx = render.WithSink(ctx, func(text string) {
+		if first.IsZero() {
+			first = time.Now()
+		}
+		s.add(text, false)
+	})
+	response, userMessageTokens, systemMessageTokens, responseTokens, _, err := common.GenerateCompletionContext(ctx, targetCfg, message)
+	result.Stats.Latency = time.Since(start)
+	if !first.IsZero() {
+		result.Stats.FirstToken = first.Sub(start)
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	result.Response = response
+	result.Stats.PromptTokens = userMessageTokens
+	result.Stats.SystemTokens = systemMessageTokens
+	result.Stats.ResponseTokens = responseTokens
+	return result
+}
+
+// Table writes the latency, tokens and cost of every result side by side.
+func Table(w io.Writer, results []Result) {
+	rows := [][]string{{"model", "first token", "total", "prompt", "response", "cost"}}
+	for _, r := range results {
+		if r.Err != nil {
+			rows = append(rows, []string{r.Target.Label, "-", stats.Duration(r.Stats.Latency), "-", "-", "failed"})
+			continue
+		}
+		cost := "unknown"
+		if value, ok := helpers.Cost(r.Target.Model, r.Stats.PromptTokens+r.Stats.SystemTokens, r.Stats.ResponseTokens); ok {
+			cost = fmt.Sprintf("$%.4f", value)
+		}
+		rows = append(rows, []string{
+			r.Target.Label,
+			stats.Duration(r.Stats.FirstToken),
+			stats.Duration(r.Stats.Latency),
+			fmt.Sprint(r.Stats.PromptTokens + r.Stats.SystemTokens),
+			fmt.Sprint(r.Stats.ResponseTokens),
+			cost,
+		})
+	}
+
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	for n, row := range rows {
+		line := ""
+		for i, cell := range row {
+			line += fmt.Sprintf("%-*s  ", widths[i], cell)
+		}
+		line = strings.TrimRight(line, " ")
+		if n == 0 {
+			line = color.New(color.Bold).Sprint(line)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,120 @@
+package compress
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var CacheFile = appdir.Path("compressed.json")
+
+// MinTokens is the size below which compress_prompts leaves prompts alone.
+const MinTokens = 200
+
+const instructions = "You shorten system prompts for language models. Rewrite the prompt you are given so it uses as few tokens as possible while keeping every instruction, constraint and fact it contains. Drop filler, repetition and politeness, prefer terse phrasing and lists. Keep every {{placeholder}} exactly as written. Reply with only the rewritten prompt in a single fenced code block."
+
+var placeholderPattern = regexp.MustCompile(`\{\{[^}]*\}\}`)
+
+// Prompt asks the model for a shorter version of prompt. Placeholders such
+// as {{dir}} must survive unchanged, otherwise the rewrite is rejected.
+func Prompt(cfg *config.Config, prompt string) (string, error) {
+	compressCfg := *cfg
+	compressCfg.SystemMessage = instructions
+	compressCfg.History = false
+	if tokens, err := helpers.CountTokens(prompt, cfg.ModelName); err == nil && compressCfg.MaxResponseTokens < tokens+100 {
+		compressCfg.MaxResponseTokens = tokens + 100
+	}
+
+	variants, err := common.GenerateVariants(&compressCfg, "Prompt to shorten:\n```\n"+prompt+"\n```", 1)
+	if err != nil {
+		return "", err
+	}
+	if len(variants) == 0 {
+		return "", fmt.Errorf("the model returned no rewrite")
+	}
+
+	compressed := strings.TrimSpace(variants[0])
+	if blocks := codeblocks.Extract(variants[0]); len(blocks) > 0 {
+		compressed = strings.TrimSpace(blocks[0].Code)
+	}
+	if compressed == "" {
+		return "", fmt.Errorf("the model returned an empty rewrite")
+	}
+
+	if want, got := placeholders(prompt), placeholders(compressed); want != got {
+		return "", fmt.Errorf("the rewrite changed the placeholders from %s to %s", want, got)
+	}
+	return compressed, nil
+}
+
+// Cached returns the compressed version of prompt, asking the model only the
+// first time a prompt is seen. Short prompts and failures return prompt.
+func Cached(cfg *config.Config, prompt string) string {
+	tokens, err := helpers.CountTokens(prompt, cfg.ModelName)
+	if err != nil || tokens < MinTokens {
+		return prompt
+	}
+
+	cache := map[string]string{}
+	if data, err := ioutil.ReadFile(CacheFile); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	sum := sha256.Sum256([]byte(cfg.ModelName + "\n" + prompt))
+	key := hex.EncodeToString(sum[:])
+	if compressed, ok := cache[key]; ok {
+		return compressed
+	}
+
+	color.New(color.FgHiBlack).Printf("Compressing the system message (%d tokens)...\n", tokens)
+	compressed, err := Prompt(cfg, prompt)
+	if err != nil {
+		color.Red("Failed to compress the system message, using it as is: %v\n", err)
+		return prompt
+	}
+
+	cache[key] = compressed
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err == nil {
+		ioutil.WriteFile(CacheFile, data, 0644)
+	}
+	return compressed
+}
+
+// Apply replaces the system message and the system message of runMode with
+// their compressed versions for this run, leaving the config file untouched.
+func Apply(cfg *config.Config, runMode string) {
+	cfg.SystemMessage = Cached(cfg, cfg.SystemMessage)
+	if mode, ok := cfg.Modes[runMode]; ok {
+		mode.SystemMessage = Cached(cfg, mode.SystemMessage)
+		modes := make(map[string]config.Mode, len(cfg.Modes))
+		for name, m := range cfg.Modes {
+			modes[name] = m
+		}
+		modes[runMode] = mode
+		cfg.Modes = modes
+	}
+}
+
+func placeholders(text string) string {
+	unique := map[string]bool{}
+	for _, placeholder := range placeholderPattern.FindAllString(text, -1) {
+		unique[placeholder] = true
+	}
+	found := []string{}
+	for placeholder := range unique {
+		found = append(found, placeholder)
+	}
+	sort.Strings(found)
+	return "[" + strings.Join(found, " ") + "]"
+}
@@ -4,41 +4,199 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/codeindex"
+	"github.com/rojolang/terminalgpt/credentials"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/models"
+	"github.com/rojolang/terminalgpt/vault"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// gitTreeCommand prints the tracked files of the working directory as an indented tree.
+const gitTreeCommand = `git ls-files | sort | awk '
+BEGIN {
+    FS="/"
+    partCount = 0
+}
+{
+    split("", parts)  # Reset array
+    split($0, parts, FS)
+    for (i = 1; i <= length(parts); i++) {
+        if (i > partCount || parts[i] != prevParts[i]) {
+            for (j = 1; j < i; j++) {
+                printf("   ")
+            }
+            if (i < length(parts)) {
+                print("-- " parts[i])
+            } else {
+                print("- " parts[i])
+            }
+        }
+    }
+    partCount = length(parts)
+    split($0, prevParts, FS)
+}'`
+
 var (
-	ConfigFile       = os.Getenv("HOME") + "/.terminalgpt/config.json"
-	HistoryFile      = os.Getenv("HOME") + "/.terminalgpt/history.json"
-	StartTime        = time.Now()
-	CompletionAPIURL = "https://api.openai.com/v1/chat/completions"
-	SystemMessage    = "You are a useful assistant, your input is streamed into command line regarding coding and terminal questions for a user that uses macosx and codes in python and go and uses aws frequently."
-	TempConfigFile   = "config_temp.json"
+	ConfigFile          = appdir.Path("config.json")
+	HistoryFile         = appdir.Path("history.jsonl")
+	TemplatesDir        = appdir.Path("templates")
+	EmbeddingsCacheFile = appdir.Path("embeddings.json")
+	StartTime           = time.Now()
+	DefaultBaseURL      = "https://api.openai.com/v1"
+	SystemMessage       = "You are a useful assistant, your input is streamed into command line regarding coding and terminal questions for a user that uses macosx and codes in python and go and uses aws frequently."
+	TempConfigFile      = "config_temp.json"
 )
 
+// DefaultInjectExtensions are injected in every mode when inject_extensions
+// is not set.
+var DefaultInjectExtensions = []string{".go", ".py", ".js", ".jsx", ".ts", ".tsx", ".php", ".rb", ".rs", ".java", ".kt", ".swift", ".c", ".h", ".cpp", ".hpp", ".cs", ".sh", ".sql", ".yaml", ".yml", ".toml", ".json", ".html", ".css", ".vue", ".svelte", ".proto", ".tf"}
+
 type Config struct {
-	AIProvider        string  `json:"ai_provider"`
-	AzureURL          string  `json:"azure_url"`
-	AzureAuthKey      string  `json:"azure_auth_key"`
-	ModelName         string  `json:"model"`
-	Temperature       float64 `json:"temperature"`
-	MaxTotalTokens    int     `json:"max_total_tokens"`
-	MaxResponseTokens int     `json:"max_tokens"`
-	TopP              float64 `json:"top_p"`
-	FrequencyPenalty  float64 `json:"frequency_penalty"`
-	PresencePenalty   float64 `json:"presence_penalty"`
-	Stream            bool    `json:"stream"`
-	PrintStats        bool    `json:"print_stats"`
-	History           bool    `json:"history"`
-	AuthorizationKey  string  `json:"authorization_key"`
-	SystemMessage     string  `json:"system_message"`
-	LastUserMessage   string  `json:"last_user_message"`
+	AIProvider         string             `json:"ai_provider"`
+	AzureURL           string             `json:"azure_url"`
+	AzureAuthKey       string             `json:"azure_auth_key"`
+	ModelName          string             `json:"model"`
+	Temperature        float64            `json:"temperature"`
+	MaxTotalTokens     int                `json:"max_total_tokens"`
+	MaxResponseTokens  int                `json:"max_tokens"`
+	TopP               float64            `json:"top_p"`
+	FrequencyPenalty   float64            `json:"frequency_penalty"`
+	PresencePenalty    float64            `json:"presence_penalty"`
+	Stop               []string           `json:"stop"`
+	Seed               *int               `json:"seed"`
+	LogitBias          map[string]int     `json:"logit_bias"`
+	User               string             `json:"user"`
+	ReasoningEffort    string             `json:"reasoning_effort"`
+	Stream             bool               `json:"stream"`
+	PrintStats         bool               `json:"print_stats"`
+	History            bool               `json:"history"`
+	AuthorizationKey   string             `json:"authorization_key"`
+	SystemMessage      string             `json:"system_message"`
+	LastUserMessage    string             `json:"last_user_message"`
+	Popup              string             `json:"popup"`
+	HistoryRanking     bool               `json:"history_ranking"`
+	EmbeddingModel     string             `json:"embedding_model"`
+	RecencyWeight      float64            `json:"recency_weight"`
+	HistoryMaxEntries  int                `json:"history_max_entries"`
+	HistoryMaxBytes    int64              `json:"history_max_bytes"`
+	TokenCounter       string             `json:"token_counter"`
+	Cache              bool               `json:"cache"`
+	CacheTTLMinutes    int                `json:"cache_ttl_minutes"`
+	TokenizerDir       string             `json:"tokenizer_dir"`
+	TrashRetentionDays int                `json:"trash_retention_days"`
+	StatsFormat        string             `json:"stats_format"`
+	AutoSession        bool               `json:"auto_session"`
+	CompressPrompts    bool               `json:"compress_prompts"`
+	CollapseRepeats    bool               `json:"collapse_repeats"`
+	HistoryKeepDays    int                `json:"history_keep_days"`
+	HistoryKeepEntries int                `json:"history_keep_entries"`
+	HistoryKeepTokens  int                `json:"history_keep_tokens"`
+	HistoryEncryption  string             `json:"history_encryption"`
+	TitleModel         string             `json:"title_model"`
+	BaseURL            string             `json:"base_url"`
+	OpenAIOrganization string             `json:"openai_organization"`
+	OpenAIProject      string             `json:"openai_project"`
+	ProxyURL           string             `json:"proxy_url"`
+	CABundle           string             `json:"ca_bundle"`
+	TLSClientCert      string             `json:"tls_client_cert"`
+	TLSClientKey       string             `json:"tls_client_key"`
+	ConnectTimeout     int                `json:"connect_timeout_seconds"`
+	HeaderTimeout      int                `json:"response_header_timeout_seconds"`
+	RequestTimeout     int                `json:"request_timeout_seconds"`
+	WebSearch          string             `json:"web_search"`
+	WebSearchURL       string             `json:"web_search_url"`
+	WebSearchKey       string             `json:"web_search_key"`
+	WebSearchResults   int                `json:"web_search_results"`
+	FetchURLs          bool               `json:"fetch_urls"`
+	FetchURLTokens     int                `json:"fetch_url_tokens"`
+	InjectExtensions   []string           `json:"inject_extensions"`
+	InjectTruncation   string             `json:"inject_truncation"`
+	Speak              bool               `json:"speak"`
+	SpeechVoice        string             `json:"speech_voice"`
+	SpeechModel        string             `json:"speech_model"`
+	Fallbacks          []string           `json:"fallbacks"`
+	FallbackLatency    int                `json:"fallback_latency_seconds"`
+	LogRequests        bool               `json:"log_requests"`
+	LogPrompts         bool               `json:"log_prompts"`
+	ScrubSecrets       bool               `json:"scrub_secrets"`
+	ConfirmTokens      int                `json:"confirm_tokens"`
+	DefaultMode        string             `json:"default_mode"`
+	InjectGlobs        []string           `json:"inject_globs"`
+	IgnoreGlobs        []string           `json:"ignore_globs"`
+	Modes              map[string]Mode    `json:"modes"`
+	Personas           map[string]Persona `json:"personas"`
+	Plugins            []Plugin           `json:"plugins"`
+	// ScrubRules add to or replace the built-in rules of scrub_secrets by
+	// name, an empty pattern turns a built-in rule off.
+	ScrubRules []ScrubRule `json:"scrub_rules"`
+	// ExtraBody holds additional JSON fields merged into every chat completion
+	// request, keyed by ai_provider (gpt or azure).
+	ExtraBody map[string]map[string]interface{} `json:"extra_body"`
+	// Headers holds additional HTTP headers sent with every request, keyed
+	// by ai_provider like ExtraBody.
+	Headers map[string]map[string]string `json:"headers"`
+	// HTTPFixtures records the API responses to a directory or replays them
+	// from it without a network, "record:<dir>" or "replay:<dir>".
+	HTTPFixtures string `json:"http_fixtures"`
+	// Users have their own API keys in the credentials store, see
+	// terminalgpt users. ActiveUser is the one whose keys are used and whose
+	// usage is recorded, picked with --as.
+	Users      []string `json:"users"`
+	ActiveUser string   `json:"active_user"`
+	// Prompt is the prompt as typed, saved with the exchange when the message
+	// sent was made from it, e.g. with pasted text or injected files.
+	Prompt string `json:"-"`
+	// Replacing is a prompt that is asked again: its last answer in the
+	// history is left out of the context and replaced by the new one.
+	Replacing string `json:"-"`
+	// userKeys is set when ApplyUser replaced the keys with a user's.
+	userKeys bool
+	// Sources lists where the running config came from, see ApplyOverrides.
+	Sources []string `json:"-"`
+}
+
+// Mode is a run mode selectable with --mode.
+type Mode struct {
+	SystemMessage string   `json:"system_message"`
+	Extensions    []string `json:"extensions"`
+	ListCommand   string   `json:"list_command"`
+	// ApplyDiffs offers to apply unified diffs in responses to the working directory
+	ApplyDiffs bool `json:"apply_diffs"`
+}
+
+// Persona is a named character for `terminalgpt duel`.
+type Persona struct {
+	SystemMessage string `json:"system_message"`
+	Color         string `json:"color"`
+}
+
+// ScrubRule finds secrets to replace with placeholders before a prompt is
+// sent. When the pattern has a group only the group is replaced.
+type ScrubRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// Plugin is an external command that changes prompts before they are sent or
+// responses after they arrive, see the plugins package.
+type Plugin struct {
+	Name    string `json:"name"`
+	Command string `json:"command"`
+	// Hooks are "prompt" and "response", empty for both.
+	Hooks          []string `json:"hooks"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
 }
 
 type Event struct {
@@ -51,6 +209,17 @@ type Event struct {
 		Delta        Message `json:"delta"`
 		FinishReason string  `json:"finish_reason"`
 	} `json:"choices"`
+	// Usage comes with the last event when stream_options asks for it.
+	Usage *Usage `json:"usage"`
+}
+
+// Usage is the token usage the API reports for a completion.
+type Usage struct {
+	PromptTokens            int `json:"prompt_tokens"`
+	CompletionTokens        int `json:"completion_tokens"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
 }
 
 type Message struct {
@@ -75,11 +244,236 @@ func LoadConfig(file string) (Config, error) {
 		return config, fmt.Errorf("Failed to parse config file: %v", err) // Add error context
 	}
 
+	// configs written before modes were configurable, or before a built-in
+	// mode was added, get the missing built-in ones
+	if config.Modes == nil {
+		config.Modes = make(map[string]Mode)
+	}
+	for name, mode := range GetDefaultModes() {
+		if _, ok := config.Modes[name]; !ok {
+			config.Modes[name] = mode
+		}
+	}
+	if config.Personas == nil {
+		config.Personas = make(map[string]Persona)
+	}
+	for name, persona := range GetDefaultPersonas() {
+		if _, ok := config.Personas[name]; !ok {
+			config.Personas[name] = persona
+		}
+	}
+
+	// API keys saved in plain text by older versions move to the keychain
+	if (config.AuthorizationKey != "" || config.AzureAuthKey != "") && file == ConfigFile {
+		err = SaveConfig(config)
+		if err != nil {
+			fmt.Printf("Failed to move the API keys out of %s: %v\n", file, err)
+		}
+	}
+	loadKeys(&config)
+
 	return config, nil
 }
 
+// Backends are the providers a request can be sent to.
+var Backends = []string{"gpt", "azure", "ollama"}
+
+// IsBackend reports whether name is one of the Backends or openai.
+func IsBackend(name string) bool {
+	for _, backend := range Backends {
+		if name == backend {
+			return true
+		}
+	}
+	return name == "openai"
+}
+
+// ParseBackend reads a provider optionally followed by its model, e.g.
+// "azure:gpt-4", and returns both. Without a model it returns model. openai
+// is another name for gpt.
+func ParseBackend(entry, model string) (string, string, error) {
+	provider, name, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if ok {
+		model = name
+	}
+	if provider == "openai" {
+		provider = "gpt"
+	}
+	for _, backend := range Backends {
+		if provider == backend {
+			if model == "" {
+				return "", "", fmt.Errorf("no model given in %q", entry)
+			}
+			return provider, model, nil
+		}
+	}
+	return "", "", fmt.Errorf("unknown provider %q in %q, expected one of %s", provider, entry, strings.Join(Backends, ", "))
+}
+
+// WithBackend returns a copy of config asking model on provider, gpt, azure or
+// ollama. Ollama is reached through its OpenAI compatible API.
+func WithBackend(config *Config, provider, model string) *Config {
+	backend := *config
+	backend.AIProvider = provider
+	backend.ModelName = model
+	if provider == "ollama" {
+		backend.AIProvider = "gpt"
+		backend.BaseURL = models.OllamaHost() + "/v1"
+		backend.OpenAIOrganization = ""
+		backend.OpenAIProject = ""
+	}
+	return &backend
+}
+
+// OpenAIKey returns the OpenAI key, OPENAI_SECRET_KEY overrides the stored one
+// but not the key of a user picked with --as.
+func OpenAIKey(config *Config) string {
+	if key := os.Getenv("OPENAI_SECRET_KEY"); key != "" && !config.userKeys {
+		return key
+	}
+	return config.AuthorizationKey
+}
+
+// HTTPOptions returns the proxy and TLS settings for httpclient.Configure.
+func HTTPOptions(config *Config) httpclient.Options {
+	return httpclient.Options{
+		ProxyURL:   config.ProxyURL,
+		CABundle:   config.CABundle,
+		ClientCert: config.TLSClientCert,
+		ClientKey:  config.TLSClientKey,
+
+		ConnectTimeout:        time.Duration(config.ConnectTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.HeaderTimeout) * time.Second,
+		RequestTimeout:        time.Duration(config.RequestTimeout) * time.Second,
+
+		Fixtures: config.HTTPFixtures,
+	}
+}
+
+// OpenAIURL returns the URL of an endpoint of the OpenAI compatible API at
+// base_url, path is like "/chat/completions".
+func OpenAIURL(config *Config, path string) string {
+	base := config.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+// OpenAIHeaders returns the headers sent to the gpt provider besides the
+// authorization: the organization and project, then the configured extra
+// headers, which win.
+func OpenAIHeaders(config *Config) map[string]string {
+	headers := map[string]string{}
+	if config.OpenAIOrganization != "" {
+		headers["OpenAI-Organization"] = config.OpenAIOrganization
+	}
+	if config.OpenAIProject != "" {
+		headers["OpenAI-Project"] = config.OpenAIProject
+	}
+	for name, value := range config.Headers["gpt"] {
+		headers[name] = value
+	}
+	return headers
+}
+
+// RequestFields returns the fields added to the chat completion requests of
+// provider: the stop sequences, seed, logit bias, user and the reasoning
+// effort of reasoning models when set, then the configured extra_body fields,
+// which win.
+func RequestFields(config *Config, provider string) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if len(config.Stop) > 0 {
+		fields["stop"] = config.Stop
+	}
+	if config.Seed != nil {
+		fields["seed"] = *config.Seed
+	}
+	if len(config.LogitBias) > 0 {
+		fields["logit_bias"] = config.LogitBias
+	}
+	if config.User != "" {
+		fields["user"] = config.User
+	}
+	if config.ReasoningEffort != "" && models.IsReasoning(config.ModelName) {
+		fields["reasoning_effort"] = config.ReasoningEffort
+	}
+	for name, value := range config.ExtraBody[provider] {
+		fields[name] = value
+	}
+	return fields
+}
+
+// SetOpenAIHeaders sets the authorization and OpenAIHeaders on req.
+func SetOpenAIHeaders(config *Config, req *http.Request) {
+	if key := OpenAIKey(config); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	for name, value := range OpenAIHeaders(config) {
+		req.Header.Set(name, value)
+	}
+}
+
+// credentialNames maps the key fields to their names in the credentials store.
+func credentialNames(config *Config) map[string]*string {
+	return map[string]*string{
+		"openai":    &config.AuthorizationKey,
+		"azure":     &config.AzureAuthKey,
+		"websearch": &config.WebSearchKey,
+	}
+}
+
+// Redacted returns a copy of config without its keys, safe to share.
+func Redacted(config Config) Config {
+	for _, field := range credentialNames(&config) {
+		*field = ""
+	}
+	// headers often carry gateway credentials
+	config.Headers = nil
+	config.Sources = nil
+	return config
+}
+
+// loadKeys fills the empty key fields from the credentials store.
+func loadKeys(config *Config) {
+	for name, field := range credentialNames(config) {
+		if *field != "" {
+			continue
+		}
+		if secret, err := credentials.Get(name); err == nil {
+			*field = secret
+		}
+	}
+}
+
+// storeKeys moves the keys into the credentials store and clears the fields
+// that were stored, so they are not written to the config file.
+func storeKeys(config *Config) {
+	for name, field := range credentialNames(config) {
+		if *field == "" {
+			continue
+		}
+		// the keys of a user picked with --as are not the defaults
+		if config.userKeys && name != "websearch" {
+			*field = ""
+			continue
+		}
+		if existing, err := credentials.Get(name); err == nil && existing == *field {
+			*field = ""
+			continue
+		}
+		where, err := credentials.Set(name, *field)
+		if err != nil {
+			fmt.Printf("Failed to store the %s key securely, keeping it in the config file: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Stored the %s key in %s\n", name, where)
+		*field = ""
+	}
+}
+
 func ensureConfigDirExists() {
-	dir := os.Getenv("HOME") + "/.terminalgpt"
+	dir := appdir.Dir
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		os.MkdirAll(dir, 0755)
 	}
@@ -90,6 +484,8 @@ func SaveConfig(config Config) error {
 	// ensure the directory exists for config files
 	ensureConfigDirExists()
 
+	storeKeys(&config)
+
 	configFile, err := os.Create(ConfigFile)
 	if err != nil {
 		return fmt.Errorf("Failed to create config file: %v", err) // Add error context
@@ -107,22 +503,73 @@ func SaveConfig(config Config) error {
 }
 func GetDefaultConfig() Config {
 	return Config{
-		AIProvider:        "gpt",
-		AzureURL:          "",
-		AzureAuthKey:      "",
-		ModelName:         "dev-gpt4-32k-4",
-		Temperature:       0.50,
-		MaxTotalTokens:    8000,
-		MaxResponseTokens: 500,
-		TopP:              1.0,
-		FrequencyPenalty:  0.0,
-		PresencePenalty:   0.0,
-		Stream:            true,
-		PrintStats:        true,
-		History:           true,
-		SystemMessage:     "You are a useful assistant, your input is streamed into command line regarding coding and terminal questions for a user that uses macosx and codes in python and go and uses aws frequently.",
-		AuthorizationKey:  os.Getenv("OPENAI_SECRET_KEY"),
-		LastUserMessage:   "",
+		AIProvider:         "gpt",
+		AzureURL:           "",
+		AzureAuthKey:       "",
+		ModelName:          "dev-gpt4-32k-4",
+		Temperature:        0.50,
+		MaxTotalTokens:     8000,
+		MaxResponseTokens:  500,
+		TopP:               1.0,
+		FrequencyPenalty:   0.0,
+		PresencePenalty:    0.0,
+		Stream:             true,
+		PrintStats:         true,
+		History:            true,
+		SystemMessage:      "You are a useful assistant, your input is streamed into command line regarding coding and terminal questions for a user that uses macosx and codes in python and go and uses aws frequently.",
+		AuthorizationKey:   os.Getenv("OPENAI_SECRET_KEY"),
+		LastUserMessage:    "",
+		Modes:              GetDefaultModes(),
+		Personas:           GetDefaultPersonas(),
+		EmbeddingModel:     "text-embedding-3-small",
+		RecencyWeight:      0.3,
+		HistoryMaxEntries:  1000,
+		HistoryMaxBytes:    5 * 1024 * 1024,
+		TokenCounter:       "local",
+		Cache:              false,
+		CacheTTLMinutes:    24 * 60,
+		TrashRetentionDays: 30,
+		AutoSession:        true,
+		CollapseRepeats:    true,
+		TitleModel:         "gpt-4o-mini",
+	}
+}
+
+func GetDefaultModes() map[string]Mode {
+	return map[string]Mode{
+		"laravel": {
+			SystemMessage: "I'm using laravel v10.10, livewire v3.x, tailwindcss v3.3 and alpinejs, also daisyui for components and tailwindcss forms plugin.",
+			Extensions:    []string{".php"},
+			ListCommand:   strings.Replace(gitTreeCommand, "git ls-files |", "git ls-files | grep -v '^public/' | grep -v '^storage/' | grep -v '^tests/' |", 1),
+		},
+		"go": {
+			SystemMessage: "Im using golang.",
+			Extensions:    []string{".go"},
+			ListCommand:   gitTreeCommand,
+		},
+		"edit": {
+			SystemMessage: "You edit files in {{dir}}. Answer every change request with the changes as a unified diff in a ```diff code block: a '--- a/<path>' and '+++ b/<path>' header per file with paths relative to {{dir}}, @@ hunk headers, and three lines of unchanged context around each change. Use '--- /dev/null' for new files. Copy context lines exactly from the files I send, never abbreviate them. Keep explanations short.\nMy files are:\n{{listing}}",
+			Extensions:    []string{".go", ".py", ".js", ".ts", ".tsx", ".jsx", ".php", ".rb", ".rs", ".java", ".c", ".h", ".cpp", ".cs", ".swift", ".kt", ".sh", ".json", ".yaml", ".yml", ".toml", ".md", ".html", ".css", ".sql"},
+			ListCommand:   gitTreeCommand,
+			ApplyDiffs:    true,
+		},
+	}
+}
+
+func GetDefaultPersonas() map[string]Persona {
+	return map[string]Persona{
+		"architect": {
+			SystemMessage: "You are a pragmatic software architect. Propose concrete designs, name the trade-offs you accept and defend them with specifics. Keep each turn under 200 words.",
+			Color:         "cyan",
+		},
+		"critic": {
+			SystemMessage: "You are a sharp but fair reviewer. Find the weakest points of the proposal on the table: failure modes, scaling limits, operational cost, simpler alternatives. Concede what is right. Keep each turn under 200 words.",
+			Color:         "red",
+		},
+		"user-advocate": {
+			SystemMessage: "You speak for the people who will use and operate the result. Judge every idea by how it feels to use, debug and change. Keep each turn under 200 words.",
+			Color:         "green",
+		},
 	}
 }
 
@@ -146,9 +593,15 @@ func InteractiveConfigure() error {
 	return nil
 }
 
+// ReadAnswer reads the answer to a configuration prompt. main replaces it with
+// the line editor of the input package.
+var ReadAnswer = func(reader *bufio.Reader) (string, error) {
+	return reader.ReadString('\n')
+}
+
 func updateConfig(reader *bufio.Reader, prompt string, updateFunc func(string) error) error {
 	fmt.Println(prompt)
-	answer, err := reader.ReadString('\n')
+	answer, err := ReadAnswer(reader)
 	if err != nil {
 		return fmt.Errorf("failed to read user input: %v", err)
 	}
@@ -168,7 +621,7 @@ func interactiveUpdate(config *Config) error {
 		printCurrentConfig(config)
 
 		fmt.Println("\nEnter the number of the setting you want to change, or 'e' to exit:")
-		answer, err := reader.ReadString('\n')
+		answer, err := ReadAnswer(reader)
 		if err != nil {
 			return fmt.Errorf("Failed to read user input: %v", err)
 		}
@@ -189,16 +642,20 @@ func interactiveUpdate(config *Config) error {
 }
 
 func printCurrentConfig(config *Config) {
-	fmt.Println("\nCurrent configuration:\n")
-	fmt.Println("\nCurrent configuration:\n")
+	fmt.Print("\nCurrent configuration:\n\n")
 
 	fmt.Printf("Config File Path: %s\n", ConfigFile)
-	fmt.Printf("History File Path: %s\n\n", HistoryFile)
+	fmt.Printf("History File Path: %s\n", HistoryFile)
+	fmt.Printf("Templates Directory: %s\n\n", TemplatesDir)
 
-	fmt.Printf("1. AI Provider: %s\n", config.AIProvider)
+	fmt.Printf("1. AI Provider (gpt/azure): %s\n", config.AIProvider)
 	fmt.Printf("2. Azure URL: %s\n", config.AzureURL)
-	fmt.Printf("3. Azure Auth Key: %s\n", config.AzureAuthKey)
-	fmt.Printf("4. Model: %s\n", config.ModelName)
+	fmt.Printf("3. Azure Auth Key: %s\n", maskKey(config.AzureAuthKey))
+	if config.AIProvider == "azure" {
+		fmt.Printf("4. Azure deployment: %s\n", config.ModelName)
+	} else {
+		fmt.Printf("4. Model: %s\n", config.ModelName)
+	}
 	fmt.Printf("5. Temperature: %f\n", config.Temperature)
 	fmt.Printf("6. Max total tokens: %d\n", config.MaxTotalTokens)
 	fmt.Printf("7. Max response tokens: %d\n", config.MaxResponseTokens)
@@ -214,35 +671,382 @@ func printCurrentConfig(config *Config) {
 	} else {
 		fmt.Println("15. Authorization key is missing.")
 	}
+	fmt.Printf("16. Response popup (none/tmux/kitty): %s\n", displayPopup(config.Popup))
+	fmt.Printf("17. Rank history by relevance: %t\n", config.HistoryRanking)
+	fmt.Printf("18. Embedding model: %s\n", config.EmbeddingModel)
+	fmt.Printf("19. Recency weight: %f\n", config.RecencyWeight)
+	fmt.Printf("20. History max entries: %d\n", config.HistoryMaxEntries)
+	fmt.Printf("21. History max size (bytes): %d\n", config.HistoryMaxBytes)
+	fmt.Printf("22. Token counter for non-OpenAI models (local/anthropic/gemini): %s\n", config.TokenCounter)
+	fmt.Printf("23. Cache responses: %t\n", config.Cache)
+	fmt.Printf("24. Cache TTL (minutes): %d\n", config.CacheTTLMinutes)
+	fmt.Printf("25. Tokenizer directory: %s\n", displayTokenizerDir(config.TokenizerDir))
+	fmt.Printf("26. Trash retention (days): %d\n", config.TrashRetentionDays)
+	fmt.Printf("27. Stats format: %s\n", displayStatsFormat(config.StatsFormat))
+	fmt.Printf("28. Automatic sessions per directory and git branch: %t\n", config.AutoSession)
+	fmt.Printf("29. Compress long system messages: %t\n", config.CompressPrompts)
+	fmt.Printf("30. Collapse lines repeated from the previous answer: %t\n", config.CollapseRepeats)
+	fmt.Printf("31. Prune history older than (days): %s\n", displayRetention(config.HistoryKeepDays))
+	fmt.Printf("32. Prune history beyond (entries): %s\n", displayRetention(config.HistoryKeepEntries))
+	fmt.Printf("33. Prune history beyond (tokens): %s\n", displayRetention(config.HistoryKeepTokens))
+	fmt.Printf("34. OpenAI compatible base URL: %s\n", OpenAIURL(config, ""))
+	fmt.Printf("35. Extra headers for %s: %s\n", headersProvider(config), displayHeaders(config.Headers[headersProvider(config)]))
+	fmt.Printf("36. OpenAI organization: %s\n", config.OpenAIOrganization)
+	fmt.Printf("37. OpenAI project: %s\n", config.OpenAIProject)
+	fmt.Printf("38. Proxy URL: %s\n", displayProxy(config.ProxyURL))
+	fmt.Printf("39. CA bundle: %s\n", displayCABundle(config.CABundle))
+	fmt.Printf("40. Connect timeout (seconds): %s\n", displayTimeout(config.ConnectTimeout, "30"))
+	fmt.Printf("41. Response header timeout (seconds): %s\n", displayTimeout(config.HeaderTimeout, "none"))
+	fmt.Printf("42. Request timeout (seconds): %s\n", displayTimeout(config.RequestTimeout, "none"))
+	fmt.Printf("43. Web search API for search: prompts: %s\n", displayWebSearch(config.WebSearch))
+	fmt.Printf("44. Web search URL: %s\n", displayWebSearchURL(config.WebSearchURL))
+	fmt.Printf("45. Web search API key: %s\n", maskKey(config.WebSearchKey))
+	fmt.Printf("46. Web search results to read: %s\n", displayTimeout(config.WebSearchResults, "3"))
+	fmt.Printf("47. Fetch the pages of URLs in prompts: %t\n", config.FetchURLs)
+	fmt.Printf("48. Max tokens per fetched page: %s\n", displayTimeout(config.FetchURLTokens, "2000"))
+	fmt.Printf("49. Extensions of files to inject in every mode: %s\n", displayExtensions(config.InjectExtensions))
+	fmt.Printf("50. How injected files over the token budget are cut: %s\n", displayDefault(config.InjectTruncation, "head_tail"))
+	fmt.Printf("51. Read responses out loud: %t\n", config.Speak)
+	fmt.Printf("52. Speech voice: %s\n", displayDefault(config.SpeechVoice, "alloy"))
+	fmt.Printf("53. Speech model: %s\n", displayDefault(config.SpeechModel, "tts-1"))
+	fmt.Printf("54. Fallback providers: %s\n", displayDefault(strings.Join(config.Fallbacks, " → "), "none"))
+	fmt.Printf("55. Fall back when no text arrives within (seconds): %s\n", displayTimeout(config.FallbackLatency, "no limit"))
+	fmt.Printf("56. Log requests and responses: %t\n", config.LogRequests)
+	fmt.Printf("57. Include prompts and answers in the log: %t\n", config.LogPrompts)
+	fmt.Printf("58. Scrub secrets from prompts: %t\n", config.ScrubSecrets)
+	fmt.Printf("59. Ask before sending requests over (tokens): %s\n", displayConfirmTokens(config.ConfirmTokens))
+	fmt.Printf("60. Stop sequences: %s\n", displayStop(config.Stop))
+	fmt.Printf("61. Seed: %s\n", displaySeed(config.Seed))
+	fmt.Printf("62. Logit bias: %s\n", displayLogitBias(config.LogitBias))
+	fmt.Printf("63. User ID sent with requests: %s\n", displayDefault(config.User, "none"))
+	fmt.Printf("64. Reasoning effort of o1, o3, o4 and gpt-5 models: %s\n", displayDefault(config.ReasoningEffort, "provider default"))
+	fmt.Printf("65. Encrypt history (%s): %s\n", strings.Join(vault.Modes, "/"), displayDefault(config.HistoryEncryption, vault.ModeOff))
+	fmt.Printf("66. Model naming new conversations: %s\n", displayDefault(config.TitleModel, "the chat model"))
+
+}
+
+func displayTokenizerDir(dir string) string {
+	if dir == "" {
+		return "embedded"
+	}
+	return dir
+}
+
+// checkAzureURL makes sure the Azure endpoint is a valid URL that answers.
+// Any HTTP response counts, since the key may not be configured yet.
+func checkAzureURL(input string) error {
+	endpoint, err := url.Parse(input)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "https" && endpoint.Scheme != "http") {
+		return fmt.Errorf("invalid Azure URL %q, expected e.g. https://my-resource.openai.azure.com", input)
+	}
+
+	client := httpclient.Client(10 * time.Second)
+	resp, err := client.Get(strings.TrimRight(input, "/") + "/openai/deployments?api-version=2022-12-01")
+	if err != nil {
+		return fmt.Errorf("Azure endpoint is not reachable: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func maskKey(key string) string {
+	if len(key) < 4 {
+		return "(not set)"
+	}
+	return "****" + key[len(key)-4:]
+}
+
+// ModelProvider returns what is needed to list the models of the configured provider.
+func ModelProvider(config *Config) models.Provider {
+	if config.AIProvider == "azure" {
+		return models.Provider{Name: "azure", AzureURL: config.AzureURL, Key: config.AzureAuthKey, Headers: config.Headers["azure"]}
+	}
+	return models.Provider{Name: config.AIProvider, Key: OpenAIKey(config), BaseURL: OpenAIURL(config, ""), Headers: OpenAIHeaders(config)}
+}
+
+func displayConfirmTokens(tokens int) string {
+	if tokens < 0 {
+		return "never ask"
+	}
+	return displayTimeout(tokens, "20000")
+}
+
+func displayStop(stop []string) string {
+	if len(stop) == 0 {
+		return "none"
+	}
+	quoted := []string{}
+	for _, sequence := range stop {
+		quoted = append(quoted, strconv.Quote(sequence))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// parseStop parses comma separated stop sequences, quoted with Go escapes
+// when they hold commas, spaces or newlines, e.g. "\n\n", END.
+func parseStop(input string) ([]string, error) {
+	stop := []string{}
+	for input = strings.TrimSpace(input); input != ""; input = strings.TrimSpace(input) {
+		sequence := input
+		if strings.HasPrefix(input, `"`) {
+			prefix, err := strconv.QuotedPrefix(input)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted stop sequence in %q", input)
+			}
+			sequence, _ = strconv.Unquote(prefix)
+			input = strings.TrimSpace(input[len(prefix):])
+			if input != "" && !strings.HasPrefix(input, ",") {
+				return nil, fmt.Errorf("expected a comma after %s", prefix)
+			}
+		} else {
+			sequence, input, _ = strings.Cut(input, ",")
+			sequence = strings.TrimSpace(sequence)
+		}
+		input = strings.TrimPrefix(input, ",")
+		if sequence == "" {
+			continue
+		}
+		stop = append(stop, sequence)
+	}
+	if len(stop) > 4 {
+		return nil, fmt.Errorf("at most 4 stop sequences are supported, got %d", len(stop))
+	}
+	return stop, nil
+}
+
+func displaySeed(seed *int) string {
+	if seed == nil {
+		return "none"
+	}
+	return strconv.Itoa(*seed)
+}
+
+func displayLogitBias(bias map[string]int) string {
+	if len(bias) == 0 {
+		return "none"
+	}
+	tokens := []string{}
+	for token := range bias {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	pairs := []string{}
+	for _, token := range tokens {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", token, bias[token]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// parseLogitBias parses "token=bias, ..." pairs of token IDs and biases from
+// -100 to 100.
+func parseLogitBias(input string) (map[string]int, error) {
+	bias := map[string]int{}
+	for _, pair := range strings.Split(input, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		token, value, ok := strings.Cut(pair, "=")
+		token = strings.TrimSpace(token)
+		if _, err := strconv.Atoi(token); !ok || err != nil {
+			return nil, fmt.Errorf("invalid logit bias %q, expected token_id=bias", strings.TrimSpace(pair))
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < -100 || n > 100 {
+			return nil, fmt.Errorf("invalid bias %q for token %s, expected -100 to 100", strings.TrimSpace(value), token)
+		}
+		bias[token] = n
+	}
+	return bias, nil
+}
+
+func displayTimeout(seconds int, fallback string) string {
+	if seconds == 0 {
+		return fallback
+	}
+	return strconv.Itoa(seconds)
+}
+
+func setTimeout(field *int, input string) error {
+	seconds, err := strconv.Atoi(input)
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("invalid number of seconds: %q", input)
+	}
+	*field = seconds
+	return nil
+}
+
+func displayExtensions(extensions []string) string {
+	switch {
+	case extensions == nil:
+		return "default (" + strings.Join(DefaultInjectExtensions, " ") + ")"
+	case len(extensions) == 0:
+		return "none, only the mode's"
+	}
+	return strings.Join(extensions, " ")
+}
+
+func displayDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func displayWebSearch(provider string) string {
+	if provider == "" {
+		return "off"
+	}
+	return provider
+}
+
+func displayWebSearchURL(webSearchURL string) string {
+	if webSearchURL == "" {
+		return "default"
+	}
+	return webSearchURL
+}
+
+func displayProxy(proxyURL string) string {
+	if proxyURL != "" {
+		return proxyURL
+	}
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if value := os.Getenv(name); value != "" {
+			return value + " (from " + name + ")"
+		}
+	}
+	return "none"
+}
+
+func displayCABundle(path string) string {
+	if path == "" {
+		return "system certificates only"
+	}
+	return path
+}
+
+// headersProvider is the provider whose headers option 35 edits.
+func headersProvider(config *Config) string {
+	if config.AIProvider == "azure" {
+		return "azure"
+	}
+	return "gpt"
+}
+
+func displayHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return "none"
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseHeaders parses "Name=value, Other=value" into a header map.
+func parseHeaders(input string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(input, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name=value", strings.TrimSpace(pair))
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+func displayRetention(limit int) string {
+	if limit == 0 {
+		return "off"
+	}
+	return strconv.Itoa(limit)
+}
+
+func setRetention(field *int, input, what string) error {
+	limit, err := strconv.Atoi(input)
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid number of %s: %q", what, input)
+	}
+	*field = limit
+	return nil
+}
+
+func displayStatsFormat(format string) string {
+	if format == "" {
+		return "default"
+	}
+	return format
+}
 
+func displayPopup(popup string) string {
+	if popup == "" {
+		return "none"
+	}
+	return popup
 }
 
 func updateConfigOption(reader *bufio.Reader, answer string, config *Config) error {
 	var updateErr error
 	switch answer {
 	case "1":
-		updateErr = updateConfig(reader, "Enter the AI Provider:", func(input string) error {
-			if input == "" {
-				return fmt.Errorf("AI Provider cannot be empty")
+		updateErr = updateConfig(reader, "Enter the AI Provider (gpt/azure):", func(input string) error {
+			if input != "gpt" && input != "azure" {
+				return fmt.Errorf("invalid AI Provider %q, expected gpt or azure", input)
 			}
 			config.AIProvider = input
 			return nil
 		})
+		// switching to azure needs the endpoint, key and deployment as well
+		if updateErr == nil && config.AIProvider == "azure" {
+			for _, option := range []string{"2", "3", "4"} {
+				updateErr = updateConfigOption(reader, option, config)
+				if updateErr != nil {
+					break
+				}
+			}
+		}
 	case "2":
-		updateErr = updateConfig(reader, "Enter the Azure URL:", func(input string) error {
+		updateErr = updateConfig(reader, "Enter the Azure URL (e.g. https://my-resource.openai.azure.com):", func(input string) error {
+			err := checkAzureURL(input)
+			if err != nil {
+				return err
+			}
 			config.AzureURL = input
 			return nil
 		})
 	case "3":
-		updateErr = updateConfig(reader, "Enter the Azure Auth Key:", func(input string) error {
+		updateErr = updateConfig(reader, "Enter the Azure Auth Key (empty to keep the current one):", func(input string) error {
+			if input == "" {
+				if config.AzureAuthKey == "" {
+					return fmt.Errorf("Azure Auth Key cannot be empty")
+				}
+				return nil
+			}
 			config.AzureAuthKey = input
 			return nil
 		})
 	case "4":
-		updateErr = updateConfig(reader, "Enter the model name:", func(input string) error {
+		prompt := "Enter the model name:"
+		if config.AIProvider == "azure" {
+			prompt = "Enter the Azure deployment name:"
+		}
+		updateErr = updateConfig(reader, prompt, func(input string) error {
 			if input == "" {
 				return fmt.Errorf("model name cannot be empty")
 			}
+			err := models.Validate(ModelProvider(config), input)
+			if errors.Is(err, models.ErrUnknownModel) {
+				return err
+			} else if err != nil {
+				fmt.Printf("Could not check the model name against the provider: %v\n", err)
+			}
 			config.ModelName = input
 			return nil
 		})
@@ -344,77 +1148,522 @@ func updateConfigOption(reader *bufio.Reader, answer string, config *Config) err
 			config.AuthorizationKey = input
 			return nil
 		})
+	case "16":
+		updateErr = updateConfig(reader, "Show responses in a popup (none/tmux/kitty):", func(input string) error {
+			switch input {
+			case "", "none":
+				config.Popup = ""
+			case "tmux", "kitty":
+				config.Popup = input
+			default:
+				return fmt.Errorf("invalid popup value %q", input)
+			}
+			return nil
+		})
+	case "17":
+		updateErr = updateConfig(reader, "Rank history by relevance to the prompt? (true/false):", func(input string) error {
+			ranking, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid history ranking value: %v", err)
+			}
+			config.HistoryRanking = ranking
+			return nil
+		})
+	case "18":
+		updateErr = updateConfig(reader, "Enter the embedding model (or Azure embedding deployment):", func(input string) error {
+			if input == "" {
+				return fmt.Errorf("embedding model cannot be empty")
+			}
+			config.EmbeddingModel = input
+			return nil
+		})
+	case "19":
+		updateErr = updateConfig(reader, "Enter the recency weight (0 = relevance only, 1 = newest first):", func(input string) error {
+			weight, err := strconv.ParseFloat(input, 64)
+			if err != nil || weight < 0 || weight > 1 {
+				return fmt.Errorf("invalid recency weight value: %q", input)
+			}
+			config.RecencyWeight = weight
+			return nil
+		})
+	case "20":
+		updateErr = updateConfig(reader, "Enter the max history entries before rotating (-1 for no limit):", func(input string) error {
+			maxEntries, err := strconv.Atoi(input)
+			if err != nil {
+				return fmt.Errorf("invalid history max entries value: %v", err)
+			}
+			config.HistoryMaxEntries = maxEntries
+			return nil
+		})
+	case "21":
+		updateErr = updateConfig(reader, "Enter the max history size in bytes before rotating (-1 for no limit):", func(input string) error {
+			maxBytes, err := strconv.ParseInt(input, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid history max size value: %v", err)
+			}
+			config.HistoryMaxBytes = maxBytes
+			return nil
+		})
+	case "22":
+		updateErr = updateConfig(reader, "Count tokens of non-OpenAI models with (local/anthropic/gemini):", func(input string) error {
+			switch input {
+			case "local", "anthropic", "gemini":
+				config.TokenCounter = input
+			default:
+				return fmt.Errorf("invalid token counter %q", input)
+			}
+			return nil
+		})
+	case "23":
+		updateErr = updateConfig(reader, "Cache responses to identical prompts? (true/false):", func(input string) error {
+			cache, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid cache value: %v", err)
+			}
+			config.Cache = cache
+			return nil
+		})
+	case "24":
+		updateErr = updateConfig(reader, "Enter the cache TTL in minutes:", func(input string) error {
+			ttl, err := strconv.Atoi(input)
+			if err != nil || ttl <= 0 {
+				return fmt.Errorf("invalid cache TTL value: %q", input)
+			}
+			config.CacheTTLMinutes = ttl
+			return nil
+		})
+	case "25":
+		updateErr = updateConfig(reader, "Enter a directory with .tiktoken files overriding the embedded tokenizers (empty for embedded):", func(input string) error {
+			config.TokenizerDir = input
+			return nil
+		})
+	case "26":
+		updateErr = updateConfig(reader, "Enter how many days deleted history stays in the trash:", func(input string) error {
+			days, err := strconv.Atoi(input)
+			if err != nil || days <= 0 {
+				return fmt.Errorf("invalid trash retention value: %q", input)
+			}
+			config.TrashRetentionDays = days
+			return nil
+		})
+	case "27":
+		updateErr = updateConfig(reader, "Enter the stats format, e.g. {model} {latency} {cost} (empty for default):", func(input string) error {
+			config.StatsFormat = input
+			return nil
+		})
+	case "28":
+		updateErr = updateConfig(reader, "Keep a separate history per directory and git branch? (true/false):", func(input string) error {
+			autoSession, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid automatic sessions value: %v", err)
+			}
+			config.AutoSession = autoSession
+			return nil
+		})
+	case "29":
+		updateErr = updateConfig(reader, "Compress long system messages with the model before using them? (true/false):", func(input string) error {
+			compressPrompts, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid compress prompts value: %v", err)
+			}
+			config.CompressPrompts = compressPrompts
+			return nil
+		})
+	case "30":
+		updateErr = updateConfig(reader, "Collapse long runs of lines repeated from the previous answer? (true/false):", func(input string) error {
+			collapseRepeats, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid collapse repeats value: %v", err)
+			}
+			config.CollapseRepeats = collapseRepeats
+			return nil
+		})
+	case "31":
+		updateErr = updateConfig(reader, "Prune history entries older than how many days? (0 to keep them):", func(input string) error {
+			return setRetention(&config.HistoryKeepDays, input, "days")
+		})
+	case "32":
+		updateErr = updateConfig(reader, "Keep at most how many history entries? (0 for no limit):", func(input string) error {
+			return setRetention(&config.HistoryKeepEntries, input, "entries")
+		})
+	case "33":
+		updateErr = updateConfig(reader, "Keep at most how many tokens of history? (0 for no limit):", func(input string) error {
+			return setRetention(&config.HistoryKeepTokens, input, "tokens")
+		})
+	case "34":
+		updateErr = updateConfig(reader, "Enter the base URL of the OpenAI compatible API, e.g. http://localhost:1234/v1 (empty for OpenAI):", func(input string) error {
+			if input == "" {
+				config.BaseURL = ""
+				return nil
+			}
+			parsed, err := url.Parse(input)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("invalid base URL %q, expected http(s)://host/path", input)
+			}
+			config.BaseURL = strings.TrimRight(input, "/")
+			return nil
+		})
+	case "35":
+		updateErr = updateConfig(reader, "Enter extra headers as Name=value pairs separated by commas (empty to remove them):", func(input string) error {
+			headers, err := parseHeaders(input)
+			if err != nil {
+				return err
+			}
+			if config.Headers == nil {
+				config.Headers = make(map[string]map[string]string)
+			}
+			config.Headers[headersProvider(config)] = headers
+			return nil
+		})
+	case "36":
+		updateErr = updateConfig(reader, "Enter the OpenAI organization ID, sent as OpenAI-Organization (empty for none):", func(input string) error {
+			config.OpenAIOrganization = input
+			return nil
+		})
+	case "37":
+		updateErr = updateConfig(reader, "Enter the OpenAI project ID, sent as OpenAI-Project (empty for none):", func(input string) error {
+			config.OpenAIProject = input
+			return nil
+		})
+	case "38":
+		updateErr = updateConfig(reader, "Enter the proxy URL, e.g. http://proxy:8080 or socks5://127.0.0.1:1080 (empty for HTTPS_PROXY):", func(input string) error {
+			options := HTTPOptions(config)
+			options.ProxyURL = input
+			err := httpclient.Configure(options)
+			if err != nil {
+				return err
+			}
+			config.ProxyURL = input
+			return nil
+		})
+	case "39":
+		updateErr = updateConfig(reader, "Enter the path of a PEM file with extra certificate authorities (empty for none):", func(input string) error {
+			options := HTTPOptions(config)
+			options.CABundle = input
+			err := httpclient.Configure(options)
+			if err != nil {
+				return err
+			}
+			config.CABundle = input
+			return nil
+		})
+	case "40":
+		updateErr = updateConfig(reader, "Give up connecting to the API after how many seconds? (0 for 30):", func(input string) error {
+			return setTimeout(&config.ConnectTimeout, input)
+		})
+	case "41":
+		updateErr = updateConfig(reader, "Give up when the API has not started answering after how many seconds? (0 for no limit):", func(input string) error {
+			return setTimeout(&config.HeaderTimeout, input)
+		})
+	case "42":
+		updateErr = updateConfig(reader, "Give up on a whole API request, streaming included, after how many seconds? (0 for no limit):", func(input string) error {
+			return setTimeout(&config.RequestTimeout, input)
+		})
+	case "43":
+		updateErr = updateConfig(reader, "Enter the web search API for search: prompts (searxng/bing/brave, empty to turn it off):", func(input string) error {
+			switch input {
+			case "", "searxng", "bing", "brave":
+				config.WebSearch = input
+				return nil
+			}
+			return fmt.Errorf("invalid web search API %q, expected searxng, bing or brave", input)
+		})
+	case "44":
+		updateErr = updateConfig(reader, "Enter the web search URL, e.g. http://localhost:8888 for SearxNG (empty for the default of bing and brave):", func(input string) error {
+			if input == "" {
+				config.WebSearchURL = ""
+				return nil
+			}
+			parsed, err := url.Parse(input)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return fmt.Errorf("invalid web search URL %q, expected http(s)://host/path", input)
+			}
+			config.WebSearchURL = strings.TrimRight(input, "/")
+			return nil
+		})
+	case "45":
+		updateErr = updateConfig(reader, "Enter the web search API key (empty to keep the current one):", func(input string) error {
+			if input != "" {
+				config.WebSearchKey = input
+			}
+			return nil
+		})
+	case "46":
+		updateErr = updateConfig(reader, "How many search results should be read? (0 for 3):", func(input string) error {
+			results, err := strconv.Atoi(input)
+			if err != nil || results < 0 {
+				return fmt.Errorf("invalid number of results: %q", input)
+			}
+			config.WebSearchResults = results
+			return nil
+		})
+	case "47":
+		updateErr = updateConfig(reader, "Fetch the pages of http(s) URLs in prompts and add their text? (true/false):", func(input string) error {
+			fetchURLs, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid fetch URLs value: %v", err)
+			}
+			config.FetchURLs = fetchURLs
+			return nil
+		})
+	case "48":
+		updateErr = updateConfig(reader, "Add at most how many tokens of each fetched page? (0 for 2000):", func(input string) error {
+			tokens, err := strconv.Atoi(input)
+			if err != nil || tokens < 0 {
+				return fmt.Errorf("invalid number of tokens: %q", input)
+			}
+			config.FetchURLTokens = tokens
+			return nil
+		})
+	case "49":
+		updateErr = updateConfig(reader, "Enter the extensions of files to inject, separated by commas, e.g. .go, .py, .sql ('default' for the built-in list, 'none' to only use the modes'):", func(input string) error {
+			switch input {
+			case "default":
+				config.InjectExtensions = nil
+				return nil
+			case "none":
+				config.InjectExtensions = []string{}
+				return nil
+			}
+			extensions := []string{}
+			for _, ext := range strings.Split(input, ",") {
+				ext = strings.TrimSpace(ext)
+				if ext == "" {
+					continue
+				}
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				extensions = append(extensions, ext)
+			}
+			config.InjectExtensions = extensions
+			return nil
+		})
+	case "50":
+		updateErr = updateConfig(reader, "How should injected files over the token budget be cut? (head_tail/strip/outline/off):", func(input string) error {
+			switch input {
+			case "", "head_tail", "strip", "outline", "off":
+				config.InjectTruncation = input
+				return nil
+			}
+			return fmt.Errorf("invalid truncation %q, expected head_tail, strip, outline or off", input)
+		})
+	case "51":
+		updateErr = updateConfig(reader, "Read every response out loud? (true/false):", func(input string) error {
+			speak, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid speak value: %v", err)
+			}
+			config.Speak = speak
+			return nil
+		})
+	case "52":
+		updateErr = updateConfig(reader, "Enter the speech voice, e.g. alloy, echo, fable, onyx, nova or shimmer (empty for alloy):", func(input string) error {
+			config.SpeechVoice = input
+			return nil
+		})
+	case "53":
+		updateErr = updateConfig(reader, "Enter the speech model, or the Azure deployment of one (empty for tts-1):", func(input string) error {
+			config.SpeechModel = input
+			return nil
+		})
+	case "54":
+		updateErr = updateConfig(reader, "Enter the providers to try in turn when a request fails, separated by commas, each optionally with its model, e.g. azure:gpt-4, ollama:llama3 (empty for none):", func(input string) error {
+			fallbacks := []string{}
+			for _, entry := range strings.Split(input, ",") {
+				entry = strings.TrimSpace(entry)
+				if entry == "" {
+					continue
+				}
+				if _, _, err := ParseBackend(entry, config.ModelName); err != nil {
+					return err
+				}
+				fallbacks = append(fallbacks, entry)
+			}
+			config.Fallbacks = fallbacks
+			return nil
+		})
+	case "55":
+		updateErr = updateConfig(reader, "Try the next fallback provider when no text arrives within how many seconds? (0 for no limit):", func(input string) error {
+			return setTimeout(&config.FallbackLatency, input)
+		})
+	case "56":
+		updateErr = updateConfig(reader, "Log the requests, timings and token counts to the logs folder? API keys are never logged (true/false):", func(input string) error {
+			logRequests, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid log requests value: %v", err)
+			}
+			config.LogRequests = logRequests
+			return nil
+		})
+	case "57":
+		updateErr = updateConfig(reader, "Log the full prompts and answers too, instead of only their length? (true/false):", func(input string) error {
+			logPrompts, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid log prompts value: %v", err)
+			}
+			config.LogPrompts = logPrompts
+			return nil
+		})
+	case "58":
+		updateErr = updateConfig(reader, "Replace keys, tokens, private keys and emails in prompts with placeholders before sending them? (true/false):", func(input string) error {
+			scrubSecrets, err := strconv.ParseBool(input)
+			if err != nil {
+				return fmt.Errorf("invalid scrub secrets value: %v", err)
+			}
+			config.ScrubSecrets = scrubSecrets
+			return nil
+		})
+	case "59":
+		updateErr = updateConfig(reader, "Ask before sending requests over how many tokens? (0 for 20000, -1 to never ask):", func(input string) error {
+			tokens, err := strconv.Atoi(input)
+			if err != nil || tokens < -1 {
+				return fmt.Errorf("invalid number of tokens: %q", input)
+			}
+			config.ConfirmTokens = tokens
+			return nil
+		})
+	case "60":
+		updateErr = updateConfig(reader, `Enter up to 4 stop sequences separated by commas, quoted with escapes for newlines or commas, e.g. "\n\n", END (empty for none):`, func(input string) error {
+			stop, err := parseStop(input)
+			if err != nil {
+				return err
+			}
+			config.Stop = stop
+			return nil
+		})
+	case "61":
+		updateErr = updateConfig(reader, "Enter the seed for repeatable sampling (empty for none):", func(input string) error {
+			if input == "" {
+				config.Seed = nil
+				return nil
+			}
+			seed, err := strconv.Atoi(input)
+			if err != nil {
+				return fmt.Errorf("invalid seed %q", input)
+			}
+			config.Seed = &seed
+			return nil
+		})
+	case "62":
+		updateErr = updateConfig(reader, "Enter token_id=bias pairs separated by commas, biases from -100 to 100 (empty for none):", func(input string) error {
+			bias, err := parseLogitBias(input)
+			if err != nil {
+				return err
+			}
+			config.LogitBias = bias
+			return nil
+		})
+	case "63":
+		updateErr = updateConfig(reader, "Enter the user ID sent with requests for abuse monitoring (empty for none):", func(input string) error {
+			config.User = input
+			return nil
+		})
+	case "64":
+		updateErr = updateConfig(reader, "Enter how hard reasoning models think before answering ("+strings.Join(models.ReasoningEfforts, "/")+", empty for the provider default):", func(input string) error {
+			if input != "" && !models.IsReasoningEffort(input) {
+				return fmt.Errorf("invalid reasoning effort %q, expected one of %s", input, strings.Join(models.ReasoningEfforts, ", "))
+			}
+			config.ReasoningEffort = input
+			return nil
+		})
+	case "65":
+		updateErr = updateConfig(reader, "Enter how to encrypt the history ("+strings.Join(vault.Modes, "/")+"), then run `terminalgpt history encrypt` for the existing history:", func(input string) error {
+			if !vault.IsMode(input) {
+				return fmt.Errorf("invalid history encryption %q, expected one of %s", input, strings.Join(vault.Modes, ", "))
+			}
+			config.HistoryEncryption = input
+			return nil
+		})
+	case "66":
+		updateErr = updateConfig(reader, "Enter the model that names new conversations after their first exchange, a cheap one like gpt-4o-mini (empty for the chat model, off to not name them):", func(input string) error {
+			config.TitleModel = input
+			return nil
+		})
 	default:
-		fmt.Println("Invalid option. Please enter a number between 1 and 12, or 'e' to exit.")
+		fmt.Println("Invalid option. Please enter a number between 1 and 66, or 'e' to exit.")
 	}
 
 	return updateErr
 }
-func GetRunModeSystemMessage(runMode string, workingDirectory string) string {
 
-	cmd := exec.Command("sh", "-c", `git ls-files | grep -v '^public/' | grep -v '^storage/' | grep -v '^tests/' | sort | awk '
-BEGIN {
-    FS="/"
-    partCount = 0
-}
-{
-    split("", parts)  # Reset array
-    split($0, parts, FS)
-    for (i = 1; i <= length(parts); i++) {
-        if (i > partCount || parts[i] != prevParts[i]) {
-            for (j = 1; j < i; j++) {
-                printf("   ")
-            }
-            if (i < length(parts)) {
-                print("-- " parts[i])
-            } else {
-                print("- " parts[i])
-            }
-        }
-    }
-    partCount = length(parts)
-    split($0, prevParts, FS)
-}'`)
-
-	// Set the working directory for the command
-	if workingDirectory != "" {
-		cmd.Dir = workingDirectory
+// GetRunModeSystemMessage builds the system message for a mode defined in
+// cfg.Modes. {{listing}} in the mode's template is replaced by the output of
+// its list command and {{dir}} by the working directory.
+func GetRunModeSystemMessage(cfg *Config, runMode string, workingDirectory string) string {
+	mode, ok := cfg.Modes[runMode]
+	if !ok {
+		fmt.Printf("Unknown run mode %q, using the configured system message.\n", runMode)
+		return cfg.SystemMessage
 	}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error: ", err)
-	}
+	listing := ""
+	if mode.ListCommand != "" {
+		cmd := exec.Command("sh", "-c", mode.ListCommand)
 
-	var tmpSystemMessage = ""
+		// Set the working directory for the command
+		if workingDirectory != "" {
+			cmd.Dir = workingDirectory
+		}
 
-	if runMode == "laravel" {
-		tmpSystemMessage = fmt.Sprintf("I'm using laravel v10.10, livewire v3.x, tailwindcss v3.3 and alpinejs, also daisyui for components and tailwindcss forms plugin.")
-	} else if runMode == "go" {
-		tmpSystemMessage = "Im using golang."
-	} else {
-		return SystemMessage
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		err := cmd.Run()
+		if err != nil {
+			fmt.Println("Error: ", err)
+		}
+		listing = out.String()
+	}
+
+	systemMessage := strings.ReplaceAll(mode.SystemMessage, "{{dir}}", workingDirectory)
+	if strings.Contains(systemMessage, "{{listing}}") {
+		return strings.ReplaceAll(systemMessage, "{{listing}}", listing)
+	}
+	if listing == "" {
+		return systemMessage
 	}
 
-	return fmt.Sprintf("\n\n%s===\nMy current directory and file structure is:\n\n%s\n===", tmpSystemMessage, out.String())
+	return fmt.Sprintf("%s\n===\nMy current directory and file structure is:\n\n%s\n===", systemMessage, listing)
 }
 
+// FindFile resolves a file mention in the project at dir: as a path when it
+// names an existing file, otherwise using the project index (see the
+// codeindex package) and falling back to a full walk for files the index
+// leaves out, such as git ignored ones.
 func FindFile(name, dir string) (string, error) {
+	// absolute paths and paths outside the project, e.g. ../other/main.go,
+	// with either kind of slash
+	local := filepath.FromSlash(name)
+	if !filepath.IsAbs(local) {
+		local = filepath.Join(dir, local)
+	}
+	if info, err := os.Stat(local); err == nil && !info.IsDir() {
+		return local, nil
+	}
+
+	if found, err := codeindex.FindFile(name, dir); err == nil {
+		return found, nil
+	}
+
 	var result string
+	base := filepath.Base(name)
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.Name() == name {
-			result = path
+		if info.IsDir() && info.Name() == ".git" {
 			return filepath.SkipDir
 		}
+		if result == "" && !info.IsDir() && info.Name() == base {
+			result = path
+		}
 		return nil
 	})
 	if err != nil {
 		return "", err
 	}
+	if result == "" {
+		return "", fmt.Errorf("could not find %s in %s", name, dir)
+	}
 	return result, nil
 }
@@ -0,0 +1,265 @@
+package config
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the environment variables that override config fields,
+// followed by the upper-cased JSON name, e.g. TERMINALGPT_MAX_TOKENS.
+const EnvPrefix = "TERMINALGPT_"
+
+const (
+	ProjectYAMLFile = ".terminalgpt.yaml"
+	ProjectEnvFile  = ".terminalgpt.env"
+	ProjectJSONFile = ".terminalgpt.json"
+)
+
+// Project is the content of a .terminalgpt.yaml in a repository.
+type Project struct {
+	SystemMessage string   `yaml:"system_message"`
+	Mode          string   `yaml:"mode"`
+	Inject        []string `yaml:"inject"`
+	Ignore        []string `yaml:"ignore"`
+}
+
+// ProjectFields are the settings .terminalgpt.json and .terminalgpt.env may
+// set. They come with the repository, so they only tune the requests: fields
+// that run commands, like plugins and modes, or that pick where requests and
+// keys go, like base_url and headers, are left to the user's own config and
+// environment.
+var ProjectFields = []string{
+	"model", "temperature", "max_total_tokens", "max_tokens", "top_p", "frequency_penalty", "presence_penalty",
+	"stop", "seed", "logit_bias", "reasoning_effort", "stream", "print_stats", "system_message",
+	"history_ranking", "recency_weight", "compress_prompts", "collapse_repeats", "stats_format",
+	"inject_extensions", "inject_truncation", "confirm_tokens", "default_mode", "inject_globs", "ignore_globs", "personas",
+}
+
+// ApplyOverrides merges the project files found in dir or its parents and the
+// TERMINALGPT_* environment variables into config, in that order, so the
+// environment wins over the project and the project over the global config.
+// It returns the files and variables that were applied.
+func ApplyOverrides(config *Config, dir string) ([]string, error) {
+	sources := []string{}
+
+	if path, ok := findProjectFile(dir, ProjectYAMLFile); ok {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return sources, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		var project Project
+		err = yaml.Unmarshal(data, &project)
+		if err != nil {
+			return sources, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if project.SystemMessage != "" {
+			config.SystemMessage = project.SystemMessage
+		}
+		if project.Mode != "" {
+			config.DefaultMode = project.Mode
+		}
+		config.InjectGlobs = append(config.InjectGlobs, project.Inject...)
+		config.IgnoreGlobs = append(config.IgnoreGlobs, project.Ignore...)
+		sources = append(sources, path)
+	}
+
+	if path, ok := findProjectFile(dir, ProjectJSONFile); ok {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return sources, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		fields := map[string]json.RawMessage{}
+		err = json.Unmarshal(data, &fields)
+		if err != nil {
+			return sources, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		ignored := []string{}
+		for name := range fields {
+			if !isProjectField(name) {
+				delete(fields, name)
+				ignored = append(ignored, name)
+			}
+		}
+		warnIgnored(path, ignored)
+		data, err = json.Marshal(fields)
+		if err == nil {
+			err = json.Unmarshal(data, config)
+		}
+		if err != nil {
+			return sources, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		sources = append(sources, path)
+	}
+
+	if path, ok := findProjectFile(dir, ProjectEnvFile); ok {
+		values, err := readEnvFile(path)
+		if err != nil {
+			return sources, err
+		}
+		ignored := []string{}
+		for name := range values {
+			if !isProjectField(strings.ToLower(strings.TrimPrefix(name, EnvPrefix))) {
+				delete(values, name)
+				ignored = append(ignored, name)
+			}
+		}
+		warnIgnored(path, ignored)
+		_, err = applyValues(config, func(name string) (string, bool) {
+			value, ok := values[name]
+			return value, ok
+		})
+		if err != nil {
+			return sources, fmt.Errorf("%s: %w", path, err)
+		}
+		sources = append(sources, path)
+	}
+
+	names, err := applyValues(config, os.LookupEnv)
+	if err != nil {
+		return sources, fmt.Errorf("environment: %w", err)
+	}
+	if len(names) > 0 {
+		sources = append(sources, "environment ("+strings.Join(names, ", ")+")")
+	}
+	return sources, nil
+}
+
+func isProjectField(name string) bool {
+	for _, field := range ProjectFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// warnIgnored tells about the settings of a project file that were left out,
+// so a repository can't silently change them.
+func warnIgnored(path string, ignored []string) {
+	if len(ignored) == 0 {
+		return
+	}
+	sort.Strings(ignored)
+	fmt.Fprintf(os.Stderr, "Ignoring %s in %s, project files can't set them. Move them to your own config or environment.\n", strings.Join(ignored, ", "), path)
+}
+
+// findProjectFile looks for name in dir and its parents.
+func findProjectFile(dir, name string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	for {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// readEnvFile reads KEY=value lines, skipping blank lines and # comments.
+func readEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+	return values, scanner.Err()
+}
+
+// applyValues sets every config field lookup has a TERMINALGPT_* value for
+// and returns the names it used. Maps and other structured fields take JSON.
+func applyValues(config *Config, lookup func(string) (string, bool)) ([]string, error) {
+	names := []string{}
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := EnvPrefix + strings.ToUpper(tag)
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		err := setField(v.Field(i), value)
+		if err != nil {
+			return names, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return json.Unmarshal([]byte(value), field.Addr().Interface())
+	}
+	return nil
+}
+
+// SaveLastUserMessage records the last prompt in the config file without
+// writing any of the overrides applied to the running config.
+func SaveLastUserMessage(message string) error {
+	config, err := LoadConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+	config.LastUserMessage = message
+	return SaveConfig(config)
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/credentials"
+	"regexp"
+	"sort"
+)
+
+// UserProviders are the providers a user can have a key for.
+var UserProviders = []string{"gpt", "azure"}
+
+// userNamePattern keeps user names safe to use in credential names.
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// userCredential is the name the key of user for provider is stored under,
+// like openai:alice next to the default openai key.
+func userCredential(provider, user string) string {
+	if provider == "azure" {
+		return "azure:" + user
+	}
+	return "openai:" + user
+}
+
+// AddUser stores key as the key of user for provider, gpt or azure, and adds
+// user to the users of the config file. It returns where the key went.
+func AddUser(user, provider, key string) (string, error) {
+	if !userNamePattern.MatchString(user) {
+		return "", fmt.Errorf("invalid user name %q, use letters, digits, dots, dashes and underscores", user)
+	}
+	if provider != "gpt" && provider != "azure" {
+		return "", fmt.Errorf("unknown provider %q, expected gpt or azure", provider)
+	}
+	if key == "" {
+		return "", fmt.Errorf("the key is empty")
+	}
+
+	config, err := LoadConfig(ConfigFile)
+	if err != nil {
+		return "", err
+	}
+	where, err := credentials.Set(userCredential(provider, user), key)
+	if err != nil {
+		return "", fmt.Errorf("failed to store the key of %s: %w", user, err)
+	}
+	if !hasUser(&config, user) {
+		config.Users = append(config.Users, user)
+		sort.Strings(config.Users)
+		err = SaveConfig(config)
+		if err != nil {
+			return "", err
+		}
+	}
+	return where, nil
+}
+
+// RemoveUser deletes the keys of user and removes it from the config file.
+// Its recorded usage is kept.
+func RemoveUser(user string) error {
+	config, err := LoadConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+	if !hasUser(&config, user) {
+		return fmt.Errorf("no user %s, see terminalgpt users list", user)
+	}
+	for _, provider := range UserProviders {
+		err := credentials.Delete(userCredential(provider, user))
+		if err != nil {
+			return err
+		}
+	}
+	users := []string{}
+	for _, other := range config.Users {
+		if other != user {
+			users = append(users, other)
+		}
+	}
+	config.Users = users
+	if config.ActiveUser == user {
+		config.ActiveUser = ""
+	}
+	return SaveConfig(config)
+}
+
+// UserKeys returns the providers user has a key for.
+func UserKeys(user string) []string {
+	providers := []string{}
+	for _, provider := range UserProviders {
+		if _, err := credentials.Get(userCredential(provider, user)); err == nil {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+// ApplyUser switches config to the keys of its active user, picked with --as
+// or active_user, and sends the user name as the user of the requests unless
+// one is configured. Providers the user has no key for get no key, so nothing
+// is billed to the default keys by mistake.
+func ApplyUser(config *Config) error {
+	user := config.ActiveUser
+	if user == "" {
+		return nil
+	}
+	if !hasUser(config, user) {
+		return fmt.Errorf("no user %s, add it with terminalgpt users add %s", user, user)
+	}
+
+	config.AuthorizationKey, _ = credentials.Get(userCredential("gpt", user))
+	config.AzureAuthKey, _ = credentials.Get(userCredential("azure", user))
+	config.userKeys = true
+	if (config.AIProvider == "azure" && config.AzureAuthKey == "") || (config.AIProvider != "azure" && config.AuthorizationKey == "") {
+		return fmt.Errorf("%s has no %s key, add one with terminalgpt users add %s --provider %s", user, config.AIProvider, user, config.AIProvider)
+	}
+	if config.User == "" {
+		config.User = user
+	}
+	return nil
+}
+
+func hasUser(config *Config, user string) bool {
+	for _, other := range config.Users {
+		if other == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package credentials
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/pbkdf2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Service is the name the keys are stored under in the OS keychain.
+const Service = "terminalgpt"
+
+var (
+	// CredentialsFile and KeyFile are the encrypted fallback for systems
+	// without a usable keychain.
+	CredentialsFile = appdir.Path("credentials.enc")
+	KeyFile         = appdir.Path("credentials.key")
+)
+
+// PassphraseEnv is the variable the credentials file key is derived from
+// instead of KeyFile.
+const PassphraseEnv = "TERMINALGPT_PASSPHRASE"
+
+const (
+	// saltedHeader starts a file encrypted with a key derived from the
+	// passphrase, followed by the salt. Older files used an unsalted SHA-256
+	// of the passphrase and are rewritten when they are read.
+	saltedHeader = "tgpt-salted1:"
+	saltSize     = 16
+	// iterations of PBKDF2-HMAC-SHA256 for passphrases, as for the history
+	iterations = 600000
+)
+
+// derived keeps the last key derived from the passphrase, deriving one takes
+// a noticeable fraction of a second and every Get reads the file.
+var (
+	derivedMu sync.Mutex
+	derived   struct {
+		passphrase string
+		salt, key  []byte
+	}
+)
+
+// ErrNotFound is returned by Get for names that were never stored.
+var ErrNotFound = errors.New("credential not found")
+
+// Get returns the secret stored under name, from the OS keychain (macOS
+// Keychain, libsecret or Windows Credential Manager) or the encrypted file.
+func Get(name string) (string, error) {
+	secret, err := keyring.Get(Service, name)
+	if err == nil {
+		return secret, nil
+	}
+
+	secrets, fileErr := readFile()
+	if fileErr != nil {
+		return "", fileErr
+	}
+	if secret, ok := secrets[name]; ok {
+		return secret, nil
+	}
+	return "", ErrNotFound
+}
+
+// Set stores secret under name in the OS keychain, or in the encrypted file
+// when there is no keychain. It returns where the secret went.
+func Set(name, secret string) (string, error) {
+	err := keyring.Set(Service, name, secret)
+	if err == nil {
+		// don't leave an older copy behind in the fallback file
+		removeFromFile(name)
+		return "the system keychain", nil
+	}
+
+	secrets, err := readFile()
+	if err != nil {
+		return "", err
+	}
+	secrets[name] = secret
+	err = writeFile(secrets)
+	if err != nil {
+		return "", err
+	}
+	return CredentialsFile, nil
+}
+
+// Delete removes name from the keychain and the encrypted file.
+func Delete(name string) error {
+	keyErr := keyring.Delete(Service, name)
+	fileErr := removeFromFile(name)
+	if keyErr != nil && !errors.Is(keyErr, keyring.ErrNotFound) && fileErr != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, keyErr)
+	}
+	return fileErr
+}
+
+func removeFromFile(name string) error {
+	secrets, err := readFile()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return nil
+	}
+	delete(secrets, name)
+	return writeFile(secrets)
+}
+
+func readFile() (map[string]string, error) {
+	secrets := map[string]string{}
+	data, err := ioutil.ReadFile(CredentialsFile)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+
+	passphrase := os.Getenv(PassphraseEnv)
+	salted := bytes.HasPrefix(data, []byte(saltedHeader))
+	var gcm cipher.AEAD
+	switch {
+	case salted && passphrase == "":
+		return nil, fmt.Errorf("the credentials are encrypted with a passphrase, set %s", PassphraseEnv)
+	case salted:
+		data = data[len(saltedHeader):]
+		if len(data) < saltSize {
+			return nil, fmt.Errorf("failed to decrypt credentials: file is too short")
+		}
+		gcm, err = passphraseGCM(passphrase, data[:saltSize])
+		data = data[saltSize:]
+	case passphrase != "":
+		gcm, err = unsaltedGCM(passphrase)
+	default:
+		gcm, err = keyFileGCM()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("failed to decrypt credentials: file is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+	}
+
+	err = json.Unmarshal(plain, &secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+
+	if passphrase != "" && !salted {
+		err = writeFile(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move the credentials to a salted key: %w", err)
+		}
+	}
+	return secrets, nil
+}
+
+func writeFile(secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	header := []byte{}
+	var gcm cipher.AEAD
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		salt, err := passphraseSalt(passphrase)
+		if err != nil {
+			return err
+		}
+		gcm, err = passphraseGCM(passphrase, salt)
+		if err != nil {
+			return err
+		}
+		header = append([]byte(saltedHeader), salt...)
+	} else {
+		gcm, err = keyFileGCM()
+		if err != nil {
+			return err
+		}
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(CredentialsFile), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create credentials directory: %w", err)
+	}
+	return ioutil.WriteFile(CredentialsFile, gcm.Seal(append(header, nonce...), nonce, plain, nil), 0600)
+}
+
+// keyFileGCM derives the file key from a random key kept in KeyFile.
+func keyFileGCM() (cipher.AEAD, error) {
+	secret, err := ioutil.ReadFile(KeyFile)
+	if os.IsNotExist(err) {
+		secret = make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, secret)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(KeyFile), 0700)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(KeyFile, secret, 0600)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the credentials key: %w", err)
+	}
+	key := sha256.Sum256(secret)
+	return newGCM(key[:])
+}
+
+// passphraseGCM derives the file key from passphrase and salt with PBKDF2.
+func passphraseGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	derivedMu.Lock()
+	defer derivedMu.Unlock()
+	if derived.passphrase != passphrase || !bytes.Equal(derived.salt, salt) {
+		derived.passphrase = passphrase
+		derived.salt = append([]byte{}, salt...)
+		derived.key = pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+	}
+	return newGCM(derived.key)
+}
+
+// passphraseSalt returns the salt of the key last derived from passphrase,
+// so rewriting the file doesn't derive a new one, or a new salt.
+func passphraseSalt(passphrase string) ([]byte, error) {
+	derivedMu.Lock()
+	defer derivedMu.Unlock()
+	if derived.passphrase == passphrase && len(derived.salt) == saltSize {
+		return derived.salt, nil
+	}
+	salt := make([]byte, saltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	return salt, err
+}
+
+// unsaltedGCM is the key of files written by older versions, only read to
+// move them to a salted key.
+func unsaltedGCM(passphrase string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	return newGCM(key[:])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,84 @@
+package deadline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type key struct{}
+
+// tracker remembers which stage of a request is running.
+type tracker struct {
+	mu      sync.Mutex
+	stage   string
+	timeout time.Duration
+}
+
+// New returns a context that expires after timeout, or never when timeout is
+// zero, and records the stages entered with Enter for error messages.
+func New(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), key{}, &tracker{timeout: timeout})
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Enter records that the request moved on to stage, e.g. "reading files".
+func Enter(ctx context.Context, stage string) {
+	if t, ok := ctx.Value(key{}).(*tracker); ok {
+		t.mu.Lock()
+		t.stage = stage
+		t.mu.Unlock()
+	}
+}
+
+// Stage returns the stage the request is in.
+func Stage(ctx context.Context) string {
+	if t, ok := ctx.Value(key{}).(*tracker); ok {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.stage
+	}
+	return ""
+}
+
+// Run enters stage and runs fn, which can't be interrupted itself, returning
+// early when ctx expires. fn keeps running in the background in that case.
+func Run(ctx context.Context, stage string, fn func() error) error {
+	Enter(ctx, stage)
+	if err := ctx.Err(); err != nil {
+		return Wrap(ctx, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return Wrap(ctx, err)
+	case <-ctx.Done():
+		return Wrap(ctx, ctx.Err())
+	}
+}
+
+// Wrap replaces err with one naming the stage that ran out of time when ctx
+// has expired, and returns err unchanged otherwise.
+func Wrap(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	t, ok := ctx.Value(key{}).(*tracker)
+	if !ok {
+		return err
+	}
+	stage := Stage(ctx)
+	if stage == "" {
+		stage = "processing the request"
+	}
+	return fmt.Errorf("timed out after %s while %s", t.timeout, stage)
+}
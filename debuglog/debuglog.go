@@ -0,0 +1,276 @@
+package debuglog
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/appdir"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dir holds the log files, the current one is File.
+var (
+	Dir  = appdir.Path("logs")
+	File = filepath.Join(Dir, "terminalgpt.log")
+)
+
+// MaxSize is how large File grows before it is rotated to File.1, and Keep
+// how many rotated files are kept.
+const (
+	MaxSize = 5 << 20
+	Keep    = 3
+)
+
+// BodyLimit is how much of a request or response body is logged.
+const BodyLimit = 4000
+
+// Options choose what is logged.
+type Options struct {
+	// Enabled writes the log, see log_requests.
+	Enabled bool
+	// Prompts logs the prompts and answers in the bodies, which are
+	// otherwise replaced by their length, see log_prompts.
+	Prompts bool
+}
+
+var (
+	mu      sync.Mutex
+	options Options
+	verbose bool
+	size    int64 = -1
+)
+
+// Configure sets what is logged.
+func Configure(o Options) {
+	mu.Lock()
+	options = o
+	mu.Unlock()
+}
+
+// SetVerbose turns the log on for this run and echoes every entry to stderr.
+func SetVerbose() {
+	mu.Lock()
+	options.Enabled = true
+	verbose = true
+	mu.Unlock()
+}
+
+// Enabled reports whether entries are logged.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return options.Enabled
+}
+
+// Log writes an entry of event with fields as one JSON line. Secrets in the
+// string fields and in maps of them, like headers, are masked.
+func Log(event string, fields map[string]interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !options.Enabled {
+		return
+	}
+
+	entry := map[string]interface{}{}
+	for name, value := range fields {
+		switch v := value.(type) {
+		case string:
+			value = RedactSecrets(v)
+		case map[string]string:
+			redacted := map[string]string{}
+			for key, text := range v {
+				redacted[key] = RedactSecrets(text)
+			}
+			value = redacted
+		}
+		entry[name] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["event"] = event
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	if verbose {
+		color.New(color.FgHiBlack).Fprintf(os.Stderr, "[log] %s", data)
+	}
+	write(data)
+}
+
+// write appends data to File, rotating it first when it would grow over
+// MaxSize. Failures are ignored, logging never stops a request.
+func write(data []byte) {
+	if size < 0 {
+		size = 0
+		if info, err := os.Stat(File); err == nil {
+			size = info.Size()
+		}
+	}
+	if size > 0 && size+int64(len(data)) > MaxSize {
+		rotate()
+		size = 0
+	}
+
+	err := os.MkdirAll(Dir, 0700)
+	if err != nil {
+		return
+	}
+	file, err := os.OpenFile(File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	n, _ := file.Write(data)
+	size += int64(n)
+}
+
+// rotate moves File to File.1, File.1 to File.2 and so on, dropping the
+// oldest beyond Keep.
+func rotate() {
+	os.Remove(fmt.Sprintf("%s.%d", File, Keep))
+	for i := Keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", File, i), fmt.Sprintf("%s.%d", File, i+1))
+	}
+	os.Rename(File, File+".1")
+}
+
+// secrets match API keys and bearer tokens wherever they appear.
+var secrets = regexp.MustCompile(`(?i)(sk-[a-z0-9_\-]{8,}|bearer\s+[a-z0-9._\-]{8,}|"(?:api[_-]?key|authorization_key|azure_auth_key|token)"\s*:\s*"[^"]*")`)
+
+// RedactSecrets masks API keys and tokens in text.
+func RedactSecrets(text string) string {
+	return secrets.ReplaceAllStringFunc(text, func(secret string) string {
+		if name, _, ok := strings.Cut(secret, ":"); ok && strings.HasPrefix(secret, `"`) {
+			return name + `:"[redacted]"`
+		}
+		return "[redacted]"
+	})
+}
+
+// sensitiveHeaders are never logged.
+var sensitiveHeaders = map[string]bool{"authorization": true, "api-key": true, "x-api-key": true, "cookie": true, "set-cookie": true, "proxy-authorization": true}
+
+// sensitiveWords mark the names of other headers that are never logged, like
+// X-Goog-Api-Key or X-Auth-Token.
+var sensitiveWords = []string{"key", "auth", "token", "secret"}
+
+// sensitiveHeader reports whether the header called name carries credentials.
+func sensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	if sensitiveHeaders[name] {
+		return true
+	}
+	for _, word := range sensitiveWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Headers returns header as a map for an entry, with the credentials masked.
+func Headers(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		value := RedactSecrets(strings.Join(values, ", "))
+		if sensitiveHeader(name) {
+			value = "[redacted]"
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// textFields hold prompts and answers in request and response bodies.
+var textFields = map[string]bool{"content": true, "input": true, "prompt": true, "text": true, "instructions": true}
+
+// Body returns a request or response body for an entry, cut to BodyLimit.
+// Unless prompts are logged, the prompts and answers in JSON bodies and in
+// the data lines of streams are replaced by their length.
+func Body(data []byte) string {
+	mu.Lock()
+	prompts := options.Prompts
+	mu.Unlock()
+
+	body := string(data)
+	if !prompts {
+		body = redactBody(body)
+	}
+	if len(body) > BodyLimit {
+		body = body[:BodyLimit] + fmt.Sprintf("... (%d more bytes)", len(body)-BodyLimit)
+	}
+	return body
+}
+
+func redactBody(body string) string {
+	if redacted, ok := redactJSON(body); ok {
+		return redacted
+	}
+	// a stream, JSON that can't be read is left out rather than risk a prompt
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		payload, stream := strings.CutPrefix(line, "data: ")
+		if !stream && !strings.HasPrefix(strings.TrimSpace(line), "{") && !strings.HasPrefix(strings.TrimSpace(line), "[") {
+			continue
+		}
+		if redacted, ok := redactJSON(payload); ok {
+			lines[i] = strings.TrimSuffix(line, payload) + redacted
+		} else if strings.TrimSpace(payload) != "[DONE]" {
+			lines[i] = strings.TrimSuffix(line, payload) + fmt.Sprintf("[%d bytes]", len(payload))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func redactJSON(text string) (string, bool) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return "", false
+	}
+	data, err := json.Marshal(redactValue(value, false))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// redactValue replaces the strings under textFields, text tells whether value
+// is under one.
+func redactValue(value interface{}, text bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			v[name] = redactValue(field, text || textFields[name])
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item, text)
+		}
+		return v
+	case string:
+		if text && v != "" {
+			return fmt.Sprintf("[%d chars]", len(v))
+		}
+	}
+	return value
+}
+
+// Text returns a prompt or answer for an entry, only its length unless
+// prompts are logged.
+func Text(text string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	if options.Prompts {
+		return text
+	}
+	return fmt.Sprintf("[%d chars]", len(text))
+}
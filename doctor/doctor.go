@@ -0,0 +1,258 @@
+package doctor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/models"
+	"github.com/rojolang/terminalgpt/render"
+	"github.com/rojolang/terminalgpt/stats"
+	"github.com/rojolang/terminalgpt/vault"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Statuses of a check.
+const (
+	OK   = "ok"
+	Warn = "warn"
+	Fail = "fail"
+)
+
+// probe is the tiny prompt the latency is measured with.
+const probe = "Reply with the single word OK."
+
+// probeTimeout limits each latency probe.
+const probeTimeout = 30 * time.Second
+
+// Check is one line of the diagnosis.
+type Check struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// backend is a provider the config can send requests to.
+type backend struct {
+	provider string
+	cfg      *config.Config
+}
+
+// Run checks the config and the tokenizers, then the key, the model and the
+// latency of the configured provider and of every fallback. The tokenizers
+// go first so loading them does not count towards the latency.
+func Run(cfg *config.Config) []Check {
+	checks := append(checkConfig(cfg), checkTokenizers(cfg)...)
+
+	backends := []backend{{cfg.AIProvider, cfg}}
+	for _, entry := range cfg.Fallbacks {
+		provider, model, err := config.ParseBackend(entry, cfg.ModelName)
+		if err != nil {
+			continue
+		}
+		backends = append(backends, backend{provider, config.WithBackend(cfg, provider, model)})
+	}
+	for _, b := range backends {
+		if problem := missing(b); problem != "" {
+			checks = append(checks, Check{keyName(b), Fail, problem}, Check{probeName(b), Fail, "not sent, " + problem})
+			continue
+		}
+		checks = append(checks, checkKey(b), checkLatency(b))
+	}
+	return checks
+}
+
+// Failed returns the number of failed checks.
+func Failed(checks []Check) int {
+	failed := 0
+	for _, check := range checks {
+		if check.Status == Fail {
+			failed++
+		}
+	}
+	return failed
+}
+
+func checkConfig(cfg *config.Config) []Check {
+	checks := []Check{}
+
+	data, err := ioutil.ReadFile(config.ConfigFile)
+	if err != nil {
+		return append(checks, Check{"config file", Fail, err.Error()})
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var strict config.Config
+	if err := decoder.Decode(&strict); err != nil {
+		status := Fail
+		if strings.Contains(err.Error(), "unknown field") {
+			status = Warn
+		}
+		checks = append(checks, Check{"config file", status, fmt.Sprintf("%s: %v", config.ConfigFile, err)})
+	} else {
+		checks = append(checks, Check{"config file", OK, config.ConfigFile})
+	}
+	if len(cfg.Sources) > 1 {
+		checks = append(checks, Check{"config overrides", OK, strings.Join(cfg.Sources[1:], ", ")})
+	}
+
+	problems := []string{}
+	switch cfg.AIProvider {
+	case "gpt":
+		if _, err := url.ParseRequestURI(config.OpenAIURL(cfg, "")); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid base_url %q", cfg.BaseURL))
+		}
+	case "azure":
+		if cfg.AzureURL == "" {
+			problems = append(problems, "azure_url is not set")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown ai_provider %q, expected gpt or azure", cfg.AIProvider))
+	}
+	if cfg.ModelName == "" {
+		problems = append(problems, "model is not set")
+	}
+	if cfg.MaxResponseTokens >= cfg.MaxTotalTokens {
+		problems = append(problems, fmt.Sprintf("max_tokens (%d) leaves no room for the prompt in max_total_tokens (%d)", cfg.MaxResponseTokens, cfg.MaxTotalTokens))
+	}
+	if cfg.Temperature < 0 || cfg.Temperature > 2 {
+		problems = append(problems, fmt.Sprintf("temperature %.2f is outside 0 to 2", cfg.Temperature))
+	}
+	if cfg.TopP < 0 || cfg.TopP > 1 {
+		problems = append(problems, fmt.Sprintf("top_p %.2f is outside 0 to 1", cfg.TopP))
+	}
+	if cfg.ReasoningEffort != "" && !models.IsReasoningEffort(cfg.ReasoningEffort) {
+		problems = append(problems, fmt.Sprintf("unknown reasoning_effort %q, expected one of %s", cfg.ReasoningEffort, strings.Join(models.ReasoningEfforts, ", ")))
+	}
+	if !vault.IsMode(cfg.HistoryEncryption) {
+		problems = append(problems, fmt.Sprintf("unknown history_encryption %q, expected one of %s", cfg.HistoryEncryption, strings.Join(vault.Modes, ", ")))
+	}
+	for _, entry := range cfg.Fallbacks {
+		if _, _, err := config.ParseBackend(entry, cfg.ModelName); err != nil {
+			problems = append(problems, "fallbacks: "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return append(checks, Check{"settings", Fail, strings.Join(problems, "; ")})
+	}
+	return append(checks, Check{"settings", OK, fmt.Sprintf("%s %s", cfg.AIProvider, cfg.ModelName)})
+}
+
+// missing returns what the backend lacks to send a request, if anything.
+// Gateways at a base_url may not need a key.
+func missing(b backend) string {
+	switch {
+	case b.cfg.AIProvider == "azure" && b.cfg.AzureURL == "":
+		return "azure_url is not set"
+	case b.cfg.AIProvider == "azure" && b.cfg.AzureAuthKey == "":
+		return "no API key, set it with --config"
+	case b.provider == "gpt" && config.OpenAIKey(b.cfg) == "" && b.cfg.BaseURL == "":
+		return "no API key, set it with --config"
+	}
+	return ""
+}
+
+func keyName(b backend) string {
+	if b.provider == "ollama" {
+		return "ollama server"
+	}
+	return b.provider + " key"
+}
+
+func probeName(b backend) string {
+	return b.provider + " " + b.cfg.ModelName
+}
+
+// checkKey lists the provider's models, which fails with a bad key, and looks
+// for the configured model among them. Other failures to list them are only
+// warnings, some gateways have no model list.
+func checkKey(b backend) Check {
+	provider := config.ModelProvider(b.cfg)
+	names, err := models.List(provider, true)
+	if err != nil {
+		if strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "403") {
+			return Check{keyName(b), Fail, "invalid key: " + err.Error()}
+		}
+		return Check{keyName(b), Warn, err.Error()}
+	}
+	if err := models.Validate(provider, b.cfg.ModelName); err != nil {
+		return Check{keyName(b), Warn, fmt.Sprintf("valid, %d models, but %v", len(names), err)}
+	}
+	return Check{keyName(b), OK, fmt.Sprintf("valid, %s is available", b.cfg.ModelName)}
+}
+
+// checkLatency sends the probe and measures the round trip and the time to
+// the first token.
+func checkLatency(b backend) Check {
+	name := probeName(b)
+	probeCfg := *b.cfg
+	probeCfg.History = false
+	probeCfg.Cache = false
+	probeCfg.Fallbacks = nil
+	probeCfg.MaxResponseTokens = 5
+
+	ctx, cancel := deadline.New(probeTimeout)
+	defer cancel()
+	start := time.Now()
+	first := time.Time{}
+	ctx = render.WithSink(ctx, func(string) {
+		if first.IsZero() {
+			first = time.Now()
+		}
+	})
+	_, _, _, _, _, err := common.GenerateCompletionContext(ctx, &probeCfg, probe)
+	total := time.Since(start)
+	if err != nil {
+		return Check{name, Fail, err.Error()}
+	}
+	if first.IsZero() {
+		return Check{name, Warn, fmt.Sprintf("round trip %s, but no text came back", stats.Duration(total))}
+	}
+	return Check{name, OK, fmt.Sprintf("round trip %s, first token %s", stats.Duration(total), stats.Duration(first.Sub(start)))}
+}
+
+func checkTokenizers(cfg *config.Config) []Check {
+	checks := []Check{}
+	for _, encoding := range helpers.Encodings {
+		if err := helpers.ValidateEncoding(encoding); err != nil {
+			checks = append(checks, Check{"tokenizer " + encoding, Fail, fmt.Sprintf("%v (%s)", err, helpers.TokenizerSource(cfg, encoding))})
+			continue
+		}
+		checks = append(checks, Check{"tokenizer " + encoding, OK, helpers.TokenizerSource(cfg, encoding)})
+	}
+	if _, err := helpers.CountTokens(probe, cfg.ModelName); err != nil {
+		checks = append(checks, Check{"token counting", Fail, fmt.Sprintf("%s: %v", cfg.ModelName, err)})
+	}
+	return checks
+}
+
+// Print writes the checks as a table.
+func Print(w io.Writer, checks []Check) {
+	width := len("check")
+	for _, check := range checks {
+		width = max(width, len(check.Name))
+	}
+
+	bold := color.New(color.Bold)
+	bold.Fprintf(w, "%-*s  %-6s  %s\n", width, "check", "status", "detail")
+	for _, check := range checks {
+		status := fmt.Sprintf("%-6s", check.Status)
+		switch check.Status {
+		case OK:
+			status = color.GreenString(status)
+		case Warn:
+			status = color.YellowString(status)
+		case Fail:
+			status = color.RedString(status)
+		}
+		fmt.Fprintf(w, "%-*s  %s  %s\n", width, check.Name, status, check.Detail)
+	}
+}
@@ -0,0 +1,144 @@
+package duel
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"strings"
+)
+
+const userSpeaker = "you"
+
+type Options struct {
+	First  string
+	Second string
+	Topic  string
+	Rounds int
+}
+
+type turn struct {
+	speaker string
+	content string
+}
+
+var colors = map[string]color.Attribute{
+	"red":     color.FgHiRed,
+	"green":   color.FgHiGreen,
+	"yellow":  color.FgHiYellow,
+	"blue":    color.FgHiBlue,
+	"magenta": color.FgHiMagenta,
+	"cyan":    color.FgHiCyan,
+	"white":   color.FgHiWhite,
+}
+
+// Run lets two personas discuss a topic for the given number of rounds. After
+// every round but the last the user can continue, interject or stop. The
+// discussion is saved to the history like a normal conversation.
+func Run(cfg *config.Config, opts Options, reader *bufio.Reader) error {
+	for _, name := range []string{opts.First, opts.Second} {
+		if _, ok := cfg.Personas[name]; !ok {
+			return fmt.Errorf("unknown persona %q, configured personas are: %s", name, strings.Join(personaNames(cfg), ", "))
+		}
+	}
+	if opts.Rounds < 1 {
+		opts.Rounds = 1
+	}
+
+	transcript := []turn{}
+	for round := 1; round <= opts.Rounds; round++ {
+		color.New(color.FgHiBlack).Printf("\n-- round %d/%d --\n", round, opts.Rounds)
+
+		for _, speakers := range [][2]string{{opts.First, opts.Second}, {opts.Second, opts.First}} {
+			name, other := speakers[0], speakers[1]
+			persona := cfg.Personas[name]
+			color.New(colorFor(persona.Color), color.Bold).Printf("\n[%s] ", name)
+
+			personaCfg := *cfg
+			personaCfg.SystemMessage = persona.SystemMessage
+			personaCfg.History = false
+			personaCfg.Cache = false
+
+			response, _, _, _, _, err := common.GenerateCompletion(&personaCfg, prompt(name, other, opts.Topic, transcript))
+			fmt.Println()
+			if err != nil {
+				return fmt.Errorf("%s failed to answer: %w", name, err)
+			}
+			transcript = append(transcript, turn{speaker: name, content: strings.TrimSpace(response)})
+		}
+
+		if round == opts.Rounds {
+			break
+		}
+		color.New(color.FgHiMagenta).Print("\nEnter to continue, type to interject, q to stop: ")
+		input, err := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if err != nil || input == "q" {
+			break
+		}
+		if input != "" {
+			transcript = append(transcript, turn{speaker: userSpeaker, content: input})
+		}
+	}
+
+	if !cfg.History {
+		return nil
+	}
+	return save(opts, transcript)
+}
+
+// prompt gives a persona the topic and everything said so far.
+func prompt(name, other, topic string, transcript []turn) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Topic: %s\n\nYou are %s, discussing the topic with %s. The user may interject.\n", topic, name, other)
+	if len(transcript) == 0 {
+		sb.WriteString("\nOpen the discussion.")
+		return sb.String()
+	}
+
+	sb.WriteString("\nThe conversation so far:\n")
+	for _, t := range transcript {
+		fmt.Fprintf(&sb, "\n[%s]: %s\n", t.speaker, t.content)
+	}
+	fmt.Fprintf(&sb, "\nGive your next turn as %s, responding to the latest points. Do not prefix it with your name.", name)
+	return sb.String()
+}
+
+func save(opts Options, transcript []turn) error {
+	entries := []helpers.HistoryEntry{{
+		Role:    "user",
+		Content: fmt.Sprintf("Discussion between %s and %s: %s", opts.First, opts.Second, opts.Topic),
+	}}
+	for _, t := range transcript {
+		if t.speaker == userSpeaker {
+			entries = append(entries, helpers.HistoryEntry{Role: "user", Content: t.content})
+			continue
+		}
+		entries = append(entries, helpers.HistoryEntry{Role: "assistant", Content: fmt.Sprintf("[%s] %s", t.speaker, t.content)})
+	}
+
+	for _, entry := range entries {
+		err := helpers.AppendHistory(entry, config.HistoryFile)
+		if err != nil {
+			return fmt.Errorf("failed to save history: %w", err)
+		}
+	}
+	return nil
+}
+
+func colorFor(name string) color.Attribute {
+	if attribute, ok := colors[strings.ToLower(name)]; ok {
+		return attribute
+	}
+	return color.FgHiWhite
+}
+
+func personaNames(cfg *config.Config) []string {
+	names := []string{}
+	for name := range cfg.Personas {
+		names = append(names, name)
+	}
+	return names
+}
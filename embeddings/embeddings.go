@@ -0,0 +1,280 @@
+package embeddings
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/apierror"
+	"github.com/rojolang/terminalgpt/azure"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultModel = "text-embedding-3-small"
+
+	// embedding inputs are limited in size, long exchanges are cut to their beginning
+	maxInputChars = 6000
+
+	// maxCacheEntries bounds the cache, about 15 KB an entry with the default
+	// model; the entries used least recently are dropped first
+	maxCacheEntries = 2000
+)
+
+// cacheEntry is an embedding in the cache, with the last time it was used.
+type cacheEntry struct {
+	Vector []float32 `json:"vector"`
+	Used   int64     `json:"used"`
+}
+
+// Embed returns one embedding per text, using the on-disk cache for texts that
+// were embedded before with the same model.
+func Embed(cfg *config.Config, texts []string) ([][]float32, error) {
+	model := cfg.EmbeddingModel
+	if model == "" {
+		model = DefaultModel
+	}
+
+	cache, err := loadCache()
+	if err != nil {
+		log.Printf("Failed to read the embeddings cache, embedding again: %v", err)
+	}
+	now := time.Now().Unix()
+	vectors := make([][]float32, len(texts))
+	missing := []string{}
+	missingIdx := []int{}
+	// the use of an entry is written at most once a day
+	touched := false
+
+	for i, text := range texts {
+		key := cacheKey(model, text)
+		if entry, ok := cache[key]; ok {
+			vectors[i] = entry.Vector
+			if now-entry.Used > 24*60*60 {
+				cache[key] = cacheEntry{Vector: entry.Vector, Used: now}
+				touched = true
+			}
+			continue
+		}
+		missing = append(missing, text)
+		missingIdx = append(missingIdx, i)
+	}
+
+	if len(missing) == 0 {
+		if touched {
+			saveCache(cache)
+		}
+		return vectors, nil
+	}
+
+	fetched, err := Fetch(cfg, missing)
+	if err != nil {
+		return nil, err
+	}
+	if len(fetched) != len(missing) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(missing), len(fetched))
+	}
+
+	for j, i := range missingIdx {
+		vectors[i] = fetched[j]
+		cache[cacheKey(model, texts[i])] = cacheEntry{Vector: fetched[j], Used: now}
+	}
+	saveCache(cache)
+
+	return vectors, nil
+}
+
+// Fetch requests embeddings for texts without consulting or filling the
+// cache, for callers that store the vectors themselves.
+func Fetch(cfg *config.Config, texts []string) ([][]float32, error) {
+	model := cfg.EmbeddingModel
+	if model == "" {
+		model = DefaultModel
+	}
+
+	prepared := make([]string, len(texts))
+	for i, text := range texts {
+		prepared[i] = prepare(text)
+	}
+
+	if cfg.AIProvider == "azure" {
+		return azure.GetEmbeddings(cfg.AzureURL, cfg.AzureAuthKey, model, prepared, cfg.Headers["azure"])
+	}
+	return openAIEmbeddings(cfg, model, prepared)
+}
+
+// Cosine returns the cosine similarity of two vectors.
+func Cosine(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func prepare(text string) string {
+	text = strings.ReplaceAll(text, "\n", " ")
+	if len(text) > maxInputChars {
+		text = text[:maxInputChars]
+	}
+	if strings.TrimSpace(text) == "" {
+		text = " "
+	}
+	return text
+}
+
+func openAIEmbeddings(cfg *config.Config, model string, texts []string) ([][]float32, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"model": model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", config.OpenAIURL(cfg, "/embeddings"), bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	config.SetOpenAIHeaders(cfg, req)
+
+	resp, err := httpclient.APIClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request embeddings: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := apierror.Check("gpt", resp, 0); err != nil {
+		return nil, fmt.Errorf("embeddings request failed: %w", err)
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings: %w", err)
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("embeddings request failed: %s", result.Error.Message)
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range result.Data {
+		if item.Index >= 0 && item.Index < len(vectors) {
+			vectors[item.Index] = item.Embedding
+		}
+	}
+	return vectors, nil
+}
+
+func cacheKey(model, text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return model + ":" + hex.EncodeToString(sum[:])
+}
+
+// loadCache reads the cache. Caches of older versions hold bare vectors, they
+// count as unused.
+func loadCache() (map[string]cacheEntry, error) {
+	cache := make(map[string]cacheEntry)
+	data, err := ioutil.ReadFile(config.EmbeddingsCacheFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return cache, err
+	}
+
+	raw := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return cache, fmt.Errorf("failed to decode %s: %w", config.EmbeddingsCacheFile, err)
+	}
+	for key, value := range raw {
+		var entry cacheEntry
+		if bytes.HasPrefix(bytes.TrimSpace(value), []byte("[")) {
+			err = json.Unmarshal(value, &entry.Vector)
+		} else {
+			err = json.Unmarshal(value, &entry)
+		}
+		if err == nil {
+			cache[key] = entry
+		}
+	}
+	return cache, nil
+}
+
+// saveCache writes the cache, without the entries used least recently beyond
+// maxCacheEntries. Failures are reported, they only cost embedding again.
+func saveCache(cache map[string]cacheEntry) {
+	if len(cache) > maxCacheEntries {
+		keys := make([]string, 0, len(cache))
+		for key := range cache {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return cache[keys[i]].Used > cache[keys[j]].Used })
+		for _, key := range keys[maxCacheEntries:] {
+			delete(cache, key)
+		}
+	}
+
+	err := writeCache(cache)
+	if err != nil {
+		log.Printf("Failed to save the embeddings cache: %v", err)
+	}
+}
+
+// writeCache replaces the cache file through a temporary file, so a failed
+// write never leaves it cut short. Embeddings are made from the history, the
+// file is only readable by the user.
+func writeCache(cache map[string]cacheEntry) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(config.EmbeddingsCacheFile)
+	tmp, err := os.CreateTemp(dir, filepath.Base(config.EmbeddingsCacheFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), config.EmbeddingsCacheFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package envschema
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"io/ioutil"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Variable struct {
+	Name string
+	Type string
+}
+
+// IsEnvFile reports whether name refers to a dotenv file such as .env or .env.local.
+func IsEnvFile(name string) bool {
+	base := filepath.Base(strings.TrimPrefix(name, "@"))
+	return base == ".env" || strings.HasPrefix(base, ".env.") || strings.HasSuffix(base, ".env")
+}
+
+// Parse reads dotenv content and returns the variable names with the inferred
+// type of their values. The values themselves are never returned.
+func Parse(content string) []Variable {
+	variables := []Variable{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		variables = append(variables, Variable{
+			Name: strings.TrimSpace(name),
+			Type: inferType(unquote(strings.TrimSpace(value))),
+		})
+	}
+	return variables
+}
+
+// Describe renders the schema of a dotenv file with every value masked.
+func Describe(fileName, content string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "My %s file defines these variables (values are masked, only their type is shown):\n==\n", fileName)
+	for _, v := range Parse(content) {
+		fmt.Fprintf(&sb, "%s=<%s>\n", v.Name, v.Type)
+	}
+	sb.WriteString("==\n")
+	return sb.String()
+}
+
+// Inject appends the masked schema of every dotenv file mentioned in userMessage.
+func Inject(userMessage string, workingDirectory string) string {
+	seen := make(map[string]bool)
+	for _, word := range strings.Fields(userMessage) {
+		word = strings.Trim(word, "`'\",;:")
+		if !IsEnvFile(word) || seen[word] {
+			continue
+		}
+		seen[word] = true
+
+		name := strings.TrimPrefix(word, "@")
+		path := filepath.Join(workingDirectory, name)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			found, findErr := config.FindFile(name, workingDirectory)
+			if findErr != nil || found == "" {
+				fmt.Printf("Failed to find %s: %v\n", name, err)
+				continue
+			}
+			content, err = ioutil.ReadFile(found)
+			if err != nil {
+				fmt.Println("Failed to read file content: ", err)
+				continue
+			}
+		}
+
+		userMessage = userMessage + "\n\n" + Describe(name, string(content))
+	}
+	return userMessage
+}
+
+func unquote(value string) string {
+	// drop trailing comments on unquoted values
+	if !strings.HasPrefix(value, `"`) && !strings.HasPrefix(value, "'") {
+		if idx := strings.Index(value, " #"); idx >= 0 {
+			value = strings.TrimSpace(value[:idx])
+		}
+		return value
+	}
+	if len(value) >= 2 && value[0] == value[len(value)-1] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func inferType(value string) string {
+	if value == "" {
+		return "empty"
+	}
+	if _, err := strconv.ParseBool(value); err == nil {
+		return "bool"
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return "int"
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return "float"
+	}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + " url"
+	}
+	if _, err := mail.ParseAddress(value); err == nil && !strings.Contains(value, " ") {
+		return "email"
+	}
+	if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+		return "json"
+	}
+	if strings.HasPrefix(value, "/") || strings.HasPrefix(value, "./") || strings.HasPrefix(value, "~/") {
+		return "path"
+	}
+	if strings.Contains(value, ",") {
+		return "list"
+	}
+	return fmt.Sprintf("string, %d chars", len(value))
+}
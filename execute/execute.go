@@ -0,0 +1,127 @@
+package execute
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"github.com/rojolang/terminalgpt/deadline"
+	"github.com/rojolang/terminalgpt/shellsafety"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// typedConfirmation must be typed in full before a flagged command runs
+const typedConfirmation = "execute"
+
+// ShellCommands returns the shell code blocks of a response, with console
+// prompts ("$ ") stripped.
+func ShellCommands(response string) []string {
+	commands := []string{}
+	for _, block := range codeblocks.Extract(response) {
+		if !block.IsShell() {
+			continue
+		}
+		lines := strings.Split(block.Code, "\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimPrefix(line, "$ ")
+		}
+		command := strings.TrimSpace(strings.Join(lines, "\n"))
+		if command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// Offer shows the shell commands suggested in response, runs each through the
+// safety analyzer and executes the ones the user confirms. If index is > 0,
+// only that command is offered. Each command is stopped after timeout unless
+// it is zero.
+func Offer(response string, workingDirectory string, reader *bufio.Reader, index int, timeout time.Duration) error {
+	commands := ShellCommands(response)
+	if len(commands) == 0 {
+		return fmt.Errorf("the last response has no shell commands")
+	}
+	if index > len(commands) {
+		return fmt.Errorf("the last response has only %d shell commands", len(commands))
+	}
+	if index > 0 {
+		commands = commands[index-1 : index]
+	}
+
+	yellow := color.New(color.FgHiYellow)
+	for i, command := range commands {
+		yellow.Printf("\nCommand %d/%d:\n", i+1, len(commands))
+		fmt.Println(command)
+
+		findings := shellsafety.Analyze(command)
+		printFindings(findings)
+
+		if !confirm(reader, shellsafety.Flagged(findings)) {
+			fmt.Println("Skipped.")
+			continue
+		}
+
+		err := run(command, workingDirectory, timeout)
+		if err != nil {
+			color.Red("Command failed: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+func printFindings(findings []shellsafety.Finding) {
+	if len(findings) == 0 {
+		color.Green("No safety findings.")
+		return
+	}
+	for _, f := range findings {
+		label := color.New(color.FgYellow).Sprint("warning")
+		if f.Severity == shellsafety.SeverityDanger {
+			label = color.New(color.FgRed, color.Bold).Sprint("DANGER")
+		}
+		fmt.Printf("  %s [%s] %s\n", label, f.Rule, f.Message)
+	}
+}
+
+func confirm(reader *bufio.Reader, flagged bool) bool {
+	if flagged {
+		color.New(color.FgRed).Printf("This command was flagged. Type %q to run it anyway: ", typedConfirmation)
+	} else {
+		fmt.Print("Run this command? [y/N]: ")
+	}
+
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.TrimSpace(answer)
+
+	if flagged {
+		return answer == typedConfirmation
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes"
+}
+
+func run(command string, workingDirectory string, timeout time.Duration) error {
+	shell := "sh"
+	if _, err := exec.LookPath("bash"); err == nil {
+		shell = "bash"
+	}
+
+	ctx, cancel := deadline.New(timeout)
+	defer cancel()
+	deadline.Enter(ctx, "running the command")
+
+	cmd := exec.CommandContext(ctx, shell, "-c", command)
+	cmd.Dir = workingDirectory
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return deadline.Wrap(ctx, cmd.Run())
+}
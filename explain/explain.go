@@ -0,0 +1,151 @@
+package explain
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/injector"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	systemMessage = "You diagnose failed shell commands. From the command, its exit status, its output and the files I send, explain in a few sentences what went wrong and why, then give the fix: the commands to run or the code to change, as code blocks. Say so when the output is not enough to tell."
+
+	// maxOutput is how much of the end of stdout and stderr each is sent.
+	maxOutput = 6000
+
+	// maxFiles is how many of the files the output points at are sent.
+	maxFiles = 5
+)
+
+// fileLine finds the file:line references of compiler errors and stack traces.
+var fileLine = regexp.MustCompile(`([A-Za-z0-9_./\\-]+\.[A-Za-z0-9]+):\d+`)
+
+type Options struct {
+	Command          []string
+	WorkingDirectory string
+	// Files adds the files the output points at to the request.
+	Files bool
+}
+
+// Run runs the command with the terminal's stdin and output, and when it
+// fails asks the model why, with the command's exit status, the end of its
+// output and the files it points at. It returns the exit status.
+func Run(cfg *config.Config, opts Options) (int, error) {
+	stdout := &tail{limit: maxOutput}
+	stderr := &tail{limit: maxOutput}
+	cmd := exec.Command(opts.Command[0], opts.Command[1:]...)
+	cmd.Dir = opts.WorkingDirectory
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	err := cmd.Run()
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, fmt.Errorf("failed to run %s: %w", opts.Command[0], err)
+	}
+	code := exitErr.ExitCode()
+
+	color.New(color.FgHiBlack).Printf("\n%s exited with status %d, asking %s why...\n", opts.Command[0], code, cfg.ModelName)
+
+	// explanations are one-off requests, they should neither read nor pollute history
+	runCfg := *cfg
+	runCfg.History = false
+	runCfg.SystemMessage = systemMessage
+
+	prompt := Prompt(opts.Command, code, stdout.String(), stderr.String())
+	if files := mentionedFiles(stdout.String()+"\n"+stderr.String(), opts.WorkingDirectory); opts.Files && len(files) > 0 {
+		prompt += "\nThe output points at these files:\n"
+		for _, file := range files {
+			prompt += "- " + file + "\n"
+		}
+		prompt, _ = injector.Inject(prompt, opts.WorkingDirectory, injector.ForMode(&runCfg, ""))
+	}
+
+	_, _, _, _, _, err = common.GenerateCompletion(&runCfg, prompt)
+	fmt.Println()
+	return code, err
+}
+
+// Prompt describes a failed run of command.
+func Prompt(command []string, code int, stdout, stderr string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "This command failed with exit status %d:\n\n```sh\n%s\n```\n", code, quote(command))
+	if text := strings.TrimSpace(stderr); text != "" {
+		fmt.Fprintf(&sb, "\nstderr:\n\n```\n%s\n```\n", text)
+	}
+	if text := strings.TrimSpace(stdout); text != "" {
+		fmt.Fprintf(&sb, "\nstdout:\n\n```\n%s\n```\n", text)
+	}
+	return sb.String()
+}
+
+// quote joins command into a line a shell reads back the same way.
+func quote(command []string) string {
+	words := make([]string, len(command))
+	for i, word := range command {
+		if word == "" || strings.ContainsAny(word, " \t\n'\"\\$`*?[]{}()<>|&;#~") {
+			word = "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+		}
+		words[i] = word
+	}
+	return strings.Join(words, " ")
+}
+
+// mentionedFiles returns the files inside dir that text points at, relative
+// to dir.
+func mentionedFiles(text, dir string) []string {
+	files := []string{}
+	seen := map[string]bool{}
+	for _, match := range fileLine.FindAllStringSubmatch(text, -1) {
+		if len(files) >= maxFiles {
+			break
+		}
+		path := filepath.FromSlash(match[1])
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || strings.HasPrefix(rel, "..") || seen[rel] {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		seen[rel] = true
+		files = append(files, filepath.ToSlash(rel))
+	}
+	return files
+}
+
+// tail keeps the last limit bytes written to it.
+type tail struct {
+	data  []byte
+	limit int
+	cut   bool
+}
+
+func (t *tail) Write(p []byte) (int, error) {
+	t.data = append(t.data, p...)
+	if len(t.data) > t.limit {
+		t.data = append([]byte{}, t.data[len(t.data)-t.limit:]...)
+		t.cut = true
+	}
+	return len(p), nil
+}
+
+func (t *tail) String() string {
+	if t.cut {
+		return "...\n" + string(t.data)
+	}
+	return string(t.data)
+}
@@ -0,0 +1,156 @@
+package explain
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/truncate"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const paneSystemMessage = "You explain terminal sessions. I send the end of a terminal's scrollback. Find the last command and its output. When it failed, explain in a few sentences what went wrong and why, then give the fix: the commands to run or the code to change, as code blocks. Otherwise explain briefly what the output means. Say so when the scrollback is not enough to tell."
+
+const (
+	// DefaultPaneLines is how much scrollback is captured.
+	DefaultPaneLines = 2000
+
+	// DefaultPaneTokens is the most tokens of scrollback sent.
+	DefaultPaneTokens = 4000
+)
+
+type PaneOptions struct {
+	// Target is the tmux pane to capture, like %3 or {last}, the current
+	// pane when empty.
+	Target string
+	// Lines is how many lines of scrollback are captured.
+	Lines int
+	// Tokens is the most tokens of scrollback sent, the end is kept.
+	Tokens int
+	// Question is asked instead of explaining the last error or output.
+	Question string
+}
+
+// Pane captures the scrollback of the current tmux pane or screen window and
+// asks the model to explain the last error or command output in it.
+func Pane(cfg *config.Config, opts PaneOptions) error {
+	scrollback, source, err := capture(opts.Target, opts.Lines)
+	if err != nil {
+		return err
+	}
+	// the current pane ends with the command that runs us
+	if opts.Target == "" {
+		scrollback = dropInvocation(scrollback)
+	}
+	if strings.TrimSpace(scrollback) == "" {
+		return fmt.Errorf("the %s is empty", source)
+	}
+
+	runCfg := *cfg
+	runCfg.History = false
+	runCfg.SystemMessage = paneSystemMessage
+
+	question := opts.Question
+	if question == "" {
+		question = "Explain the last error or command output."
+	}
+	count := truncate.Counter(runCfg.ModelName)
+	budget := runCfg.MaxTotalTokens - runCfg.MaxResponseTokens - count(runCfg.SystemMessage) - count(question) - 20
+	if opts.Tokens > 0 && opts.Tokens < budget {
+		budget = opts.Tokens
+	}
+	if budget <= 0 {
+		return fmt.Errorf("max_total_tokens leaves no room for the scrollback")
+	}
+	captured := strings.Count(scrollback, "\n") + 1
+	scrollback, omitted := truncate.HeadTail(scrollback, budget, 0, runCfg.ModelName)
+
+	gray := color.New(color.FgHiBlack)
+	gray.Printf("Captured %d lines of the %s", captured, source)
+	if omitted > 0 {
+		gray.Printf(", sending the last %d", captured-omitted)
+	}
+	gray.Printf(", asking %s...\n", runCfg.ModelName)
+
+	prompt := fmt.Sprintf("%s\n\nThe end of my terminal:\n\n```\n%s\n```\n", question, scrollback)
+	_, _, _, _, _, err = common.GenerateCompletion(&runCfg, prompt)
+	fmt.Println()
+	return err
+}
+
+// capture returns the last lines of scrollback of the tmux pane target, or
+// of the current tmux pane or screen window, and what it captured.
+func capture(target string, lines int) (string, string, error) {
+	if lines <= 0 {
+		lines = DefaultPaneLines
+	}
+	if os.Getenv("TMUX") != "" || target != "" {
+		args := []string{"capture-pane", "-p", "-J", "-S", "-" + strconv.Itoa(lines)}
+		if target != "" {
+			args = append(args, "-t", target)
+		}
+		out, err := exec.Command("tmux", args...).Output()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to capture the tmux pane: %w", commandError(err))
+		}
+		return string(out), "tmux pane", nil
+	}
+	if os.Getenv("STY") != "" {
+		text, err := captureScreen(lines)
+		return text, "screen window", err
+	}
+	return "", "", fmt.Errorf("not inside tmux or screen, run it in a tmux pane or screen window or pick a pane with --target")
+}
+
+// captureScreen has screen write the scrollback of the current window to a
+// file, which it does after the command returns.
+func captureScreen(lines int) (string, error) {
+	dir, err := os.MkdirTemp("", "terminalgpt-screen")
+	if err != nil {
+		return "", fmt.Errorf("failed to create a temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hardcopy")
+
+	err = exec.Command("screen", "-X", "hardcopy", "-h", file).Run()
+	if err != nil {
+		return "", fmt.Errorf("failed to capture the screen window: %w", commandError(err))
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		data, err := os.ReadFile(file)
+		if err == nil && len(data) > 0 {
+			all := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+			if len(all) > lines {
+				all = all[len(all)-lines:]
+			}
+			return strings.Join(all, "\n"), nil
+		}
+	}
+	return "", fmt.Errorf("screen did not write the scrollback")
+}
+
+// dropInvocation removes the trailing blank lines and the prompt line with
+// the explain-pane command from the end of scrollback.
+func dropInvocation(scrollback string) string {
+	lines := strings.Split(strings.TrimRight(scrollback, " \n"), "\n")
+	// the prompt may span a few lines, but not many
+	for i := len(lines) - 1; i >= 0 && i >= len(lines)-3; i-- {
+		if strings.Contains(lines[i], "explain-pane") {
+			return strings.TrimRight(strings.Join(lines[:i], "\n"), " \n")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// commandError adds what the command wrote to stderr to err.
+func commandError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
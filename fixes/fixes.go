@@ -0,0 +1,171 @@
+package fixes
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"strings"
+)
+
+// Formats are the values accepted by --format.
+var Formats = []string{"fixes", "rdjson", "sarif"}
+
+// Instructions is appended to the system message so the model answers with
+// fixes in the format Parse understands.
+const Instructions = `
+
+Answer only with a JSON object and nothing else, in this form:
+{"fixes": [{"file": "path/of/the/file.go", "line": 12, "end_line": 14, "severity": "error|warning|info", "message": "what is wrong and why", "replacement": "the corrected text of lines line..end_line, omit when there is no concrete fix"}]}
+Count lines from 1 in the files as given. Use an empty list when there is nothing to fix.`
+
+// Fix is one suggestion about a range of lines in a file.
+type Fix struct {
+	File        string  `json:"file"`
+	Line        int     `json:"line"`
+	EndLine     int     `json:"end_line,omitempty"`
+	Severity    string  `json:"severity"`
+	Message     string  `json:"message"`
+	Replacement *string `json:"replacement,omitempty"`
+}
+
+// IsFormat reports whether format is one of Formats.
+func IsFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse reads the fixes from a response, from a JSON code block if it has one.
+func Parse(response string) ([]Fix, error) {
+	text := strings.TrimSpace(response)
+	for _, block := range codeblocks.Extract(response) {
+		if (block.Lang == "json" || block.Lang == "") && strings.TrimSpace(block.Code) != "" {
+			text = block.Code
+			break
+		}
+	}
+	if start, end := strings.Index(text, "{"), strings.LastIndex(text, "}"); start >= 0 && end > start {
+		text = text[start : end+1]
+	}
+
+	var result struct {
+		Fixes []Fix `json:"fixes"`
+	}
+	err := json.Unmarshal([]byte(text), &result)
+	if err != nil {
+		return nil, fmt.Errorf("the response is not a list of fixes: %w", err)
+	}
+
+	for i := range result.Fixes {
+		fix := &result.Fixes[i]
+		if fix.Line < 1 {
+			fix.Line = 1
+		}
+		if fix.EndLine < fix.Line {
+			fix.EndLine = fix.Line
+		}
+		fix.Severity = strings.ToLower(fix.Severity)
+		if fix.Severity != "error" && fix.Severity != "info" {
+			fix.Severity = "warning"
+		}
+	}
+	return result.Fixes, nil
+}
+
+// Format renders fixes as plain JSON ("fixes"), reviewdog's rdjson or SARIF 2.1.0.
+func Format(fixes []Fix, format string) ([]byte, error) {
+	switch format {
+	case "fixes":
+		return json.MarshalIndent(map[string]interface{}{"fixes": fixes}, "", "  ")
+	case "rdjson":
+		return json.MarshalIndent(rdjson(fixes), "", "  ")
+	case "sarif":
+		return json.MarshalIndent(sarif(fixes), "", "  ")
+	}
+	return nil, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+func rdjson(fixes []Fix) map[string]interface{} {
+	diagnostics := []map[string]interface{}{}
+	for _, fix := range fixes {
+		lineRange := map[string]interface{}{
+			"start": map[string]int{"line": fix.Line},
+			// rdjson ranges end before the end position, so the end is the next line
+			"end": map[string]int{"line": fix.EndLine + 1},
+		}
+		diagnostic := map[string]interface{}{
+			"message":  fix.Message,
+			"location": map[string]interface{}{"path": fix.File, "range": lineRange},
+			"severity": strings.ToUpper(fix.Severity),
+		}
+		if fix.Replacement != nil {
+			diagnostic["suggestions"] = []map[string]interface{}{{"range": lineRange, "text": withNewline(*fix.Replacement)}}
+		}
+		diagnostics = append(diagnostics, diagnostic)
+	}
+
+	return map[string]interface{}{
+		"source":      map[string]string{"name": "terminalgpt", "url": "https://github.com/rojolang/terminalgpt"},
+		"diagnostics": diagnostics,
+	}
+}
+
+func sarif(fixes []Fix) map[string]interface{} {
+	levels := map[string]string{"error": "error", "warning": "warning", "info": "note"}
+
+	results := []map[string]interface{}{}
+	for _, fix := range fixes {
+		artifact := map[string]string{"uri": fix.File}
+		region := map[string]int{"startLine": fix.Line, "endLine": fix.EndLine}
+		result := map[string]interface{}{
+			"ruleId":  "terminalgpt-review",
+			"level":   levels[fix.Severity],
+			"message": map[string]string{"text": fix.Message},
+			"locations": []map[string]interface{}{{
+				"physicalLocation": map[string]interface{}{"artifactLocation": artifact, "region": region},
+			}},
+		}
+		if fix.Replacement != nil {
+			result["fixes"] = []map[string]interface{}{{
+				"description": map[string]string{"text": fix.Message},
+				"artifactChanges": []map[string]interface{}{{
+					"artifactLocation": artifact,
+					"replacements": []map[string]interface{}{{
+						"deletedRegion":   region,
+						"insertedContent": map[string]string{"text": withNewline(*fix.Replacement)},
+					}},
+				}},
+			}}
+		}
+		results = append(results, result)
+	}
+
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []map[string]interface{}{{
+			"tool": map[string]interface{}{
+				"driver": map[string]interface{}{
+					"name":           "terminalgpt",
+					"informationUri": "https://github.com/rojolang/terminalgpt",
+					"rules": []map[string]interface{}{{
+						"id":               "terminalgpt-review",
+						"shortDescription": map[string]string{"text": "Model code review finding"},
+					}},
+				},
+			},
+			"results": results,
+		}},
+	}
+}
+
+// withNewline ends replacements of whole lines with a newline.
+func withNewline(text string) string {
+	if text == "" || strings.HasSuffix(text, "\n") {
+		return text
+	}
+	return text + "\n"
+}
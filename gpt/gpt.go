@@ -3,22 +3,35 @@ package gpt
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/apierror"
 	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/deadline"
 	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/models"
+	"github.com/rojolang/terminalgpt/ratelimit"
+	"github.com/rojolang/terminalgpt/relevance"
+	"github.com/rojolang/terminalgpt/render"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 )
 
+// Doer sends requests, like *http.Client.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
 type GPT struct {
 	cfg     *config.Config
 	history []helpers.HistoryEntry
+	// pinned is sent with every request, see helpers.Pin
+	pinned []helpers.HistoryEntry
+	client Doer
 }
 
 func (g *GPT) GetHistory() []helpers.HistoryEntry {
@@ -26,98 +39,175 @@ func (g *GPT) GetHistory() []helpers.HistoryEntry {
 }
 
 func New(cfg *config.Config) (*GPT, error) {
+	return NewWithClient(cfg, httpclient.APIClient())
+}
+
+// NewWithClient is New sending the requests with client, e.g. one answering
+// from a fake server in tests.
+func NewWithClient(cfg *config.Config, client Doer) (*GPT, error) {
 	history, err := helpers.LoadHistory(config.HistoryFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load history: %w", err)
 	}
+	history = helpers.WithoutExchange(history, cfg.Replacing)
+	pinned := []helpers.HistoryEntry{}
+	if cfg.History {
+		pinned, err = helpers.PinnedEntries(config.HistoryFile)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &GPT{
 		cfg:     cfg,
 		history: history,
+		pinned:  pinned,
+		client:  client,
 	}, nil
 }
 
-func (g *GPT) CreatePayload(userMessage string) (string, int, int, error) {
-	history := []helpers.HistoryEntry{
-		{
-			Role:    "system",
-			Content: g.cfg.SystemMessage,
-		},
-		{
-			Role:    "user",
-			Content: userMessage,
-		},
+// CreatePayload builds the request body for userMessage with as much of the
+// history as fits, and returns it with the tokens of the user message, the
+// system message and the history it includes.
+func (g *GPT) CreatePayload(userMessage string) (string, int, int, int, error) {
+	systemEntry := helpers.HistoryEntry{
+		Role:    "system",
+		Content: g.cfg.SystemMessage,
+	}
+	userEntry := helpers.HistoryEntry{
+		Role:    "user",
+		Content: userMessage,
 	}
 
 	userMessageTokens, err := helpers.CountTokens(userMessage, g.cfg.ModelName)
 	if err != nil {
-		return "", 0, 0, err
+		return "", 0, 0, 0, err
 	}
 
 	systemMessageTokens, err := helpers.CountTokens(g.cfg.SystemMessage, g.cfg.ModelName)
 	if err != nil {
-		return "", 0, 0, err
+		return "", 0, 0, 0, err
 	}
 
-	totalRequestTokens := userMessageTokens + systemMessageTokens
+	// budget with the chat format overhead, not just the content tokens
+	totalRequestTokens, err := helpers.CountMessageTokens([]helpers.HistoryEntry{systemEntry, userEntry}, g.cfg.ModelName)
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
 
 	if totalRequestTokens > (g.cfg.MaxTotalTokens - g.cfg.MaxResponseTokens) {
-		return "", 0, 0, fmt.Errorf("Request token count (%d) exceeds the maximum total token count (%d - %d = %d)", totalRequestTokens, g.cfg.MaxTotalTokens, g.cfg.MaxResponseTokens, (g.cfg.MaxTotalTokens - g.cfg.MaxResponseTokens))
+		return "", 0, 0, 0, fmt.Errorf("Request token count (%d) exceeds the maximum total token count (%d - %d = %d)", totalRequestTokens, g.cfg.MaxTotalTokens, g.cfg.MaxResponseTokens, (g.cfg.MaxTotalTokens - g.cfg.MaxResponseTokens))
 	}
 
+	context := []helpers.HistoryEntry{}
+	historyTokens := 0
 	if g.cfg.History {
-		for i := len(g.history) - 1; i >= 0; i-- {
-			historyTokens, err := helpers.CountTokens(g.history[i].Content, g.cfg.ModelName)
+		// the pins go first and always, the history fills the rest
+		pinnedTokens, err := helpers.CountEntriesTokens(g.pinned, g.cfg.ModelName)
+		if err != nil {
+			return "", 0, 0, 0, err
+		}
+		for _, entryTokens := range pinnedTokens {
+			totalRequestTokens += entryTokens
+			historyTokens += entryTokens
+		}
+		if totalRequestTokens > (g.cfg.MaxTotalTokens - g.cfg.MaxResponseTokens) {
+			return "", 0, 0, 0, fmt.Errorf("Request token count with the pins (%d) exceeds the maximum total token count (%d - %d = %d), unpin some with --pins remove <id>", totalRequestTokens, g.cfg.MaxTotalTokens, g.cfg.MaxResponseTokens, (g.cfg.MaxTotalTokens - g.cfg.MaxResponseTokens))
+		}
+		candidates := helpers.WithoutPinned(g.history, g.pinned)
+
+		ranked := false
+		if g.cfg.HistoryRanking {
+			selected, err := relevance.Select(g.cfg, candidates, userMessage, g.cfg.MaxTotalTokens-g.cfg.MaxResponseTokens-totalRequestTokens)
 			if err != nil {
-				return "", 0, 0, err
+				log.Printf("Failed to rank history by relevance, using the most recent messages: %v", err)
+			} else {
+				context = selected
+				ranked = true
+				selectedTokens, err := helpers.CountEntriesTokens(selected, g.cfg.ModelName)
+				if err != nil {
+					return "", 0, 0, 0, err
+				}
+				for _, tokens := range selectedTokens {
+					historyTokens += tokens
+				}
 			}
+		}
 
-			if totalRequestTokens+historyTokens <= g.cfg.MaxTotalTokens-g.cfg.MaxResponseTokens {
-				totalRequestTokens += historyTokens
-				history = append([]helpers.HistoryEntry{g.history[i]}, history...)
-			} else {
-				break
+		if !ranked {
+			// one count for all the candidates, not a request per entry
+			candidateTokens, err := helpers.CountEntriesTokens(candidates, g.cfg.ModelName)
+			if err != nil {
+				return "", 0, 0, 0, err
+			}
+			for i := len(candidates) - 1; i >= 0; i-- {
+				entryTokens := candidateTokens[i]
+				if totalRequestTokens+entryTokens <= g.cfg.MaxTotalTokens-g.cfg.MaxResponseTokens {
+					totalRequestTokens += entryTokens
+					historyTokens += entryTokens
+					context = append([]helpers.HistoryEntry{candidates[i]}, context...)
+				} else {
+					break
+				}
 			}
 		}
+		context = append(append([]helpers.HistoryEntry{}, g.pinned...), context...)
+	}
+
+	history := append([]helpers.HistoryEntry{systemEntry}, context...)
+	history = append(history, userEntry)
+
+	// only role and content, the other fields are for the history file
+	messages := make([]config.Message, 0, len(history))
+	for _, entry := range history {
+		messages = append(messages, config.Message{Role: entry.Role, Content: entry.Content})
 	}
 
-	historyJSON, err := json.Marshal(history)
+	body := map[string]interface{}{
+		"model":    g.cfg.ModelName,
+		"messages": messages,
+		"stream":   g.cfg.Stream,
+	}
+	if models.IsReasoning(g.cfg.ModelName) {
+		// reasoning models reject the sampling parameters, and their limit
+		// covers the hidden reasoning as well as the answer
+		body["max_completion_tokens"] = g.cfg.MaxResponseTokens
+	} else {
+		body["temperature"] = g.cfg.Temperature
+		body["max_tokens"] = g.cfg.MaxResponseTokens
+		body["top_p"] = g.cfg.TopP
+		body["frequency_penalty"] = g.cfg.FrequencyPenalty
+		body["presence_penalty"] = g.cfg.PresencePenalty
+	}
+	// the token counts of the answer come with the last event
+	if g.cfg.Stream {
+		body["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	data, err := json.Marshal(body)
 	if err != nil {
-		return "", 0, 0, err
+		return "", 0, 0, 0, err
 	}
+	payload := string(data)
 
-	payload := fmt.Sprintf(`{
-		"model": "%s",
-		"messages": %s,
-		"temperature": %f,
-		"max_tokens": %d,
-		"top_p": %f,
-		"frequency_penalty": %f,
-		"presence_penalty": %f,
-		"stream": %t
-	}`, g.cfg.ModelName, historyJSON, g.cfg.Temperature, g.cfg.MaxResponseTokens, g.cfg.TopP, g.cfg.FrequencyPenalty, g.cfg.PresencePenalty, g.cfg.Stream)
+	if extra := config.RequestFields(g.cfg, g.cfg.AIProvider); len(extra) > 0 {
+		merged, err := helpers.MergeJSON([]byte(payload), extra)
+		if err != nil {
+			return "", 0, 0, 0, fmt.Errorf("failed to add request fields: %w", err)
+		}
+		payload = string(merged)
+	}
 
-	return payload, userMessageTokens, systemMessageTokens, nil
+	return payload, userMessageTokens, systemMessageTokens, historyTokens, nil
 }
 
-func (g *GPT) HandleResponse(resp *http.Response, startTime time.Time, totalRequestTokens int, userMessageTokens int, systemMessageTokens int) (string, int, int, int, int, error) {
+// HandleResponse streams the answer in resp to the terminal and returns it
+// with its tokens.
+func (g *GPT) HandleResponse(resp *http.Response) (string, int, error) {
 	defer resp.Body.Close()
 	reader := bufio.NewReader(resp.Body)
-	assistantMsg := ""
-	totalResponseTokens := 0
-	isFirstChunk := true
-	boldBlue := color.New(color.FgBlue, color.Bold).SprintFunc()
-	blue := color.New(color.FgBlue).SprintFunc()
-
-	max := func(a, b int) int {
-		if a > b {
-			return a
-		}
-		return b
-	}
-
-	promptLabel := "Prompt:"
-	responseLabel := "Response:"
-	maxLabelLength := max(len(promptLabel), len(responseLabel))
+	var assistantMsg strings.Builder
+	var usage *config.Usage
+	out := render.New(resp.Request.Context())
+	defer out.Close()
 
 	for {
 		line, err := reader.ReadString('\n')
@@ -126,7 +216,7 @@ func (g *GPT) HandleResponse(resp *http.Response, startTime time.Time, totalRequ
 				break
 			}
 			log.Printf("Error reading response line: %v", err)
-			return "", 0, 0, 0, 0, err
+			return "", 0, err
 		}
 		if strings.HasPrefix(line, "data: ") {
 			jsonData := line[6:]
@@ -137,59 +227,146 @@ func (g *GPT) HandleResponse(resp *http.Response, startTime time.Time, totalRequ
 			err = json.Unmarshal([]byte(jsonData), &event)
 			if err != nil {
 				log.Printf("Error unmarshalling event: %v", err)
-				return "", 0, 0, 0, 0, fmt.Errorf("Failed to unmarshal event: %v", err)
+				return "", 0, fmt.Errorf("Failed to unmarshal event: %v", err)
 			}
-
-			responseTokens, err := helpers.CountTokens(event.Choices[0].Delta.Content, g.cfg.ModelName)
-			if err != nil {
-				return "", 0, 0, 0, 0, err
+			if event.Usage != nil {
+				usage = event.Usage
+				helpers.SetReasoningTokens(usage.CompletionTokensDetails.ReasoningTokens)
 			}
-
-			totalResponseTokens += responseTokens
-
-			if isFirstChunk {
-				fmt.Printf("\n%-*s ", maxLabelLength, boldBlue(responseLabel))
-				isFirstChunk = false
+			if len(event.Choices) == 0 {
+				continue
 			}
 
-			// Apply tabbing to each chunk
-			tabbedChunk := strings.ReplaceAll(event.Choices[0].Delta.Content, "\n", "\n\t")
+			if event.Choices[0].FinishReason != "" {
+				helpers.SetFinishReason(event.Choices[0].FinishReason)
+			}
 
-			fmt.Print(blue(tabbedChunk))
-			assistantMsg += tabbedChunk
+			// the API streams about a token per chunk, which is close enough
+			// for the live count until the usage at the end has the real one
+			text := event.Choices[0].Delta.Content
+			tokens := 0
+			if text != "" {
+				tokens = 1
+			}
+			out.Write(text, tokens)
+			assistantMsg.WriteString(text)
 		}
 	}
 
-	return assistantMsg, totalResponseTokens, userMessageTokens, systemMessageTokens, totalRequestTokens + totalResponseTokens, nil
-}
+	// completion_tokens includes the hidden reasoning, the answer does not
+	if usage != nil && usage.CompletionTokens > 0 {
+		return assistantMsg.String(), usage.CompletionTokens - usage.CompletionTokensDetails.ReasoningTokens, nil
+	}
 
-func (g *GPT) GenerateCompletion(userMessage string) (string, int, int, int, int, error) {
-	startTime := time.Now()
+	// providers that ignore stream_options are counted locally, once
+	responseTokens, err := helpers.CountTokens(assistantMsg.String(), g.cfg.ModelName)
+	if err != nil {
+		return "", 0, err
+	}
+	return assistantMsg.String(), responseTokens, nil
+}
 
-	payload, userMessageTokens, systemMessageTokens, err := g.CreatePayload(userMessage)
+// GenerateCompletion streams the answer to userMessage and returns it with the
+// tokens of the user message, the system message, the response and the
+// history sent along, in the order of azure.GenerateCompletion.
+func (g *GPT) GenerateCompletion(ctx context.Context, userMessage string) (string, int, int, int, int, error) {
+	deadline.Enter(ctx, "building the request")
+	payload, userMessageTokens, systemMessageTokens, historyTokens, err := g.CreatePayload(userMessage)
 	if err != nil {
 		return "", 0, 0, 0, 0, err
 	}
 
-	totalRequestTokens := userMessageTokens + systemMessageTokens
+	totalRequestTokens := userMessageTokens + systemMessageTokens + historyTokens
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer([]byte(payload)))
+	req, err := http.NewRequestWithContext(ctx, "POST", config.OpenAIURL(g.cfg, "/chat/completions"), bytes.NewBuffer([]byte(payload)))
 	if err != nil {
 		return "", 0, 0, 0, 0, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_SECRET_KEY"))
+	config.SetOpenAIHeaders(g.cfg, req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	deadline.Enter(ctx, "waiting for the provider to answer")
+	resp, err := g.client.Do(req)
 	if err != nil {
 		return "", 0, 0, 0, 0, fmt.Errorf("Failed to send HTTP request: %v", err)
 	}
+	ratelimit.Record("gpt", resp.Header)
+	if err := apierror.Check("gpt", resp, totalRequestTokens); err != nil {
+		resp.Body.Close()
+		return "", 0, 0, 0, 0, err
+	}
 
-	response, responseTokens, userMessageTokens, systemMessageTokens, totalTokens, err := g.HandleResponse(resp, startTime, totalRequestTokens, userMessageTokens, systemMessageTokens)
+	deadline.Enter(ctx, "streaming the response")
+
+	response, responseTokens, err := g.HandleResponse(resp)
 	if err != nil {
 		return "", 0, 0, 0, 0, fmt.Errorf("Failed to handle response: %v", err)
 	}
 
-	return response, responseTokens, userMessageTokens, systemMessageTokens, totalTokens, nil
+	return response, userMessageTokens, systemMessageTokens, responseTokens, historyTokens, nil
+}
+
+// GenerateVariants requests n alternative completions for userMessage in a
+// single non-streamed request and returns their contents with the tokens of
+// the prompt, which is billed once for all of them.
+func (g *GPT) GenerateVariants(ctx context.Context, userMessage string, n int) ([]string, int, error) {
+	deadline.Enter(ctx, "building the request")
+	payload, userMessageTokens, systemMessageTokens, historyTokens, err := g.CreatePayload(userMessage)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body := map[string]interface{}{}
+	err = json.Unmarshal([]byte(payload), &body)
+	if err != nil {
+		return nil, 0, err
+	}
+	body["n"] = n
+	body["stream"] = false
+	delete(body, "stream_options")
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.OpenAIURL(g.cfg, "/chat/completions"), bytes.NewBuffer(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	config.SetOpenAIHeaders(g.cfg, req)
+
+	deadline.Enter(ctx, "waiting for the provider to answer")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to send HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+	ratelimit.Record("gpt", resp.Header)
+	if err := apierror.Check("gpt", resp, 0); err != nil {
+		return nil, 0, err
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message config.Message `json:"message"`
+		} `json:"choices"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&completion)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to decode response: %v", err)
+	}
+	if completion.Error != nil {
+		return nil, 0, fmt.Errorf("API error: %s", completion.Error.Message)
+	}
+
+	variants := []string{}
+	for _, choice := range completion.Choices {
+		variants = append(variants, choice.Message.Content)
+	}
+	return variants, userMessageTokens + systemMessageTokens + historyTokens, nil
 }
@@ -0,0 +1,113 @@
+package gpt
+
+import (
+	"context"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/mockapi"
+	"github.com/rojolang/terminalgpt/render"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestGPT(t *testing.T, server *mockapi.Server) *GPT {
+	t.Helper()
+	historyFile := config.HistoryFile
+	config.HistoryFile = filepath.Join(t.TempDir(), "history.jsonl")
+	t.Cleanup(func() { config.HistoryFile = historyFile })
+
+	cfg := &config.Config{
+		AIProvider:        "gpt",
+		BaseURL:           server.BaseURL(),
+		AuthorizationKey:  "test-key",
+		ModelName:         "gpt-4o",
+		SystemMessage:     "You are terse.",
+		MaxTotalTokens:    4000,
+		MaxResponseTokens: 500,
+		Temperature:       0.5,
+		TopP:              1,
+		Stream:            true,
+	}
+	g, err := NewWithClient(cfg, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// quiet keeps the streamed answer off the test output.
+func quiet() (context.Context, *strings.Builder) {
+	var shown strings.Builder
+	return render.WithSink(context.Background(), func(text string) { shown.WriteString(text) }), &shown
+}
+
+func TestGenerateCompletionStreams(t *testing.T) {
+	server := mockapi.New("Use tar --zstd to unpack it.")
+	defer server.Close()
+	g := newTestGPT(t, server)
+
+	ctx, shown := quiet()
+	response, userTokens, systemTokens, responseTokens, _, err := g.GenerateCompletion(ctx, "How do I unpack a .tar.zst file?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "Use tar --zstd to unpack it." {
+		t.Errorf("got response %q", response)
+	}
+	if shown.String() != response {
+		t.Errorf("streamed %q, want the response", shown.String())
+	}
+	if userTokens == 0 || systemTokens == 0 || responseTokens == 0 {
+		t.Errorf("got %d user, %d system and %d response tokens, want them counted", userTokens, systemTokens, responseTokens)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	body := requests[0].Body
+	if body["model"] != "gpt-4o" || body["stream"] != true {
+		t.Errorf("got model %v and stream %v", body["model"], body["stream"])
+	}
+	messages, _ := body["messages"].([]interface{})
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want the system message and the prompt", len(messages))
+	}
+	if last, _ := messages[1].(map[string]interface{}); last["role"] != "user" || last["content"] != "How do I unpack a .tar.zst file?" {
+		t.Errorf("got last message %v", last)
+	}
+}
+
+func TestGenerateCompletionAPIError(t *testing.T) {
+	server := mockapi.New()
+	defer server.Close()
+	server.Fail(401, "Incorrect API key provided")
+	g := newTestGPT(t, server)
+
+	ctx, _ := quiet()
+	_, _, _, _, _, err := g.GenerateCompletion(ctx, "hello")
+	if err == nil || !strings.Contains(err.Error(), "Incorrect API key provided") {
+		t.Errorf("got error %v, want the API's message", err)
+	}
+}
+
+func TestGenerateVariants(t *testing.T) {
+	server := mockapi.New("first", "second", "third")
+	defer server.Close()
+	g := newTestGPT(t, server)
+
+	variants, promptTokens, err := g.GenerateVariants(context.Background(), "hello", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(variants, ",") != "first,second,third" {
+		t.Errorf("got variants %q", variants)
+	}
+	if promptTokens == 0 {
+		t.Error("got no prompt tokens")
+	}
+	body := server.Requests()[0].Body
+	if body["n"] != float64(3) || body["stream"] != false {
+		t.Errorf("got n %v and stream %v", body["n"], body["stream"])
+	}
+}
@@ -0,0 +1,130 @@
+package helpers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/rojolang/terminalgpt/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encodings are the tokenizer encodings shipped with the binary.
+var Encodings = []string{tiktoken.MODEL_CL100K_BASE, tiktoken.MODEL_O200K_BASE, tiktoken.MODEL_P50K_BASE, tiktoken.MODEL_R50K_BASE}
+
+// bpeLoader reads tokenizer files from the configured directory when they are
+// there, and otherwise uses the copies embedded in the binary, so counting
+// tokens never needs the network.
+type bpeLoader struct {
+	dir string
+}
+
+var embeddedBpe = tiktoken_loader.NewOfflineLoader()
+
+func init() {
+	tiktoken.SetBpeLoader(&bpeLoader{})
+}
+
+// SetTokenizerDir makes the tokenizer prefer .tiktoken files in cfg.TokenizerDir
+// over the embedded ones.
+func SetTokenizerDir(cfg *config.Config) {
+	tiktoken.SetBpeLoader(&bpeLoader{dir: cfg.TokenizerDir})
+	resetEncodings()
+}
+
+func (l *bpeLoader) LoadTiktokenBpe(tiktokenBpeFile string) (map[string]int, error) {
+	if l.dir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(l.dir, path.Base(tiktokenBpeFile)))
+		if err == nil {
+			return parseBpe(data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return embeddedBpe.LoadTiktokenBpe(tiktokenBpeFile)
+}
+
+// ValidateEncoding loads an encoding and checks that it round-trips a sample.
+func ValidateEncoding(encoding string) error {
+	tkm, err := getEncoding(encoding)
+	if err != nil {
+		return err
+	}
+	sample := "func main() { fmt.Println(\"héllo, wörld 👋\") }"
+	if decoded := tkm.Decode(tkm.Encode(sample, nil, nil)); decoded != sample {
+		return fmt.Errorf("decoding the sample returned %q", decoded)
+	}
+	return nil
+}
+
+// TokenizerSource returns where the given encoding is loaded from.
+func TokenizerSource(cfg *config.Config, encoding string) string {
+	if cfg.TokenizerDir != "" {
+		file := filepath.Join(cfg.TokenizerDir, encoding+".tiktoken")
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return "embedded"
+}
+
+// ExportTokenizers writes the embedded tokenizer files to dir, e.g. to seed
+// a tokenizer_dir on another machine.
+func ExportTokenizers(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, encoding := range Encodings {
+		ranks, err := embeddedBpe.LoadTiktokenBpe(encoding + ".tiktoken")
+		if err != nil {
+			return fmt.Errorf("failed to load embedded %s: %w", encoding, err)
+		}
+		tokens := make([]string, 0, len(ranks))
+		for token := range ranks {
+			tokens = append(tokens, token)
+		}
+		sort.Slice(tokens, func(i, j int) bool { return ranks[tokens[i]] < ranks[tokens[j]] })
+
+		var sb strings.Builder
+		for _, token := range tokens {
+			sb.WriteString(base64.StdEncoding.EncodeToString([]byte(token)) + " " + strconv.Itoa(ranks[token]) + "\n")
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, encoding+".tiktoken"), []byte(sb.String()), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBpe parses a .tiktoken file: one base64 encoded token and its rank per line.
+func parseBpe(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed tokenizer line %d", i+1)
+		}
+		token, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed token on line %d: %w", i+1, err)
+		}
+		rank, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed rank on line %d: %w", i+1, err)
+		}
+		ranks[string(token)] = rank
+	}
+	return ranks, nil
+}
@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/progress"
+	"strings"
+)
+
+// MinRepeatedLines is the number of non-blank lines an answer has to repeat
+// from the previous one in a row before they are collapsed.
+const MinRepeatedLines = 8
+
+var (
+	// lines of the previous answer, see CollapseRepeats
+	previousLines map[string]bool
+
+	partialLine   string
+	repeatedLines []string
+	repeatedCount int
+	render        func(string) string
+)
+
+// CollapseRepeats makes PrintChunk hide runs of lines the next response copies
+// from previous, such as license headers or unchanged code echoed back. The
+// response is printed line by line until FlushChunks; only the terminal output
+// is affected, the full text still reaches the history and --output.
+func CollapseRepeats(previous string) {
+	previousLines = nil
+	if strings.TrimSpace(previous) == "" {
+		return
+	}
+	previousLines = make(map[string]bool)
+	for _, line := range strings.Split(previous, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			previousLines[line] = true
+		}
+	}
+}
+
+// PrintChunk prints a piece of response text to the terminal, formatted by
+// format.
+func PrintChunk(text string, format func(string) string) {
+	if previousLines == nil {
+		progress.Print(format(text))
+		return
+	}
+
+	render = format
+	partialLine += text
+	for {
+		end := strings.Index(partialLine, "\n")
+		if end < 0 {
+			return
+		}
+		printLine(partialLine[:end+1])
+		partialLine = partialLine[end+1:]
+	}
+}
+
+// FlushChunks prints what PrintChunk still holds back at the end of a
+// response.
+func FlushChunks() {
+	if previousLines == nil {
+		return
+	}
+	if partialLine != "" {
+		printLine(partialLine)
+		partialLine = ""
+	}
+	flushRepeated()
+	previousLines = nil
+}
+
+func printLine(line string) {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	// code fences stay visible so the structure of the answer is kept
+	case trimmed != "" && previousLines[trimmed] && !strings.HasPrefix(trimmed, "```"):
+		repeatedLines = append(repeatedLines, line)
+		repeatedCount++
+	case trimmed == "" && len(repeatedLines) > 0:
+		// blank lines do not end a run
+		repeatedLines = append(repeatedLines, line)
+	default:
+		flushRepeated()
+		progress.Print(render(line))
+	}
+}
+
+// flushRepeated prints the held back run of repeated lines, or a marker in
+// their place when the run is long enough.
+func flushRepeated() {
+	if repeatedCount >= MinRepeatedLines {
+		progress.Print(color.New(color.FgHiBlack).Sprintf("[%d lines repeated from the previous answer, --expand shows them]", len(repeatedLines)))
+		progress.Print(render("\n"))
+	} else {
+		for _, line := range repeatedLines {
+			progress.Print(render(line))
+		}
+	}
+	repeatedLines = nil
+	repeatedCount = 0
+}
@@ -0,0 +1,91 @@
+package helpers
+
+import (
+	"github.com/fatih/color"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// charsPerToken maps model name prefixes to the average characters per token
+// of their tokenizers on English text and code, for estimates without a
+// tokenizer. The longest matching prefix wins.
+var charsPerToken = map[string]float64{
+	"gpt-3.5":    4.0,
+	"gpt-35":     4.0,
+	"gpt-4":      4.0,
+	"gpt-4o":     4.2,
+	"gpt-4.1":    4.2,
+	"gpt-4.5":    4.2,
+	"gpt-5":      4.2,
+	"chatgpt-4o": 4.2,
+	"o1":         4.2,
+	"o3":         4.2,
+	"o4":         4.2,
+	"claude":     3.5,
+	"gemini":     4.0,
+	"llama":      3.8,
+	"mistral":    3.6,
+	"mixtral":    3.6,
+	"qwen":       3.8,
+	"deepseek":   3.8,
+}
+
+const defaultCharsPerToken = 4.0
+
+var (
+	// estimateErr is why token counts are estimated, see Estimating
+	estimateErr error
+	estimateMu  sync.Mutex
+)
+
+// EstimateTokens estimates the tokens of text without a tokenizer: ASCII
+// characters by the average length of a token of modelName's family, every
+// other character as a token of its own, which fits CJK text and emoji
+// better than their byte length.
+func EstimateTokens(text string, modelName string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 128 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(math.Ceil(float64(ascii)/charsPerTokenFor(modelName))) + other
+}
+
+func charsPerTokenFor(modelName string) float64 {
+	name := strings.ToLower(modelName)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	best, chars := "", defaultCharsPerToken
+	for prefix, value := range charsPerToken {
+		if strings.HasPrefix(name, prefix) && len(prefix) > len(best) {
+			best, chars = prefix, value
+		}
+	}
+	return chars
+}
+
+// Estimating returns why token counts are estimates instead of exact counts,
+// nil while the tokenizers load.
+func Estimating() error {
+	estimateMu.Lock()
+	defer estimateMu.Unlock()
+	return estimateErr
+}
+
+// noteEstimate records that a count was estimated because of err, and says so
+// once per run.
+func noteEstimate(err error) {
+	estimateMu.Lock()
+	defer estimateMu.Unlock()
+	if estimateErr != nil {
+		return
+	}
+	estimateErr = err
+	color.New(color.FgYellow).Fprintf(os.Stderr, "Token counts are estimates, the tokenizer failed to load: %v\n", err)
+}
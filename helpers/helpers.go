@@ -3,117 +3,94 @@ package helpers
 import (
 	"encoding/json"
 	"flag"
-	"fmt"
 	"github.com/fatih/color"
-	"github.com/pkoukk/tiktoken-go"
 	"github.com/rojolang/terminalgpt/config"
-	"io/ioutil"
+	"github.com/rojolang/terminalgpt/debuglog"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/vault"
 	"os"
-	"strings"
+	"time"
 )
 
-type HistoryEntry struct {
-	Role       string `json:"role"`
-	Content    string `json:"content"`
-	TokenCount int    `json:"tokenCount"`
-}
-
-func AppendHistory(entry HistoryEntry, historyFile string) error {
-	entry.TokenCount, _ = CountTokens(entry.Content, "gpt-4")
-
-	history, err := LoadHistory(historyFile)
-	if err != nil {
-		return err
-	}
-
-	history = append(history, entry)
-
-	file, err := os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	historyJSON, err := json.Marshal(history)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal history: %v", err)
-	}
-
-	_, err = file.Write(historyJSON)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func ClearHistory(historyFile string) error {
-	err := os.Remove(historyFile)
-	if err != nil {
-		return fmt.Errorf("Failed to clear history: %v", err)
-	}
-	return nil
-}
-
-func GetHistoryLength(history []map[string]string, modelName string) (int, int, error) {
-	tokenSize := 0
-	entries := len(history)
-
-	if entries == 0 {
-		return tokenSize, entries, nil
-	}
-
-	for _, message := range history {
-		tokens, err := CountTokens(message["content"], modelName)
-		if err != nil {
-			return 0, 0, err
-		}
-		tokenSize += tokens
-	}
-
-	return tokenSize, entries, nil
-}
-
-func LoadHistory(historyFile string) ([]HistoryEntry, error) {
-	file, err := os.Open(historyFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []HistoryEntry{}, nil
-		}
-		return nil, err
-	}
-	defer file.Close()
-
-	history := []HistoryEntry{}
-	err = json.NewDecoder(file).Decode(&history)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to decode history: %v", err)
-	}
-
-	return history, nil
-}
-
-func CountTokens(text string, modelName string) (int, error) {
-	tkm, err := tiktoken.EncodingForModel("gpt-4")
-	if err != nil {
-		return 0, fmt.Errorf("EncodingForModel: %v", err)
-	}
-	return len(tkm.Encode(text, nil, nil)), nil
+type Flags struct {
+	Config           *bool
+	Clear            *bool
+	RunMode          *string
+	WorkingDirectory *string
+	Template         *string
+	EnvSchema        *bool
+	Session          *string
+	Timeout          *time.Duration
+	Prune            *bool
+	DryRun           *bool
+	Yes              *bool
+	Version          *bool
+	Popup            *string
+	Regen            *bool
+	Diff             *bool
+	RegenTemperature *float64
+	NoCache          *bool
+	KB               *string
+	Paste            *bool
+	Output           *string
+	Format           *string
+	Append           *bool
+	KBTopK           *int
+	Color            *string
+	Speak            *string
+	Schema           *string
+	Compare          *string
+	Verbose          *bool
+	As               *string
+	ListSessions     *bool
+	Args             []string
 }
 
 // New functions...
-func HandleFlags() (*bool, *bool, *string, *string) {
-	configFlag := flag.Bool("config", false, "Configure settings")
-	clearFlag := flag.Bool("clear", false, "Clear history")
-	runMode := flag.String("mode", "", "What mode to run in. (Default or empty: your config.json SystemMessage)")
-	workingDirectory := flag.String("dir", "", "What directory to run in. (Default or empty: current directory)")
+func HandleFlags() Flags {
+	flags := Flags{
+		Config:           flag.Bool("config", false, "Configure settings"),
+		Clear:            flag.Bool("clear", false, "Clear history"),
+		RunMode:          flag.String("mode", "", "What mode to run in, one of the modes in your config.json. (Default or empty: your config.json SystemMessage)"),
+		WorkingDirectory: flag.String("dir", "", "What directory to run in. (Default or empty: current directory)"),
+		Template:         flag.String("template", "", "Prompt template to send first, followed by key=value variables. (e.g. --template review file=main.go)"),
+		Popup:            flag.String("popup", "", "Show responses in a tmux or kitty popup instead of inline. (Default or empty: your config.json popup)"),
+		Regen:            flag.Bool("regen", false, "Re-send the last prompt, replacing its answer in history"),
+		RegenTemperature: flag.Float64("regen-temperature", -1, "Temperature to use with --regen. (Default: your config.json temperature)"),
+		Diff:             flag.Bool("diff", false, "After a regenerated response, show a word-level diff against the previous one"),
+		NoCache:          flag.Bool("no-cache", false, "Always call the API, even when response caching is enabled"),
+		Format:           flag.String("format", "", "Ask for review findings and print them as fixes (JSON), rdjson (reviewdog) or sarif"),
+		Output:           flag.String("output", "", "Also write the raw text of every response to this file as it streams"),
+		Append:           flag.Bool("append", false, "Append to the --output file instead of overwriting it"),
+		Paste:            flag.Bool("paste", false, "Include the clipboard content in the first prompt"),
+		KB:               flag.String("kb", "", "Knowledge base to retrieve relevant excerpts from for every prompt (see `terminalgpt kb`)"),
+		KBTopK:           flag.Int("kb-top-k", 5, "Number of knowledge base excerpts to inject with --kb"),
+		Session:          flag.String("session", "", "Conversation to continue, \"global\" for the shared history. (Default: derived from the directory and git branch when auto_session is on)"),
+		Timeout:          flag.Duration("timeout", 0, "Give up on a request, or a command run with --exec, after this long, e.g. 120s. (Default: no limit)"),
+		Prune:            flag.Bool("prune", false, "Apply the history retention policies to every session now and exit"),
+		DryRun:           flag.Bool("dry-run", false, "Show the messages, tokens, cost and JSON payload of each request instead of sending it. With --prune, only report what would be removed"),
+		Yes:              flag.Bool("yes", false, "Send requests over confirm_tokens without asking"),
+		Version:          flag.Bool("version", false, "Print the version, commit and build date and exit"),
+		Color:            flag.String("color", "auto", "Color the output: always, never, or auto to only color terminals without NO_COLOR set"),
+		Speak:            flag.String("speak", "", "Save every response read out loud as mp3 audio to this file, see speak in --config to play them instead"),
+		Schema:           flag.String("schema", "", "Answer with JSON matching this JSON schema file, validated and retried, printing only the JSON"),
+		Compare:          flag.String("compare", "", "Ask these comma separated models at once and compare their answers, latency, tokens and cost, e.g. gpt-4o,azure:gpt-4,ollama:llama3"),
+		Verbose:          flag.Bool("verbose", false, "Log the requests, timings and token counts of this run to the logs folder and show them on stderr"),
+		EnvSchema:        flag.Bool("env-schema", false, "Inject mentioned .env files as variable names and types only, with every value masked"),
+		ListSessions:     flag.Bool("list-sessions", false, "List the conversations by title, most recent first, and exit"),
+		As:               flag.String("as", "", "Use the API keys of this user, added with terminalgpt users add, and record the usage for them. (Default: your config.json active_user)"),
+	}
 
 	flag.Parse()
+	flags.Args = flag.Args()
 
-	return configFlag, clearFlag, runMode, workingDirectory
+	return flags
 }
 
-func LoadConfig(configFlag *bool) *config.Config {
+// LoadConfig loads the global config with the project files of
+// workingDirectory (the current directory when empty) and the TERMINALGPT_*
+// environment variables applied on top.
+func LoadConfig(configFlag *bool, workingDirectory string) *config.Config {
 	_, err := os.Stat(config.ConfigFile)
 	if os.IsNotExist(err) || *configFlag {
 		err := config.InteractiveConfigure()
@@ -134,13 +111,41 @@ func LoadConfig(configFlag *bool) *config.Config {
 		}
 	}
 
+	if workingDirectory == "" {
+		workingDirectory, _ = os.Getwd()
+	}
+	sources, err := config.ApplyOverrides(&cfg, workingDirectory)
+	if err != nil {
+		color.Red("Failed to apply config overrides: %v\n", err)
+		os.Exit(1)
+	}
+	cfg.Sources = append([]string{config.ConfigFile}, sources...)
+
+	err = config.ApplyUser(&cfg)
+	if err != nil {
+		color.Red("%v\n", err)
+		os.Exit(1)
+	}
+
+	err = httpclient.Configure(config.HTTPOptions(&cfg))
+	if err != nil {
+		color.Red("Failed to set up the connection settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	debuglog.Configure(debuglog.Options{Enabled: cfg.LogRequests, Prompts: cfg.LogPrompts})
+	SetHistoryLimits(&cfg)
+	vault.Configure(cfg.HistoryEncryption)
+	SetTokenCounter(&cfg)
+	SetTokenizerDir(&cfg)
+
 	return &cfg
 }
 
 func HandleRunMode(runMode *string, workingDirectory *string, cfg *config.Config) {
 	// if runMode is set, use that instead of the config.SystemMessage
 	if *runMode != "" {
-		cfg.SystemMessage = config.GetRunModeSystemMessage(*runMode, *workingDirectory)
+		cfg.SystemMessage = config.GetRunModeSystemMessage(cfg, *runMode, *workingDirectory)
 	}
 }
 
@@ -154,86 +159,31 @@ func HandleClearFlag(clearFlag *bool) {
 	}
 }
 
-func GetHistory(historyFile string) ([]HistoryEntry, error) {
-	history, err := LoadHistory(historyFile)
+// MergeJSON merges fields into the JSON object body. Nested objects are merged
+// key by key, null removes the field and any other value in fields replaces
+// the one in body.
+func MergeJSON(body []byte, fields map[string]interface{}) ([]byte, error) {
+	object := map[string]interface{}{}
+	err := json.Unmarshal(body, &object)
 	if err != nil {
 		return nil, err
 	}
-	return history, nil
+	mergeObjects(object, fields)
+	return json.Marshal(object)
 }
 
-func HandleLaravelMode(userMessage string, workingDirectory string) string {
-	// Split userMessage into array of strings
-	userMessageArray := strings.Split(userMessage, " ")
-
-	// build a dictionary/mapping of filename => filecontent
-	fileContentMap := make(map[string]string)
-
-	// loop through userMessageArray and find any *.php files
-	for _, potentialFileName := range userMessageArray {
-		if strings.HasSuffix(potentialFileName, ".php") {
-
-			codeFilePath, err := config.FindFile(potentialFileName, workingDirectory)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-
-			// read file content
-			fileContent, err := ioutil.ReadFile(codeFilePath)
-			if err != nil {
-				fmt.Println("Failed to read file content: ", err)
-				continue
-			}
-
-			// add file content to fileContentMap
-			fileContentMap[potentialFileName] = string(fileContent)
+func mergeObjects(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
 		}
-	}
-
-	// loop through fileContentMap and append file content to userMessage
-	for filePath, fileContent := range fileContentMap {
-		// append file content with a prefix of "my current {filename} is: "
-		userMessage = userMessage + "\n\nMy  " + filePath + " file is:\n==\n" + fileContent + "\n==\n"
-	}
-
-	return userMessage
-}
-
-func HandleGoMode(userMessage string, workingDirectory string) string {
-	// Split userMessage into array of strings
-	userMessageArray := strings.Split(userMessage, " ")
-
-	// build a dictionary/mapping of filename => filecontent
-	fileContentMap := make(map[string]string)
-
-	// loop through userMessageArray and find any *.php files
-	for _, potentialFileName := range userMessageArray {
-		if strings.HasSuffix(potentialFileName, ".go") {
-
-			codeFilePath, err := config.FindFile(potentialFileName, workingDirectory)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-
-			// read file content
-			fileContent, err := ioutil.ReadFile(codeFilePath)
-			if err != nil {
-				fmt.Println("Failed to read file content: ", err)
-				continue
-			}
-
-			// add file content to fileContentMap
-			fileContentMap[potentialFileName] = string(fileContent)
+		srcObject, srcIsObject := value.(map[string]interface{})
+		dstObject, dstIsObject := dst[key].(map[string]interface{})
+		if srcIsObject && dstIsObject {
+			mergeObjects(dstObject, srcObject)
+			continue
 		}
+		dst[key] = value
 	}
-
-	// loop through fileContentMap and append file content to userMessage
-	for filePath, fileContent := range fileContentMap {
-		// append file content with a prefix of "my current {filename} is: "
-		userMessage = userMessage + "\n\nMy  " + filePath + " file is:\n==\n" + fileContent + "\n==\n"
-	}
-
-	return userMessage
 }
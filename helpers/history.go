@@ -0,0 +1,592 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/trash"
+	"github.com/rojolang/terminalgpt/vault"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultHistoryMaxEntries = 1000
+	DefaultHistoryMaxBytes   = 5 * 1024 * 1024
+
+	// number of rotated archives (history.jsonl.1 ... .3) that are kept
+	historyArchives = 3
+
+	// a single history line may hold a large injected file
+	maxHistoryLineBytes = 16 * 1024 * 1024
+)
+
+var (
+	historyMaxEntries = DefaultHistoryMaxEntries
+	historyMaxBytes   = int64(DefaultHistoryMaxBytes)
+)
+
+type HistoryEntry struct {
+	Role       string `json:"role"`
+	Content    string `json:"content"`
+	TokenCount int    `json:"tokenCount"`
+	// Prompt is the prompt as typed when Content is what was made of it, with
+	// pasted text, injected files and the like, so it can be asked again
+	Prompt string `json:"prompt,omitempty"`
+	// Unix time the entry was added, zero for entries from older versions
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// SetHistoryLimits applies the configured rotation limits and retention
+// policies. Zero means the default rotation limit, a negative value disables
+// that limit.
+func SetHistoryLimits(cfg *config.Config) {
+	historyMaxEntries = cfg.HistoryMaxEntries
+	if historyMaxEntries == 0 {
+		historyMaxEntries = DefaultHistoryMaxEntries
+	}
+	historyMaxBytes = cfg.HistoryMaxBytes
+	if historyMaxBytes == 0 {
+		historyMaxBytes = DefaultHistoryMaxBytes
+	}
+	retentionAge = time.Duration(cfg.HistoryKeepDays) * 24 * time.Hour
+	retentionEntries = cfg.HistoryKeepEntries
+	retentionTokens = cfg.HistoryKeepTokens
+}
+
+// AppendHistory appends one JSON line to the history file and rotates it when
+// it grows past the configured limits. Entries without a token count are
+// counted.
+func AppendHistory(entry HistoryEntry, historyFile string) error {
+	if entry.TokenCount == 0 {
+		entry.TokenCount, _ = CountTokens(entry.Content, "gpt-4")
+	}
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+
+	err := migrateHistory(historyFile)
+	if err != nil {
+		return err
+	}
+
+	line, err := marshalEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(historyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// most appends prune nothing, so the history is only decoded when due
+	if RetentionEnabled() {
+		due, err := pruneDue(historyFile)
+		if err != nil {
+			return err
+		}
+		if due {
+			_, err = pruneHistory(historyFile, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return rotateHistory(historyFile)
+}
+
+// lockHistory waits for the advisory lock of the history file, shared unless
+// exclusive, so instances running at the same time don't change it under each
+// other. The lock is held on a separate file since the history file is
+// replaced when it is rewritten. The returned function releases it.
+func lockHistory(historyFile string, exclusive bool) (func(), error) {
+	err := os.MkdirAll(filepath.Dir(historyFile), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock history: %w", err)
+	}
+	file, err := os.OpenFile(historyFile+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock history: %w", err)
+	}
+	err = lockFile(file, exclusive)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock history: %w", err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// ReadHistory streams the entries of the history file to fn, oldest first,
+// without loading the whole file into memory.
+func ReadHistory(historyFile string, fn func(HistoryEntry) error) error {
+	err := migrateHistory(historyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(historyFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	unlock, err := lockHistory(historyFile, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return readHistory(historyFile, fn)
+}
+
+// readHistory is ReadHistory for callers holding the lock.
+func readHistory(historyFile string, fn func(HistoryEntry) error) error {
+	file, err := os.Open(historyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxHistoryLineBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		line, err := vault.Open(line)
+		if err != nil {
+			return err
+		}
+		var entry HistoryEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return fmt.Errorf("Failed to decode history: %v", err)
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func LoadHistory(historyFile string) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+	err := ReadHistory(historyFile, func(entry HistoryEntry) error {
+		history = append(history, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// loadHistory is LoadHistory for callers holding the lock.
+func loadHistory(historyFile string) ([]HistoryEntry, error) {
+	history := []HistoryEntry{}
+	err := readHistory(historyFile, func(entry HistoryEntry) error {
+		history = append(history, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func GetHistory(historyFile string) ([]HistoryEntry, error) {
+	history, err := LoadHistory(historyFile)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// SaveHistory replaces the history file with the given entries.
+func SaveHistory(history []HistoryEntry, historyFile string) error {
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeHistory(history, historyFile)
+}
+
+// writeHistory replaces the history file for callers holding the lock. The
+// entries are written to a temporary file that is renamed over it, so readers
+// never see a partly written history.
+func writeHistory(history []HistoryEntry, historyFile string) error {
+	var buf bytes.Buffer
+	for _, entry := range history {
+		line, err := marshalEntry(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(historyFile), filepath.Base(historyFile)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), historyFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	return nil
+}
+
+// marshalEntry returns the history line of entry, encrypted when
+// history_encryption is on.
+func marshalEntry(entry HistoryEntry) ([]byte, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal history: %v", err)
+	}
+	return vault.Seal(line)
+}
+
+// RewriteHistory rewrites the history file with every entry encrypted, or in
+// plain text when encrypt is false, and returns how many entries changed.
+func RewriteHistory(historyFile string, encrypt bool) (int, error) {
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	return vault.RewriteFile(historyFile, encrypt)
+}
+
+// RemoveLastExchange drops the last user/assistant pair from the history file.
+func RemoveLastExchange(historyFile string) error {
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	history, err := loadHistory(historyFile)
+	if err != nil {
+		return err
+	}
+
+	if len(history) < 2 || history[len(history)-1].Role != "assistant" || history[len(history)-2].Role != "user" {
+		return fmt.Errorf("no exchange to remove from history")
+	}
+
+	err = trashExchange(history[len(history)-2:], historyFile)
+	if err != nil {
+		return err
+	}
+	return writeHistory(history[:len(history)-2], historyFile)
+}
+
+// IsLastExchange reports whether the history file ends with an answer to
+// userMessage.
+func IsLastExchange(historyFile, userMessage string) bool {
+	history, err := LoadHistory(historyFile)
+	return err == nil && endsWithExchange(history, userMessage)
+}
+
+// WithoutExchange returns history without its last exchange when that answers
+// userMessage, the context of a prompt that is asked again.
+func WithoutExchange(history []HistoryEntry, userMessage string) []HistoryEntry {
+	if userMessage != "" && endsWithExchange(history, userMessage) {
+		return history[:len(history)-2]
+	}
+	return history
+}
+
+// ReplaceExchange removes the previous answer to userMessage once the new one
+// was saved after it. The old exchange goes to the trash.
+func ReplaceExchange(historyFile, userMessage string) error {
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	history, err := loadHistory(historyFile)
+	if err != nil {
+		return err
+	}
+	n := len(history)
+	if n < 4 || history[n-1].Role != "assistant" || !endsWithExchange(history[:n-2], userMessage) {
+		return nil
+	}
+
+	err = trashExchange(history[n-4:n-2], historyFile)
+	if err != nil {
+		return err
+	}
+	kept := append(append([]HistoryEntry{}, history[:n-4]...), history[n-2:]...)
+	return writeHistory(kept, historyFile)
+}
+
+func endsWithExchange(history []HistoryEntry, userMessage string) bool {
+	n := len(history)
+	if n < 2 || history[n-1].Role != "assistant" || history[n-2].Role != "user" {
+		return false
+	}
+	if history[n-2].Prompt != "" {
+		return history[n-2].Prompt == userMessage
+	}
+	return history[n-2].Content == userMessage
+}
+
+// trashExchange keeps a removed exchange in the trash so it can be appended
+// back.
+func trashExchange(exchange []HistoryEntry, historyFile string) error {
+	var removed bytes.Buffer
+	for _, entry := range exchange {
+		line, err := marshalEntry(entry)
+		if err != nil {
+			return err
+		}
+		removed.Write(line)
+		removed.WriteByte('\n')
+	}
+	// the description is plain text, so it leaves out the prompt of an
+	// encrypted history
+	description := "removed exchange"
+	if !vault.Enabled() {
+		description += ": " + summarize(exchange[0].Content)
+	}
+	_, err := trash.Keep(removed.Bytes(), historyFile, description)
+	if err != nil {
+		return fmt.Errorf("failed to move the exchange to the trash: %w", err)
+	}
+	return nil
+}
+
+// LastAssistantMessage returns the most recent assistant reply in the history file.
+func LastAssistantMessage(historyFile string) string {
+	last := ""
+	ReadHistory(historyFile, func(entry HistoryEntry) error {
+		if entry.Role == "assistant" {
+			last = entry.Content
+		}
+		return nil
+	})
+	return last
+}
+
+// ClearHistory moves the history file to the trash.
+func ClearHistory(historyFile string) error {
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	id, err := trash.Move(historyFile, "cleared history")
+	if err != nil {
+		return fmt.Errorf("Failed to clear history: %v", err)
+	}
+	fmt.Printf("History moved to the trash, restore it with `terminalgpt trash restore %s`\n", id)
+	return nil
+}
+
+// summarize shortens a message to its first line for descriptions.
+func summarize(content string) string {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(content), "\n", 2)[0])
+	if runes := []rune(line); len(runes) > 60 {
+		line = string(runes[:57]) + "..."
+	}
+	return line
+}
+
+func GetHistoryLength(history []map[string]string, modelName string) (int, int, error) {
+	tokenSize := 0
+	entries := len(history)
+
+	if entries == 0 {
+		return tokenSize, entries, nil
+	}
+
+	for _, message := range history {
+		tokens, err := CountTokens(message["content"], modelName)
+		if err != nil {
+			return 0, 0, err
+		}
+		tokenSize += tokens
+	}
+
+	return tokenSize, entries, nil
+}
+
+// migrateHistory converts a history file written in the old single JSON
+// array format, or the old history.json next to it, into JSON lines.
+func migrateHistory(historyFile string) error {
+	if !legacyHistory(historyFile) {
+		return nil
+	}
+	unlock, err := lockHistory(historyFile, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// another instance may have migrated it while we waited
+	if !legacyHistory(historyFile) {
+		return nil
+	}
+
+	if _, err := os.Stat(historyFile); os.IsNotExist(err) {
+		legacyFile := strings.TrimSuffix(historyFile, ".jsonl") + ".json"
+		err = convertLegacyHistory(legacyFile, historyFile)
+		if err != nil {
+			return err
+		}
+		return os.Rename(legacyFile, legacyFile+".migrated")
+	}
+	return convertLegacyHistory(historyFile, historyFile)
+}
+
+// legacyHistory reports whether the history file is in the old format, or
+// missing with an old history.json next to it.
+func legacyHistory(historyFile string) bool {
+	if _, err := os.Stat(historyFile); os.IsNotExist(err) {
+		legacyFile := strings.TrimSuffix(historyFile, ".jsonl") + ".json"
+		if legacyFile == historyFile {
+			return false
+		}
+		_, err := os.Stat(legacyFile)
+		return err == nil
+	}
+
+	file, err := os.Open(historyFile)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	first := make([]byte, 1)
+	for {
+		_, err = file.Read(first)
+		if err != nil || !isSpace(first[0]) {
+			break
+		}
+	}
+	return err == nil && first[0] == '['
+}
+
+func convertLegacyHistory(legacyFile, historyFile string) error {
+	data, err := ioutil.ReadFile(legacyFile)
+	if err != nil {
+		return err
+	}
+
+	history := []HistoryEntry{}
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &history)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate history from %s: %v", legacyFile, err)
+		}
+	}
+
+	return writeHistory(history, historyFile)
+}
+
+// rotateHistory moves the oldest entries into numbered archives once the
+// history file exceeds the size or entry limit, keeping the newest half.
+func rotateHistory(historyFile string) error {
+	info, err := os.Stat(historyFile)
+	if err != nil {
+		return err
+	}
+
+	tooLarge := historyMaxBytes > 0 && info.Size() > historyMaxBytes
+	if !tooLarge && historyMaxEntries <= 0 {
+		return nil
+	}
+	// counting the lines is enough to tell, the file is only decoded to rotate it
+	if !tooLarge {
+		count, err := CountEntries(historyFile)
+		if err != nil || count <= historyMaxEntries {
+			return err
+		}
+	}
+
+	history, err := loadHistory(historyFile)
+	if err != nil {
+		return err
+	}
+
+	keep := len(history) / 2
+	if historyMaxEntries > 0 && keep > historyMaxEntries/2 {
+		keep = historyMaxEntries / 2
+	}
+	// never split an exchange, the kept part starts with a user message
+	cut := len(history) - keep
+	for cut < len(history) && history[cut].Role != "user" {
+		cut++
+	}
+
+	for i := historyArchives - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", historyFile, i), fmt.Sprintf("%s.%d", historyFile, i+1))
+	}
+	err = writeHistory(history[:cut], historyFile+".1")
+	if err != nil {
+		return fmt.Errorf("Failed to archive history: %v", err)
+	}
+	return writeHistory(history[cut:], historyFile)
+}
+
+// CountEntries counts the entries of a history file by its lines, without
+// decoding or decrypting them.
+func CountEntries(historyFile string) (int, error) {
+	file, err := os.Open(historyFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxHistoryLineBytes)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\n' || b == '\r' || b == '\t'
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package helpers
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// lockFile waits for an advisory lock on file, shared unless exclusive.
+func lockFile(file *os.File, exclusive bool) error {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	for {
+		err := unix.Flock(int(file.Fd()), how)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package helpers
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockFile waits for an advisory lock on file, shared unless exclusive.
+func lockFile(file *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -0,0 +1,178 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/vault"
+	"os"
+	"strings"
+	"time"
+)
+
+// Pin is context that is sent with every request of a conversation, however
+// much of its history fits: a copy of an exchange, or a snippet as a user
+// message.
+type Pin struct {
+	ID      int            `json:"id"`
+	Created time.Time      `json:"created"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// PinsFile returns the file with the pins of the conversation in historyFile.
+func PinsFile(historyFile string) string {
+	return strings.TrimSuffix(historyFile, ".jsonl") + ".pins"
+}
+
+// LoadPins returns the pins of the conversation in historyFile, oldest first.
+func LoadPins(historyFile string) ([]Pin, error) {
+	pins := []Pin{}
+	file, err := os.Open(PinsFile(historyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pins, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxHistoryLineBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		line, err := vault.Open(line)
+		if err != nil {
+			return nil, err
+		}
+		var pin Pin
+		err = json.Unmarshal(line, &pin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode pins: %w", err)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, scanner.Err()
+}
+
+// PinnedEntries returns the entries of all pins of the conversation in
+// historyFile, in the order they were pinned.
+func PinnedEntries(historyFile string) ([]HistoryEntry, error) {
+	pins, err := LoadPins(historyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pins: %w", err)
+	}
+	entries := []HistoryEntry{}
+	for _, pin := range pins {
+		entries = append(entries, pin.Entries...)
+	}
+	return entries, nil
+}
+
+// PinLastExchange pins a copy of the last exchange of historyFile, so it
+// stays in the context after it is trimmed or pruned from the history.
+func PinLastExchange(historyFile string) (Pin, error) {
+	history, err := LoadHistory(historyFile)
+	if err != nil {
+		return Pin{}, err
+	}
+	if len(history) < 2 || history[len(history)-1].Role != "assistant" || history[len(history)-2].Role != "user" {
+		return Pin{}, fmt.Errorf("no exchange to pin yet")
+	}
+	return addPin(historyFile, history[len(history)-2:])
+}
+
+// PinSnippet pins text as a user message.
+func PinSnippet(historyFile, text, modelName string) (Pin, error) {
+	tokens, _ := CountTokens(text, modelName)
+	return addPin(historyFile, []HistoryEntry{{Role: "user", Content: text, TokenCount: tokens, Timestamp: time.Now().Unix()}})
+}
+
+// RemovePin unpins the pin with id.
+func RemovePin(historyFile string, id int) error {
+	pins, err := LoadPins(historyFile)
+	if err != nil {
+		return err
+	}
+	kept := []Pin{}
+	for _, pin := range pins {
+		if pin.ID != id {
+			kept = append(kept, pin)
+		}
+	}
+	if len(kept) == len(pins) {
+		return fmt.Errorf("no pin %d", id)
+	}
+	return writePins(historyFile, kept)
+}
+
+func addPin(historyFile string, entries []HistoryEntry) (Pin, error) {
+	pins, err := LoadPins(historyFile)
+	if err != nil {
+		return Pin{}, err
+	}
+	pin := Pin{ID: 1, Created: time.Now(), Entries: entries}
+	for _, other := range pins {
+		if other.ID >= pin.ID {
+			pin.ID = other.ID + 1
+		}
+	}
+	return pin, writePins(historyFile, append(pins, pin))
+}
+
+// writePins replaces the pins file, encrypted like the history when
+// history_encryption is on.
+func writePins(historyFile string, pins []Pin) error {
+	path := PinsFile(historyFile)
+	if len(pins) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, pin := range pins {
+		data, err := json.Marshal(pin)
+		if err != nil {
+			return err
+		}
+		data, err = vault.Seal(data)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	err := os.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save pins: %w", err)
+	}
+	return nil
+}
+
+// WithoutPinned returns history without the entries that are also pinned, so
+// a pinned exchange that is still in the history is not sent twice.
+func WithoutPinned(history, pinned []HistoryEntry) []HistoryEntry {
+	if len(pinned) == 0 {
+		return history
+	}
+	kept := []HistoryEntry{}
+	for _, entry := range history {
+		isPinned := false
+		for _, pin := range pinned {
+			if entry.Role == pin.Role && entry.Content == pin.Content && entry.Timestamp == pin.Timestamp {
+				isPinned = true
+				break
+			}
+		}
+		if !isPinned {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
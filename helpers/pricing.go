@@ -0,0 +1,60 @@
+package helpers
+
+import (
+	"strings"
+)
+
+// modelPrice is the USD price of one million tokens.
+type modelPrice struct {
+	Input  float64
+	Output float64
+}
+
+// prices maps model name prefixes to their token prices. The longest
+// matching prefix wins.
+var prices = map[string]modelPrice{
+	"gpt-3.5-turbo": {Input: 0.50, Output: 1.50},
+	"gpt-35-turbo":  {Input: 0.50, Output: 1.50},
+	"gpt-4":         {Input: 30.00, Output: 60.00},
+	"gpt-4-32k":     {Input: 60.00, Output: 120.00},
+	"gpt-4-turbo":   {Input: 10.00, Output: 30.00},
+	"gpt-4-1106":    {Input: 10.00, Output: 30.00},
+	"gpt-4-0125":    {Input: 10.00, Output: 30.00},
+	"gpt-4o":        {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini":   {Input: 0.15, Output: 0.60},
+	"gpt-4.1":       {Input: 2.00, Output: 8.00},
+	"gpt-4.1-mini":  {Input: 0.40, Output: 1.60},
+	"o1":            {Input: 15.00, Output: 60.00},
+	"o3":            {Input: 2.00, Output: 8.00},
+	"o4-mini":       {Input: 1.10, Output: 4.40},
+}
+
+// InputCost estimates the USD cost of sending tokens input tokens to the
+// model. The second result is false when the model's price is unknown.
+func InputCost(modelName string, tokens int) (float64, bool) {
+	return Cost(modelName, tokens, 0)
+}
+
+// Cost estimates the USD cost of a request with the given input and output
+// token counts. The second result is false when the model's price is unknown.
+func Cost(modelName string, inputTokens, outputTokens int) (float64, bool) {
+	price, ok := priceForModel(modelName)
+	if !ok {
+		return 0, false
+	}
+	return (float64(inputTokens)*price.Input + float64(outputTokens)*price.Output) / 1000000, true
+}
+
+func priceForModel(modelName string) (modelPrice, bool) {
+	modelName = strings.ToLower(modelName)
+	best := ""
+	for prefix := range prices {
+		if strings.HasPrefix(modelName, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return modelPrice{}, false
+	}
+	return prices[best], true
+}
@@ -0,0 +1,231 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rojolang/terminalgpt/trash"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// retention policies, see SetHistoryLimits; zero keeps everything
+	retentionAge     time.Duration
+	retentionEntries int
+	retentionTokens  int
+
+	// keptTokens are the tokens of history files after their last prune,
+	// with the size the files had then
+	keptTokens   = map[string]keptSize{}
+	keptTokensMu sync.Mutex
+)
+
+type keptSize struct {
+	tokens int
+	size   int64
+}
+
+// errFound stops a read of the history once the entry looked for is found.
+var errFound = errors.New("found")
+
+// PruneResult tells how many entries of a history file the retention
+// policies remove, and how many each policy alone would remove.
+type PruneResult struct {
+	File      string
+	Total     int
+	Removed   int
+	ByAge     int
+	ByEntries int
+	ByTokens  int
+}
+
+func (r PruneResult) String() string {
+	if r.Removed == 0 {
+		return fmt.Sprintf("%s: nothing to prune (%d entries)", r.File, r.Total)
+	}
+	reasons := []string{}
+	if r.ByAge > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d older than %d days", r.ByAge, int(retentionAge.Hours()/24)))
+	}
+	if r.ByEntries > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d over %d entries", r.ByEntries, retentionEntries))
+	}
+	if r.ByTokens > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d over %d tokens", r.ByTokens, retentionTokens))
+	}
+	return fmt.Sprintf("%s: %d of %d entries (%s)", r.File, r.Removed, r.Total, strings.Join(reasons, ", "))
+}
+
+// RetentionEnabled reports whether any retention policy is configured.
+func RetentionEnabled() bool {
+	return retentionAge > 0 || retentionEntries > 0 || retentionTokens > 0
+}
+
+// PruneHistory removes the oldest entries of the history file that are past
+// the retention policies and moves them to the trash. With dryRun it only
+// reports what would be removed.
+func PruneHistory(historyFile string, dryRun bool) (PruneResult, error) {
+	if !RetentionEnabled() {
+		return PruneResult{File: historyFile}, nil
+	}
+	err := migrateHistory(historyFile)
+	if err != nil {
+		return PruneResult{File: historyFile}, err
+	}
+	unlock, err := lockHistory(historyFile, !dryRun)
+	if err != nil {
+		return PruneResult{File: historyFile}, err
+	}
+	defer unlock()
+	return pruneHistory(historyFile, dryRun)
+}
+
+// pruneDue reports whether the retention policies may remove entries of the
+// history file, without decoding all of it: the entries are counted, only the
+// oldest dated entry is read, and every token takes a byte of the file at
+// least, so it grows by as many bytes as tokens are added since the last
+// prune.
+func pruneDue(historyFile string) (bool, error) {
+	if retentionEntries > 0 {
+		count, err := CountEntries(historyFile)
+		if err != nil {
+			return false, err
+		}
+		if count > retentionEntries {
+			return true, nil
+		}
+	}
+
+	if retentionAge > 0 {
+		oldest := int64(0)
+		err := readHistory(historyFile, func(entry HistoryEntry) error {
+			if entry.Timestamp == 0 {
+				return nil
+			}
+			oldest = entry.Timestamp
+			return errFound
+		})
+		if err != nil && err != errFound {
+			return false, err
+		}
+		if oldest != 0 && oldest < time.Now().Add(-retentionAge).Unix() {
+			return true, nil
+		}
+	}
+
+	if retentionTokens > 0 {
+		info, err := os.Stat(historyFile)
+		if err != nil {
+			return false, err
+		}
+		keptTokensMu.Lock()
+		kept, ok := keptTokens[historyFile]
+		keptTokensMu.Unlock()
+		tokens := info.Size()
+		// unless the file was rewritten since, by another run or command
+		if ok && info.Size() >= kept.size {
+			tokens = int64(kept.tokens) + info.Size() - kept.size
+		}
+		if tokens > int64(retentionTokens) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// keepTokens remembers the tokens of history, which the history file holds
+// now, for pruneDue.
+func keepTokens(historyFile string, history []HistoryEntry) {
+	info, err := os.Stat(historyFile)
+	if err != nil {
+		return
+	}
+	tokens := 0
+	for _, entry := range history {
+		tokens += entry.TokenCount
+	}
+	keptTokensMu.Lock()
+	keptTokens[historyFile] = keptSize{tokens: tokens, size: info.Size()}
+	keptTokensMu.Unlock()
+}
+
+// pruneHistory is PruneHistory for callers holding the lock.
+func pruneHistory(historyFile string, dryRun bool) (PruneResult, error) {
+	result := PruneResult{File: historyFile}
+	if !RetentionEnabled() {
+		return result, nil
+	}
+
+	history, err := loadHistory(historyFile)
+	if err != nil {
+		return result, err
+	}
+	result.Total = len(history)
+
+	if retentionAge > 0 {
+		// entries from older versions have no time, but precede the first dated one
+		cutoff := time.Now().Add(-retentionAge).Unix()
+		for i, entry := range history {
+			if entry.Timestamp != 0 && entry.Timestamp < cutoff {
+				result.ByAge = i + 1
+			}
+		}
+	}
+	if retentionEntries > 0 && len(history) > retentionEntries {
+		result.ByEntries = len(history) - retentionEntries
+	}
+	if retentionTokens > 0 {
+		tokens := 0
+		for i := len(history) - 1; i >= 0; i-- {
+			tokens += history[i].TokenCount
+			if tokens > retentionTokens {
+				result.ByTokens = i + 1
+				break
+			}
+		}
+	}
+
+	cut := result.ByAge
+	if result.ByEntries > cut {
+		cut = result.ByEntries
+	}
+	if result.ByTokens > cut {
+		cut = result.ByTokens
+	}
+	// never split an exchange, the kept part starts with a user message
+	for cut > 0 && cut < len(history) && history[cut].Role != "user" {
+		cut++
+	}
+	result.Removed = cut
+	if dryRun {
+		return result, nil
+	}
+	if cut == 0 {
+		keepTokens(historyFile, history)
+		return result, nil
+	}
+
+	var removed bytes.Buffer
+	for _, entry := range history[:cut] {
+		line, err := marshalEntry(entry)
+		if err != nil {
+			return result, err
+		}
+		removed.Write(line)
+		removed.WriteByte('\n')
+	}
+	_, err = trash.Keep(removed.Bytes(), historyFile, fmt.Sprintf("pruned %d history entries", cut))
+	if err != nil {
+		return result, fmt.Errorf("failed to move the pruned entries to the trash: %w", err)
+	}
+
+	err = writeHistory(history[cut:], historyFile)
+	if err != nil {
+		return result, err
+	}
+	keepTokens(historyFile, history[cut:])
+	return result, nil
+}
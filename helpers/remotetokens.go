@@ -0,0 +1,212 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	TokenCounterLocal     = "local"
+	TokenCounterAnthropic = "anthropic"
+	TokenCounterGemini    = "gemini"
+)
+
+var (
+	tokenCounter = TokenCounterLocal
+
+	remoteCountCache = make(map[string]int)
+	remoteCountMutex sync.Mutex
+	// remoteCountErr is the first failure of the remote counter, after which
+	// the run counts locally instead of waiting on it again
+	remoteCountErr error
+)
+
+// remoteCountTimeout bounds a count request, which holds up the prompt.
+const remoteCountTimeout = 5 * time.Second
+
+// SetTokenCounter selects the server-side token counter used for models that
+// have no local tiktoken encoding.
+func SetTokenCounter(cfg *config.Config) {
+	tokenCounter = cfg.TokenCounter
+	if tokenCounter == "" {
+		tokenCounter = TokenCounterLocal
+	}
+}
+
+// useRemoteCounter reports whether tokens of this model should be counted by
+// the provider's count endpoint instead of a local approximation.
+func useRemoteCounter(modelName string) bool {
+	if tokenCounter == TokenCounterLocal || HasLocalEncoding(modelName) {
+		return false
+	}
+	remoteCountMutex.Lock()
+	defer remoteCountMutex.Unlock()
+	return remoteCountErr == nil
+}
+
+// noteRemoteFailure records that the remote counter failed with err, and says
+// so once per run.
+func noteRemoteFailure(err error) {
+	remoteCountMutex.Lock()
+	defer remoteCountMutex.Unlock()
+	if remoteCountErr != nil {
+		return
+	}
+	remoteCountErr = err
+	color.New(color.FgYellow).Fprintf(os.Stderr, "Counting tokens with %s failed, using local estimates for the rest of the run: %v\n", tokenCounter, err)
+}
+
+// countRemote counts the tokens of a batch of messages with a single request,
+// caching results by content so repeated budgeting passes are free. After a
+// failure, the counter isn't used for the rest of the run.
+func countRemote(messages []HistoryEntry, modelName string) (int, error) {
+	keyData, _ := json.Marshal(messages)
+	sum := sha256.Sum256(append([]byte(tokenCounter+"|"+modelName+"|"), keyData...))
+	key := hex.EncodeToString(sum[:])
+
+	remoteCountMutex.Lock()
+	count, ok := remoteCountCache[key]
+	remoteCountMutex.Unlock()
+	if ok {
+		return count, nil
+	}
+
+	var err error
+	switch tokenCounter {
+	case TokenCounterAnthropic:
+		count, err = countAnthropic(messages, modelName)
+	case TokenCounterGemini:
+		count, err = countGemini(messages, modelName)
+	default:
+		return 0, fmt.Errorf("unknown token counter %q", tokenCounter)
+	}
+	if err != nil {
+		noteRemoteFailure(err)
+		return 0, err
+	}
+
+	remoteCountMutex.Lock()
+	remoteCountCache[key] = count
+	remoteCountMutex.Unlock()
+
+	return count, nil
+}
+
+func countAnthropic(messages []HistoryEntry, modelName string) (int, error) {
+	apiKey := os.Getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		return 0, fmt.Errorf("ANTHROPIC_API_KEY is not set")
+	}
+
+	type anthropicMessage struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	body := struct {
+		Model    string             `json:"model"`
+		System   string             `json:"system,omitempty"`
+		Messages []anthropicMessage `json:"messages"`
+	}{Model: modelName, Messages: []anthropicMessage{}}
+
+	for _, message := range messages {
+		if message.Role == "system" {
+			body.System += message.Content
+			continue
+		}
+		body.Messages = append(body.Messages, anthropicMessage{Role: message.Role, Content: message.Content})
+	}
+	// the endpoint needs at least one message
+	if len(body.Messages) == 0 {
+		body.Messages = append(body.Messages, anthropicMessage{Role: "user", Content: " "})
+	}
+
+	headers := map[string]string{
+		"x-api-key":         apiKey,
+		"anthropic-version": "2023-06-01",
+	}
+
+	var result struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	err := postCount("https://api.anthropic.com/v1/messages/count_tokens", headers, body, &result)
+	return result.InputTokens, err
+}
+
+func countGemini(messages []HistoryEntry, modelName string) (int, error) {
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return 0, fmt.Errorf("GEMINI_API_KEY is not set")
+	}
+
+	type part struct {
+		Text string `json:"text"`
+	}
+	type content struct {
+		Role  string `json:"role"`
+		Parts []part `json:"parts"`
+	}
+	body := struct {
+		Contents []content `json:"contents"`
+	}{}
+
+	for _, message := range messages {
+		role := "user"
+		if message.Role == "assistant" {
+			role = "model"
+		}
+		body.Contents = append(body.Contents, content{Role: role, Parts: []part{{Text: message.Content}}})
+	}
+
+	endpoint := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:countTokens?key=%s", url.PathEscape(modelName), url.QueryEscape(apiKey))
+
+	var result struct {
+		TotalTokens int `json:"totalTokens"`
+	}
+	err := postCount(endpoint, nil, body, &result)
+	return result.TotalTokens, err
+}
+
+func postCount(endpoint string, headers map[string]string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := httpclient.Client(remoteCountTimeout).Do(req)
+	if err != nil {
+		return fmt.Errorf("token count request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("token count request failed with status %d: %s", resp.StatusCode, apiErr.Error.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
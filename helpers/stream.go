@@ -0,0 +1,96 @@
+package helpers
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// streamOutput receives the raw text of every streamed response, see SetStreamOutput.
+	streamOutput io.Writer
+
+	// timing of the current request, see StartRequest
+	requestStart time.Time
+	firstChunk   time.Time
+	finishReason string
+	// reasoningTokens are the hidden tokens a reasoning model thought with
+	reasoningTokens int
+	finishMu        sync.Mutex
+
+	// which fallback answered the current request, see SetAnswered
+	answeredProvider string
+	answeredModel    string
+)
+
+// SetStreamOutput copies the uncolored text of every streamed response to w
+// as it arrives, next to the colored terminal output. nil turns it off.
+func SetStreamOutput(w io.Writer) {
+	streamOutput = w
+}
+
+// StreamChunk is called by the providers with each piece of response text.
+func StreamChunk(text string) {
+	if firstChunk.IsZero() && text != "" {
+		firstChunk = time.Now()
+	}
+	if streamOutput != nil {
+		io.WriteString(streamOutput, text)
+	}
+}
+
+// StartRequest resets the timing reported by LastRequest for a new request.
+func StartRequest() {
+	requestStart = time.Now()
+	firstChunk = time.Time{}
+	SetFinishReason("")
+	SetReasoningTokens(0)
+	SetAnswered("", "")
+}
+
+// SetFinishReason is called by the providers with the reason the model stopped.
+func SetFinishReason(reason string) {
+	finishMu.Lock()
+	finishReason = reason
+	finishMu.Unlock()
+}
+
+// SetReasoningTokens is called by the providers with the reasoning tokens the
+// API reports for the current request.
+func SetReasoningTokens(tokens int) {
+	finishMu.Lock()
+	reasoningTokens = tokens
+	finishMu.Unlock()
+}
+
+// LastReasoningTokens returns the reasoning tokens of the current request, 0
+// when the model does not reason or the provider does not report them.
+func LastReasoningTokens() int {
+	finishMu.Lock()
+	defer finishMu.Unlock()
+	return reasoningTokens
+}
+
+// LastRequest returns when the current request started, when its first text
+// arrived (zero if none did) and why the model stopped.
+func LastRequest() (time.Time, time.Time, string) {
+	finishMu.Lock()
+	defer finishMu.Unlock()
+	return requestStart, firstChunk, finishReason
+}
+
+// SetAnswered records that a fallback provider and model answered the current
+// request instead of the configured ones.
+func SetAnswered(provider, model string) {
+	finishMu.Lock()
+	answeredProvider, answeredModel = provider, model
+	finishMu.Unlock()
+}
+
+// LastAnswered returns the fallback that answered the current request, empty
+// when the configured provider did.
+func LastAnswered() (string, string) {
+	finishMu.Lock()
+	defer finishMu.Unlock()
+	return answeredProvider, answeredModel
+}
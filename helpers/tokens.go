@@ -0,0 +1,277 @@
+package helpers
+
+import (
+	"fmt"
+	"github.com/pkoukk/tiktoken-go"
+	"strings"
+	"sync"
+)
+
+// chatOverhead is the number of tokens the chat format adds around messages.
+type chatOverhead struct {
+	PerMessage   int // <|start|>{role/name}\n{content}<|end|>\n
+	PerName      int // added when a message carries a name
+	ReplyPriming int // every reply is primed with <|start|>assistant<|message|>
+}
+
+// chatOverheads maps model name prefixes to their chat format overhead. The
+// longest matching prefix wins, unknown models use defaultChatOverhead.
+var chatOverheads = map[string]chatOverhead{
+	"gpt-3.5-turbo-0301": {PerMessage: 4, PerName: -1, ReplyPriming: 3},
+	"gpt-3.5-turbo":      {PerMessage: 3, PerName: 1, ReplyPriming: 3},
+	"gpt-35-turbo":       {PerMessage: 3, PerName: 1, ReplyPriming: 3},
+	"gpt-4":              {PerMessage: 3, PerName: 1, ReplyPriming: 3},
+	"gpt-4o":             {PerMessage: 3, PerName: 1, ReplyPriming: 3},
+	"o1":                 {PerMessage: 3, PerName: 1, ReplyPriming: 3},
+	"o3":                 {PerMessage: 3, PerName: 1, ReplyPriming: 3},
+}
+
+var defaultChatOverhead = chatOverhead{PerMessage: 3, PerName: 1, ReplyPriming: 3}
+
+// o200kPrefixes are model families tokenized with o200k_base that tiktoken-go
+// does not know about yet.
+var o200kPrefixes = []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+
+func CountTokens(text string, modelName string) (int, error) {
+	if useRemoteCounter(modelName) {
+		count, err := countRemote([]HistoryEntry{{Role: "user", Content: text}}, modelName)
+		if err == nil {
+			return count, nil
+		}
+	}
+	return localTokens(text, modelName)
+}
+
+// localTokens counts text with the local tokenizer, or estimates it.
+func localTokens(text string, modelName string) (int, error) {
+	tkm, err := encodingForModel(modelName)
+	if err != nil {
+		noteEstimate(err)
+		return EstimateTokens(text, modelName), nil
+	}
+	return len(tkm.Encode(text, nil, nil)), nil
+}
+
+// LocalTokenizer returns a function counting tokens with the model's local
+// tokenizer, which is built once instead of on every call. It never calls a
+// provider endpoint, so it suits frequent estimates such as live counts.
+func LocalTokenizer(modelName string) (func(text string) int, error) {
+	tkm, err := encodingForModel(modelName)
+	if err != nil {
+		noteEstimate(err)
+		return nil, fmt.Errorf("EncodingForModel: %v", err)
+	}
+	return func(text string) int {
+		return len(tkm.Encode(text, nil, nil))
+	}, nil
+}
+
+// CountEntryTokens counts a single chat message including its format overhead.
+func CountEntryTokens(entry HistoryEntry, modelName string) (int, error) {
+	if useRemoteCounter(modelName) {
+		count, err := countRemote([]HistoryEntry{entry}, modelName)
+		if err == nil {
+			return count, nil
+		}
+	}
+
+	return localEntryTokens(entry, modelName)
+}
+
+// CountEntriesTokens counts every entry like CountEntryTokens. A remote
+// counter gets all of them in one request, and its total is shared out among
+// the entries in proportion to their local counts.
+func CountEntriesTokens(entries []HistoryEntry, modelName string) ([]int, error) {
+	counts := make([]int, len(entries))
+	local := 0
+	for i, entry := range entries {
+		tokens, err := localEntryTokens(entry, modelName)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = tokens
+		local += tokens
+	}
+	if len(entries) == 0 || local == 0 || !useRemoteCounter(modelName) {
+		return counts, nil
+	}
+
+	total, err := countRemote(entries, modelName)
+	if err != nil {
+		return counts, nil
+	}
+	shared := 0
+	for i := range counts {
+		counts[i] = counts[i] * total / local
+		shared += counts[i]
+	}
+	// the rounding goes to the newest entry
+	counts[len(counts)-1] += total - shared
+	return counts, nil
+}
+
+// localEntryTokens counts an entry with the local tokenizer or estimate.
+func localEntryTokens(entry HistoryEntry, modelName string) (int, error) {
+	overhead := overheadForModel(modelName)
+
+	roleTokens, err := localTokens(entry.Role, modelName)
+	if err != nil {
+		return 0, err
+	}
+	contentTokens, err := localTokens(entry.Content, modelName)
+	if err != nil {
+		return 0, err
+	}
+
+	return overhead.PerMessage + roleTokens + contentTokens, nil
+}
+
+// CountMessageTokens counts the prompt tokens a chat request with these
+// messages is billed for, the same way the API does.
+func CountMessageTokens(messages []HistoryEntry, modelName string) (int, error) {
+	// providers with a count endpoint get the whole batch in one request
+	if useRemoteCounter(modelName) {
+		count, err := countRemote(messages, modelName)
+		if err == nil {
+			return count, nil
+		}
+	}
+
+	total := overheadForModel(modelName).ReplyPriming
+	for _, message := range messages {
+		tokens, err := CountEntryTokens(message, modelName)
+		if err != nil {
+			return 0, err
+		}
+		total += tokens
+	}
+	return total, nil
+}
+
+// ReplyPrimingTokens is the overhead of a chat request beyond its messages.
+func ReplyPrimingTokens(modelName string) int {
+	return overheadForModel(modelName).ReplyPriming
+}
+
+func overheadForModel(modelName string) chatOverhead {
+	modelName = strings.ToLower(modelName)
+	best := ""
+	for prefix := range chatOverheads {
+		if strings.HasPrefix(modelName, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return defaultChatOverhead
+	}
+	return chatOverheads[best]
+}
+
+// HasLocalEncoding reports whether the model belongs to a family tiktoken can
+// tokenize exactly, as opposed to the cl100k_base approximation.
+func HasLocalEncoding(modelName string) bool {
+	name := strings.ToLower(modelName)
+	if _, err := tiktoken.EncodingForModel(name); err == nil {
+		return true
+	}
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return strings.Contains(name, "gpt") || strings.Contains(name, "4o")
+}
+
+// EncodingName returns the tokenizer encoding of a model, cl100k_base for
+// unknown models such as Azure deployment names.
+func EncodingName(modelName string) string {
+	name := strings.ToLower(modelName)
+	if encoding, ok := tiktoken.MODEL_TO_ENCODING[name]; ok {
+		return encoding
+	}
+	for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(name, prefix) {
+			return encoding
+		}
+	}
+
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	if strings.Contains(name, "4o") {
+		return tiktoken.MODEL_O200K_BASE
+	}
+
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+// CountEncodingTokens counts the tokens of text in one of Encodings.
+func CountEncodingTokens(text string, encoding string) (int, error) {
+	tkm, err := getEncoding(encoding)
+	if err != nil {
+		noteEstimate(err)
+		return 0, fmt.Errorf("failed to load %s: %w", encoding, err)
+	}
+	return len(tkm.Encode(text, nil, nil)), nil
+}
+
+// encodingForModel resolves the tokenizer of a model, see EncodingName.
+func encodingForModel(modelName string) (*tiktoken.Tiktoken, error) {
+	return getEncoding(EncodingName(modelName))
+}
+
+// encodings caches the loaded tokenizers by encoding name, loading one parses
+// its whole BPE file and takes far longer than counting a response. A file
+// that failed to load is not read again either.
+var (
+	encodings      = map[string]*tiktoken.Tiktoken{}
+	encodingErrors = map[string]error{}
+	encodingsMu    sync.Mutex
+)
+
+func getEncoding(encoding string) (*tiktoken.Tiktoken, error) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if tkm, ok := encodings[encoding]; ok {
+		return tkm, nil
+	}
+	if err, ok := encodingErrors[encoding]; ok {
+		return nil, err
+	}
+	tkm, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		encodingErrors[encoding] = err
+		return nil, err
+	}
+	encodings[encoding] = tkm
+	return tkm, nil
+}
+
+// resetEncodings drops the cached tokenizers, e.g. when their files change.
+func resetEncodings() {
+	encodingsMu.Lock()
+	encodings = map[string]*tiktoken.Tiktoken{}
+	encodingErrors = map[string]error{}
+	encodingsMu.Unlock()
+}
+
+// TruncateTokens cuts text to at most maxTokens tokens of modelName's local
+// tokenizer, or to the characters EstimateTokens expects in them when the
+// tokenizer is unavailable.
+func TruncateTokens(text string, maxTokens int, modelName string) string {
+	tkm, err := encodingForModel(modelName)
+	if err != nil {
+		noteEstimate(err)
+		if limit := int(float64(maxTokens) * charsPerTokenFor(modelName)); len([]rune(text)) > limit {
+			return string([]rune(text)[:limit])
+		}
+		return text
+	}
+	tokens := tkm.Encode(text, nil, nil)
+	if len(tokens) <= maxTokens {
+		return text
+	}
+	return tkm.Decode(tokens[:maxTokens])
+}
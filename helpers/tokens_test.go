@@ -0,0 +1,91 @@
+package helpers
+
+import (
+	"testing"
+)
+
+// cookbookMessages is the example of the OpenAI cookbook "How to count tokens
+// with tiktoken". Four of its messages have a name, which HistoryEntry doesn't
+// carry, so cookbookNames are counted apart.
+var cookbookMessages = []HistoryEntry{
+	{Role: "system", Content: "You are a helpful, pattern-following assistant that translates corporate jargon into plain English."},
+	{Role: "system", Content: "New synergies will help drive top-line growth."},
+	{Role: "system", Content: "Things working well together will increase revenue."},
+	{Role: "system", Content: "Let's circle back when we have more bandwidth to touch base on opportunities for increased leverage."},
+	{Role: "system", Content: "Let's talk later when we're less busy about how to do better."},
+	{Role: "user", Content: "This late pivot means we don't have time to boil the ocean for the client deliverable."},
+}
+
+var cookbookNames = []string{"example_user", "example_assistant", "example_user", "example_assistant"}
+
+func TestCountMessageTokensMatchesCookbook(t *testing.T) {
+	tests := []struct {
+		model string
+		// reference is the prompt token count the cookbook gets from the API
+		reference int
+	}{
+		{"gpt-3.5-turbo-0301", 127},
+		{"gpt-3.5-turbo-0613", 129},
+		{"gpt-4", 129},
+		{"gpt-4-0613", 129},
+		{"gpt-4o", 124},
+		{"gpt-4o-mini", 124},
+	}
+
+	for _, test := range tests {
+		t.Run(test.model, func(t *testing.T) {
+			count, err := CountMessageTokens(cookbookMessages, test.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a name adds its tokens and PerName to its message
+			for _, name := range cookbookNames {
+				tokens, err := CountTokens(name, test.model)
+				if err != nil {
+					t.Fatal(err)
+				}
+				count += tokens + overheadForModel(test.model).PerName
+			}
+			if count != test.reference {
+				t.Errorf("got %d tokens, the cookbook counts %d", count, test.reference)
+			}
+		})
+	}
+}
+
+func TestChatOverheads(t *testing.T) {
+	tests := []struct {
+		model    string
+		overhead chatOverhead
+	}{
+		{"gpt-3.5-turbo-0301", chatOverhead{PerMessage: 4, PerName: -1, ReplyPriming: 3}},
+		{"gpt-3.5-turbo-0613", chatOverhead{PerMessage: 3, PerName: 1, ReplyPriming: 3}},
+		{"gpt-4", chatOverhead{PerMessage: 3, PerName: 1, ReplyPriming: 3}},
+		{"GPT-4o-2024-08-06", chatOverhead{PerMessage: 3, PerName: 1, ReplyPriming: 3}},
+		{"unknown-model", defaultChatOverhead},
+	}
+
+	for _, test := range tests {
+		if got := overheadForModel(test.model); got != test.overhead {
+			t.Errorf("%s: got %+v, want %+v", test.model, got, test.overhead)
+		}
+		if got := ReplyPrimingTokens(test.model); got != test.overhead.ReplyPriming {
+			t.Errorf("%s: got %d reply priming tokens, want %d", test.model, got, test.overhead.ReplyPriming)
+		}
+	}
+}
+
+func TestCountEntryTokens(t *testing.T) {
+	entry := HistoryEntry{Role: "user", Content: "hello world"}
+	for _, model := range []string{"gpt-3.5-turbo-0301", "gpt-4", "gpt-4o"} {
+		count, err := CountEntryTokens(entry, model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// "user" and "hello world" are one and two tokens in cl100k_base and o200k_base
+		want := overheadForModel(model).PerMessage + 1 + 2
+		if count != want {
+			t.Errorf("%s: got %d tokens, want %d", model, count, want)
+		}
+	}
+}
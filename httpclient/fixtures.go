@@ -0,0 +1,154 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/debuglog"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fixture modes, see ParseFixtures.
+const (
+	Record = "record"
+	Replay = "replay"
+)
+
+// fixture is a recorded request and its response.
+type fixture struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Body    string            `json:"body,omitempty"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Response is the whole response body, for a stream every event.
+	Response string `json:"response"`
+}
+
+// ParseFixtures reads a http_fixtures setting, "record:<dir>" or
+// "replay:<dir>".
+func ParseFixtures(setting string) (string, string, error) {
+	mode, dir, ok := strings.Cut(setting, ":")
+	if !ok || dir == "" || (mode != Record && mode != Replay) {
+		return "", "", fmt.Errorf("invalid http_fixtures %q, expected record:<dir> or replay:<dir>", setting)
+	}
+	return mode, dir, nil
+}
+
+// fixtureTransport saves every response to a file in dir when recording, and
+// answers from those files instead of the network when replaying, so the
+// providers can be exercised offline. A request is found again by its
+// method, URL and body, the credentials in headers and query are not part of
+// it and not saved.
+type fixtureTransport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+func (t fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	path := filepath.Join(t.dir, fixtureName(req, body))
+
+	if t.mode == Replay {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("no recorded response at %s, record it with http_fixtures record:%s", path, t.dir)
+		}
+		var f fixture
+		err = json.Unmarshal(data, &f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixture %s: %w", path, err)
+		}
+		header := http.Header{}
+		for name, value := range f.Headers {
+			header.Set(name, value)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+			StatusCode:    f.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(strings.NewReader(f.Response)),
+			ContentLength: int64(len(f.Response)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	headers := debuglog.Headers(resp.Header)
+	delete(headers, "Set-Cookie")
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		path:       path,
+		fixture: fixture{
+			Method:  req.Method,
+			URL:     redactURL(req.URL),
+			Body:    debuglog.RedactSecrets(string(body)),
+			Status:  resp.StatusCode,
+			Headers: headers,
+		},
+	}
+	return resp, nil
+}
+
+// fixtureName identifies a request by its method, host, path, query and body.
+func fixtureName(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", req.Method, redactURL(req.URL))
+	hash.Write(body)
+	name := strings.Trim(strings.NewReplacer("/", "_", ":", "_").Replace(req.URL.Host+req.URL.Path), "_")
+	return fmt.Sprintf("%s_%s_%s.json", strings.ToLower(req.Method), name, hex.EncodeToString(hash.Sum(nil))[:12])
+}
+
+// recordingBody passes the response through as it streams and saves the
+// fixture once the body was read to the end. Responses that were cut off
+// are not saved.
+type recordingBody struct {
+	io.ReadCloser
+	path    string
+	fixture fixture
+	data    bytes.Buffer
+	saved   bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.data.Write(p[:n])
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.save()
+	}
+	return n, err
+}
+
+func (b *recordingBody) save() {
+	b.fixture.Response = b.data.String()
+	data, err := json.MarshalIndent(b.fixture, "", "  ")
+	if err != nil {
+		return
+	}
+	if os.MkdirAll(filepath.Dir(b.path), 0755) == nil {
+		os.WriteFile(b.path, append(data, '\n'), 0644)
+	}
+}
@@ -0,0 +1,77 @@
+package httpclient
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/mockapi"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// offline fails every request that reaches the network.
+type offline struct{}
+
+func (offline) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("unexpected request to %s", req.URL)
+}
+
+func post(t *testing.T, transport http.RoundTripper, url, body string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer sk-secret")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+func TestFixtureRecordAndReplay(t *testing.T) {
+	server := mockapi.New("Use tar --zstd to unpack it.")
+	defer server.Close()
+	dir := t.TempDir()
+	url := server.BaseURL() + "/chat/completions"
+	body := `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+
+	recorded, recordedBody := post(t, fixtureTransport{mode: Record, dir: dir, next: http.DefaultTransport}, url, body)
+	if !strings.Contains(recordedBody, "data: [DONE]") {
+		t.Fatalf("recorded %q, want a stream", recordedBody)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("got %d fixtures, want 1", len(files))
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if strings.Contains(string(data), "sk-secret") {
+		t.Error("the fixture contains the key")
+	}
+
+	replayed, replayedBody := post(t, fixtureTransport{mode: Replay, dir: dir, next: offline{}}, url, body)
+	if replayedBody != recordedBody {
+		t.Errorf("replayed %q, recorded %q", replayedBody, recordedBody)
+	}
+	if replayed.StatusCode != recorded.StatusCode || replayed.Header.Get("Content-Type") != recorded.Header.Get("Content-Type") {
+		t.Errorf("replayed %d %s, recorded %d %s", replayed.StatusCode, replayed.Header.Get("Content-Type"), recorded.StatusCode, recorded.Header.Get("Content-Type"))
+	}
+	if len(server.Requests()) != 1 {
+		t.Errorf("the server got %d requests, want only the recorded one", len(server.Requests()))
+	}
+
+	// another body is another request, which was never recorded
+	req, _ := http.NewRequest("POST", url, strings.NewReader(`{"model":"gpt-4o"}`))
+	_, err := fixtureTransport{mode: Replay, dir: dir, next: offline{}}.RoundTrip(req)
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("got error %v, want no recorded response", err)
+	}
+}
@@ -0,0 +1,134 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Options configure how API requests leave the machine.
+type Options struct {
+	// ProxyURL is an http, https or socks5 URL. When empty the HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY environment variables are used.
+	ProxyURL string
+	// CABundle is a PEM file of certificate authorities trusted in addition
+	// to the system ones, e.g. of a TLS inspecting corporate proxy.
+	CABundle string
+	// ClientCert and ClientKey are PEM files of a certificate to present to
+	// servers that require one.
+	ClientCert string
+	ClientKey  string
+
+	// ConnectTimeout limits establishing a connection, 0 means
+	// DefaultConnectTimeout. ResponseHeaderTimeout limits the wait for the
+	// response headers after sending a request and RequestTimeout a whole
+	// API request including a streamed body, 0 means no limit.
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+
+	// Fixtures records every response to a directory or answers from the
+	// recorded ones offline, "record:<dir>" or "replay:<dir>".
+	Fixtures string
+}
+
+// DefaultConnectTimeout is used when Options.ConnectTimeout is 0.
+const DefaultConnectTimeout = 30 * time.Second
+
+var (
+	transport      http.RoundTripper = http.DefaultTransport
+	requestTimeout time.Duration
+)
+
+// Configure sets up the transport used by every client from Client.
+func Configure(options Options) error {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	// one transport for every client, so connections are kept alive and
+	// reused across requests, over HTTP/2 where the server offers it
+	connectTimeout := options.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	t.DialContext = dialer.DialContext
+	t.ForceAttemptHTTP2 = true
+	t.MaxIdleConnsPerHost = 4
+	t.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return fmt.Errorf("invalid proxy_url %q, expected e.g. http://proxy:8080 or socks5://127.0.0.1:1080", options.ProxyURL)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy_url scheme %q, expected http, https or socks5", proxyURL.Scheme)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if options.CABundle != "" || options.ClientCert != "" || options.ClientKey != "" {
+		tlsConfig := &tls.Config{}
+
+		if options.CABundle != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			pem, err := os.ReadFile(options.CABundle)
+			if err != nil {
+				return fmt.Errorf("failed to read ca_bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in ca_bundle %s", options.CABundle)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if options.ClientCert != "" || options.ClientKey != "" {
+			cert, err := tls.LoadX509KeyPair(options.ClientCert, options.ClientKey)
+			if err != nil {
+				return fmt.Errorf("failed to load the TLS client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		t.TLSClientConfig = tlsConfig
+	}
+
+	transport = t
+	if options.Fixtures != "" {
+		mode, dir, err := ParseFixtures(options.Fixtures)
+		if err != nil {
+			return err
+		}
+		transport = fixtureTransport{mode: mode, dir: dir, next: t}
+	}
+	requestTimeout = options.RequestTimeout
+	return nil
+}
+
+// SetTransport replaces the transport of every client from Client, e.g. with
+// one answering like a provider in tests. Configure sets it up again.
+func SetTransport(t http.RoundTripper) {
+	transport = t
+}
+
+// Client returns a client using the configured transport, timeout 0 means
+// no limit.
+func Client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: tracingTransport{next: loggingTransport{next: transport}}, Timeout: timeout}
+}
+
+// APIClient returns a client for completion requests, limited by
+// Options.RequestTimeout.
+func APIClient() *http.Client {
+	return Client(requestTimeout)
+}
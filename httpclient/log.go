@@ -0,0 +1,144 @@
+package httpclient
+
+import (
+	"bytes"
+	"github.com/rojolang/terminalgpt/debuglog"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// logLimit is how much of a body is kept for the debug log, larger ones are
+// only logged by size.
+const logLimit = 1 << 20
+
+// loggingTransport writes every request and its response to the debug log
+// when it is enabled.
+type loggingTransport struct {
+	next http.RoundTripper
+}
+
+func (t loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !debuglog.Enabled() {
+		return t.next.RoundTrip(req)
+	}
+
+	fields := map[string]interface{}{
+		"method":  req.Method,
+		"url":     redactURL(req.URL),
+		"headers": debuglog.Headers(req.Header),
+	}
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		fields["body"] = logBody(data)
+	}
+	debuglog.Log("request", fields)
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		debuglog.Log("response", map[string]interface{}{
+			"url":         redactURL(req.URL),
+			"error":       err.Error(),
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+		return resp, err
+	}
+	resp.Body = &loggedBody{
+		body:    resp.Body,
+		url:     redactURL(req.URL),
+		status:  resp.Status,
+		headers: debuglog.Headers(resp.Header),
+		start:   start,
+		header:  time.Since(start),
+	}
+	return resp, nil
+}
+
+// loggedBody logs the response once its body is read or closed.
+type loggedBody struct {
+	body    io.ReadCloser
+	url     string
+	status  string
+	headers map[string]string
+	start   time.Time
+	header  time.Duration
+	data    bytes.Buffer
+	size    int
+	err     error
+	logged  bool
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.size += n
+	if b.size <= logLimit {
+		b.data.Write(p[:n])
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	if err != nil {
+		b.log()
+	}
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	b.log()
+	return b.body.Close()
+}
+
+func (b *loggedBody) log() {
+	if b.logged {
+		return
+	}
+	b.logged = true
+
+	fields := map[string]interface{}{
+		"url":            b.url,
+		"status":         b.status,
+		"headers":        b.headers,
+		"header_time_ms": b.header.Milliseconds(),
+		"duration_ms":    time.Since(b.start).Milliseconds(),
+		"bytes":          b.size,
+	}
+	if b.size > logLimit {
+		fields["body"] = "(too large to log)"
+	} else if b.size > 0 {
+		fields["body"] = logBody(b.data.Bytes())
+	}
+	if b.err != nil {
+		fields["error"] = b.err.Error()
+	}
+	debuglog.Log("response", fields)
+}
+
+func logBody(data []byte) string {
+	if len(data) > logLimit {
+		return "(too large to log)"
+	}
+	return debuglog.Body(data)
+}
+
+// redactURL masks keys passed as query parameters.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	for name := range query {
+		switch strings.ToLower(name) {
+		case "key", "api-key", "api_key", "apikey", "token", "access_token":
+			query.Set(name, "[redacted]")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	redacted.User = nil
+	return redacted.String()
+}
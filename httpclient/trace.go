@@ -0,0 +1,63 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Connection describes the connection a request was sent over.
+type Connection struct {
+	Observed time.Time
+	Reused   bool
+	// Setup is how long getting the connection took: DNS, connecting and the
+	// TLS handshake for a new one, close to nothing for a reused one.
+	Setup    time.Duration
+	Protocol string
+}
+
+var (
+	lastConnection Connection
+	connectionMu   sync.Mutex
+)
+
+// LastConnection returns the connection of the most recent request.
+func LastConnection() (Connection, bool) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	return lastConnection, !lastConnection.Observed.IsZero()
+}
+
+// tracingTransport records the Connection of every request.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var getConn time.Time
+	connection := Connection{}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			getConn = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			connection.Reused = info.Reused
+			if !getConn.IsZero() {
+				connection.Setup = time.Since(getConn)
+			}
+		},
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		return resp, err
+	}
+
+	connection.Observed = time.Now()
+	connection.Protocol = resp.Proto
+	connectionMu.Lock()
+	lastConnection = connection
+	connectionMu.Unlock()
+	return resp, nil
+}
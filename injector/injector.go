@@ -0,0 +1,221 @@
+package injector
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/codeindex"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/envschema"
+	"github.com/rojolang/terminalgpt/truncate"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Options choose which files mentioned in a prompt are injected.
+type Options struct {
+	// Extensions are injected wherever the file is in the project.
+	Extensions []string
+	// Inject are globs of further files to inject, Ignore globs of files
+	// never to inject, both relative to the working directory.
+	Inject []string
+	Ignore []string
+	// Budget is the number of tokens the prompt with the injected files may
+	// use, 0 for no limit. Files over it are cut with Truncation, one of the
+	// truncate strategies, counting tokens for ModelName.
+	Budget     int
+	Truncation string
+	ModelName  string
+}
+
+// overhead covers the chat format tokens around the prompt.
+const overhead = 50
+
+// ForMode returns the options of the running mode: the configured
+// inject_extensions plus the mode's own extensions, the project globs, and
+// the budget left next to the system message and the response.
+func ForMode(cfg *config.Config, runMode string) Options {
+	extensions := cfg.InjectExtensions
+	if extensions == nil {
+		extensions = config.DefaultInjectExtensions
+	}
+	extensions = append([]string{}, extensions...)
+	if mode, ok := cfg.Modes[runMode]; ok {
+		extensions = append(extensions, mode.Extensions...)
+	}
+	truncation := cfg.InjectTruncation
+	if truncation == "" {
+		truncation = truncate.StrategyHeadTail
+	}
+	count := truncate.Counter(cfg.ModelName)
+	return Options{
+		Extensions: extensions,
+		Inject:     cfg.InjectGlobs,
+		Ignore:     cfg.IgnoreGlobs,
+		Budget:     max(cfg.MaxTotalTokens-cfg.MaxResponseTokens-count(cfg.SystemMessage)-overhead, 1),
+		Truncation: truncation,
+		ModelName:  cfg.ModelName,
+	}
+}
+
+// words are the whitespace separated words of a prompt, or its quoted
+// phrases so paths with spaces can be mentioned as "my notes/todo.md".
+var words = regexp.MustCompile("\"([^\"]+)\"|'([^']+)'|`([^`]+)`|(\\S+)")
+
+// Candidates returns the words of message that may name files, in order.
+// Punctuation around unquoted words is dropped, so "main.go," and
+// "(main.go)" name main.go.
+func Candidates(message string) []string {
+	candidates := []string{}
+	for _, match := range words.FindAllStringSubmatch(message, -1) {
+		word := match[1] + match[2] + match[3]
+		if match[4] != "" {
+			word = strings.Trim(match[4], ",;:!?()[]{}<>\"'`")
+			word = strings.TrimRight(word, ".")
+		}
+		if word != "" {
+			candidates = append(candidates, word)
+		}
+	}
+	return candidates
+}
+
+// file is a file to inject.
+type file struct {
+	name    string
+	path    string
+	content string
+}
+
+// Inject appends the content of every file mentioned in message that has one
+// of the extensions or matches the inject globs, and returns the paths of the
+// injected files. Files that do not fit the budget are cut.
+func Inject(message string, workingDirectory string, options Options) (string, []string) {
+	seen := map[string]bool{}
+	files := []file{}
+
+	for _, name := range Candidates(message) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		// links are fetched by fetch_urls, not looked up as files
+		if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+			continue
+		}
+		byExtension := hasExtension(name, options.Extensions)
+		if !byExtension && (len(options.Inject) == 0 || !strings.ContainsAny(name, `./\`)) {
+			continue
+		}
+
+		// secrets never leave the machine, --env-schema sends a masked description instead
+		if envschema.IsEnvFile(name) {
+			fmt.Printf("Refusing to inject %s, use --env-schema to send its variable names only\n", name)
+			continue
+		}
+
+		path, err := config.FindFile(name, workingDirectory)
+		if err != nil {
+			if byExtension {
+				color.New(color.FgHiBlack).Println(err)
+			}
+			continue
+		}
+
+		rel, err := filepath.Rel(workingDirectory, path)
+		if err != nil {
+			rel = path
+		}
+		rel = filepath.ToSlash(rel)
+		if !byExtension && !codeindex.MatchPatterns(options.Inject, rel) {
+			continue
+		}
+		if codeindex.MatchPatterns(options.Ignore, rel) {
+			fmt.Printf("Not injecting %s, it matches the project's ignore patterns\n", rel)
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Println("Failed to read file content: ", err)
+			continue
+		}
+
+		files = append(files, file{name: name, path: path, content: string(content)})
+	}
+
+	if options.Budget > 0 && options.Truncation != truncate.StrategyOff {
+		fit(files, options.Budget-truncate.Counter(options.ModelName)(message), options)
+	}
+
+	injected := []string{}
+	var sb strings.Builder
+	sb.WriteString(message)
+	for _, f := range files {
+		injected = append(injected, f.path)
+		sb.WriteString(header(f.name) + f.content + footer)
+	}
+	return sb.String(), injected
+}
+
+func header(name string) string {
+	return "\n\nMy  " + name + " file is:\n==\n"
+}
+
+const footer = "\n==\n"
+
+// fit cuts files to budget tokens in total. Files smaller than an even share
+// are kept whole and leave the rest of their share to the larger ones.
+func fit(files []file, budget int, options Options) {
+	count := truncate.Counter(options.ModelName)
+	tokens := make([]int, len(files))
+	total := 0
+	for i, f := range files {
+		tokens[i] = count(header(f.name)+footer) + count(f.content)
+		total += tokens[i]
+	}
+	if total <= budget {
+		return
+	}
+
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return tokens[order[a]] < tokens[order[b]] })
+
+	gray := color.New(color.FgHiBlack)
+	remaining := max(budget, 0)
+	for n, i := range order {
+		share := remaining / (len(order) - n)
+		if tokens[i] <= share {
+			remaining -= tokens[i]
+			continue
+		}
+		remaining -= share
+
+		f := &files[i]
+		lines := strings.Count(f.content, "\n") + 1
+		result := truncate.Fit(f.content, max(share-count(header(f.name)+footer), 1), options.Truncation, options.ModelName)
+		f.content = result.Text
+		gray.Printf("Cut %s to fit the token budget (%s): %d of %d lines omitted\n", f.name, result.Strategy, result.Omitted, lines)
+	}
+}
+
+// hasExtension reports whether fileName ends in one of extensions, which may
+// be given with or without the leading dot. A bare extension such as ".yaml"
+// does not name a file.
+func hasExtension(fileName string, extensions []string) bool {
+	for _, ext := range extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if strings.HasSuffix(strings.ToLower(fileName), strings.ToLower(ext)) && len(fileName) > len(ext) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package input
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Commands are the prompt commands Tab completes at the start of the input.
+var Commands []string
+
+// Files lists the project files Tab completes, slash separated and relative to
+// the working directory. nil turns file completion off.
+var Files func() []string
+
+// maxHints is how many candidates are listed when Tab finds several.
+const maxHints = 12
+
+// complete extends the word before the cursor to the longest prefix shared by
+// its candidates, and lists them below the input when there are several.
+func (l *line) complete() {
+	start := l.pos
+	for start > 0 && !unicode.IsSpace(l.buf[start-1]) {
+		start--
+	}
+	word := string(l.buf[start:l.pos])
+
+	var candidates []string
+	if start == 0 && strings.HasPrefix(word, "-") {
+		for _, command := range Commands {
+			if strings.HasPrefix(command, word) {
+				candidates = append(candidates, command+" ")
+			}
+		}
+	} else if Files != nil && word != "" {
+		candidates = completeFile(word, Files())
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	common := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(candidates) == 1 || len(common) > len(word) {
+		l.delete(start, l.pos)
+		for _, r := range common {
+			l.insert(r)
+		}
+	}
+	if len(candidates) > 1 {
+		hints := candidates
+		if len(hints) > maxHints {
+			hints = hints[:maxHints]
+		}
+		l.hint = strings.TrimSpace(strings.Join(hints, "  "))
+		if len(candidates) > maxHints {
+			l.hint += "  …"
+		}
+	}
+}
+
+// completeFile returns the completions of word among files: paths starting
+// with word up to their next directory, or when there are none, the paths of
+// files whose name starts with word.
+func completeFile(word string, files []string) []string {
+	seen := map[string]bool{}
+	var candidates []string
+	add := func(candidate string) {
+		if !seen[candidate] {
+			seen[candidate] = true
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	// the indexed paths use slashes on Windows too
+	word = filepath.ToSlash(word)
+	for _, file := range files {
+		if !strings.HasPrefix(file, word) {
+			continue
+		}
+		if slash := strings.Index(file[len(word):], "/"); slash >= 0 {
+			add(file[:len(word)+slash+1])
+		} else {
+			add(file + " ")
+		}
+	}
+
+	if len(candidates) == 0 && !strings.Contains(word, "/") {
+		for _, file := range files {
+			if strings.HasPrefix(path.Base(file), word) {
+				add(file + " ")
+			}
+		}
+	}
+
+	sort.Strings(candidates)
+	return candidates
+}
@@ -0,0 +1,137 @@
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/vault"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HistoryFile keeps the prompts typed at the chat prompt, one JSON string per
+// line so multi-line prompts survive.
+var HistoryFile = appdir.Path("input_history")
+
+// maxHistory is how many prompts are kept in HistoryFile.
+const maxHistory = 1000
+
+// history is the list of earlier prompts the up and down keys and Ctrl-R walk
+// through, oldest first.
+type history struct {
+	entries []string
+	// index is the entry shown, len(entries) is the input being typed
+	index int
+	draft []rune
+	// stored is the number of lines in HistoryFile
+	stored int
+}
+
+func loadHistory() *history {
+	h := &history{}
+	file, err := os.Open(HistoryFile)
+	if err != nil {
+		return h
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line, err := vault.Open(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		var entry string
+		if json.Unmarshal(line, &entry) == nil && entry != "" {
+			h.entries = append(h.entries, entry)
+		}
+	}
+	h.stored = len(h.entries)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+	h.index = len(h.entries)
+	return h
+}
+
+// add appends a submitted prompt to the history and to HistoryFile, skipping
+// blank prompts and repeats of the previous one.
+func (h *history) add(entry string) error {
+	if strings.TrimSpace(entry) == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return nil
+	}
+	h.entries = append(h.entries, entry)
+
+	err := os.MkdirAll(filepath.Dir(HistoryFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+
+	// rewrite the file once it has grown well past the limit
+	if h.stored >= 2*maxHistory {
+		h.stored = len(h.entries)
+		var sb strings.Builder
+		for _, e := range h.entries {
+			line, err := marshalEntry(e)
+			if err != nil {
+				return err
+			}
+			sb.Write(line)
+			sb.WriteByte('\n')
+		}
+		return os.WriteFile(HistoryFile, []byte(sb.String()), 0600)
+	}
+
+	file, err := os.OpenFile(HistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h.stored++
+	line, err := marshalEntry(entry)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// marshalEntry returns the line of entry in HistoryFile, encrypted when
+// history_encryption is on.
+func marshalEntry(entry string) ([]byte, error) {
+	line, _ := json.Marshal(entry)
+	return vault.Seal(line)
+}
+
+// move walks delta entries through the history from the current input,
+// returning false at either end.
+func (h *history) move(delta int, current []rune) ([]rune, bool) {
+	next := h.index + delta
+	if next < 0 || next > len(h.entries) {
+		return nil, false
+	}
+	if h.index == len(h.entries) {
+		h.draft = append([]rune{}, current...)
+	}
+	h.index = next
+	if next == len(h.entries) {
+		return append([]rune{}, h.draft...), true
+	}
+	return []rune(h.entries[next]), true
+}
+
+// search finds the newest entry before index containing query.
+func (h *history) search(query string, before int) (int, bool) {
+	for i := before - 1; i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,522 @@
+package input
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/termcap"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrInterrupted is returned when the user presses Ctrl-C while typing.
+var ErrInterrupted = errors.New("interrupted")
+
+// maxRows limits how many terminal rows the pending prompt may take up, longer
+// input such as big pastes only shows its tail.
+const maxRows = 8
+
+// budgetWarning is the share of the input budget at which the counter turns yellow.
+const budgetWarning = 0.8
+
+// ReadPrompt reads one prompt from the terminal. On a terminal it shows a live
+// count of the input tokens and their estimated cost below the input, and
+// keeps pasted newlines instead of submitting on them. The input can be
+// edited with the usual Emacs keys, and earlier prompts are recalled with the
+// up and down keys or searched with Ctrl-R. Otherwise it reads a plain line
+// from reader.
+func ReadPrompt(reader *bufio.Reader, prompt string, promptColor *color.Color, cfg *config.Config) (string, error) {
+	if promptHistory == nil {
+		promptHistory = loadHistory()
+	}
+	promptHistory.index = len(promptHistory.entries)
+
+	l := &line{prompt: prompt, promptColor: promptColor, cfg: cfg, counter: newCounter(cfg.ModelName), history: promptHistory, completes: true}
+	answer, err := read(reader, l)
+	if err == nil {
+		if err := promptHistory.add(answer); err != nil {
+			color.Red("Failed to save the input history: %v\n", err)
+		}
+	}
+	return answer, err
+}
+
+// ReadLine reads one line with the editing keys of ReadPrompt, but without
+// the token counter and history, e.g. for answers to the config prompts.
+func ReadLine(reader *bufio.Reader, prompt string) (string, error) {
+	return read(reader, &line{prompt: prompt, promptColor: color.New()})
+}
+
+// promptHistory is loaded from HistoryFile on the first prompt.
+var promptHistory *history
+
+func read(reader *bufio.Reader, l *line) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !termcap.Get().TTY {
+		l.promptColor.Print(l.prompt)
+		line, err := reader.ReadString('\n')
+		return strings.TrimSpace(line), err
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		l.promptColor.Print(l.prompt)
+		line, err := reader.ReadString('\n')
+		return strings.TrimSpace(line), err
+	}
+	defer term.Restore(fd, state)
+
+	// bracketed paste lets us tell typed enters from pasted newlines
+	fmt.Print("\033[?2004h")
+	defer fmt.Print("\033[?2004l")
+
+	l.render()
+
+	pasting := false
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			l.finish()
+			return strings.TrimSpace(string(l.buf)), err
+		}
+
+		l.hint = ""
+		escape := ""
+		if r == 27 {
+			escape = readEscape(reader)
+			switch escape {
+			case "[200~":
+				pasting = true
+				continue
+			case "[201~":
+				pasting = false
+				continue
+			}
+		}
+
+		if l.searching {
+			if !l.searchKey(r) {
+				if r == '\r' || r == '\n' {
+					l.finish()
+					return strings.TrimSpace(string(l.buf)), nil
+				}
+				l.edit(r, escape)
+			}
+		} else {
+			switch r {
+			case '\r', '\n':
+				if !pasting {
+					l.finish()
+					return strings.TrimSpace(string(l.buf)), nil
+				}
+				l.insert('\n')
+			case '\t':
+				if pasting || !l.completes {
+					l.insert('\t')
+				} else {
+					l.complete()
+				}
+			case 3: // Ctrl-C
+				l.finish()
+				return "", ErrInterrupted
+			case 4: // Ctrl-D
+				if len(l.buf) == 0 {
+					l.finish()
+					return "", io.EOF
+				}
+				l.edit(r, escape)
+			default:
+				l.edit(r, escape)
+			}
+		}
+
+		// only count and redraw once the pending input is consumed, so pastes
+		// and fast typing are not tokenized keystroke by keystroke
+		if reader.Buffered() == 0 {
+			l.count()
+			l.render()
+		}
+	}
+}
+
+// edit applies an editing key to the input. escape is the sequence read
+// after ESC, e.g. "[A" for the up key or "b" for Alt-b.
+func (l *line) edit(r rune, escape string) {
+	switch r {
+	case 1: // Ctrl-A
+		l.pos = 0
+	case 5: // Ctrl-E
+		l.pos = len(l.buf)
+	case 2: // Ctrl-B
+		l.pos = max(l.pos-1, 0)
+	case 6: // Ctrl-F
+		l.pos = min(l.pos+1, len(l.buf))
+	case 4: // Ctrl-D
+		l.delete(l.pos, l.pos+1)
+	case 127, '\b':
+		l.delete(l.pos-1, l.pos)
+	case 11: // Ctrl-K
+		l.kill(l.pos, len(l.buf))
+	case 21: // Ctrl-U
+		l.kill(0, l.pos)
+	case 23: // Ctrl-W
+		l.kill(l.wordStart(), l.pos)
+	case 25: // Ctrl-Y
+		for _, k := range l.killed {
+			l.insert(k)
+		}
+	case 16: // Ctrl-P
+		l.recall(-1)
+	case 14: // Ctrl-N
+		l.recall(1)
+	case 18: // Ctrl-R
+		if l.history != nil {
+			l.searching = true
+			l.query = nil
+			l.match = len(l.history.entries)
+			l.original = append([]rune{}, l.buf...)
+		}
+	case 27:
+		switch escape {
+		case "[A", "OA":
+			l.recall(-1)
+		case "[B", "OB":
+			l.recall(1)
+		case "[C", "OC":
+			l.pos = min(l.pos+1, len(l.buf))
+		case "[D", "OD":
+			l.pos = max(l.pos-1, 0)
+		case "[H", "OH", "[1~", "[7~":
+			l.pos = 0
+		case "[F", "OF", "[4~", "[8~":
+			l.pos = len(l.buf)
+		case "[3~":
+			l.delete(l.pos, l.pos+1)
+		case "b", "[1;5D", "[1;3D":
+			l.pos = l.wordStart()
+		case "f", "[1;5C", "[1;3C":
+			l.pos = l.wordEnd()
+		case "d":
+			l.kill(l.pos, l.wordEnd())
+		case "\x7f":
+			l.kill(l.wordStart(), l.pos)
+		}
+	default:
+		if r == '\t' || r >= 32 {
+			l.insert(r)
+		}
+	}
+}
+
+// searchKey handles a key during a Ctrl-R search and reports whether it did.
+// Other keys end the search, keeping the match as the input.
+func (l *line) searchKey(r rune) bool {
+	switch {
+	case r == 18: // Ctrl-R, the next older match
+		if index, ok := l.history.search(string(l.query), l.match); ok && len(l.query) > 0 {
+			l.show(index)
+		}
+	case r == 7 || r == 3: // Ctrl-G or Ctrl-C, back to the input before the search
+		l.searching = false
+		l.buf = l.original
+		l.pos = len(l.buf)
+	case r == 127 || r == '\b':
+		if len(l.query) > 0 {
+			l.query = l.query[:len(l.query)-1]
+			l.match = len(l.history.entries)
+			l.find()
+		}
+	case r >= 32:
+		l.query = append(l.query, r)
+		l.find()
+	default:
+		l.searching = false
+		return false
+	}
+	return true
+}
+
+// find shows the newest entry at or before the current match containing the query.
+func (l *line) find() {
+	if len(l.query) == 0 {
+		return
+	}
+	if index, ok := l.history.search(string(l.query), min(l.match+1, len(l.history.entries))); ok {
+		l.show(index)
+	}
+}
+
+func (l *line) show(index int) {
+	l.match = index
+	l.buf = []rune(l.history.entries[index])
+	l.pos = strings.Index(l.history.entries[index], string(l.query))
+	l.pos = utf8.RuneCountInString(l.history.entries[index][:max(l.pos, 0)])
+	l.history.index = index
+}
+
+func (l *line) recall(delta int) {
+	if l.history == nil {
+		return
+	}
+	if entry, ok := l.history.move(delta, l.buf); ok {
+		l.buf = entry
+		l.pos = len(l.buf)
+	}
+}
+
+func (l *line) insert(r rune) {
+	l.buf = append(l.buf[:l.pos], append([]rune{r}, l.buf[l.pos:]...)...)
+	l.pos++
+}
+
+func (l *line) delete(from, to int) {
+	from, to = max(from, 0), min(to, len(l.buf))
+	if from >= to {
+		return
+	}
+	l.buf = append(l.buf[:from], l.buf[to:]...)
+	l.pos = from
+}
+
+// kill deletes a range and keeps it for Ctrl-Y.
+func (l *line) kill(from, to int) {
+	from, to = max(from, 0), min(to, len(l.buf))
+	if from < to {
+		l.killed = append([]rune{}, l.buf[from:to]...)
+	}
+	l.delete(from, to)
+}
+
+func (l *line) wordStart() int {
+	pos := l.pos
+	for pos > 0 && unicode.IsSpace(l.buf[pos-1]) {
+		pos--
+	}
+	for pos > 0 && !unicode.IsSpace(l.buf[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+func (l *line) wordEnd() int {
+	pos := l.pos
+	for pos < len(l.buf) && unicode.IsSpace(l.buf[pos]) {
+		pos++
+	}
+	for pos < len(l.buf) && !unicode.IsSpace(l.buf[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// readEscape consumes the sequence after ESC: a CSI sequence such as "[A"
+// or "[200~" for the start of a bracketed paste, an SS3 sequence such as
+// "OH", or the key pressed with Alt such as "b".
+func readEscape(reader *bufio.Reader) string {
+	next, err := reader.ReadByte()
+	if err != nil {
+		return ""
+	}
+	switch next {
+	case 'O':
+		final, err := reader.ReadByte()
+		if err != nil {
+			return "O"
+		}
+		return "O" + string(final)
+	case '[':
+	default:
+		return string(next)
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return sb.String()
+		}
+		sb.WriteByte(b)
+		if b >= 0x40 && b <= 0x7e {
+			return sb.String()
+		}
+	}
+}
+
+type line struct {
+	prompt      string
+	promptColor *color.Color
+	cfg         *config.Config
+	counter     *counter
+	history     *history
+	completes   bool
+	hint        string
+	buf         []rune
+	pos         int
+	killed      []rune
+	tokens      int
+	rows        int
+	cursorRow   int
+
+	// Ctrl-R search
+	searching bool
+	query     []rune
+	match     int
+	original  []rune
+}
+
+func (l *line) count() {
+	if l.counter != nil {
+		l.tokens = l.counter.count(string(l.buf))
+	}
+}
+
+// render redraws the prompt, the input and the counter line below it, leaving
+// the cursor at its place in the input.
+func (l *line) render() {
+	width := terminalWidth()
+	prompt := l.promptColor.Sprint(l.prompt)
+	promptLength := utf8.RuneCountInString(l.prompt)
+	if l.searching {
+		label := fmt.Sprintf("(reverse-i-search)`%s': ", string(l.query))
+		prompt = color.New(color.FgHiBlack).Sprint(label)
+		promptLength = utf8.RuneCountInString(label)
+	}
+
+	// newlines and tabs take one column each, so positions in the input and
+	// on the screen match
+	text := []rune(strings.NewReplacer("\n", "↵", "\t", " ").Replace(string(l.buf)))
+	start, end := 0, len(text)
+	room := width*maxRows - promptLength
+	if room > 2 && len(text) > room {
+		// show the end of the input, or the part around the cursor
+		start = len(text) - room + 1
+		if l.pos <= start {
+			start = max(l.pos-1, 0)
+		}
+		end = min(start+room, len(text))
+	}
+	shown := append([]rune{}, text[start:end]...)
+	if start > 0 {
+		shown[0] = '…'
+	}
+	if end < len(text) {
+		shown[len(shown)-1] = '…'
+	}
+
+	var sb strings.Builder
+	if l.cursorRow > 0 {
+		fmt.Fprintf(&sb, "\033[%dA", l.cursorRow)
+	}
+	sb.WriteString("\r\033[J")
+	sb.WriteString(prompt)
+	sb.WriteString(string(shown))
+
+	length := promptLength + len(shown)
+	if length > 0 && length%width == 0 {
+		// the terminal waits to wrap after a full row, wrap now so the
+		// lines below are where they are expected
+		sb.WriteString(" \r")
+	}
+	rows := length/width + 1
+	cursor := promptLength + l.pos - start
+	l.cursorRow = cursor / width
+
+	up := rows - 1 - l.cursorRow
+	if l.counter != nil {
+		status := l.status()
+		if hint := []rune(l.hint); len(hint) > 0 {
+			if len(hint) >= width {
+				hint = append(hint[:width-2], '…')
+			}
+			status = color.New(color.FgHiBlack).Sprint(string(hint))
+		}
+		fmt.Fprintf(&sb, "\r\n\033[2K%s", status)
+		up++
+	}
+	if up > 0 {
+		fmt.Fprintf(&sb, "\033[%dA", up)
+	}
+	fmt.Fprintf(&sb, "\033[%dG", cursor%width+1)
+	l.rows = rows
+	fmt.Print(sb.String())
+}
+
+// finish removes the counter line and moves to a fresh line, like a plain
+// terminal does after enter.
+func (l *line) finish() {
+	if down := l.rows - 1 - l.cursorRow; down > 0 {
+		fmt.Printf("\033[%dB", down)
+	}
+	fmt.Print("\r\n\033[2K")
+}
+
+func (l *line) status() string {
+	approx := ""
+	if l.counter.estimated {
+		approx = "~"
+	}
+	status := fmt.Sprintf("%s%d tokens", approx, l.tokens)
+	if cost, ok := helpers.InputCost(l.cfg.ModelName, l.tokens); ok {
+		status += fmt.Sprintf(" · ~$%.4f", cost)
+	}
+
+	budget := l.cfg.MaxTotalTokens - l.cfg.MaxResponseTokens
+	if budget <= 0 {
+		return color.New(color.FgHiBlack).Sprint(status)
+	}
+	share := float64(l.tokens) / float64(budget)
+	status += fmt.Sprintf(" · %.0f%% of the %d token input budget", share*100, budget)
+
+	switch {
+	case share >= 1:
+		return color.New(color.FgRed).Sprint(status + " · too long, history will be dropped or the request rejected")
+	case share >= budgetWarning:
+		return color.New(color.FgYellow).Sprint(status + " · close to the budget")
+	}
+	return color.New(color.FgHiBlack).Sprint(status)
+}
+
+// counter counts tokens with the local tokenizer, estimating them when the
+// tokenizer is unavailable.
+type counter struct {
+	tokenize  func(string) int
+	model     string
+	estimated bool
+}
+
+// counters keeps one counter per model so the tokenizer is built only once.
+var counters = make(map[string]*counter)
+
+func newCounter(modelName string) *counter {
+	if c, ok := counters[modelName]; ok {
+		return c
+	}
+	c := &counter{model: modelName, estimated: true}
+	if tokenize, err := helpers.LocalTokenizer(modelName); err == nil {
+		c = &counter{tokenize: tokenize}
+	}
+	counters[modelName] = c
+	return c
+}
+
+func (c *counter) count(text string) int {
+	if c.tokenize == nil {
+		return helpers.EstimateTokens(text, c.model)
+	}
+	return c.tokenize(text)
+}
+
+func terminalWidth() int {
+	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 {
+		return width
+	}
+	return termcap.Width()
+}
@@ -0,0 +1,336 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/render"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var JobsDir = appdir.Path("jobs")
+
+const (
+	// CheckInterval is how often the daemon looks for due jobs.
+	CheckInterval = 30 * time.Second
+
+	// commandTimeout limits the command whose output is sent with a prompt.
+	commandTimeout = time.Minute
+
+	// maxCommandOutput is how much of the end of that output is sent.
+	maxCommandOutput = 20000
+)
+
+// Job is a standing prompt, asked daily at a time of day or every interval.
+type Job struct {
+	ID     string `json:"id"`
+	Prompt string `json:"prompt"`
+	// At is the time of day like 17:30 the job runs at, every day.
+	At string `json:"at,omitempty"`
+	// Every is the interval like 1h the job runs at instead.
+	Every string `json:"every,omitempty"`
+	// Command runs in Dir before the prompt is asked, its output is sent
+	// with the prompt.
+	Command string `json:"command,omitempty"`
+	Dir     string `json:"dir"`
+	Model   string `json:"model,omitempty"`
+	// Output is the file the answers are appended to.
+	Output string `json:"output"`
+	// Notify also shows the answer as a desktop notification.
+	Notify    bool      `json:"notify,omitempty"`
+	Created   time.Time `json:"created"`
+	LastRun   time.Time `json:"last_run,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Validate checks that the job has a prompt and exactly one valid schedule.
+func (j Job) Validate() error {
+	if strings.TrimSpace(j.Prompt) == "" {
+		return fmt.Errorf("the job has no prompt")
+	}
+	if (j.At == "") == (j.Every == "") {
+		return fmt.Errorf("give the job a time of day with --at or an interval with --every")
+	}
+	if j.At != "" {
+		_, err := time.Parse("15:04", j.At)
+		if err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM like 17:30", j.At)
+		}
+	}
+	if j.Every != "" {
+		every, err := time.ParseDuration(j.Every)
+		if err != nil || every < time.Minute {
+			return fmt.Errorf("invalid interval %q, expected at least a minute like 30m or 6h", j.Every)
+		}
+	}
+	return nil
+}
+
+// Next returns when the job runs next: after its last run, or after it was
+// created when it never ran. A run missed while the daemon was down is due
+// right away.
+func (j Job) Next() time.Time {
+	from := j.LastRun
+	if from.IsZero() {
+		from = j.Created
+	}
+	if j.Every != "" {
+		every, _ := time.ParseDuration(j.Every)
+		return from.Add(every)
+	}
+	at, _ := time.Parse("15:04", j.At)
+	from = from.Local()
+	next := time.Date(from.Year(), from.Month(), from.Day(), at.Hour(), at.Minute(), 0, 0, time.Local)
+	if !next.After(from) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Schedule describes when the job runs.
+func (j Job) Schedule() string {
+	if j.Every != "" {
+		return "every " + j.Every
+	}
+	return "daily at " + j.At
+}
+
+// Add stores a new job and returns it with its ID and output file.
+func Add(job Job) (Job, error) {
+	err := job.Validate()
+	if err != nil {
+		return job, err
+	}
+	err = os.MkdirAll(JobsDir, 0700)
+	if err != nil {
+		return job, fmt.Errorf("failed to create %s: %w", JobsDir, err)
+	}
+
+	existing, err := List()
+	if err != nil {
+		return job, err
+	}
+	id := 1
+	for _, other := range existing {
+		if n, err := strconv.Atoi(other.ID); err == nil && n >= id {
+			id = n + 1
+		}
+	}
+	job.ID = strconv.Itoa(id)
+	job.Created = time.Now()
+	if job.Output == "" {
+		job.Output = filepath.Join(JobsDir, job.ID+".md")
+	}
+	return job, Save(job)
+}
+
+// Save writes the job to its file in JobsDir.
+func Save(job Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(JobsDir, job.ID+".json"), data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// List returns the stored jobs in the order they were added.
+func List() ([]Job, error) {
+	entries, err := ioutil.ReadDir(JobsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Job{}, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", JobsDir, err)
+	}
+
+	jobs := []Job{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		job, err := Load(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a < b
+	})
+	return jobs, nil
+}
+
+// Load reads the job with id.
+func Load(id string) (Job, error) {
+	var job Job
+	data, err := ioutil.ReadFile(filepath.Join(JobsDir, filepath.Base(id)+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return job, fmt.Errorf("no job %s, see terminalgpt cron list", id)
+		}
+		return job, err
+	}
+	err = json.Unmarshal(data, &job)
+	if err != nil {
+		return job, fmt.Errorf("failed to parse job %s: %w", id, err)
+	}
+	return job, nil
+}
+
+// Remove deletes the job with id. Its output file is kept.
+func Remove(id string) error {
+	_, err := Load(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(JobsDir, filepath.Base(id)+".json"))
+}
+
+// Run asks the job's prompt now, appends the answer to its output file and
+// records the run.
+func Run(cfg *config.Config, job Job) (string, error) {
+	answer, err := ask(cfg, job)
+	job.LastRun = time.Now()
+	job.LastError = ""
+	if err != nil {
+		job.LastError = err.Error()
+		answer = "Failed: " + err.Error()
+	}
+
+	writeErr := appendOutput(job, answer)
+	if job.Notify {
+		notify("terminalgpt: "+firstLine(job.Prompt), answer)
+	}
+	saveErr := Save(job)
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = saveErr
+	}
+	return answer, err
+}
+
+// Daemon runs the due jobs every CheckInterval until the process is stopped.
+// Jobs are reread on every check, so added and removed jobs take effect
+// without a restart.
+func Daemon(cfg *config.Config, logf func(format string, args ...interface{})) error {
+	for {
+		jobs, err := List()
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if time.Now().Before(job.Next()) {
+				continue
+			}
+			logf("Running job %s: %s\n", job.ID, firstLine(job.Prompt))
+			_, err := Run(cfg, job)
+			if err != nil {
+				logf("Job %s failed: %v\n", job.ID, err)
+				continue
+			}
+			logf("Job %s done, wrote %s\n", job.ID, job.Output)
+		}
+		time.Sleep(CheckInterval)
+	}
+}
+
+func ask(cfg *config.Config, job Job) (string, error) {
+	runCfg := *cfg
+	runCfg.History = false
+	if job.Model != "" {
+		runCfg.ModelName = job.Model
+	}
+
+	prompt := job.Prompt
+	if job.Command != "" {
+		output, err := runCommand(job.Command, job.Dir)
+		if err != nil {
+			return "", err
+		}
+		prompt += fmt.Sprintf("\n\nOutput of `%s`:\n\n```\n%s\n```\n", job.Command, output)
+	}
+
+	// answers go to the output file, not the terminal of the daemon
+	ctx := render.WithSink(context.Background(), func(string) {})
+	response, _, _, _, _, err := common.GenerateCompletionContext(ctx, &runCfg, prompt)
+	return response, err
+}
+
+func runCommand(command, dir string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w\n%s", command, err, strings.TrimSpace(string(output)))
+	}
+	if len(output) > maxCommandOutput {
+		output = append([]byte("...\n"), output[len(output)-maxCommandOutput:]...)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func appendOutput(job Job, answer string) error {
+	err := os.MkdirAll(filepath.Dir(job.Output), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", job.Output, err)
+	}
+	file, err := os.OpenFile(job.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", job.Output, err)
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "## %s: %s\n\n%s\n\n", job.LastRun.Format("2006-01-02 15:04"), firstLine(job.Prompt), strings.TrimSpace(answer))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", job.Output, err)
+	}
+	return nil
+}
+
+// notify shows a desktop notification where the platform has a command for
+// it, failures are ignored since the answer is in the output file anyway.
+func notify(title, body string) {
+	if runes := []rune(body); len(runes) > 200 {
+		body = string(runes[:200]) + "..."
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(body), strconv.Quote(title))
+		exec.Command("osascript", "-e", script).Run()
+	case "windows":
+		// no notification command ships with Windows
+	default:
+		exec.Command("notify-send", title, body).Run()
+	}
+}
+
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if runes := []rune(line); len(runes) > 60 {
+		line = string(runes[:60]) + "..."
+	}
+	return line
+}
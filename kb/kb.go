@@ -0,0 +1,313 @@
+package kb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/embeddings"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/trash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var KBDir = appdir.Path("kb")
+
+const (
+	DefaultName        = "default"
+	DefaultTopK        = 5
+	DefaultChunkTokens = 400
+
+	maxFileBytes   = 1024 * 1024
+	embedBatchSize = 64
+	overlapLines   = 3
+)
+
+type Chunk struct {
+	Source    string    `json:"source"`
+	StartLine int       `json:"start_line"`
+	Text      string    `json:"text"`
+	Vector    []float32 `json:"vector"`
+}
+
+type Index struct {
+	Name   string  `json:"name"`
+	Model  string  `json:"model"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Add chunks every text file under paths, embeds the chunks and stores them
+// in the named knowledge base, replacing earlier chunks of the same files.
+func Add(cfg *config.Config, name string, paths []string, chunkTokens int) (int, int, error) {
+	if chunkTokens <= 0 {
+		chunkTokens = DefaultChunkTokens
+	}
+
+	index, err := Load(name)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	if index.Model != "" && index.Model != cfg.EmbeddingModel {
+		return 0, 0, fmt.Errorf("knowledge base %q was built with %s, the configured embedding model is %s", name, index.Model, cfg.EmbeddingModel)
+	}
+	index.Name = name
+	index.Model = cfg.EmbeddingModel
+
+	files := []string{}
+	for _, path := range paths {
+		found, err := collectFiles(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		files = append(files, found...)
+	}
+
+	replaced := make(map[string]bool)
+	newChunks := []Chunk{}
+	for _, file := range files {
+		chunks, err := chunkFile(file, chunkTokens, cfg.ModelName)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", file, err)
+			continue
+		}
+		replaced[file] = true
+		newChunks = append(newChunks, chunks...)
+	}
+
+	for start := 0; start < len(newChunks); start += embedBatchSize {
+		end := start + embedBatchSize
+		if end > len(newChunks) {
+			end = len(newChunks)
+		}
+		fmt.Printf("\rEmbedding chunks %d-%d of %d", start+1, end, len(newChunks))
+
+		texts := []string{}
+		for _, chunk := range newChunks[start:end] {
+			texts = append(texts, chunk.Source+"\n"+chunk.Text)
+		}
+		vectors, err := embeddings.Fetch(cfg, texts)
+		if err != nil {
+			fmt.Println()
+			return 0, 0, err
+		}
+		for i, vector := range vectors {
+			newChunks[start+i].Vector = vector
+		}
+	}
+	if len(newChunks) > 0 {
+		fmt.Println()
+	}
+
+	kept := []Chunk{}
+	for _, chunk := range index.Chunks {
+		if !replaced[chunk.Source] {
+			kept = append(kept, chunk)
+		}
+	}
+	index.Chunks = append(kept, newChunks...)
+
+	return len(replaced), len(newChunks), Save(index)
+}
+
+// Retrieve returns the k chunks of the knowledge base most similar to query.
+func Retrieve(cfg *config.Config, name string, query string, k int) ([]Chunk, error) {
+	index, err := Load(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("knowledge base %q does not exist, create it with `terminalgpt kb add`", name)
+		}
+		return nil, err
+	}
+	if len(index.Chunks) == 0 {
+		return []Chunk{}, nil
+	}
+
+	queryCfg := *cfg
+	if index.Model != "" {
+		queryCfg.EmbeddingModel = index.Model
+	}
+	vectors, err := embeddings.Fetch(&queryCfg, []string{query})
+	if err != nil {
+		return nil, err
+	}
+
+	type scored struct {
+		chunk Chunk
+		score float64
+	}
+	results := make([]scored, len(index.Chunks))
+	for i, chunk := range index.Chunks {
+		results[i] = scored{chunk, embeddings.Cosine(vectors[0], chunk.Vector)}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].score > results[j].score })
+
+	if k <= 0 {
+		k = DefaultTopK
+	}
+	if k > len(results) {
+		k = len(results)
+	}
+	chunks := []Chunk{}
+	for _, result := range results[:k] {
+		chunks = append(chunks, result.chunk)
+	}
+	return chunks, nil
+}
+
+// Inject appends the top k knowledge base excerpts for userMessage to it.
+func Inject(cfg *config.Config, name string, userMessage string, k int) (string, error) {
+	chunks, err := Retrieve(cfg, name, userMessage, k)
+	if err != nil {
+		return userMessage, err
+	}
+	if len(chunks) == 0 {
+		return userMessage, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(userMessage)
+	fmt.Fprintf(&sb, "\n\nRelevant excerpts from my %q knowledge base (cite them by number):\n", name)
+	for i, chunk := range chunks {
+		fmt.Fprintf(&sb, "\n[%d] %s:%d\n==\n%s\n==\n", i+1, chunk.Source, chunk.StartLine, chunk.Text)
+	}
+	return sb.String(), nil
+}
+
+// List returns the names of all knowledge bases.
+func List() ([]string, error) {
+	entries, err := ioutil.ReadDir(KBDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+		}
+	}
+	return names, nil
+}
+
+// Remove moves a knowledge base to the trash.
+func Remove(name string) error {
+	_, err := trash.Move(indexPath(name), fmt.Sprintf("knowledge base %s", name))
+	return err
+}
+
+func Load(name string) (Index, error) {
+	index := Index{Name: name}
+	data, err := ioutil.ReadFile(indexPath(name))
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return index, fmt.Errorf("failed to parse knowledge base %q: %w", name, err)
+	}
+	return index, nil
+}
+
+func Save(index Index) error {
+	err := os.MkdirAll(KBDir, 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath(index.Name), data, 0644)
+}
+
+func indexPath(name string) string {
+	return filepath.Join(KBDir, name+".json")
+}
+
+func collectFiles(root string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != root && (strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, ".") || info.Size() > maxFileBytes || info.Size() == 0 {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	return files, err
+}
+
+// chunkFile splits a text file into chunks of about chunkTokens tokens on line
+// boundaries, repeating a few lines between chunks for context.
+func chunkFile(path string, chunkTokens int, modelName string) ([]Chunk, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(data) || strings.ContainsRune(string(data[:min(len(data), 8000)]), 0) {
+		return nil, fmt.Errorf("not a text file")
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(make([]byte, 64*1024), maxFileBytes)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	chunks := []Chunk{}
+	start := 0
+	for start < len(lines) {
+		end := start
+		tokens := 0
+		for end < len(lines) {
+			lineTokens, err := helpers.CountTokens(lines[end], modelName)
+			if err != nil {
+				lineTokens = len(lines[end]) / 4
+			}
+			if tokens+lineTokens > chunkTokens && end > start {
+				break
+			}
+			tokens += lineTokens + 1
+			end++
+		}
+
+		text := strings.TrimSpace(strings.Join(lines[start:end], "\n"))
+		if text != "" {
+			chunks = append(chunks, Chunk{Source: path, StartLine: start + 1, Text: text})
+		}
+
+		if end >= len(lines) {
+			break
+		}
+		next := end - overlapLines
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,172 @@
+package mockapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Server answers like the OpenAI API, and like an Azure OpenAI deployment at
+// its URL, with canned answers, so the providers can be exercised without a
+// network or a key. Point base_url at BaseURL, or azure_url at URL.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	answers  []string
+	next     int
+	failures []failure
+	requests []Request
+	// Models are listed by GET /models.
+	Models []string
+}
+
+// Request is a chat completion the server received.
+type Request struct {
+	Path string
+	Body map[string]interface{}
+}
+
+type failure struct {
+	status  int
+	message string
+}
+
+// New starts a server giving the answers in turn, the last one again once
+// they run out.
+func New(answers ...string) *Server {
+	s := &Server{answers: answers, Models: []string{"gpt-4o", "gpt-4o-mini"}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// BaseURL is the base_url of the OpenAI compatible API.
+func (s *Server) BaseURL() string {
+	return s.URL + "/v1"
+}
+
+// Fail makes the next request fail with status and an OpenAI error message.
+func (s *Server) Fail(status int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{status, message})
+}
+
+// Requests returns the chat completions received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		s.mu.Unlock()
+		writeError(w, f.status, f.message)
+		return
+	}
+	s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models"):
+		s.listModels(w)
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/chat/completions"):
+		s.complete(w, r)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) listModels(w http.ResponseWriter) {
+	data := []map[string]string{}
+	for _, model := range s.Models {
+		data = append(data, map[string]string{"id": model, "object": "model"})
+	}
+	writeJSON(w, map[string]interface{}{"object": "list", "data": data})
+}
+
+func (s *Server) complete(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	model, _ := body["model"].(string)
+	n := 1
+	if value, ok := body["n"].(float64); ok && value > 1 {
+		n = int(value)
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Path: r.URL.Path, Body: body})
+	answers := []string{}
+	for i := 0; i < n; i++ {
+		answers = append(answers, s.answer())
+	}
+	s.mu.Unlock()
+
+	if stream, _ := body["stream"].(bool); !stream {
+		choices := []map[string]interface{}{}
+		for i, answer := range answers {
+			choices = append(choices, map[string]interface{}{
+				"index":         i,
+				"message":       map[string]string{"role": "assistant", "content": answer},
+				"finish_reason": "stop",
+			})
+		}
+		writeJSON(w, map[string]interface{}{"object": "chat.completion", "model": model, "choices": choices})
+		return
+	}
+
+	// the answer streams word by word like the real API
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	words := strings.SplitAfter(answers[0], " ")
+	for i, word := range words {
+		choice := map[string]interface{}{"index": 0, "delta": map[string]string{"content": word}}
+		if i == len(words)-1 {
+			choice["finish_reason"] = "stop"
+		}
+		event, _ := json.Marshal(map[string]interface{}{"object": "chat.completion.chunk", "model": model, "choices": []interface{}{choice}})
+		fmt.Fprintf(w, "data: %s\n\n", event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// answer returns the next canned answer, the caller holds mu.
+func (s *Server) answer() string {
+	if len(s.answers) == 0 {
+		return "OK"
+	}
+	answer := s.answers[min(s.next, len(s.answers)-1)]
+	s.next++
+	return answer
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": "invalid_request_error", "code": nil},
+	})
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"strings"
+)
+
+// reasoningPrefixes are the model families that think before they answer.
+// They reject temperature, top_p and the penalties, take
+// max_completion_tokens instead of max_tokens and a reasoning_effort.
+var reasoningPrefixes = []string{"o1", "o3", "o4", "gpt-5"}
+
+// ReasoningEfforts are the values of reasoning_effort, minimal only for gpt-5.
+var ReasoningEfforts = []string{"minimal", "low", "medium", "high"}
+
+// IsReasoningEffort reports whether effort is one of ReasoningEfforts.
+func IsReasoningEffort(effort string) bool {
+	for _, e := range ReasoningEfforts {
+		if e == effort {
+			return true
+		}
+	}
+	return false
+}
+
+// IsReasoning reports whether model is a reasoning model. Gateway names like
+// openai/o3-mini are matched by their last part.
+func IsReasoning(model string) bool {
+	name := strings.ToLower(model)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	// the chat variant of gpt-5 is a regular model
+	if strings.HasPrefix(name, "gpt-5-chat") {
+		return false
+	}
+	for _, prefix := range reasoningPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
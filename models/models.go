@@ -0,0 +1,241 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var CacheFile = appdir.Path("models.json")
+
+// ErrUnknownModel is returned by Validate for names the provider does not have.
+var ErrUnknownModel = errors.New("unknown model")
+
+// CacheTTL is how long a fetched model list is reused.
+const CacheTTL = 24 * time.Hour
+
+// Provider holds what is needed to reach a provider's model list.
+type Provider struct {
+	Name     string // gpt, azure or ollama
+	AzureURL string
+	Key      string
+	BaseURL  string // OpenAI compatible API, empty for OpenAI
+	Headers  map[string]string
+}
+
+type cacheEntry struct {
+	Fetched time.Time `json:"fetched"`
+	Models  []string  `json:"models"`
+}
+
+// List returns the models (deployments for azure) available from the
+// provider, from the cache when it was fetched less than CacheTTL ago.
+func List(provider Provider, refresh bool) ([]string, error) {
+	entries := map[string]cacheEntry{}
+	if data, err := ioutil.ReadFile(CacheFile); err == nil {
+		json.Unmarshal(data, &entries)
+	}
+
+	key := provider.Name + " " + provider.AzureURL + provider.BaseURL
+	if entry, ok := entries[key]; ok && !refresh && time.Since(entry.Fetched) < CacheTTL {
+		return entry.Models, nil
+	}
+
+	names, err := fetch(provider)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	entries[key] = cacheEntry{Fetched: time.Now(), Models: names}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		ioutil.WriteFile(CacheFile, data, 0644)
+	}
+	return names, nil
+}
+
+// Validate checks that name is one of the provider's models and suggests the
+// closest ones when it is not.
+func Validate(provider Provider, name string) error {
+	names, err := List(provider, false)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+
+	suggestions := Suggest(name, names, 3)
+	if len(suggestions) == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownModel, name)
+	}
+	return fmt.Errorf("%w %q, did you mean %s?", ErrUnknownModel, name, strings.Join(suggestions, ", "))
+}
+
+// Suggest returns up to n names closest to name by edit distance.
+func Suggest(name string, names []string, n int) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+	candidates := []candidate{}
+	for _, candidateName := range names {
+		d := distance(strings.ToLower(name), strings.ToLower(candidateName))
+		// anything needing more edits than half the name is not a typo
+		if d <= len(name)/2+1 || strings.Contains(candidateName, name) {
+			candidates = append(candidates, candidate{candidateName, d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	suggestions := []string{}
+	for i := 0; i < len(candidates) && i < n; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+func fetch(provider Provider) ([]string, error) {
+	switch provider.Name {
+	case "gpt", "":
+		var body struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		base := provider.BaseURL
+		if base == "" {
+			base = "https://api.openai.com/v1"
+		}
+		headers := map[string]string{"Authorization": "Bearer " + provider.Key}
+		for name, value := range provider.Headers {
+			headers[name] = value
+		}
+		err := get(base+"/models", headers, &body)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, model := range body.Data {
+			names = append(names, model.ID)
+		}
+		return names, nil
+	case "azure":
+		var body struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+		}
+		url := strings.TrimRight(provider.AzureURL, "/") + "/openai/deployments?api-version=2022-12-01"
+		headers := map[string]string{"api-key": provider.Key}
+		for name, value := range provider.Headers {
+			headers[name] = value
+		}
+		err := get(url, headers, &body)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, deployment := range body.Data {
+			names = append(names, deployment.ID)
+		}
+		return names, nil
+	case "ollama":
+		var body struct {
+			Models []struct {
+				Name string `json:"name"`
+			} `json:"models"`
+		}
+		err := get(OllamaHost()+"/api/tags", nil, &body)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, model := range body.Models {
+			names = append(names, model.Name)
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("listing models is not supported for provider %q", provider.Name)
+}
+
+// OllamaHost returns the address of the local Ollama server, OLLAMA_HOST or
+// its default.
+func OllamaHost() string {
+	host := os.Getenv("OLLAMA_HOST")
+	if host == "" {
+		host = "http://localhost:11434"
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimRight(host, "/")
+}
+
+func get(url string, headers map[string]string, out interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	client := httpclient.Client(15 * time.Second)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to list models: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the model list: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to list models: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = smallest(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func smallest(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,156 @@
+package patch
+
+import (
+	"strings"
+)
+
+// maxDiffCells bounds the line comparison table of Diff. Larger changes are
+// shown as one replacement of everything between the common start and end.
+const maxDiffCells = 4000000
+
+// Diff compares two versions of the file at path and returns the changes as
+// hunks with context lines around them, like `diff -u`.
+func Diff(path, original, changed string, context int) FileDiff {
+	ops := diffLines(splitLines(original), splitLines(changed))
+
+	diff := FileDiff{OldPath: path, NewPath: path}
+	oldLine := 1
+	for i := 0; i < len(ops); {
+		if ops[i][0] == ' ' {
+			oldLine++
+			i++
+			continue
+		}
+
+		// start the hunk up to context lines before the change
+		start := i
+		for start > 0 && i-start < context && ops[start-1][0] == ' ' {
+			start--
+		}
+		hunk := Hunk{OldStart: oldLine - (i - start)}
+
+		// extend it until more than 2*context unchanged lines follow a change
+		end := i
+		for end < len(ops) {
+			if ops[end][0] != ' ' {
+				end++
+				continue
+			}
+			run := 0
+			for end+run < len(ops) && ops[end+run][0] == ' ' {
+				run++
+			}
+			if end+run == len(ops) || run > 2*context {
+				if run > context {
+					run = context
+				}
+				end += run
+				break
+			}
+			end += run
+		}
+
+		hunk.Lines = append(hunk.Lines, ops[start:end]...)
+		diff.Hunks = append(diff.Hunks, hunk)
+
+		for _, op := range ops[i:end] {
+			if op[0] != '+' {
+				oldLine++
+			}
+		}
+		i = end
+	}
+	return diff
+}
+
+// DiffTokens compares any two sequences, e.g. the words of two texts, the
+// way Diff compares lines: every token of a and b prefixed with ' ', '-' or
+// '+'.
+func DiffTokens(a, b []string) []string {
+	return diffLines(a, b)
+}
+
+// diffLines returns the lines of a and b prefixed with ' ', '-' or '+',
+// based on their longest common subsequence.
+func diffLines(a, b []string) []string {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := []string{}
+	for _, line := range a[:prefix] {
+		ops = append(ops, " "+line)
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		for _, line := range midA {
+			ops = append(ops, "-"+line)
+		}
+		for _, line := range midB {
+			ops = append(ops, "+"+line)
+		}
+	} else {
+		ops = append(ops, lcsDiff(midA, midB)...)
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, " "+line)
+	}
+	return ops
+}
+
+func lcsDiff(a, b []string) []string {
+	// lengths[i][j] is the LCS length of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	ops := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, " "+a[i])
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			ops = append(ops, "-"+a[i])
+			i++
+		default:
+			ops = append(ops, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, "+"+b[j])
+	}
+	return ops
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,359 @@
+package patch
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var BackupDir = appdir.Path("backups")
+
+// FileDiff is the part of a unified diff that changes one file.
+type FileDiff struct {
+	OldPath string
+	NewPath string
+	Hunks   []Hunk
+}
+
+// Hunk is one @@ section of a file diff. Lines keep their leading ' ', '-' or '+'.
+type Hunk struct {
+	OldStart int
+	Lines    []string
+}
+
+// IsNew reports whether the diff creates a file.
+func (d FileDiff) IsNew() bool {
+	return d.OldPath == "/dev/null"
+}
+
+// IsDelete reports whether the diff removes a file.
+func (d FileDiff) IsDelete() bool {
+	return d.NewPath == "/dev/null"
+}
+
+// Path returns the path of the file the diff changes.
+func (d FileDiff) Path() string {
+	if d.IsNew() {
+		return d.NewPath
+	}
+	return d.OldPath
+}
+
+// Parse extracts the unified diffs of a response, from its diff code blocks
+// when it has any and from the whole text otherwise.
+func Parse(response string) ([]FileDiff, error) {
+	text := response
+	diffBlocks := []string{}
+	for _, block := range codeblocks.Extract(response) {
+		if block.Lang == "diff" || block.Lang == "patch" || strings.HasPrefix(strings.TrimSpace(block.Code), "--- ") {
+			diffBlocks = append(diffBlocks, block.Code)
+		}
+	}
+	if len(diffBlocks) > 0 {
+		text = strings.Join(diffBlocks, "\n")
+	}
+
+	diffs := []FileDiff{}
+	var current *FileDiff
+	var hunk *Hunk
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			diffs = append(diffs, FileDiff{OldPath: cleanPath(line[4:]), NewPath: cleanPath(lines[i+1][4:])})
+			current = &diffs[len(diffs)-1]
+			hunk = nil
+			i++
+		case strings.HasPrefix(line, "@@"):
+			if current == nil {
+				return nil, fmt.Errorf("hunk on line %d has no file header", i+1)
+			}
+			current.Hunks = append(current.Hunks, Hunk{OldStart: oldStart(line)})
+			hunk = &current.Hunks[len(current.Hunks)-1]
+		case hunk != nil && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "-") || strings.HasPrefix(line, "+")):
+			hunk.Lines = append(hunk.Lines, line)
+		case hunk != nil && line == "":
+			// editors and models often strip the space of empty context lines
+			hunk.Lines = append(hunk.Lines, " ")
+		case strings.HasPrefix(line, "\\"):
+			// "\ No newline at end of file"
+		default:
+			hunk = nil
+		}
+	}
+
+	for i := range diffs {
+		trimTrailingContext(&diffs[i])
+	}
+	return diffs, nil
+}
+
+// Preview prints the diffs in color.
+func Preview(diffs []FileDiff) {
+	bold := color.New(color.Bold)
+	for _, diff := range diffs {
+		switch {
+		case diff.IsNew():
+			bold.Printf("new file %s\n", diff.NewPath)
+		case diff.IsDelete():
+			bold.Printf("delete %s\n", diff.OldPath)
+		default:
+			bold.Printf("--- %s\n+++ %s\n", diff.OldPath, diff.NewPath)
+		}
+		for _, hunk := range diff.Hunks {
+			PreviewHunk(hunk)
+		}
+	}
+}
+
+// PreviewHunk prints one hunk in color.
+func PreviewHunk(hunk Hunk) {
+	color.Cyan("@@ -%d @@", hunk.OldStart)
+	for _, line := range hunk.Lines {
+		switch line[0] {
+		case '+':
+			color.Green(line)
+		case '-':
+			color.Red(line)
+		default:
+			fmt.Println(line)
+		}
+	}
+}
+
+// Apply applies diffs to the files under workingDirectory. Every diff is
+// checked before anything is written, and the originals are copied to a new
+// directory under BackupDir first. It returns the changed paths and the
+// backup directory.
+func Apply(diffs []FileDiff, workingDirectory string) ([]string, string, error) {
+	type change struct {
+		path    string
+		content string
+		remove  bool
+	}
+	changes := []change{}
+	for _, diff := range diffs {
+		path := filepath.Join(workingDirectory, filepath.FromSlash(diff.Path()))
+		rel, err := filepath.Rel(workingDirectory, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return nil, "", fmt.Errorf("%s is outside of %s", diff.Path(), workingDirectory)
+		}
+
+		if diff.IsDelete() {
+			changes = append(changes, change{path: path, remove: true})
+			continue
+		}
+
+		original := ""
+		if !diff.IsNew() {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to read %s: %w", diff.Path(), err)
+			}
+			original = string(data)
+		}
+		content, err := applyHunks(original, diff.Hunks)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", diff.Path(), err)
+		}
+		changes = append(changes, change{path: path, content: content})
+	}
+
+	backup := filepath.Join(BackupDir, time.Now().Format("20060102-150405"))
+	changed := []string{}
+	for _, c := range changes {
+		if data, err := ioutil.ReadFile(c.path); err == nil {
+			rel, _ := filepath.Rel(workingDirectory, c.path)
+			target := filepath.Join(backup, rel)
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(target, data, 0644)
+			}
+			if err != nil {
+				return changed, backup, fmt.Errorf("failed to back up %s: %w", c.path, err)
+			}
+		}
+
+		var err error
+		if c.remove {
+			err = os.Remove(c.path)
+		} else {
+			err = os.MkdirAll(filepath.Dir(c.path), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(c.path, []byte(c.content), filePerm(c.path))
+			}
+		}
+		if err != nil {
+			return changed, backup, fmt.Errorf("failed to write %s: %w", c.path, err)
+		}
+		changed = append(changed, c.path)
+	}
+	return changed, backup, nil
+}
+
+// Offer previews the diffs in response and applies them after confirmation.
+// It returns the changed paths, nil when the response has no diffs.
+func Offer(response string, workingDirectory string, reader *bufio.Reader) ([]string, error) {
+	diffs, err := Parse(response)
+	if err != nil {
+		return nil, err
+	}
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+
+	fmt.Println()
+	Preview(diffs)
+	fmt.Printf("Apply these changes to %d file(s)? [y/N]: ", len(diffs))
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, nil
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		fmt.Println("Skipped.")
+		return nil, nil
+	}
+
+	changed, backup, err := Apply(diffs, workingDirectory)
+	if err != nil {
+		return changed, err
+	}
+	color.Green("Applied changes to %d file(s), originals backed up in %s\n", len(changed), backup)
+	return changed, nil
+}
+
+// applyHunks applies hunks in order. Models get line numbers wrong, so each
+// hunk is placed where its old lines match, preferring the match closest to
+// the stated line, and compared ignoring trailing whitespace if needed.
+func applyHunks(original string, hunks []Hunk) (string, error) {
+	lines := []string{}
+	if original != "" {
+		lines = strings.Split(strings.TrimSuffix(original, "\n"), "\n")
+	}
+
+	offset := 0
+	for i, hunk := range hunks {
+		oldLines, newLines := []string{}, []string{}
+		for _, line := range hunk.Lines {
+			if line[0] != '+' {
+				oldLines = append(oldLines, line[1:])
+			}
+			if line[0] != '-' {
+				newLines = append(newLines, line[1:])
+			}
+		}
+
+		at := find(lines, oldLines, hunk.OldStart-1+offset, false)
+		if at < 0 {
+			at = find(lines, oldLines, hunk.OldStart-1+offset, true)
+		}
+		if at < 0 {
+			return "", fmt.Errorf("hunk %d does not match the file", i+1)
+		}
+
+		lines = append(lines[:at], append(newLines, lines[at+len(oldLines):]...)...)
+		offset = at + len(newLines) - (hunk.OldStart - 1 + len(oldLines))
+	}
+
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// find returns the position of needle in lines closest to want, or -1.
+func find(lines, needle []string, want int, loose bool) int {
+	if len(needle) == 0 {
+		if want < 0 || want > len(lines) {
+			return len(lines)
+		}
+		return want
+	}
+
+	best := -1
+	for i := 0; i+len(needle) <= len(lines); i++ {
+		if !matches(lines[i:i+len(needle)], needle, loose) {
+			continue
+		}
+		if best < 0 || abs(i-want) < abs(best-want) {
+			best = i
+		}
+	}
+	return best
+}
+
+func matches(lines, needle []string, loose bool) bool {
+	for i := range needle {
+		a, b := lines[i], needle[i]
+		if loose {
+			a, b = strings.TrimRight(a, " \t\r"), strings.TrimRight(b, " \t\r")
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// trimTrailingContext drops empty context lines at the end of hunks, which
+// come from blank lines between the diff and the rest of a response.
+func trimTrailingContext(diff *FileDiff) {
+	for i := range diff.Hunks {
+		lines := diff.Hunks[i].Lines
+		for len(lines) > 0 && lines[len(lines)-1] == " " {
+			lines = lines[:len(lines)-1]
+		}
+		diff.Hunks[i].Lines = lines
+	}
+}
+
+// oldStart reads the old start line from a "@@ -12,5 +12,6 @@" header.
+func oldStart(header string) int {
+	fields := strings.Fields(header)
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "-") {
+		return 1
+	}
+	start, err := strconv.Atoi(strings.SplitN(fields[1][1:], ",", 2)[0])
+	if err != nil || start < 1 {
+		return 1
+	}
+	return start
+}
+
+func cleanPath(path string) string {
+	path = strings.TrimSpace(path)
+	if tab := strings.Index(path, "\t"); tab >= 0 {
+		path = path[:tab]
+	}
+	if path == "/dev/null" {
+		return path
+	}
+	if strings.HasPrefix(path, "a/") || strings.HasPrefix(path, "b/") {
+		path = path[2:]
+	}
+	return path
+}
+
+func filePerm(path string) os.FileMode {
+	if info, err := os.Stat(path); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
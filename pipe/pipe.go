@@ -0,0 +1,65 @@
+package pipe
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/truncate"
+	"io"
+	"os"
+	"strings"
+)
+
+// fenceOverhead covers the fence, the omission marker and the chat format
+// tokens around the prompt.
+const fenceOverhead = 50
+
+// headShare is the part of the budget kept from the start of truncated input,
+// the rest goes to its end where logs usually show the actual failure.
+const headShare = 0.25
+
+// IsPiped reports whether stdin is a pipe or a redirected file rather than a terminal.
+func IsPiped() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice == 0
+}
+
+// Read returns everything written to stdin.
+func Read() (string, error) {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read stdin: %w", err)
+	}
+	return string(data), nil
+}
+
+// Fit truncates data to about budget tokens, keeping whole lines from its
+// start and end and marking what was left out. It returns the number of
+// omitted lines, 0 when data already fits.
+func Fit(data string, budget int, modelName string) (string, int) {
+	return truncate.HeadTail(data, budget, headShare, modelName)
+}
+
+// Budget returns how many tokens piped data may use next to the system
+// message, the question and the response.
+func Budget(cfg *config.Config, question string) int {
+	count := truncate.Counter(cfg.ModelName)
+	return cfg.MaxTotalTokens - cfg.MaxResponseTokens - count(cfg.SystemMessage) - count(question) - fenceOverhead
+}
+
+// Prompt combines the question with the piped data as a fenced block. Without
+// a question the data itself is the prompt.
+func Prompt(question, data string) string {
+	data = strings.TrimRight(data, "\n")
+	if strings.TrimSpace(question) == "" {
+		return data
+	}
+
+	fence := "```"
+	for strings.Contains(data, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("%s\n\n%s\n%s\n%s", question, fence, data, fence)
+}
@@ -0,0 +1,141 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Hooks a plugin can run at.
+const (
+	// Prompt runs before a request is sent and may change the prompt and
+	// the system message.
+	Prompt = "prompt"
+	// Response runs after the answer arrived and may change it.
+	Response = "response"
+)
+
+// DefaultTimeout limits a plugin without a timeout_seconds.
+const DefaultTimeout = 10 * time.Second
+
+// Message is what a plugin reads as JSON on stdin.
+type Message struct {
+	Hook     string `json:"hook"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	System   string `json:"system"`
+	Prompt   string `json:"prompt"`
+	Response string `json:"response,omitempty"`
+}
+
+// reply is what a plugin writes as JSON on stdout. Fields it leaves out are
+// kept, and no output at all changes nothing.
+type reply struct {
+	System   *string `json:"system"`
+	Prompt   *string `json:"prompt"`
+	Response *string `json:"response"`
+	// Error stops the request with this message, e.g. when the prompt holds
+	// something that must not be sent.
+	Error string `json:"error"`
+}
+
+// Runs reports whether plugin runs at hook, plugins without hooks run at all.
+func Runs(plugin config.Plugin, hook string) bool {
+	if len(plugin.Hooks) == 0 {
+		return true
+	}
+	for _, h := range plugin.Hooks {
+		if h == hook {
+			return true
+		}
+	}
+	return false
+}
+
+// Run passes m through the plugins running at its hook, in the configured
+// order, each seeing the changes of the ones before it. It returns the
+// changed message and the names of the plugins that changed it.
+func Run(ctx context.Context, plugins []config.Plugin, m Message) (Message, []string, error) {
+	changedBy := []string{}
+	for _, plugin := range plugins {
+		if !Runs(plugin, m.Hook) {
+			continue
+		}
+		changed, err := run(ctx, plugin, m)
+		if err != nil {
+			return m, changedBy, err
+		}
+		if changed != m {
+			changedBy = append(changedBy, plugin.Name)
+		}
+		m = changed
+	}
+	return m, changedBy, nil
+}
+
+func run(ctx context.Context, plugin config.Plugin, m Message) (Message, error) {
+	input, err := json.Marshal(m)
+	if err != nil {
+		return m, err
+	}
+
+	timeout := DefaultTimeout
+	if plugin.TimeoutSeconds > 0 {
+		timeout = time.Duration(plugin.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", plugin.Command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", plugin.Command)
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return m, fmt.Errorf("plugin %s timed out after %s", plugin.Name, timeout)
+	}
+	if err != nil {
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return m, fmt.Errorf("plugin %s failed: %w: %s", plugin.Name, err, detail)
+		}
+		return m, fmt.Errorf("plugin %s failed: %w", plugin.Name, err)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return m, nil
+	}
+	var r reply
+	err = json.Unmarshal(stdout.Bytes(), &r)
+	if err != nil {
+		return m, fmt.Errorf("plugin %s wrote invalid JSON: %w", plugin.Name, err)
+	}
+	if r.Error != "" {
+		return m, fmt.Errorf("plugin %s stopped the request: %s", plugin.Name, r.Error)
+	}
+
+	// a hook only changes what is not sent or received yet
+	switch m.Hook {
+	case Prompt:
+		if r.Prompt != nil {
+			m.Prompt = *r.Prompt
+		}
+		if r.System != nil {
+			m.System = *r.System
+		}
+	case Response:
+		if r.Response != nil {
+			m.Response = *r.Response
+		}
+	}
+	return m, nil
+}
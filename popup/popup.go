@@ -0,0 +1,87 @@
+package popup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// viewer streams the response file while it is being written, then opens it
+// in a pager once the ".done" marker appears. Quitting the pager closes the popup.
+const viewer = `tail -n +1 -f "$0" & t=$!
+while [ ! -e "$0.done" ]; do sleep 0.1; done
+kill $t 2>/dev/null
+clear
+LESS="-R -P(press q to close)" less "$0"
+rm -f "$0" "$0.done"`
+
+// Session redirects stdout into a popup window for the duration of one response.
+type Session struct {
+	file   *os.File
+	stdout *os.File
+	cmd    *exec.Cmd
+}
+
+// Available reports whether the given popup kind can be used in this terminal.
+func Available(kind string) error {
+	switch kind {
+	case "tmux":
+		if os.Getenv("TMUX") == "" {
+			return fmt.Errorf("tmux popups need to run inside tmux")
+		}
+	case "kitty":
+		if os.Getenv("KITTY_WINDOW_ID") == "" {
+			return fmt.Errorf("kitty overlays need to run inside kitty")
+		}
+	default:
+		return fmt.Errorf("unknown popup kind %q (expected tmux or kitty)", kind)
+	}
+	_, err := exec.LookPath(kind)
+	return err
+}
+
+// Start opens the popup and redirects os.Stdout into it until Finish is called.
+func Start(kind string) (*Session, error) {
+	err := Available(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile("", "terminalgpt-response-*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create popup buffer: %w", err)
+	}
+
+	var cmd *exec.Cmd
+	if kind == "tmux" {
+		cmd = exec.Command("tmux", "display-popup", "-E", "-w", "90%", "-h", "90%", "-T", " terminalgpt ", "sh", "-c", viewer, file.Name())
+	} else {
+		cmd = exec.Command("kitty", "@", "launch", "--type=overlay", "--title", "terminalgpt", "sh", "-c", viewer, file.Name())
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("failed to open %s popup: %w", kind, err)
+	}
+
+	session := &Session{file: file, stdout: os.Stdout, cmd: cmd}
+	os.Stdout = file
+	return session, nil
+}
+
+// Finish restores stdout and lets the popup switch to paging mode.
+func (s *Session) Finish() {
+	os.Stdout = s.stdout
+	s.file.Close()
+
+	done, err := os.Create(s.file.Name() + ".done")
+	if err == nil {
+		done.Close()
+	}
+
+	// the popup closes on its own once the user quits the pager
+	go s.cmd.Wait()
+}
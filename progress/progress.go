@@ -0,0 +1,173 @@
+package progress
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/termcap"
+	"golang.org/x/term"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The status is drawn right after the response text with the cursor saved
+// and restored around it, so the next chunk simply overwrites it once it is
+// erased to the end of the line.
+const (
+	saveCursor    = "\0337"
+	restoreCursor = "\0338"
+	eraseLine     = "\033[K"
+)
+
+// margin keeps the status off the last columns, the column is only an
+// estimate (wide characters, text printed before Start).
+const margin = 16
+
+var (
+	spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+	asciiFrames   = []string{"|", "/", "-", "\\"}
+
+	ansi = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]|\x1b\][^\x1b\a]*(\x1b\\|\a)`)
+)
+
+var (
+	mu      sync.Mutex
+	active  bool
+	stop    chan struct{}
+	done    chan struct{}
+	started time.Time
+	first   time.Time
+	tokens  int
+	column  int
+	drawn   bool
+	frame   int
+)
+
+// Start shows a spinner with the elapsed time until the first response text
+// arrives, then the response speed in tokens per second. Nothing is shown
+// unless stdout is a terminal. Stop removes it again.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+	if active || !termcap.Get().TTY || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return
+	}
+
+	active = true
+	started = time.Now()
+	first = time.Time{}
+	tokens = 0
+	column = 0
+	frame = 0
+	stop = make(chan struct{})
+	done = make(chan struct{})
+	draw()
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				mu.Lock()
+				frame++
+				erase()
+				draw()
+				mu.Unlock()
+			}
+		}
+	}(stop, done)
+}
+
+// Stop removes the status line.
+func Stop() {
+	mu.Lock()
+	if !active {
+		mu.Unlock()
+		return
+	}
+	active = false
+	erase()
+	close(stop)
+	finished := done
+	mu.Unlock()
+	<-finished
+}
+
+// Print writes response text to stdout, keeping the status after it.
+func Print(text string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !active {
+		fmt.Print(text)
+		return
+	}
+
+	erase()
+	fmt.Print(text)
+	if first.IsZero() && text != "" {
+		first = time.Now()
+	}
+	advance(text)
+	draw()
+}
+
+// AddTokens counts response tokens for the speed shown in the status.
+func AddTokens(n int) {
+	mu.Lock()
+	tokens += n
+	mu.Unlock()
+}
+
+func status() string {
+	if first.IsZero() {
+		frames := asciiFrames
+		if termcap.Get().Emoji {
+			frames = spinnerFrames
+		}
+		return fmt.Sprintf("%s %.1fs", frames[frame%len(frames)], time.Since(started).Seconds())
+	}
+
+	elapsed := time.Since(first)
+	if tokens == 0 || elapsed < 200*time.Millisecond {
+		return ""
+	}
+	return fmt.Sprintf("%d tokens, %.0f tok/s", tokens, float64(tokens)/elapsed.Seconds())
+}
+
+func draw() {
+	text := status()
+	if text == "" || column+1+len(text)+margin > termcap.Width() {
+		return
+	}
+	fmt.Print(saveCursor + " " + color.New(color.FgHiBlack).Sprint(text) + restoreCursor)
+	drawn = true
+}
+
+func erase() {
+	if drawn {
+		fmt.Print(eraseLine)
+		drawn = false
+	}
+}
+
+// advance moves the column estimate past text.
+func advance(text string) {
+	for _, r := range ansi.ReplaceAllString(text, "") {
+		switch r {
+		case '\n', '\r':
+			column = 0
+		case '\t':
+			column += 8 - column%8
+		default:
+			if r >= ' ' && r != utf8.RuneError {
+				column++
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var LimitsFile = appdir.Path("ratelimits.json")
+
+// MaxWait caps how long Wait sleeps, in case a reset header is off.
+const MaxWait = 2 * time.Minute
+
+// Limits is the rate limit status a provider reported with its last
+// response. Counts are -1 when the provider did not send them.
+type Limits struct {
+	Observed          time.Time     `json:"observed"`
+	LimitRequests     int           `json:"limit_requests"`
+	LimitTokens       int           `json:"limit_tokens"`
+	RemainingRequests int           `json:"remaining_requests"`
+	RemainingTokens   int           `json:"remaining_tokens"`
+	ResetRequests     time.Duration `json:"reset_requests"`
+	ResetTokens       time.Duration `json:"reset_tokens"`
+}
+
+// limits holds the last Limits of every provider, loaded from LimitsFile on
+// first use so consecutive runs share what they learned. mu guards it for
+// requests running at the same time.
+var (
+	mu     sync.Mutex
+	limits map[string]Limits
+)
+
+// Parse reads the x-ratelimit-* headers of a response. The second result is
+// false when there are none.
+func Parse(header http.Header) (Limits, bool) {
+	l := Limits{
+		Observed:          time.Now(),
+		LimitRequests:     count(header.Get("x-ratelimit-limit-requests")),
+		LimitTokens:       count(header.Get("x-ratelimit-limit-tokens")),
+		RemainingRequests: count(header.Get("x-ratelimit-remaining-requests")),
+		RemainingTokens:   count(header.Get("x-ratelimit-remaining-tokens")),
+		ResetRequests:     reset(header.Get("x-ratelimit-reset-requests")),
+		ResetTokens:       reset(header.Get("x-ratelimit-reset-tokens")),
+	}
+	found := l.LimitRequests >= 0 || l.LimitTokens >= 0 || l.RemainingRequests >= 0 || l.RemainingTokens >= 0
+	return l, found
+}
+
+// Record remembers the rate limit headers of a provider response.
+func Record(provider string, header http.Header) {
+	l, ok := Parse(header)
+	if !ok {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	load()
+	limits[name(provider)] = l
+
+	data, err := json.MarshalIndent(limits, "", "  ")
+	if err == nil {
+		ioutil.WriteFile(LimitsFile, data, 0644)
+	}
+}
+
+// Last returns the most recently recorded limits of provider.
+func Last(provider string) (Limits, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	load()
+	l, ok := limits[name(provider)]
+	return l, ok
+}
+
+// All returns the recorded limits of every provider.
+func All() map[string]Limits {
+	mu.Lock()
+	defer mu.Unlock()
+	load()
+	all := map[string]Limits{}
+	for provider, l := range limits {
+		all[provider] = l
+	}
+	return all
+}
+
+// Wait sleeps until the provider's limits reset when the last response said
+// there is at most one request, or fewer than tokens tokens, left.
+func Wait(provider string, tokens int) {
+	l, ok := Last(provider)
+	if !ok {
+		return
+	}
+
+	wait := time.Duration(0)
+	if l.RemainingRequests >= 0 && l.RemainingRequests <= 1 && l.ResetRequests > wait {
+		wait = l.ResetRequests
+	}
+	if l.RemainingTokens >= 0 && l.RemainingTokens < tokens && l.ResetTokens > wait {
+		wait = l.ResetTokens
+	}
+	wait -= time.Since(l.Observed)
+	if wait <= 0 {
+		return
+	}
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+
+	fmt.Fprintf(os.Stderr, "Close to the %s rate limit, waiting %s\n", provider, wait.Round(100*time.Millisecond))
+	time.Sleep(wait)
+}
+
+// String describes the limits in one line.
+func (l Limits) String() string {
+	return fmt.Sprintf("requests %s (reset %s) | tokens %s (reset %s) | seen %s",
+		remaining(l.RemainingRequests, l.LimitRequests), resetString(l.ResetRequests),
+		remaining(l.RemainingTokens, l.LimitTokens), resetString(l.ResetTokens),
+		l.Observed.Format("2006-01-02 15:04:05"))
+}
+
+// name maps ai_provider values to the provider that answers, everything
+// but azure goes to OpenAI.
+func name(provider string) string {
+	if provider == "azure" {
+		return provider
+	}
+	return "gpt"
+}
+
+func load() {
+	if limits != nil {
+		return
+	}
+	limits = map[string]Limits{}
+	if data, err := ioutil.ReadFile(LimitsFile); err == nil {
+		json.Unmarshal(data, &limits)
+	}
+}
+
+func count(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// reset parses durations like "1s" or "6m0s" (OpenAI) and plain seconds (Azure).
+func reset(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return 0
+}
+
+func remaining(remaining, limit int) string {
+	if remaining < 0 {
+		return "unknown"
+	}
+	if limit < 0 {
+		return strconv.Itoa(remaining) + " left"
+	}
+	return fmt.Sprintf("%d/%d left", remaining, limit)
+}
+
+func resetString(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.String()
+}
@@ -0,0 +1,98 @@
+package relevance
+
+import (
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/embeddings"
+	"github.com/rojolang/terminalgpt/helpers"
+	"sort"
+)
+
+const DefaultRecencyWeight = 0.3
+
+type exchange struct {
+	entries []helpers.HistoryEntry
+	index   int
+	tokens  int
+	score   float64
+}
+
+// Select picks the prior exchanges most relevant to prompt that fit into
+// budget tokens. Relevance is the embedding similarity to the prompt blended
+// with recency by cfg.RecencyWeight. The result keeps chronological order.
+func Select(cfg *config.Config, history []helpers.HistoryEntry, prompt string, budget int) ([]helpers.HistoryEntry, error) {
+	exchanges, err := group(history, cfg.ModelName)
+	if err != nil {
+		return nil, err
+	}
+	if len(exchanges) == 0 || budget <= 0 {
+		return []helpers.HistoryEntry{}, nil
+	}
+
+	texts := []string{prompt}
+	for _, ex := range exchanges {
+		text := ""
+		for _, entry := range ex.entries {
+			text += entry.Content + "\n"
+		}
+		texts = append(texts, text)
+	}
+
+	vectors, err := embeddings.Embed(cfg, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	weight := cfg.RecencyWeight
+	if weight < 0 || weight > 1 {
+		weight = DefaultRecencyWeight
+	}
+
+	for i := range exchanges {
+		similarity := embeddings.Cosine(vectors[0], vectors[i+1])
+		recency := float64(i+1) / float64(len(exchanges))
+		exchanges[i].score = (1-weight)*similarity + weight*recency
+	}
+
+	ranked := make([]exchange, len(exchanges))
+	copy(ranked, exchanges)
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score > ranked[j].score })
+
+	chosen := []exchange{}
+	used := 0
+	for _, ex := range ranked {
+		if used+ex.tokens > budget {
+			continue
+		}
+		used += ex.tokens
+		chosen = append(chosen, ex)
+	}
+
+	sort.Slice(chosen, func(i, j int) bool { return chosen[i].index < chosen[j].index })
+
+	selected := []helpers.HistoryEntry{}
+	for _, ex := range chosen {
+		selected = append(selected, ex.entries...)
+	}
+	return selected, nil
+}
+
+// group splits history into exchanges of a user message and the replies that follow it.
+func group(history []helpers.HistoryEntry, modelName string) ([]exchange, error) {
+	counts, err := helpers.CountEntriesTokens(history, modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	exchanges := []exchange{}
+	for i, entry := range history {
+		tokens := counts[i]
+		last := len(exchanges) - 1
+		if entry.Role == "user" || last < 0 {
+			exchanges = append(exchanges, exchange{index: len(exchanges)})
+			last++
+		}
+		exchanges[last].entries = append(exchanges[last].entries, entry)
+		exchanges[last].tokens += tokens
+	}
+	return exchanges, nil
+}
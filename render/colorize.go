@@ -0,0 +1,314 @@
+package render
+
+import (
+	"github.com/fatih/color"
+	"strings"
+	"unicode"
+)
+
+// styles of the colorized text
+const (
+	stylePlain = iota
+	styleProse
+	styleInline
+	styleFence
+	styleCode
+	styleKeyword
+	styleString
+	styleComment
+	styleNumber
+)
+
+var styles = map[int]*color.Color{
+	styleProse:   color.New(color.FgBlue),
+	styleInline:  color.New(color.FgCyan),
+	styleFence:   color.New(color.FgHiBlack),
+	styleCode:    color.New(color.FgYellow),
+	styleKeyword: color.New(color.FgMagenta),
+	styleString:  color.New(color.FgGreen),
+	styleComment: color.New(color.FgHiBlack),
+	styleNumber:  color.New(color.FgCyan),
+}
+
+// keywords are highlighted in code blocks of any language.
+var keywords = wordSet(`func function def fn class struct interface trait impl enum type
+	package import from as use mod module namespace var let const mut static
+	return if else elif for while do range switch case default break continue
+	go defer select chan map new try catch except finally raise throw with
+	yield async await lambda in is not and or pub public private protected
+	void true false nil null None True False self this then fi done esac
+	SELECT FROM WHERE INSERT INTO UPDATE DELETE JOIN ON ORDER BY GROUP CREATE TABLE AND OR NOT NULL`)
+
+// languages whose comments start with # or --, the others use // and /* */
+var (
+	hashComments = wordSet("python py ruby rb bash sh shell zsh fish console yaml yml toml perl r dockerfile makefile powershell ps1 ini conf nix elixir")
+	dashComments = wordSet("sql pgsql mysql sqlite lua haskell hs")
+	// languages with backtick strings
+	backtickStrings = wordSet("go javascript js jsx typescript ts tsx")
+)
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// colorizer colors markdown as it streams in: prose, `inline code`, fences
+// and the keywords, strings, comments and numbers of fenced code. Its state
+// carries over from one Write to the next, so a fence or a word split across
+// chunks is still recognized. Text that is not decided yet, such as the
+// start of a possible fence or a word that may be a keyword, is held back
+// until the next Write or Flush.
+type colorizer struct {
+	// lineStart is set while the line holds only whitespace, ticks counts the
+	// backticks held back at its start
+	lineStart bool
+	ticks     int
+	// fence is set on a fence line, whose rest is the info string in info
+	fence bool
+	info  strings.Builder
+	code  bool
+	lang  string
+
+	inline  bool
+	quote   rune
+	escaped bool
+	comment bool
+	block   bool
+	star    bool
+	// op is a / or - held back until it is known to start a comment
+	op   rune
+	word strings.Builder
+
+	out   strings.Builder
+	style int
+	run   strings.Builder
+}
+
+func newColorizer() *colorizer {
+	return &colorizer{lineStart: true}
+}
+
+// Write returns text colorized, without what is held back.
+func (c *colorizer) Write(text string) string {
+	for _, r := range text {
+		c.next(r)
+	}
+	return c.take()
+}
+
+// Flush returns what is still held back at the end of the response.
+func (c *colorizer) Flush() string {
+	c.releaseTicks()
+	c.releaseOp()
+	c.flushWord()
+	return c.take()
+}
+
+func (c *colorizer) next(r rune) {
+	if c.ticks > 0 {
+		if r == '`' {
+			c.ticks++
+			if c.ticks == 3 {
+				c.ticks = 0
+				c.fence = true
+				c.info.Reset()
+				c.quote, c.block, c.comment, c.inline = 0, false, false, false
+				c.emit(styleFence, "```")
+			}
+			return
+		}
+		c.releaseTicks()
+	}
+	c.char(r)
+}
+
+// releaseTicks handles the held back backticks that turned out not to start
+// a fence.
+func (c *colorizer) releaseTicks() {
+	ticks := c.ticks
+	c.ticks = 0
+	for i := 0; i < ticks; i++ {
+		c.char('`')
+	}
+}
+
+func (c *colorizer) char(r rune) {
+	if c.fence {
+		if r != '\n' {
+			c.info.WriteRune(r)
+			c.emit(styleFence, string(r))
+			return
+		}
+		c.fence = false
+		c.code = !c.code
+		c.lang = ""
+		if c.code {
+			c.lang = strings.ToLower(strings.TrimSpace(c.info.String()))
+		}
+		c.newline()
+		return
+	}
+
+	if r == '\n' {
+		c.releaseOp()
+		c.flushWord()
+		c.newline()
+		return
+	}
+
+	if c.lineStart {
+		if r == ' ' || r == '\t' {
+			c.emit(stylePlain, string(r))
+			return
+		}
+		c.lineStart = false
+		if r == '`' {
+			c.ticks = 1
+			return
+		}
+	}
+
+	if !c.code {
+		if r == '`' {
+			c.emit(styleInline, "`")
+			c.inline = !c.inline
+			return
+		}
+		if c.inline {
+			c.emit(styleInline, string(r))
+		} else {
+			c.emit(styleProse, string(r))
+		}
+		return
+	}
+	c.codeChar(r)
+}
+
+func (c *colorizer) codeChar(r rune) {
+	switch {
+	case c.comment:
+		c.emit(styleComment, string(r))
+		return
+	case c.block:
+		c.emit(styleComment, string(r))
+		if c.star && r == '/' {
+			c.block = false
+		}
+		c.star = r == '*'
+		return
+	case c.quote != 0:
+		c.emit(styleString, string(r))
+		if r == c.quote && !c.escaped {
+			c.quote = 0
+		}
+		c.escaped = r == '\\' && !c.escaped
+		return
+	}
+
+	if c.op != 0 {
+		op := c.op
+		c.op = 0
+		switch {
+		case op == '/' && r == '/', op == '-' && r == '-':
+			c.comment = true
+			c.emit(styleComment, string(op)+string(r))
+			return
+		case op == '/' && r == '*':
+			c.block = true
+			c.star = false
+			c.emit(styleComment, "/*")
+			return
+		}
+		c.emit(styleCode, string(op))
+	}
+
+	if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+		c.word.WriteRune(r)
+		return
+	}
+	c.flushWord()
+
+	switch {
+	case r == '"' || r == '\'' || (r == '`' && backtickStrings[c.lang]):
+		c.quote = r
+		c.escaped = false
+		c.emit(styleString, string(r))
+	case r == '/' && !hashComments[c.lang], r == '-' && dashComments[c.lang]:
+		c.op = r
+	case r == '#' && hashComments[c.lang]:
+		c.comment = true
+		c.emit(styleComment, "#")
+	default:
+		c.emit(styleCode, string(r))
+	}
+}
+
+func (c *colorizer) releaseOp() {
+	if c.op != 0 {
+		c.emit(styleCode, string(c.op))
+		c.op = 0
+	}
+}
+
+func (c *colorizer) flushWord() {
+	word := c.word.String()
+	if word == "" {
+		return
+	}
+	c.word.Reset()
+	switch {
+	case !c.code:
+		c.emit(styleProse, word)
+	case keywords[word]:
+		c.emit(styleKeyword, word)
+	case unicode.IsDigit([]rune(word)[0]):
+		c.emit(styleNumber, word)
+	default:
+		c.emit(styleCode, word)
+	}
+}
+
+// newline ends the line, closing inline code, comments and strings that do
+// not span lines.
+func (c *colorizer) newline() {
+	c.emit(stylePlain, "\n")
+	c.lineStart = true
+	c.inline = false
+	c.comment = false
+	if c.quote != '`' {
+		c.quote = 0
+	}
+	c.escaped = false
+}
+
+// emit appends text in style, joining runs of the same style.
+func (c *colorizer) emit(style int, text string) {
+	if style != c.style {
+		c.endRun()
+		c.style = style
+	}
+	c.run.WriteString(text)
+}
+
+func (c *colorizer) endRun() {
+	if c.run.Len() == 0 {
+		return
+	}
+	if style := styles[c.style]; style != nil {
+		c.out.WriteString(style.Sprint(c.run.String()))
+	} else {
+		c.out.WriteString(c.run.String())
+	}
+	c.run.Reset()
+}
+
+// take returns the text colorized so far.
+func (c *colorizer) take() string {
+	c.endRun()
+	text := c.out.String()
+	c.out.Reset()
+	return text
+}
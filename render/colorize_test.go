@@ -0,0 +1,132 @@
+package render
+
+import (
+	"github.com/fatih/color"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var colorizeInputs = []struct {
+	name string
+	text string
+}{
+	{"prose", "Plain prose with a few words.\n"},
+	{"inline", "Run `go test ./...` and `make` to check.\n"},
+	{"inline at line start", "`inline` starts the line\n"},
+	{"two backticks", "``not a fence`` here\n"},
+	{"fence", "Before\n```go\nfunc main() {\n\treturn 42\n}\n```\nAfter\n"},
+	{"indented fence", "  ```python\n  def f(): # note\n  ```\n"},
+	{"fence without newline", "```sh\nls -la"},
+	{"strings", "```js\nconst s = \"a \\\" b\" + 'c' + `d`;\n```\n"},
+	{"comments", "```go\nx := 1 // one\ny := 2 / 3 /* block\nstill */ z\n```\n"},
+	{"dash comments", "```sql\nSELECT a - b -- difference\nFROM t\n```\n"},
+	{"keywords and numbers", "```\nif x1 == 10 { return nil }\n```\n"},
+	{"unicode", "Grüße `naïve` 👋\n```\nlet ünï = \"ü\"\n```\n"},
+}
+
+// styledRunes pairs every visible rune of colorized output with the escape
+// sequence it is shown in, so outputs that only differ in where runs of a
+// style were cut compare equal.
+func styledRunes(out string) []string {
+	runes := []string{}
+	current := ""
+	for len(out) > 0 {
+		if strings.HasPrefix(out, "\x1b[") {
+			end := strings.IndexByte(out, 'm')
+			current = out[:end+1]
+			if current == "\x1b[0m" {
+				current = ""
+			}
+			out = out[end+1:]
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(out)
+		runes = append(runes, current+string(r))
+		out = out[size:]
+	}
+	return runes
+}
+
+func colorize(chunks []string) string {
+	c := newColorizer()
+	var out strings.Builder
+	for _, chunk := range chunks {
+		out.WriteString(c.Write(chunk))
+	}
+	out.WriteString(c.Flush())
+	return out.String()
+}
+
+func equalRunes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestColorizerChunking(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	for _, input := range colorizeInputs {
+		t.Run(input.name, func(t *testing.T) {
+			want := styledRunes(colorize([]string{input.text}))
+			if got := strings.Join(want, ""); !strings.Contains(got, "\x1b[") {
+				t.Fatalf("single chunk is not colorized: %q", got)
+			}
+
+			runes := []rune(input.text)
+			for i := 1; i < len(runes); i++ {
+				chunks := []string{string(runes[:i]), string(runes[i:])}
+				if got := styledRunes(colorize(chunks)); !equalRunes(got, want) {
+					t.Errorf("split at %d %q: got %q, want %q", i, chunks, got, want)
+				}
+			}
+
+			chunks := []string{}
+			for _, r := range runes {
+				chunks = append(chunks, string(r))
+			}
+			if got := styledRunes(colorize(chunks)); !equalRunes(got, want) {
+				t.Errorf("one rune per Write: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestColorizerStyles(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	tests := []struct {
+		text  string
+		word  string
+		style int
+	}{
+		{"some prose\n", "prose", styleProse},
+		{"use `make`\n", "make", styleInline},
+		{"```go\nreturn x\n```\n", "return", styleKeyword},
+		{"```go\nx = 42\n```\n", "42", styleNumber},
+		{"```go\ns := \"text\"\n```\n", "text", styleString},
+		{"```go\n// note\n```\n", "note", styleComment},
+		{"```python\n# note\n```\n", "note", styleComment},
+		{"```go\nfoo()\n```\n", "foo", styleCode},
+	}
+
+	for _, test := range tests {
+		got := styledRunes(colorize([]string{test.text}))
+		at := utf8.RuneCountInString(test.text[:strings.Index(test.text, test.word)])
+		want := styledRunes(styles[test.style].Sprint(test.word))
+		if !equalRunes(got[at:at+len(want)], want) {
+			t.Errorf("%q: got %q, want %q", test.text, got[at:at+len(want)], want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/progress"
+	"strings"
+)
+
+// label starts the response on its own line.
+const label = "Response:"
+
+var boldBlue = color.New(color.FgBlue, color.Bold).SprintFunc()
+
+type (
+	sinkKey      struct{}
+	firstTextKey struct{}
+	restorerKey  struct{}
+)
+
+// Restorer changes the streamed text before it is shown, e.g. puts secrets
+// back for their placeholders. Write may hold text back until the next
+// piece shows how it continues, Flush returns what it still holds.
+type Restorer interface {
+	Write(text string) string
+	Flush() string
+}
+
+// WithRestorer returns a context whose responses pass through r.
+func WithRestorer(ctx context.Context, r Restorer) context.Context {
+	return context.WithValue(ctx, restorerKey{}, r)
+}
+
+// WithSink returns a context whose responses are passed to sink as plain text
+// instead of being printed, for requests running next to others.
+func WithSink(ctx context.Context, sink func(text string)) context.Context {
+	return context.WithValue(ctx, sinkKey{}, sink)
+}
+
+// HasSink reports whether the responses of ctx go to a sink.
+func HasSink(ctx context.Context) bool {
+	_, ok := ctx.Value(sinkKey{}).(func(string))
+	return ok
+}
+
+// WithFirstText returns a context that calls fn when the first text of its
+// response arrives.
+func WithFirstText(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, firstTextKey{}, fn)
+}
+
+// Stream renders one streamed response the same way for every provider: a
+// label before the first text, then the text indented and colorized. The
+// text also reaches the collapsing of repeated lines, --output and the
+// progress status. Close prints what the colorizer still holds back.
+type Stream struct {
+	label     string
+	started   bool
+	colors    *colorizer
+	sink      func(string)
+	firstText func()
+	restorer  Restorer
+}
+
+// New returns a Stream for the next response, or one passing the text to the
+// sink of ctx when it has one.
+func New(ctx context.Context) *Stream {
+	s := Labeled(label)
+	s.sink, _ = ctx.Value(sinkKey{}).(func(string))
+	s.firstText, _ = ctx.Value(firstTextKey{}).(func())
+	s.restorer, _ = ctx.Value(restorerKey{}).(Restorer)
+	return s
+}
+
+// Labeled returns a Stream that starts with its own label, e.g. the model
+// name of a section.
+func Labeled(label string) *Stream {
+	return &Stream{label: label, colors: newColorizer()}
+}
+
+// Write renders a piece of response text that counted tokens.
+func (s *Stream) Write(text string, tokens int) {
+	if s.restorer != nil {
+		text = s.restorer.Write(text)
+	}
+	s.write(text, tokens)
+}
+
+func (s *Stream) write(text string, tokens int) {
+	if text != "" && s.firstText != nil {
+		s.firstText()
+		s.firstText = nil
+	}
+	if s.sink != nil {
+		if text != "" {
+			s.sink(text)
+		}
+		return
+	}
+	progress.AddTokens(tokens)
+	if text == "" {
+		return
+	}
+	if !s.started {
+		progress.Print(fmt.Sprintf("\n%-*s ", len(s.label), boldBlue(s.label)))
+		s.started = true
+	}
+	helpers.PrintChunk(text, s.format)
+	helpers.StreamChunk(text)
+}
+
+// Close ends the response.
+func (s *Stream) Close() {
+	if s.restorer != nil {
+		s.write(s.restorer.Flush(), 0)
+	}
+	if s.sink != nil {
+		return
+	}
+	helpers.FlushChunks()
+	if rest := s.colors.Flush(); rest != "" {
+		progress.Print(indent(rest))
+	}
+}
+
+// format colors text, which continues the text formatted before, and indents
+// its lines.
+func (s *Stream) format(text string) string {
+	return indent(s.colors.Write(text))
+}
+
+func indent(text string) string {
+	return strings.ReplaceAll(text, "\n", "\n\t")
+}
@@ -0,0 +1,104 @@
+package replay
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/sessions"
+	"github.com/rojolang/terminalgpt/trash"
+	"os"
+)
+
+type Options struct {
+	// Session is the stored session whose user turns are replayed.
+	Session string
+	// Provider and Model answer the replayed turns.
+	Provider string
+	Model    string
+	// Target is the session the new conversation is saved to.
+	Target string
+}
+
+// TargetName is the default session a replay of session with model is saved
+// to, e.g. "myrepo@main+gpt-4o-mini".
+func TargetName(session, model string) string {
+	return session + "+" + model
+}
+
+// Run asks the model every user turn of the session in order, as a new
+// conversation in the target session, so each answer sees the replayed
+// answers before it rather than the original ones. A previous target session
+// is moved to the trash.
+func Run(cfg *config.Config, opts Options) error {
+	source := historyFile(opts.Session)
+	history, err := helpers.LoadHistory(source)
+	if err != nil {
+		return fmt.Errorf("failed to load session %s: %w", opts.Session, err)
+	}
+	turns := []string{}
+	originalTokens := 0
+	for _, entry := range history {
+		switch entry.Role {
+		case "user":
+			turns = append(turns, entry.Content)
+		case "assistant":
+			tokens, _ := helpers.CountTokens(entry.Content, opts.Model)
+			originalTokens += tokens
+		}
+	}
+	if len(turns) == 0 {
+		return fmt.Errorf("session %s has no messages to replay (%s)", opts.Session, source)
+	}
+
+	target := historyFile(opts.Target)
+	if target == source {
+		return fmt.Errorf("the replay can't be saved to the session it replays")
+	}
+	if _, err := os.Stat(target); err == nil {
+		_, err = trash.Move(target, "history replaced by replay")
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Target != sessions.GlobalSession {
+		err = sessions.Use(opts.Target)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the history holds the replayed conversation, the cache and fallbacks
+	// would answer with something other than the model
+	replayCfg := config.WithBackend(cfg, opts.Provider, opts.Model)
+	replayCfg.History = true
+	replayCfg.Cache = false
+	replayCfg.Fallbacks = nil
+
+	gray := color.New(color.FgHiBlack)
+	replayedTokens := 0
+	for i, turn := range turns {
+		gray.Printf("\n[%d/%d] %s\n", i+1, len(turns), sessions.Snippet(turn, "", 80))
+		_, _, _, responseTokens, _, err := common.GenerateCompletion(replayCfg, turn)
+		fmt.Println()
+		if err != nil {
+			return fmt.Errorf("turn %d failed, %s holds the turns before it: %w", i+1, opts.Target, err)
+		}
+		replayedTokens += responseTokens
+	}
+
+	fmt.Printf("\nReplayed %d turns of %s with %s %s into %s\n", len(turns), opts.Session, opts.Provider, opts.Model, opts.Target)
+	fmt.Printf("Answers: %d tokens, the original ones %d\n", replayedTokens, originalTokens)
+	fmt.Printf("Continue with: terminalgpt --session %s\n", opts.Target)
+	return nil
+}
+
+// historyFile returns the history file of the named session, the global one
+// for sessions.GlobalSession.
+func historyFile(name string) string {
+	if name == sessions.GlobalSession {
+		return config.HistoryFile
+	}
+	return sessions.HistoryFile(name)
+}
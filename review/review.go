@@ -0,0 +1,244 @@
+package review
+
+import (
+	"context"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/fixes"
+	"github.com/rojolang/terminalgpt/render"
+	"github.com/rojolang/terminalgpt/truncate"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const systemMessage = "You review code changes. You get the diff of one file, where every kept or added line starts with its line number in the new version of the file. Report bugs, security problems, races, missing error handling and misleading code in the added and changed lines, most important first. Skip style nitpicks a formatter fixes and code that was only removed. Use the line numbers of the new version, and give a replacement only for lines of the new version." + fixes.Instructions
+
+// Formats are the report formats, markdown and those of the fixes package.
+var Formats = append([]string{"markdown"}, fixes.Formats...)
+
+// IsFormat reports whether format is one of Formats.
+func IsFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// hunkHeader reads the first line of a hunk in the new file.
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+type Options struct {
+	// Range is what to review as git diff takes it, e.g. HEAD~3..HEAD, or a
+	// single commit to review the changes since it.
+	Range            string
+	WorkingDirectory string
+}
+
+// Run reviews the diff of every file changed in opts.Range, split into
+// chunks that fit a request, and returns the findings ordered by file and
+// line.
+func Run(cfg *config.Config, opts Options) ([]fixes.Fix, error) {
+	names, err := git(opts.WorkingDirectory, "diff", "--name-only", "-z", "--diff-filter=d", opts.Range)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, name := range strings.Split(names, "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no changes in %s", opts.Range)
+	}
+
+	// review calls are one-off requests, they should neither read nor pollute history
+	runCfg := *cfg
+	runCfg.History = false
+	runCfg.SystemMessage = systemMessage
+	count := truncate.Counter(runCfg.ModelName)
+	budget := max(runCfg.MaxTotalTokens-runCfg.MaxResponseTokens-count(systemMessage)-200, 100)
+
+	gray := color.New(color.FgHiBlack)
+	findings := []fixes.Fix{}
+	reviewed := 0
+	for _, file := range files {
+		diff, err := git(opts.WorkingDirectory, "diff", "--no-color", "-U5", opts.Range, "--", file)
+		if err != nil {
+			return nil, err
+		}
+		chunks := chunk(annotate(diff), budget, runCfg.ModelName)
+		for i, text := range chunks {
+			gray.Fprintf(os.Stderr, "Reviewing %s (%d/%d)\n", file, i+1, len(chunks))
+			found, err := reviewChunk(&runCfg, file, text)
+			if err != nil {
+				color.New(color.FgRed).Fprintf(os.Stderr, "Skipping part %d of %s: %v\n", i+1, file, err)
+				continue
+			}
+			reviewed++
+			findings = append(findings, found...)
+		}
+	}
+	if reviewed == 0 {
+		return nil, fmt.Errorf("no part of the diff could be reviewed")
+	}
+
+	order := map[string]int{}
+	for i, file := range files {
+		order[file] = i
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].File != findings[j].File {
+			return order[findings[i].File] < order[findings[j].File]
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+// reviewChunk asks for the findings in one chunk of the diff of file.
+func reviewChunk(cfg *config.Config, file, diff string) ([]fixes.Fix, error) {
+	ctx := render.WithSink(context.Background(), func(string) {})
+	prompt := fmt.Sprintf("Review the changes to %s:\n\n```diff\n%s\n```", file, diff)
+	response, _, _, _, _, err := common.GenerateCompletionContext(ctx, cfg, prompt)
+	if err != nil {
+		return nil, err
+	}
+	found, err := fixes.Parse(response)
+	if err != nil {
+		return nil, err
+	}
+	// a chunk only has one file, whatever path the model made of it
+	for i := range found {
+		found[i].File = file
+	}
+	return found, nil
+}
+
+// annotate returns the hunks of a one-file diff, every kept and added line
+// prefixed with its line number in the new version.
+func annotate(diff string) []string {
+	hunks := []string{}
+	var current strings.Builder
+	line := 0
+	for _, text := range strings.Split(diff, "\n") {
+		if match := hunkHeader.FindStringSubmatch(text); match != nil {
+			if current.Len() > 0 {
+				hunks = append(hunks, current.String())
+				current.Reset()
+			}
+			line, _ = strconv.Atoi(match[1])
+			current.WriteString(text + "\n")
+			continue
+		}
+		if current.Len() == 0 {
+			// the diff --git, index and ---/+++ header
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text, "-"):
+			fmt.Fprintf(&current, "%6s%s\n", "", text)
+		case strings.HasPrefix(text, "+"), strings.HasPrefix(text, " "):
+			fmt.Fprintf(&current, "%5d %s\n", line, text)
+			line++
+		case text != "":
+			current.WriteString(text + "\n")
+		}
+	}
+	if current.Len() > 0 {
+		hunks = append(hunks, current.String())
+	}
+	return hunks
+}
+
+// chunk groups hunks into texts of at most budget tokens, cutting hunks that
+// are larger on their own.
+func chunk(hunks []string, budget int, modelName string) []string {
+	count := truncate.Counter(modelName)
+	chunks := []string{}
+	current, currentTokens := "", 0
+	for _, hunk := range hunks {
+		tokens := count(hunk)
+		if tokens > budget {
+			hunk, _ = truncate.HeadTail(hunk, budget, 0.5, modelName)
+			tokens = count(hunk)
+		}
+		if currentTokens+tokens > budget && current != "" {
+			chunks = append(chunks, current)
+			current, currentTokens = "", 0
+		}
+		current += hunk
+		currentTokens += tokens
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// Format renders findings as a Markdown report of the review of diffRange, or
+// in one of the formats of the fixes package.
+func Format(findings []fixes.Fix, format string, diffRange string) ([]byte, error) {
+	if format != "markdown" {
+		return fixes.Format(findings, format)
+	}
+
+	severities := map[string]int{}
+	files := []string{}
+	for _, f := range findings {
+		severities[f.Severity]++
+		if len(files) == 0 || files[len(files)-1] != f.File {
+			files = append(files, f.File)
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Review of %s\n\n", diffRange)
+	if len(findings) == 0 {
+		sb.WriteString("No findings.\n")
+		return []byte(sb.String()), nil
+	}
+	fmt.Fprintf(&sb, "%d findings in %d files: %d errors, %d warnings, %d info.\n", len(findings), len(files), severities["error"], severities["warning"], severities["info"])
+
+	file := ""
+	for _, f := range findings {
+		if f.File != file {
+			file = f.File
+			fmt.Fprintf(&sb, "\n## %s\n\n", file)
+		}
+		lines := fmt.Sprintf("line %d", f.Line)
+		if f.EndLine > f.Line {
+			lines = fmt.Sprintf("lines %d-%d", f.Line, f.EndLine)
+		}
+		fmt.Fprintf(&sb, "- **%s** %s: %s\n", f.Severity, lines, strings.TrimSpace(f.Message))
+		if f.Replacement != nil {
+			sb.WriteString("\n  Suggestion:\n\n  ```\n")
+			for _, line := range strings.Split(strings.TrimRight(*f.Replacement, "\n"), "\n") {
+				sb.WriteString(strings.TrimRight("  "+line, " ") + "\n")
+			}
+			sb.WriteString("  ```\n")
+		}
+	}
+	return []byte(sb.String()), nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return string(out), nil
+}
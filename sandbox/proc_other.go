@@ -0,0 +1,16 @@
+//go:build !windows
+
+package sandbox
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup makes cmd stop the processes it started too when it is canceled.
+func killGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
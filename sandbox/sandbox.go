@@ -0,0 +1,212 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout stops a snippet when no --timeout is given.
+const DefaultTimeout = 10 * time.Second
+
+// maxOutput is how much of stdout and stderr each is kept.
+const maxOutput = 64 * 1024
+
+// maxFeedback is how much of the output a fix request quotes.
+const maxFeedback = 4000
+
+// runners maps language tags to the file a snippet is written to and the
+// command running it.
+var runners = map[string]struct {
+	file    string
+	command []string
+}{
+	"go":      {"main.go", []string{"go", "run", "main.go"}},
+	"golang":  {"main.go", []string{"go", "run", "main.go"}},
+	"python":  {"main.py", []string{"python3", "-I", "main.py"}},
+	"python3": {"main.py", []string{"python3", "-I", "main.py"}},
+	"py":      {"main.py", []string{"python3", "-I", "main.py"}},
+}
+
+// Result is what a snippet printed and how it ended.
+type Result struct {
+	Command  string
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	TimedOut bool
+	Duration time.Duration
+}
+
+// Failed reports whether the snippet exited with an error or timed out.
+func (r Result) Failed() bool {
+	return r.ExitCode != 0 || r.TimedOut
+}
+
+// Runnable reports whether block is Go or Python code.
+func Runnable(block codeblocks.Block) bool {
+	_, ok := runners[block.Lang]
+	return ok
+}
+
+// Pick returns the last Go or Python block of response, or the index-th one
+// when index is > 0.
+func Pick(response string, index int) (codeblocks.Block, error) {
+	blocks := []codeblocks.Block{}
+	for _, block := range codeblocks.Extract(response) {
+		if Runnable(block) && strings.TrimSpace(block.Code) != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	if len(blocks) == 0 {
+		return codeblocks.Block{}, fmt.Errorf("the last response has no Go or Python code blocks")
+	}
+	if index > len(blocks) {
+		return codeblocks.Block{}, fmt.Errorf("the last response has only %d Go or Python code blocks", len(blocks))
+	}
+	if index > 0 {
+		return blocks[index-1], nil
+	}
+	return blocks[len(blocks)-1], nil
+}
+
+// Run writes block to a new temporary directory and runs it there with go
+// run or python3, without stdin and without the API keys and other secrets
+// of the environment, stopping it after timeout (DefaultTimeout when zero).
+// The directory is removed afterwards.
+func Run(block codeblocks.Block, timeout time.Duration) (Result, error) {
+	runner, ok := runners[block.Lang]
+	if !ok {
+		return Result{}, fmt.Errorf("can't run %q code, only Go and Python", block.Lang)
+	}
+	if _, err := exec.LookPath(runner.command[0]); err != nil {
+		return Result{}, fmt.Errorf("%s is not installed: %w", runner.command[0], err)
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	dir, err := os.MkdirTemp("", "terminalgpt-run-")
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to create the sandbox directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.WriteFile(filepath.Join(dir, runner.file), []byte(block.Code+"\n"), 0600)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to write the snippet: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: maxOutput}
+	stderr := &limitedBuffer{limit: maxOutput}
+	cmd := exec.CommandContext(ctx, runner.command[0], runner.command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = environment(dir)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// go run starts the compiled program as a child, stop them together
+	killGroup(cmd)
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err = cmd.Run()
+	result := Result{
+		Command:  strings.Join(runner.command, " "),
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Duration: time.Since(start),
+		TimedOut: ctx.Err() == context.DeadlineExceeded,
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil && !result.TimedOut {
+		return result, fmt.Errorf("failed to run %s: %w", result.Command, err)
+	}
+	if result.TimedOut && result.ExitCode == 0 {
+		result.ExitCode = -1
+	}
+	return result, nil
+}
+
+// FixPrompt asks for a corrected version of block after it failed with result.
+func FixPrompt(block codeblocks.Block, result Result) string {
+	output := strings.TrimSpace(result.Stderr)
+	if out := strings.TrimSpace(result.Stdout); out != "" {
+		output = strings.TrimSpace(out + "\n" + output)
+	}
+	// the end of the output has the error
+	if len(output) > maxFeedback {
+		output = "..." + output[len(output)-maxFeedback:]
+	}
+
+	ending := fmt.Sprintf("it exited with status %d", result.ExitCode)
+	if result.TimedOut {
+		ending = fmt.Sprintf("it was stopped after %s", result.Duration.Round(time.Second))
+	}
+	return fmt.Sprintf("Running this code with `%s` failed, %s:\n\n```%s\n%s\n```\n\nOutput:\n\n```\n%s\n```\n\nFix it and reply with the whole corrected program in a single code block.", result.Command, ending, block.Lang, block.Code, output)
+}
+
+// environment returns the environment of this process with HOME set to dir
+// and the variables that look like credentials left out.
+func environment(dir string) []string {
+	env := []string{}
+	for _, entry := range os.Environ() {
+		name := strings.ToUpper(strings.SplitN(entry, "=", 2)[0])
+		if name == "HOME" || secretName(name) {
+			continue
+		}
+		env = append(env, entry)
+	}
+
+	// go keeps using the caches of the real home
+	if home, err := os.UserHomeDir(); err == nil && os.Getenv("GOPATH") == "" {
+		env = append(env, "GOPATH="+filepath.Join(home, "go"))
+	}
+	if cache, err := os.UserCacheDir(); err == nil && os.Getenv("GOCACHE") == "" {
+		env = append(env, "GOCACHE="+filepath.Join(cache, "go-build"))
+	}
+	return append(env, "HOME="+dir)
+}
+
+func secretName(name string) bool {
+	for _, part := range []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "CREDENTIAL", "AUTH"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.Buffer.String() + "\n... output cut off"
+	}
+	return b.Buffer.String()
+}
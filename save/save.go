@@ -0,0 +1,159 @@
+package save
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// previewLines is how many lines of each block are shown before saving.
+const previewLines = 12
+
+// Block writes the index-th (1-based) code block of response to path,
+// relative to workingDirectory, after showing a preview and asking for
+// confirmation. It returns the absolute path written.
+func Block(response string, workingDirectory string, reader *bufio.Reader, index int, path string) (string, error) {
+	blocks := codeblocks.Extract(response)
+	if len(blocks) == 0 {
+		return "", fmt.Errorf("the last response has no code blocks")
+	}
+	if index < 1 || index > len(blocks) {
+		return "", fmt.Errorf("the last response has only %d code blocks", len(blocks))
+	}
+
+	block := blocks[index-1]
+	if path == "" {
+		path = defaultName(block, index)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDirectory, path)
+	}
+
+	preview(block, index, path)
+	if !confirm(reader, "Save this block?") {
+		fmt.Println("Skipped.")
+		return "", nil
+	}
+
+	err := write(path, block.Code)
+	if err != nil {
+		return "", err
+	}
+	color.Green("Saved %s\n", path)
+	return path, nil
+}
+
+// All writes every code block of response into dir, relative to
+// workingDirectory, named after the file name in the block's first line or
+// snippet-<n> with an extension from its language. It asks once for all
+// blocks and returns the paths written.
+func All(response string, workingDirectory string, reader *bufio.Reader, dir string) ([]string, error) {
+	blocks := codeblocks.Extract(response)
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("the last response has no code blocks")
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(workingDirectory, dir)
+	}
+
+	paths := []string{}
+	used := make(map[string]bool)
+	for i, block := range blocks {
+		name := block.FileName()
+		if name == "" || !inside(dir, filepath.Join(dir, name)) {
+			name = defaultName(block, i+1)
+		}
+		path := filepath.Join(dir, name)
+		for n := 2; used[path]; n++ {
+			ext := filepath.Ext(name)
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext))
+		}
+		used[path] = true
+		paths = append(paths, path)
+
+		preview(block, i+1, path)
+	}
+
+	if !confirm(reader, fmt.Sprintf("Save these %d blocks?", len(blocks))) {
+		fmt.Println("Skipped.")
+		return nil, nil
+	}
+
+	written := []string{}
+	for i, block := range blocks {
+		err := write(paths[i], block.Code)
+		if err != nil {
+			return written, err
+		}
+		written = append(written, paths[i])
+		color.Green("Saved %s\n", paths[i])
+	}
+	return written, nil
+}
+
+func defaultName(block codeblocks.Block, index int) string {
+	if name := block.FileName(); name != "" && !filepath.IsAbs(name) && !strings.HasPrefix(filepath.Clean(name), "..") {
+		return name
+	}
+	return fmt.Sprintf("snippet-%d%s", index, block.Extension())
+}
+
+func preview(block codeblocks.Block, index int, path string) {
+	lang := block.Lang
+	if lang == "" {
+		lang = "plain"
+	}
+	color.New(color.FgHiYellow).Printf("\nBlock %d (%s) -> %s", index, lang, path)
+	if _, err := os.Stat(path); err == nil {
+		color.New(color.FgRed).Print(" (overwrites the existing file)")
+	}
+	fmt.Println()
+
+	lines := strings.Split(block.Code, "\n")
+	shown := lines
+	if len(lines) > previewLines {
+		shown = lines[:previewLines]
+	}
+	gray := color.New(color.FgHiBlack)
+	for _, line := range shown {
+		gray.Printf("  %s\n", line)
+	}
+	if len(lines) > previewLines {
+		gray.Printf("  ... %d more lines\n", len(lines)-previewLines)
+	}
+}
+
+func confirm(reader *bufio.Reader, question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func write(path, code string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if !strings.HasSuffix(code, "\n") {
+		code += "\n"
+	}
+	err = ioutil.WriteFile(path, []byte(code), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func inside(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
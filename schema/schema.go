@@ -0,0 +1,153 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"github.com/rojolang/terminalgpt/config"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// MaxRetries is how often a request is repeated with the validation errors
+// before giving up.
+const MaxRetries = 2
+
+// Schema is a JSON schema the answers of --schema have to match.
+type Schema struct {
+	// Name identifies the schema in the request, from its title or file name.
+	Name string
+	root map[string]interface{}
+}
+
+var invalidName = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Load reads the JSON schema in path.
+func Load(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the schema: %w", err)
+	}
+	var root map[string]interface{}
+	err = json.Unmarshal(data, &root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the schema %s: %w", path, err)
+	}
+
+	name, _ := root["title"].(string)
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	name = strings.Trim(invalidName.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = "response"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return &Schema{Name: name, root: root}, nil
+}
+
+// Apply returns a copy of cfg that asks for answers matching s: the schema
+// is added to the system message and, for models that support it, sent as
+// the response_format.
+func (s *Schema) Apply(cfg *config.Config) *config.Config {
+	schemaCfg := *cfg
+	indented, _ := json.MarshalIndent(s.root, "", "  ")
+	schemaCfg.SystemMessage += "\n\nAnswer only with JSON that matches this JSON schema, without any other text:\n" + string(indented)
+
+	format := s.responseFormat(cfg.ModelName)
+	if format == nil {
+		return &schemaCfg
+	}
+	// the extra_body maps are shared with cfg
+	schemaCfg.ExtraBody = map[string]map[string]interface{}{}
+	for provider, fields := range cfg.ExtraBody {
+		schemaCfg.ExtraBody[provider] = fields
+	}
+	fields := map[string]interface{}{}
+	for name, value := range cfg.ExtraBody[cfg.AIProvider] {
+		fields[name] = value
+	}
+	fields["response_format"] = format
+	schemaCfg.ExtraBody[cfg.AIProvider] = fields
+	return &schemaCfg
+}
+
+// responseFormat returns json_schema for models with structured outputs,
+// json_object for the older models with a JSON mode and nil for the others,
+// which only get the instructions.
+func (s *Schema) responseFormat(model string) map[string]interface{} {
+	model = strings.ToLower(model)
+	if model == "gpt-4o-2024-05-13" {
+		return map[string]interface{}{"type": "json_object"}
+	}
+	for _, prefix := range []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return map[string]interface{}{
+				"type":        "json_schema",
+				"json_schema": map[string]interface{}{"name": s.Name, "schema": s.root},
+			}
+		}
+	}
+	for _, prefix := range []string{"gpt-4-turbo", "gpt-4-1106", "gpt-4-0125", "gpt-3.5-turbo"} {
+		if strings.HasPrefix(model, prefix) {
+			return map[string]interface{}{"type": "json_object"}
+		}
+	}
+	return nil
+}
+
+// Check finds the JSON in response and validates it. It returns the JSON
+// indented, or the reasons it does not match.
+func (s *Schema) Check(response string) (string, []string) {
+	text, ok := extract(response)
+	if !ok {
+		return "", []string{"the answer is not valid JSON"}
+	}
+	var value interface{}
+	json.Unmarshal([]byte(text), &value)
+
+	errs := s.Validate(value)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	indented, _ := json.MarshalIndent(value, "", "  ")
+	return string(indented), nil
+}
+
+// Correction asks again for message, pointing out what was wrong with the
+// previous answer.
+func Correction(message, answer string, errs []string) string {
+	return fmt.Sprintf("%s\n\nYour previous answer was:\n%s\n\nIt does not match the JSON schema:\n- %s\n\nAnswer again with only the corrected JSON.", message, answer, strings.Join(errs, "\n- "))
+}
+
+// extract returns the JSON value in a response: the content of a json code
+// block, or the text from the first { or [ that starts valid JSON.
+func extract(response string) (string, bool) {
+	for _, block := range codeblocks.Extract(response) {
+		if (block.Lang == "json" || block.Lang == "") && json.Valid([]byte(block.Code)) {
+			return block.Code, true
+		}
+	}
+	text := strings.TrimSpace(response)
+	if json.Valid([]byte(text)) {
+		return text, true
+	}
+	for start, r := range text {
+		if r != '{' && r != '[' {
+			continue
+		}
+		closer := "}"
+		if r == '[' {
+			closer = "]"
+		}
+		end := strings.LastIndex(text, closer)
+		if end > start && json.Valid([]byte(text[start:end+1])) {
+			return text[start : end+1], true
+		}
+	}
+	return "", false
+}
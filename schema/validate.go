@@ -0,0 +1,298 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate checks value, as decoded by encoding/json, against the schema. It
+// supports the keywords structured outputs use: type, enum, const,
+// properties, required, additionalProperties, items, prefixItems, the
+// length, size and range limits, pattern, allOf, anyOf, oneOf, not and
+// local $refs. Others, such as format, are not checked.
+func (s *Schema) Validate(value interface{}) []string {
+	errs := []string{}
+	s.validate(s.root, value, "$", &errs, 0)
+	return errs
+}
+
+// maxDepth stops recursive $refs that never reach a value.
+const maxDepth = 64
+
+func (s *Schema) validate(schema map[string]interface{}, value interface{}, path string, errs *[]string, depth int) {
+	if depth > maxDepth {
+		return
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := s.resolve(ref)
+		if err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s: %v", path, err))
+			return
+		}
+		s.validate(resolved, value, path, errs, depth+1)
+	}
+
+	if types, ok := typeNames(schema["type"]); ok && !hasType(value, types) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(types, " or "), typeOf(value)))
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && !contains(enum, value) {
+		*errs = append(*errs, fmt.Sprintf("%s: %s is not one of %s", path, show(value), show(enum)))
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		*errs = append(*errs, fmt.Sprintf("%s: expected %s", path, show(constant)))
+	}
+
+	switch v := value.(type) {
+	case string:
+		s.validateString(schema, v, path, errs)
+	case float64:
+		s.validateNumber(schema, v, path, errs)
+	case map[string]interface{}:
+		s.validateObject(schema, v, path, errs, depth)
+	case []interface{}:
+		s.validateArray(schema, v, path, errs, depth)
+	}
+
+	for _, sub := range schemas(schema["allOf"]) {
+		s.validate(sub, value, path, errs, depth+1)
+	}
+	if anyOf := schemas(schema["anyOf"]); len(anyOf) > 0 && s.matching(anyOf, value, path, depth) == 0 {
+		*errs = append(*errs, fmt.Sprintf("%s: does not match any of the allowed schemas", path))
+	}
+	if oneOf := schemas(schema["oneOf"]); len(oneOf) > 0 {
+		if n := s.matching(oneOf, value, path, depth); n != 1 {
+			*errs = append(*errs, fmt.Sprintf("%s: matches %d of the schemas instead of exactly one", path, n))
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && s.matching([]map[string]interface{}{not}, value, path, depth) == 1 {
+		*errs = append(*errs, fmt.Sprintf("%s: matches a schema it must not match", path))
+	}
+}
+
+func (s *Schema) validateString(schema map[string]interface{}, value string, path string, errs *[]string) {
+	length := float64(utf8.RuneCountInString(value))
+	if limit, ok := schema["minLength"].(float64); ok && length < limit {
+		*errs = append(*errs, fmt.Sprintf("%s: shorter than %g characters", path, limit))
+	}
+	if limit, ok := schema["maxLength"].(float64); ok && length > limit {
+		*errs = append(*errs, fmt.Sprintf("%s: longer than %g characters", path, limit))
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(value) {
+			*errs = append(*errs, fmt.Sprintf("%s: %q does not match the pattern %s", path, value, pattern))
+		}
+	}
+}
+
+func (s *Schema) validateNumber(schema map[string]interface{}, value float64, path string, errs *[]string) {
+	if limit, ok := schema["minimum"].(float64); ok && value < limit {
+		*errs = append(*errs, fmt.Sprintf("%s: %g is less than the minimum %g", path, value, limit))
+	}
+	if limit, ok := schema["maximum"].(float64); ok && value > limit {
+		*errs = append(*errs, fmt.Sprintf("%s: %g is more than the maximum %g", path, value, limit))
+	}
+	if limit, ok := schema["exclusiveMinimum"].(float64); ok && value <= limit {
+		*errs = append(*errs, fmt.Sprintf("%s: %g is not more than %g", path, value, limit))
+	}
+	if limit, ok := schema["exclusiveMaximum"].(float64); ok && value >= limit {
+		*errs = append(*errs, fmt.Sprintf("%s: %g is not less than %g", path, value, limit))
+	}
+	if divisor, ok := schema["multipleOf"].(float64); ok && divisor > 0 {
+		if quotient := value / divisor; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			*errs = append(*errs, fmt.Sprintf("%s: %g is not a multiple of %g", path, value, divisor))
+		}
+	}
+}
+
+func (s *Schema) validateObject(schema map[string]interface{}, value map[string]interface{}, path string, errs *[]string, depth int) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					*errs = append(*errs, fmt.Sprintf("%s: missing the required property %q", path, name))
+				}
+			}
+		}
+	}
+	if limit, ok := schema["minProperties"].(float64); ok && float64(len(value)) < limit {
+		*errs = append(*errs, fmt.Sprintf("%s: fewer than %g properties", path, limit))
+	}
+	if limit, ok := schema["maxProperties"].(float64); ok && float64(len(value)) > limit {
+		*errs = append(*errs, fmt.Sprintf("%s: more than %g properties", path, limit))
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		childPath := path + "." + name
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			s.validate(property, value[name], childPath, errs, depth+1)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*errs = append(*errs, fmt.Sprintf("%s: unexpected property %q", path, name))
+			}
+		case map[string]interface{}:
+			s.validate(additional, value[name], childPath, errs, depth+1)
+		}
+	}
+}
+
+func (s *Schema) validateArray(schema map[string]interface{}, value []interface{}, path string, errs *[]string, depth int) {
+	if limit, ok := schema["minItems"].(float64); ok && float64(len(value)) < limit {
+		*errs = append(*errs, fmt.Sprintf("%s: fewer than %g items", path, limit))
+	}
+	if limit, ok := schema["maxItems"].(float64); ok && float64(len(value)) > limit {
+		*errs = append(*errs, fmt.Sprintf("%s: more than %g items", path, limit))
+	}
+	if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		for i := range value {
+			for j := i + 1; j < len(value); j++ {
+				if reflect.DeepEqual(value[i], value[j]) {
+					*errs = append(*errs, fmt.Sprintf("%s: items %d and %d are the same", path, i, j))
+				}
+			}
+		}
+	}
+
+	prefix := schemas(schema["prefixItems"])
+	items, _ := schema["items"].(map[string]interface{})
+	for i, item := range value {
+		childPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i < len(prefix):
+			s.validate(prefix[i], item, childPath, errs, depth+1)
+		case items != nil:
+			s.validate(items, item, childPath, errs, depth+1)
+		}
+	}
+}
+
+// matching returns how many of schemas value matches.
+func (s *Schema) matching(schemas []map[string]interface{}, value interface{}, path string, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		subErrs := []string{}
+		s.validate(sub, value, path, &subErrs, depth+1)
+		if len(subErrs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// resolve looks up a $ref within the schema, such as #/$defs/item.
+func (s *Schema) resolve(ref string) (map[string]interface{}, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only references within the schema are supported, not %s", ref)
+	}
+	var current interface{} = s.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolved reference %s", ref)
+		}
+		current, ok = object[part]
+		if !ok {
+			return nil, fmt.Errorf("unresolved reference %s", ref)
+		}
+	}
+	resolved, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("reference %s is not a schema", ref)
+	}
+	return resolved, nil
+}
+
+func schemas(value interface{}) []map[string]interface{} {
+	list, _ := value.([]interface{})
+	result := []map[string]interface{}{}
+	for _, item := range list {
+		if schema, ok := item.(map[string]interface{}); ok {
+			result = append(result, schema)
+		}
+	}
+	return result
+}
+
+func typeNames(value interface{}) ([]string, bool) {
+	switch t := value.(type) {
+	case string:
+		return []string{t}, true
+	case []interface{}:
+		names := []string{}
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names, len(names) > 0
+	}
+	return nil, false
+}
+
+func hasType(value interface{}, types []string) bool {
+	actual := typeOf(value)
+	for _, name := range types {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func contains(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// show returns value as JSON for the error messages.
+func show(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
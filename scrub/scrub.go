@@ -0,0 +1,198 @@
+package scrub
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Builtin are the rules of scrub_secrets, scrub_rules can replace them by
+// name.
+var Builtin = []config.ScrubRule{
+	{Name: "private_key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{Name: "aws_access_key", Pattern: `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "aws_secret_key", Pattern: `(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`},
+	{Name: "openai_key", Pattern: `\bsk-[A-Za-z0-9_\-]{20,}`},
+	{Name: "github_token", Pattern: `\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`},
+	{Name: "slack_token", Pattern: `\bxox[abposr]-[A-Za-z0-9\-]{10,}`},
+	{Name: "jwt", Pattern: `\beyJ[A-Za-z0-9_\-]{10,}\.eyJ[A-Za-z0-9_\-]{10,}\.[A-Za-z0-9_\-]{10,}`},
+	{Name: "bearer_token", Pattern: `(?i)\bbearer\s+([A-Za-z0-9._~+/\-]{20,}=*)`},
+	{Name: "password", Pattern: `(?i)\b(?:password|passwd|pwd|secret|api_?key|token)["']?\s*[:=]\s*["']?([^\s"']{8,})`},
+	{Name: "email", Pattern: `\b[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}\b`},
+}
+
+// rule is a compiled ScrubRule.
+type rule struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// Scrubber replaces secrets with placeholders like [EMAIL_1] and puts them
+// back in what is shown. The same secret always gets the same placeholder.
+// The secrets are only kept in memory.
+type Scrubber struct {
+	rules []rule
+
+	mu       sync.Mutex
+	secrets  map[string]string // placeholder to secret
+	names    map[string]string // secret to placeholder
+	counters map[string]int
+}
+
+// New returns a Scrubber with the built-in rules, replaced, turned off or
+// extended by rules of the same name.
+func New(rules []config.ScrubRule) (*Scrubber, error) {
+	merged := append([]config.ScrubRule{}, Builtin...)
+	for _, r := range rules {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == r.Name {
+				merged[i] = r
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, r)
+		}
+	}
+
+	s := &Scrubber{secrets: map[string]string{}, names: map[string]string{}, counters: map[string]int{}}
+	for _, r := range merged {
+		if r.Pattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scrub rule %s: %w", r.Name, err)
+		}
+		s.rules = append(s.rules, rule{r.Name, pattern})
+	}
+	return s, nil
+}
+
+// Scrub returns text with every secret replaced and the names of the rules
+// that found one, in order.
+func (s *Scrubber) Scrub(text string) (string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := []string{}
+	for _, r := range s.rules {
+		matched := false
+		text = replaceAll(r.pattern, text, func(secret string) string {
+			// placeholders of earlier rules are not secrets
+			if s.secrets[secret] != "" {
+				return secret
+			}
+			matched = true
+			return s.placeholder(r.name, secret)
+		})
+		if matched {
+			found = append(found, r.name)
+		}
+	}
+	return text, found
+}
+
+// replaceAll replaces the matches of pattern, or only their first group when
+// it has one.
+func replaceAll(pattern *regexp.Regexp, text string, replace func(string) string) string {
+	if pattern.NumSubexp() == 0 {
+		return pattern.ReplaceAllStringFunc(text, replace)
+	}
+	var sb strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[2], match[3]
+		if start < 0 {
+			continue
+		}
+		sb.WriteString(text[last:start])
+		sb.WriteString(replace(text[start:end]))
+		last = end
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+// placeholder returns the placeholder of secret, the caller holds mu.
+func (s *Scrubber) placeholder(name, secret string) string {
+	if placeholder, ok := s.names[secret]; ok {
+		return placeholder
+	}
+	s.counters[name]++
+	placeholder := fmt.Sprintf("[%s_%d]", strings.ToUpper(name), s.counters[name])
+	s.names[secret] = placeholder
+	s.secrets[placeholder] = secret
+	return placeholder
+}
+
+// Restore puts the secrets back for their placeholders in text.
+func (s *Scrubber) Restore(text string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.secrets) == 0 {
+		return text
+	}
+	pairs := []string{}
+	for _, placeholder := range s.placeholders() {
+		pairs = append(pairs, placeholder, s.secrets[placeholder])
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// placeholders returns the placeholders longest first, so [EMAIL_12] is not
+// taken for [EMAIL_1] followed by "2]". The caller holds mu.
+func (s *Scrubber) placeholders() []string {
+	placeholders := make([]string, 0, len(s.secrets))
+	for placeholder := range s.secrets {
+		placeholders = append(placeholders, placeholder)
+	}
+	sort.Slice(placeholders, func(i, j int) bool {
+		return len(placeholders[i]) > len(placeholders[j])
+	})
+	return placeholders
+}
+
+// Restorer returns a render.Restorer putting the secrets back in a streamed
+// response, holding back a piece that may be the start of a placeholder.
+func (s *Scrubber) Restorer() *Restorer {
+	return &Restorer{scrubber: s}
+}
+
+// Restorer restores the secrets of a streamed response.
+type Restorer struct {
+	scrubber *Scrubber
+	pending  string
+}
+
+func (r *Restorer) Write(text string) string {
+	text = r.pending + text
+	r.pending = ""
+	if open := strings.LastIndex(text, "["); open >= 0 && !strings.Contains(text[open:], "]") && r.mayStart(text[open:]) {
+		r.pending = text[open:]
+		text = text[:open]
+	}
+	return r.scrubber.Restore(text)
+}
+
+func (r *Restorer) Flush() string {
+	text := r.scrubber.Restore(r.pending)
+	r.pending = ""
+	return text
+}
+
+// mayStart reports whether text is the start of a placeholder.
+func (r *Restorer) mayStart(text string) bool {
+	r.scrubber.mu.Lock()
+	defer r.scrubber.mu.Unlock()
+	for placeholder := range r.scrubber.secrets {
+		if strings.HasPrefix(placeholder, text) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package sessions
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/trash"
+	"os"
+	"time"
+)
+
+// HandoffVersion is the format version written to new handoff files.
+const HandoffVersion = 1
+
+// Handoff is everything needed to continue a conversation on another machine.
+// The config is a snapshot of the running settings with the keys removed, so
+// whoever imports it uses their own credentials.
+type Handoff struct {
+	Version int                    `json:"version"`
+	Created time.Time              `json:"created"`
+	Session string                 `json:"session"`
+	Mode    string                 `json:"mode,omitempty"`
+	Config  config.Config          `json:"config"`
+	History []helpers.HistoryEntry `json:"history"`
+}
+
+// WriteHandoff writes the history file together with a redacted snapshot of
+// cfg to path.
+func WriteHandoff(path string, cfg *config.Config, session, mode, historyFile string) (Handoff, error) {
+	history, err := helpers.LoadHistory(historyFile)
+	if err != nil {
+		return Handoff{}, err
+	}
+
+	handoff := Handoff{
+		Version: HandoffVersion,
+		Created: time.Now(),
+		Session: session,
+		Mode:    mode,
+		Config:  config.Redacted(*cfg),
+		History: history,
+	}
+
+	data, err := json.MarshalIndent(handoff, "", "  ")
+	if err != nil {
+		return Handoff{}, err
+	}
+	err = os.WriteFile(path, append(data, '\n'), 0600)
+	if err != nil {
+		return Handoff{}, fmt.Errorf("failed to write handoff: %w", err)
+	}
+	return handoff, nil
+}
+
+// ReadHandoff parses a file written by WriteHandoff.
+func ReadHandoff(path string) (Handoff, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Handoff{}, err
+	}
+
+	var handoff Handoff
+	err = json.Unmarshal(data, &handoff)
+	if err != nil {
+		return Handoff{}, fmt.Errorf("failed to parse handoff: %w", err)
+	}
+	if handoff.Version == 0 || handoff.Version > HandoffVersion {
+		return Handoff{}, fmt.Errorf("unsupported handoff version %d", handoff.Version)
+	}
+	return handoff, nil
+}
+
+// ImportHandoff replaces the history file with the history of the handoff,
+// the previous history is moved to the trash.
+func ImportHandoff(handoff Handoff, historyFile string) error {
+	if _, err := os.Stat(historyFile); err == nil {
+		_, err = trash.Move(historyFile, "history replaced by import-handoff")
+		if err != nil {
+			return err
+		}
+	}
+	return helpers.SaveHistory(handoff.History, historyFile)
+}
+
+// ApplyHandoffConfig saves the settings of the handoff as the global config,
+// keeping the local keys and Azure endpoint.
+func ApplyHandoffConfig(handoff Handoff) error {
+	local := config.GetDefaultConfig()
+	if _, err := os.Stat(config.ConfigFile); err == nil {
+		local, err = config.LoadConfig(config.ConfigFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg := handoff.Config
+	if handoff.Mode != "" {
+		// the snapshot holds the system message of the mode, which --mode restores
+		cfg.SystemMessage = local.SystemMessage
+	}
+	cfg.AuthorizationKey = local.AuthorizationKey
+	cfg.AzureAuthKey = local.AzureAuthKey
+	cfg.AzureURL = local.AzureURL
+	return config.SaveConfig(cfg)
+}
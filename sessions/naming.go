@@ -0,0 +1,89 @@
+package sessions
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/config"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var SessionsDir = appdir.Path("sessions")
+
+// globalHistoryFile is config.HistoryFile before Use switches it to a session.
+var globalHistoryFile = config.HistoryFile
+
+// GlobalSession is the --session name that keeps using the global history file.
+const GlobalSession = "global"
+
+// Name derives a session name from the project at dir: the name of the git
+// repository and its current branch ("myrepo@feature/login"), or just the
+// directory name outside of git.
+func Name(dir string) string {
+	root, err := git(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return filepath.Base(dir)
+	}
+
+	branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil || branch == "HEAD" {
+		// no commits yet or a detached HEAD
+		branch, err = git(dir, "rev-parse", "--short", "HEAD")
+		if err != nil {
+			return filepath.Base(root)
+		}
+	}
+	return filepath.Base(root) + "@" + branch
+}
+
+// HistoryFile returns the history file of the named session.
+func HistoryFile(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	return filepath.Join(SessionsDir, safe+".jsonl")
+}
+
+// NameOf returns the session name of historyFile as it is stored, with the
+// characters HistoryFile replaces, or GlobalSession for the global history.
+func NameOf(historyFile string) string {
+	if historyFile == globalHistoryFile {
+		return GlobalSession
+	}
+	return strings.TrimSuffix(filepath.Base(historyFile), ".jsonl")
+}
+
+// HistoryFiles returns the global history file followed by the history files
+// of all sessions.
+func HistoryFiles() ([]string, error) {
+	named, err := filepath.Glob(filepath.Join(SessionsDir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{globalHistoryFile}, named...), nil
+}
+
+// Use switches config.HistoryFile to the history of the named session.
+func Use(name string) error {
+	err := os.MkdirAll(SessionsDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions directory: %w", err)
+	}
+	config.HistoryFile = HistoryFile(name)
+	return nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
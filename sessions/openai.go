@@ -0,0 +1,146 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/trash"
+	"io"
+	"os"
+	"strings"
+)
+
+// OpenAIMessage is a message in the OpenAI chat completions format.
+type OpenAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+var validRoles = map[string]bool{"system": true, "user": true, "assistant": true, "developer": true}
+
+// ExportOpenAI writes the history file as a plain OpenAI messages array.
+func ExportOpenAI(historyFile string, w io.Writer) (int, error) {
+	history, err := helpers.LoadHistory(historyFile)
+	if err != nil {
+		return 0, err
+	}
+
+	messages := make([]OpenAIMessage, 0, len(history))
+	for _, entry := range history {
+		messages = append(messages, OpenAIMessage{Role: entry.Role, Content: entry.Content})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return len(messages), encoder.Encode(messages)
+}
+
+// ImportOpenAI reads an OpenAI messages array, or an object with a "messages"
+// array such as a saved request body, and writes it to the history file.
+// Existing history is replaced unless appendToHistory is set.
+func ImportOpenAI(r io.Reader, historyFile string, appendToHistory bool) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	messages, err := parseMessages(data)
+	if err != nil {
+		return 0, err
+	}
+
+	history := []helpers.HistoryEntry{}
+	if appendToHistory {
+		history, err = helpers.LoadHistory(historyFile)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for i, message := range messages {
+		role := message.Role
+		if role == "developer" {
+			role = "system"
+		}
+		if !validRoles[role] {
+			return 0, fmt.Errorf("message %d has unsupported role %q", i+1, message.Role)
+		}
+		tokens, _ := helpers.CountTokens(message.Content, "gpt-4")
+		history = append(history, helpers.HistoryEntry{Role: role, Content: message.Content, TokenCount: tokens})
+	}
+
+	if !appendToHistory {
+		if _, err := os.Stat(historyFile); err == nil {
+			_, err = trash.Move(historyFile, "history replaced by import-openai")
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(messages), helpers.SaveHistory(history, historyFile)
+}
+
+func parseMessages(data []byte) ([]OpenAIMessage, error) {
+	data = bytes.TrimSpace(data)
+
+	var raw []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if len(data) > 0 && data[0] == '{' {
+		var wrapper struct {
+			Messages json.RawMessage `json:"messages"`
+		}
+		err := json.Unmarshal(data, &wrapper)
+		if err != nil || wrapper.Messages == nil {
+			return nil, fmt.Errorf("expected a messages array or an object with a \"messages\" field")
+		}
+		data = wrapper.Messages
+	}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse messages: %w", err)
+	}
+
+	messages := []OpenAIMessage{}
+	for i, message := range raw {
+		content, err := contentText(message.Content)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i+1, err)
+		}
+		messages = append(messages, OpenAIMessage{Role: message.Role, Content: content})
+	}
+	return messages, nil
+}
+
+// contentText flattens content given as a string or as an array of parts.
+func contentText(content json.RawMessage) (string, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return "", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text, nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	err := json.Unmarshal(content, &parts)
+	if err != nil {
+		return "", fmt.Errorf("unsupported content format")
+	}
+
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type == "text" || part.Type == "input_text" || part.Type == "output_text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
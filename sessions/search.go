@@ -0,0 +1,113 @@
+package sessions
+
+import (
+	"github.com/rojolang/terminalgpt/helpers"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Match is a history entry containing the search query, with the entries
+// around it in the same session.
+type Match struct {
+	Session string
+	Entry   helpers.HistoryEntry
+	Before  []helpers.HistoryEntry
+	After   []helpers.HistoryEntry
+}
+
+// Time returns when the matching entry was added, zero for old entries.
+func (m Match) Time() time.Time {
+	if m.Entry.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.Entry.Timestamp, 0)
+}
+
+// Search looks for query, ignoring case, in the user and assistant messages
+// of every session and the global history, including rotated archives. The
+// newest matches come first, each with up to context entries around it.
+func Search(query string, context int) ([]Match, error) {
+	files, err := HistoryFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(query)
+	matches := []Match{}
+	for _, file := range files {
+		session := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+		if file == globalHistoryFile {
+			session = GlobalSession
+		}
+
+		archives, _ := filepath.Glob(file + ".[0-9]")
+		// archives hold older entries, the highest number the oldest
+		sort.Sort(sort.Reverse(sort.StringSlice(archives)))
+
+		for _, path := range append(archives, file) {
+			history, err := helpers.LoadHistory(path)
+			if err != nil {
+				return nil, err
+			}
+			for i, entry := range history {
+				if entry.Role != "user" && entry.Role != "assistant" {
+					continue
+				}
+				if !strings.Contains(strings.ToLower(entry.Content), query) {
+					continue
+				}
+				matches = append(matches, Match{
+					Session: session,
+					Entry:   entry,
+					Before:  history[max(0, i-context):i],
+					After:   history[i+1 : min(len(history), i+1+context)],
+				})
+			}
+		}
+	}
+
+	// entries without a timestamp sort last, keeping their order in the file
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Entry.Timestamp > matches[j].Entry.Timestamp
+	})
+	return matches, nil
+}
+
+// Snippet returns the line of content containing query, shortened to about
+// width characters around the first occurrence.
+func Snippet(content, query string, width int) string {
+	line := strings.TrimSpace(content)
+	lower := strings.ToLower(line)
+	index := strings.Index(lower, strings.ToLower(query))
+	if index < 0 || len(lower) != len(line) {
+		index = 0
+	}
+
+	start := strings.LastIndex(line[:index], "\n") + 1
+	end := len(line)
+	if newline := strings.Index(line[index:], "\n"); newline >= 0 {
+		end = index + newline
+	}
+	line = line[start:end]
+	index -= start
+
+	runes := []rune(line)
+	if len(runes) <= width {
+		return line
+	}
+	center := len([]rune(line[:index]))
+	from := max(0, center-width/2)
+	to := min(len(runes), from+width)
+	from = max(0, to-width)
+
+	snippet := string(runes[from:to])
+	if from > 0 {
+		snippet = "..." + snippet
+	}
+	if to < len(runes) {
+		snippet += "..."
+	}
+	return snippet
+}
@@ -0,0 +1,136 @@
+package sessions
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/vault"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var SummariesFile = appdir.Path("sessions.jsonl")
+
+// Summary describes one interactive session, it is printed on exit and
+// appended to SummariesFile.
+type Summary struct {
+	Started          time.Time `json:"started"`
+	Ended            time.Time `json:"ended"`
+	WorkingDirectory string    `json:"working_directory"`
+	Exchanges        int       `json:"exchanges"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	ResponseTokens   int       `json:"response_tokens"`
+	Cost             float64   `json:"cost"`
+	// UnpricedExchanges counts exchanges with models of unknown price, which
+	// are missing from Cost.
+	UnpricedExchanges int      `json:"unpriced_exchanges"`
+	Models            []string `json:"models"`
+	Files             []string `json:"files"`
+}
+
+func NewSummary(workingDirectory string) *Summary {
+	return &Summary{
+		Started:          config.StartTime,
+		WorkingDirectory: workingDirectory,
+		Models:           []string{},
+		Files:            []string{},
+	}
+}
+
+// AddExchange records one answered prompt.
+func (s *Summary) AddExchange(model string, promptTokens, responseTokens int) {
+	s.Exchanges++
+	s.PromptTokens += promptTokens
+	s.ResponseTokens += responseTokens
+
+	if cost, ok := helpers.Cost(model, promptTokens, responseTokens); ok {
+		s.Cost += cost
+	} else {
+		s.UnpricedExchanges++
+	}
+
+	if !contains(s.Models, model) {
+		s.Models = append(s.Models, model)
+	}
+}
+
+// AddFiles records files that were attached to prompts or written.
+func (s *Summary) AddFiles(paths ...string) {
+	for _, path := range paths {
+		if !contains(s.Files, path) {
+			s.Files = append(s.Files, path)
+		}
+	}
+}
+
+// Print writes the summary in two compact lines.
+func (s *Summary) Print(w io.Writer) {
+	ended := s.Ended
+	if ended.IsZero() {
+		ended = time.Now()
+	}
+
+	cost := fmt.Sprintf("$%.4f", s.Cost)
+	if s.UnpricedExchanges == s.Exchanges {
+		cost = "cost unknown"
+	} else if s.UnpricedExchanges > 0 {
+		cost += fmt.Sprintf(" (+%d unpriced)", s.UnpricedExchanges)
+	}
+
+	fmt.Fprintf(w, "Session: %d exchanges | %d tokens (%d prompt, %d response) | %s | %s | %s\n",
+		s.Exchanges, s.PromptTokens+s.ResponseTokens, s.PromptTokens, s.ResponseTokens, cost,
+		strings.Join(s.Models, ", "), ended.Sub(s.Started).Round(time.Second))
+
+	if len(s.Files) > 0 {
+		names := []string{}
+		for _, path := range s.Files {
+			if rel, err := filepath.Rel(s.WorkingDirectory, path); err == nil && !strings.HasPrefix(rel, "..") {
+				path = rel
+			}
+			names = append(names, path)
+		}
+		fmt.Fprintf(w, "Files: %s\n", strings.Join(names, ", "))
+	}
+}
+
+// SaveSummary marks the session as ended and appends it to SummariesFile.
+func SaveSummary(s *Summary) error {
+	if s.Ended.IsZero() {
+		s.Ended = time.Now()
+	}
+
+	err := os.MkdirAll(filepath.Dir(SummariesFile), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(SummariesFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	data, err = vault.Seal(data)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package sessions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/render"
+	"github.com/rojolang/terminalgpt/vault"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// TitleModelOff as title_model turns the naming of conversations off.
+const TitleModelOff = "off"
+
+const titleSystemMessage = "You name conversations. Answer with a title of at most five words for the conversation I send, in its language, without quotes and without a period."
+
+// titleExcerpt is how much of the first prompt and answer is sent to name a
+// conversation, they say what it is about well before the end.
+const titleExcerpt = 2000
+
+// Meta is what is kept about a conversation besides its history, in a file
+// next to the history file.
+type Meta struct {
+	Title string `json:"title"`
+	// TitleModel is the model that named the conversation.
+	TitleModel string    `json:"title_model,omitempty"`
+	Titled     time.Time `json:"titled"`
+}
+
+// MetaFile returns the metadata file of the conversation in historyFile.
+func MetaFile(historyFile string) string {
+	return strings.TrimSuffix(historyFile, ".jsonl") + ".meta"
+}
+
+// LoadMeta reads the metadata of the conversation in historyFile, empty when
+// it has none yet.
+func LoadMeta(historyFile string) (Meta, error) {
+	var meta Meta
+	data, err := ioutil.ReadFile(MetaFile(historyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return meta, nil
+		}
+		return meta, err
+	}
+	data, err = vault.Open(bytes.TrimSpace(data))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("failed to parse %s: %w", MetaFile(historyFile), err)
+	}
+	return meta, nil
+}
+
+// SaveMeta writes the metadata of the conversation in historyFile, encrypted
+// like the history when history_encryption is on.
+func SaveMeta(historyFile string, meta Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	data, err = vault.Seal(data)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(MetaFile(historyFile), append(data, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", MetaFile(historyFile), err)
+	}
+	return nil
+}
+
+// RemoveMeta forgets the metadata of a cleared conversation, so it is named
+// again after its next first exchange.
+func RemoveMeta(historyFile string) error {
+	err := os.Remove(MetaFile(historyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// NameConversation asks for a title of the conversation that starts with
+// userMessage and response and saves it in the metadata of historyFile. The
+// request is quiet and not saved to the history. A title_model the provider
+// doesn't have, like with Azure deployments, falls back to the chat model.
+func NameConversation(ctx context.Context, cfg *config.Config, historyFile, userMessage, response string) (string, error) {
+	runCfg := *cfg
+	runCfg.History = false
+	runCfg.SystemMessage = titleSystemMessage
+	runCfg.MaxResponseTokens = 20
+	runCfg.Fallbacks = nil
+
+	prompt := fmt.Sprintf("User: %s\n\nAssistant: %s", excerpt(userMessage), excerpt(response))
+	ctx = render.WithSink(ctx, func(string) {})
+	models := []string{cfg.ModelName}
+	if cfg.TitleModel != "" && cfg.TitleModel != cfg.ModelName {
+		models = []string{cfg.TitleModel, cfg.ModelName}
+	}
+
+	var err error
+	for _, model := range models {
+		runCfg.ModelName = model
+		var answer string
+		answer, _, _, _, _, err = common.GenerateCompletionContext(ctx, &runCfg, prompt)
+		if err != nil {
+			continue
+		}
+		title := cleanTitle(answer)
+		if title == "" {
+			return "", fmt.Errorf("%s gave no title", model)
+		}
+		return title, SaveMeta(historyFile, Meta{Title: title, TitleModel: model, Titled: time.Now()})
+	}
+	return "", err
+}
+
+// cleanTitle keeps the first line of answer without the quotes, labels and
+// trailing punctuation models add anyway.
+func cleanTitle(answer string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(answer), "\n")
+	title = strings.TrimPrefix(strings.TrimPrefix(title, "Title:"), "title:")
+	title = strings.Trim(strings.TrimSpace(title), "\"'`*#.")
+	if runes := []rune(title); len(runes) > 60 {
+		title = strings.TrimSpace(string(runes[:60])) + "..."
+	}
+	return title
+}
+
+func excerpt(text string) string {
+	if runes := []rune(text); len(runes) > titleExcerpt {
+		return string(runes[:titleExcerpt]) + "..."
+	}
+	return text
+}
@@ -0,0 +1,97 @@
+package shellsafety
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+const (
+	SeverityWarning = "warning"
+	SeverityDanger  = "danger"
+)
+
+type Finding struct {
+	Severity string
+	Rule     string
+	Message  string
+}
+
+type rule struct {
+	name     string
+	severity string
+	pattern  *regexp.Regexp
+	message  string
+}
+
+var rules = []rule{
+	{"rm-recursive", SeverityDanger, regexp.MustCompile(`\brm\s+(-[a-zA-Z]*[rR][a-zA-Z]*\s+|--recursive\s+)`), "recursively deletes files"},
+	{"rm-root", SeverityDanger, regexp.MustCompile(`\brm\s+.*\s(/|~|/\*|~/\*|\*|\$HOME)(\s|$)`), "deletes the root, home directory or everything in the current directory"},
+	{"pipe-to-shell", SeverityDanger, regexp.MustCompile(`\b(curl|wget|fetch)\b[^|]*\|\s*(sudo\s+)?(ba|z|k|da)?sh\b`), "pipes a downloaded script straight into a shell"},
+	{"dd", SeverityDanger, regexp.MustCompile(`\bdd\b.*\bof=`), "writes raw data to a file or device"},
+	{"mkfs", SeverityDanger, regexp.MustCompile(`\bmkfs(\.\w+)?\b`), "formats a filesystem"},
+	{"device-write", SeverityDanger, regexp.MustCompile(`>\s*/dev/(sd|nvme|disk|hd)`), "overwrites a block device"},
+	{"fork-bomb", SeverityDanger, regexp.MustCompile(`:\(\)\s*\{\s*:\|:&\s*\};:`), "is a fork bomb"},
+	{"kill-all", SeverityDanger, regexp.MustCompile(`\bkill\s+-9\s+-1\b`), "kills every process you own"},
+	{"sudo", SeverityWarning, regexp.MustCompile(`\bsudo\b`), "runs with root privileges"},
+	{"chmod-recursive", SeverityWarning, regexp.MustCompile(`\b(chmod|chown)\s+-R\b`), "recursively changes permissions or ownership"},
+	{"chmod-777", SeverityWarning, regexp.MustCompile(`\bchmod\s+(-R\s+)?0?777\b`), "makes files world-writable"},
+	{"git-destructive", SeverityWarning, regexp.MustCompile(`\bgit\s+(push\s+.*(--force|-f)\b|reset\s+--hard|clean\s+-[a-zA-Z]*f)`), "discards git history or uncommitted work"},
+	{"find-delete", SeverityWarning, regexp.MustCompile(`\bfind\b.*(-delete|-exec\s+rm)\b`), "deletes every file matched by find"},
+	{"system-files", SeverityWarning, regexp.MustCompile(`(>|\btee\b\s+(-a\s+)?)\s*/etc/`), "modifies system configuration in /etc"},
+	{"power", SeverityWarning, regexp.MustCompile(`\b(shutdown|reboot|halt|poweroff)\b`), "shuts down or restarts the machine"},
+	{"history-wipe", SeverityWarning, regexp.MustCompile(`\bhistory\s+-c\b|>\s*~/\.\w*_history`), "wipes shell history"},
+}
+
+// Analyze checks a shell command against the built-in pattern rules and,
+// when shellcheck is installed, against shellcheck's warnings.
+func Analyze(command string) []Finding {
+	findings := []Finding{}
+	for _, r := range rules {
+		if r.pattern.MatchString(command) {
+			findings = append(findings, Finding{Severity: r.severity, Rule: r.name, Message: r.message})
+		}
+	}
+	return append(findings, shellcheck(command)...)
+}
+
+// Flagged reports whether any finding is serious enough to need typed confirmation.
+func Flagged(findings []Finding) bool {
+	for _, f := range findings {
+		// shellcheck findings are style and quoting hints, not dangerous behaviour
+		if f.Rule != "shellcheck" {
+			return true
+		}
+	}
+	return false
+}
+
+func shellcheck(command string) []Finding {
+	if _, err := exec.LookPath("shellcheck"); err != nil {
+		return nil
+	}
+
+	cmd := exec.Command("shellcheck", "--shell=bash", "--format=gcc", "--severity=warning", "-")
+	cmd.Stdin = strings.NewReader(command)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	// shellcheck exits non-zero when it has findings
+	cmd.Run()
+
+	findings := []Finding{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		// -:1:5: warning: message [SC2086]
+		parts := strings.SplitN(line, ": ", 3)
+		message := line
+		if len(parts) == 3 {
+			message = fmt.Sprintf("line %s %s", strings.TrimPrefix(strings.TrimSuffix(parts[0], ":"), "-:"), parts[2])
+		}
+		findings = append(findings, Finding{Severity: SeverityWarning, Rule: "shellcheck", Message: message})
+	}
+	return findings
+}
@@ -0,0 +1,198 @@
+package speech
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/apierror"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+const (
+	DefaultModel = "tts-1"
+	DefaultVoice = "alloy"
+
+	// the speech endpoint takes at most 4096 characters per request
+	maxInputChars = 4000
+
+	azureAPIVersion = "2024-02-15-preview"
+)
+
+// Voices are the voices of the OpenAI speech models.
+var Voices = []string{"alloy", "echo", "fable", "onyx", "nova", "shimmer"}
+
+// Synthesize turns text into mp3 audio with the speech endpoint of the
+// configured provider. Code blocks are not read out, and long texts are
+// sent in parts whose audio is joined.
+func Synthesize(cfg *config.Config, text string) ([]byte, error) {
+	var audio []byte
+	for _, part := range split(Prepare(text), maxInputChars) {
+		data, err := synthesize(cfg, part)
+		if err != nil {
+			return nil, err
+		}
+		audio = append(audio, data...)
+	}
+	if len(audio) == 0 {
+		return nil, fmt.Errorf("nothing to read out")
+	}
+	return audio, nil
+}
+
+func synthesize(cfg *config.Config, text string) ([]byte, error) {
+	model := cfg.SpeechModel
+	if model == "" {
+		model = DefaultModel
+	}
+	voice := cfg.SpeechVoice
+	if voice == "" {
+		voice = DefaultVoice
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"model":           model,
+		"input":           text,
+		"voice":           voice,
+		"response_format": "mp3",
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Azure serves the speech model as a deployment of its own
+	endpoint := config.OpenAIURL(cfg, "/audio/speech")
+	if cfg.AIProvider == "azure" {
+		endpoint = strings.TrimRight(cfg.AzureURL, "/") + "/openai/deployments/" + url.PathEscape(model) + "/audio/speech?api-version=" + azureAPIVersion
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.AIProvider == "azure" {
+		req.Header.Set("api-key", cfg.AzureAuthKey)
+		for name, value := range cfg.Headers["azure"] {
+			req.Header.Set(name, value)
+		}
+	} else {
+		config.SetOpenAIHeaders(cfg, req)
+	}
+
+	resp, err := httpclient.APIClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request speech: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := apierror.Check(cfg.AIProvider, resp, 0); err != nil {
+		return nil, fmt.Errorf("speech request failed: %w", err)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+var (
+	codeBlock  = regexp.MustCompile("(?s)```.*?(```|$)")
+	markup     = regexp.MustCompile("[*_#>`]+")
+	link       = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// Prepare returns text as it should be read out: without code blocks, which
+// are mentioned instead, and without markdown syntax.
+func Prepare(text string) string {
+	text = codeBlock.ReplaceAllString(text, "\n(code block omitted)\n")
+	text = link.ReplaceAllString(text, "$1")
+	text = markup.ReplaceAllString(text, "")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// split cuts text into parts of at most max bytes, at paragraph, sentence or
+// word boundaries where possible.
+func split(text string, max int) []string {
+	parts := []string{}
+	for len(text) > max {
+		cut := -1
+		for _, separator := range []string{"\n\n", ". ", " "} {
+			if i := strings.LastIndex(text[:max], separator); i > 0 {
+				cut = i + len(separator)
+				break
+			}
+		}
+		if cut < 0 {
+			cut = max
+		}
+		parts = append(parts, strings.TrimSpace(text[:cut]))
+		text = text[cut:]
+	}
+	if strings.TrimSpace(text) != "" {
+		parts = append(parts, strings.TrimSpace(text))
+	}
+	return parts
+}
+
+// Save writes audio to path, or appends it with appendAudio so the answers
+// of a session end up in one file.
+func Save(path string, audio []byte, appendAudio bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendAudio {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+	_, err = file.Write(audio)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// Play plays mp3 audio with the first player found and waits until it ends.
+func Play(audio []byte) error {
+	file, err := ioutil.TempFile("", "terminalgpt-*.mp3")
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(audio)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", file.Name(), err)
+	}
+
+	for _, candidate := range players(file.Name()) {
+		if _, err := exec.LookPath(candidate[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(candidate[0], candidate[1:]...)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	return fmt.Errorf("no audio player found, install mpv, ffplay or mpg123, or save the audio with --speak <file.mp3>")
+}
+
+func players(path string) [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"afplay", path}}
+	case "windows":
+		script := "Add-Type -AssemblyName presentationCore; $p = New-Object System.Windows.Media.MediaPlayer; $p.Open([uri]'" + strings.ReplaceAll(path, "'", "''") + "'); " +
+			"while (-not $p.NaturalDuration.HasTimeSpan) { Start-Sleep -Milliseconds 50 }; $p.Play(); Start-Sleep -Milliseconds $p.NaturalDuration.TimeSpan.TotalMilliseconds"
+		return [][]string{{"powershell", "-NoProfile", "-Command", script}}
+	}
+	return [][]string{
+		{"mpv", "--no-video", "--really-quiet", path},
+		{"ffplay", "-nodisp", "-autoexit", "-loglevel", "quiet", path},
+		{"mpg123", "-q", path},
+	}
+}
@@ -0,0 +1,193 @@
+package stats
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/ratelimit"
+	"github.com/rojolang/terminalgpt/termcap"
+	"strings"
+	"time"
+)
+
+// Stats describes one completion.
+type Stats struct {
+	Model string
+	// Provider answered, Fallback is set when it was not the configured one.
+	Provider       string
+	Fallback       bool
+	FirstToken     time.Duration
+	Latency        time.Duration
+	PromptTokens   int
+	SystemTokens   int
+	HistoryTokens  int
+	ResponseTokens int
+	// ReasoningTokens are the hidden tokens of a reasoning model, billed
+	// like the response but not part of it.
+	ReasoningTokens int
+	// Estimated is set when the token counts are estimates, see
+	// helpers.Estimating.
+	Estimated      bool
+	HistoryEntries int
+	FinishReason   string
+	// Limits is the rate limit status sent with the response, if any.
+	Limits    ratelimit.Limits
+	HasLimits bool
+	// Connection is how the request reached the provider, if known.
+	Connection    httpclient.Connection
+	HasConnection bool
+	// Seed is the sampling seed sent with the request, if any.
+	Seed *int
+}
+
+// Collect builds the stats of the request that just finished from the token
+// counts returned by the provider and the timing recorded by helpers. The
+// model of a fallback that answered replaces model.
+func Collect(provider, model string, promptTokens, systemTokens, responseTokens, historyTokens int) Stats {
+	start, firstChunk, finishReason := helpers.LastRequest()
+	fallback := false
+	if answeredProvider, answeredModel := helpers.LastAnswered(); answeredModel != "" {
+		provider, model, fallback = answeredProvider, answeredModel, true
+	}
+	s := Stats{
+		Model:           model,
+		Provider:        provider,
+		Fallback:        fallback,
+		PromptTokens:    promptTokens,
+		SystemTokens:    systemTokens,
+		HistoryTokens:   historyTokens,
+		ResponseTokens:  responseTokens,
+		ReasoningTokens: helpers.LastReasoningTokens(),
+		Estimated:       helpers.Estimating() != nil,
+		FinishReason:    finishReason,
+	}
+	if limits, ok := ratelimit.Last(provider); ok && !limits.Observed.Before(start) {
+		s.Limits, s.HasLimits = limits, true
+	}
+	if connection, ok := httpclient.LastConnection(); ok && !connection.Observed.Before(start) {
+		s.Connection, s.HasConnection = connection, true
+	}
+	if !start.IsZero() {
+		s.Latency = time.Since(start)
+		if !firstChunk.IsZero() {
+			s.FirstToken = firstChunk.Sub(start)
+		}
+	}
+	return s
+}
+
+// TotalTokens is everything sent and received.
+func (s Stats) TotalTokens() int {
+	return s.PromptTokens + s.SystemTokens + s.HistoryTokens + s.ResponseTokens + s.ReasoningTokens
+}
+
+// DefaultFormat is used when stats_format is empty.
+func DefaultFormat() string {
+	return termcap.Emoji("🤖", "model") + " {model} | " +
+		termcap.Emoji("⏱️", "first token") + " {first_token} | " +
+		termcap.Emoji("⌛", "total") + " {latency} | " +
+		termcap.Emoji("⌨️", "prompt") + " {prompt_tokens} | " +
+		termcap.Emoji("📥", "response") + " {response_tokens} | " +
+		termcap.Emoji("📜", "history") + " {history_tokens} | " +
+		termcap.Emoji("💰", "cost") + " {cost} | " +
+		termcap.Emoji("🏁", "finish") + " {finish_reason} | " +
+		termcap.Emoji("🔌", "connection") + " {connection}"
+}
+
+// Render replaces the {field} placeholders of format with the values of s.
+// Unknown placeholders are left untouched.
+func Render(format string, s Stats) string {
+	if format == "" {
+		format = DefaultFormat()
+	}
+
+	cost := "unknown"
+	if value, ok := helpers.Cost(s.Model, s.PromptTokens+s.SystemTokens+s.HistoryTokens, s.ResponseTokens+s.ReasoningTokens); ok {
+		cost = fmt.Sprintf("$%.4f", value)
+	}
+
+	tokensPerSecond := "-"
+	if generating := s.Latency - s.FirstToken; s.ResponseTokens > 0 && generating > 0 {
+		tokensPerSecond = fmt.Sprintf("%.1f", float64(s.ResponseTokens)/generating.Seconds())
+	}
+
+	finishReason := s.FinishReason
+	if finishReason == "" {
+		finishReason = "unknown"
+	}
+
+	remainingRequests, remainingTokens := "-", "-"
+	if s.HasLimits && s.Limits.RemainingRequests >= 0 {
+		remainingRequests = fmt.Sprint(s.Limits.RemainingRequests)
+	}
+	if s.HasLimits && s.Limits.RemainingTokens >= 0 {
+		remainingTokens = fmt.Sprint(s.Limits.RemainingTokens)
+	}
+
+	// a new connection shows what setting it up added to the first token
+	connection := "-"
+	if s.HasConnection && s.Connection.Reused {
+		connection = "reused " + s.Connection.Protocol
+	} else if s.HasConnection {
+		connection = "new " + s.Connection.Protocol + " +" + Duration(s.Connection.Setup)
+	}
+
+	// estimated counts are marked like the live counter marks them
+	approx := ""
+	if s.Estimated {
+		approx = "~"
+	}
+
+	seed := "-"
+	if s.Seed != nil {
+		seed = fmt.Sprint(*s.Seed)
+	}
+
+	// the default format only shows the reasoning and the seed when there are any
+	if format == DefaultFormat() {
+		if s.ReasoningTokens > 0 {
+			format = strings.Replace(format, " {response_tokens}", " {response_tokens} + "+termcap.Emoji("🧠", "reasoning")+" {reasoning_tokens}", 1)
+		}
+		if s.Seed != nil {
+			format += " | " + termcap.Emoji("🎲", "seed") + " {seed}"
+		}
+	}
+
+	// the default format has no {backend}, a fallback shows next to the model
+	model := s.Model
+	if s.Fallback && !strings.Contains(format, "{backend}") {
+		model += " (fallback " + s.Provider + ")"
+	}
+
+	return strings.NewReplacer(
+		"{model}", model,
+		"{backend}", s.Provider,
+		"{first_token}", Duration(s.FirstToken),
+		"{latency}", Duration(s.Latency),
+		"{prompt_tokens}", approx+fmt.Sprint(s.PromptTokens),
+		"{system_tokens}", approx+fmt.Sprint(s.SystemTokens),
+		"{history_tokens}", approx+fmt.Sprint(s.HistoryTokens),
+		"{response_tokens}", approx+fmt.Sprint(s.ResponseTokens),
+		"{reasoning_tokens}", fmt.Sprint(s.ReasoningTokens),
+		"{total_tokens}", approx+fmt.Sprint(s.TotalTokens()),
+		"{history_entries}", fmt.Sprint(s.HistoryEntries),
+		"{tokens_per_second}", tokensPerSecond,
+		"{cost}", cost,
+		"{finish_reason}", finishReason,
+		"{remaining_requests}", remainingRequests,
+		"{remaining_tokens}", remainingTokens,
+		"{connection}", connection,
+		"{seed}", seed,
+	).Replace(format)
+}
+
+// Duration formats d for the stats, - when it is unknown.
+func Duration(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
@@ -0,0 +1,116 @@
+package suggest
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/codeblocks"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/patch"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const systemMessage = "You improve source files. Reply with the complete new version of the file in a single fenced code block and nothing else. Keep everything the instruction does not ask to change exactly as it is."
+
+// contextLines is how many unchanged lines are shown around every change.
+const contextLines = 3
+
+// Run asks for an improved version of the file name following instruction,
+// shows the differences hunk by hunk and applies the accepted ones. It
+// returns the path of the file when it was changed.
+func Run(cfg *config.Config, name, instruction, workingDirectory string, reader *bufio.Reader) (string, error) {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDirectory, name)
+	}
+	if _, err := os.Stat(path); err != nil {
+		found, err := config.FindFile(name, workingDirectory)
+		if err != nil {
+			return "", fmt.Errorf("failed to find %s: %w", name, err)
+		}
+		path = found
+	}
+	rel, err := filepath.Rel(workingDirectory, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside of %s", name, workingDirectory)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", rel, err)
+	}
+	original := string(data)
+
+	// the reply is the whole file, so the response budget has to fit it
+	suggestCfg := *cfg
+	suggestCfg.SystemMessage = systemMessage
+	suggestCfg.History = false
+	if tokens, err := helpers.CountTokens(original, cfg.ModelName); err == nil && suggestCfg.MaxResponseTokens < tokens*3/2+200 {
+		suggestCfg.MaxResponseTokens = tokens*3/2 + 200
+	}
+
+	color.New(color.FgHiBlack).Printf("Asking for a new version of %s...\n", rel)
+	prompt := fmt.Sprintf("File %s:\n```\n%s\n```\n\nInstruction: %s", rel, strings.TrimSuffix(original, "\n"), instruction)
+	variants, err := common.GenerateVariants(&suggestCfg, prompt, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(variants) == 0 {
+		return "", fmt.Errorf("the model returned no suggestion")
+	}
+
+	blocks := codeblocks.Extract(variants[0])
+	if len(blocks) == 0 {
+		return "", fmt.Errorf("the suggestion has no code block")
+	}
+	suggested := blocks[0].Code + "\n"
+
+	diff := patch.Diff(filepath.ToSlash(rel), original, suggested, contextLines)
+	if len(diff.Hunks) == 0 {
+		fmt.Println("The suggestion does not change anything.")
+		return "", nil
+	}
+
+	accepted := []patch.Hunk{}
+	for i, hunk := range diff.Hunks {
+		fmt.Println()
+		color.New(color.Bold).Printf("%s change %d/%d\n", rel, i+1, len(diff.Hunks))
+		patch.PreviewHunk(hunk)
+
+		fmt.Print("Apply this change? [y]es/[n]o/[a]ll remaining/[q]uit: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return "", nil
+		}
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer == "q" {
+			break
+		}
+		if answer == "a" {
+			accepted = append(accepted, diff.Hunks[i:]...)
+			break
+		}
+		if answer == "y" || answer == "yes" {
+			accepted = append(accepted, hunk)
+		}
+	}
+
+	if len(accepted) == 0 {
+		fmt.Println("No changes applied.")
+		return "", nil
+	}
+
+	total := len(diff.Hunks)
+	diff.Hunks = accepted
+	_, backup, err := patch.Apply([]patch.FileDiff{diff}, workingDirectory)
+	if err != nil {
+		return "", err
+	}
+	color.Green("Applied %d of %d change(s) to %s, the original is backed up in %s\n", len(accepted), total, rel, backup)
+	return path, nil
+}
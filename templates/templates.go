@@ -0,0 +1,161 @@
+package templates
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/clipboard"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/envschema"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const templateExt = ".txt"
+
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+// List returns the names of all templates stored in config.TemplatesDir.
+func List() ([]string, error) {
+	entries, err := ioutil.ReadDir(config.TemplatesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed to read templates directory: %w", err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != templateExt {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(entry.Name(), templateExt))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Load reads the raw body of the named template.
+func Load(name string) (string, error) {
+	path := filepath.Join(config.TemplatesDir, name+templateExt)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("template %q not found in %s", name, config.TemplatesDir)
+		}
+		return "", fmt.Errorf("failed to read template %q: %w", name, err)
+	}
+	return string(content), nil
+}
+
+// ParseVars turns arguments like file=main.go into a variable map.
+func ParseVars(args []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid template variable %q, expected key=value", arg)
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
+// Render loads the named template and expands it with the given key=value arguments.
+func Render(name string, args []string, workingDirectory string) (string, error) {
+	body, err := Load(name)
+	if err != nil {
+		return "", err
+	}
+
+	vars, err := ParseVars(args)
+	if err != nil {
+		return "", err
+	}
+
+	return Expand(body, vars, workingDirectory)
+}
+
+// Expand replaces every {{placeholder}} in body. {{file}} is replaced with the
+// content of the file named by the "file" variable, {{clipboard}} and
+// {{selection}} are read from the system unless given explicitly, and any
+// other placeholder must be supplied as a variable.
+func Expand(body string, vars map[string]string, workingDirectory string) (string, error) {
+	var expandErr error
+
+	expanded := placeholderPattern.ReplaceAllStringFunc(body, func(match string) string {
+		if expandErr != nil {
+			return match
+		}
+		name := placeholderPattern.FindStringSubmatch(match)[1]
+
+		value, err := resolve(name, vars, workingDirectory)
+		if err != nil {
+			expandErr = err
+			return match
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	return expanded, nil
+}
+
+func resolve(name string, vars map[string]string, workingDirectory string) (string, error) {
+	switch name {
+	case "file":
+		fileName, ok := vars["file"]
+		if !ok {
+			return "", fmt.Errorf("template needs a file, pass file=<name>")
+		}
+		return readFile(fileName, workingDirectory)
+	case "clipboard":
+		if value, ok := vars["clipboard"]; ok {
+			return value, nil
+		}
+		return clipboard.Read()
+	case "selection":
+		if value, ok := vars["selection"]; ok {
+			return value, nil
+		}
+		return clipboard.ReadSelection()
+	}
+
+	value, ok := vars[name]
+	if !ok {
+		return "", fmt.Errorf("missing value for template variable {{%s}}", name)
+	}
+	return value, nil
+}
+
+func readFile(fileName string, workingDirectory string) (string, error) {
+	// secrets never leave the machine, like with injected files
+	if envschema.IsEnvFile(fileName) {
+		return "", fmt.Errorf("refusing to read %s into a template, use --env-schema to send its variable names only", fileName)
+	}
+
+	path := fileName
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDirectory, fileName)
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		found, err := config.FindFile(fileName, workingDirectory)
+		if err != nil || found == "" {
+			return "", fmt.Errorf("file %q not found in %s", fileName, workingDirectory)
+		}
+		path = found
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %q: %w", fileName, err)
+	}
+	return string(content), nil
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package termcap
+
+// enableVirtualTerminal is only needed on Windows consoles, other terminals
+// interpret escape sequences anyway.
+func enableVirtualTerminal() bool {
+	return true
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package termcap
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// enableVirtualTerminal makes the Windows console interpret the escape
+// sequences used for colors and for moving the cursor. It reports false on
+// consoles that do not support them, before Windows 10.
+func enableVirtualTerminal() bool {
+	handle := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return false
+	}
+	if mode&windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING != 0 {
+		return true
+	}
+	return windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil
+}
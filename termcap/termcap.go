@@ -0,0 +1,222 @@
+package termcap
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"golang.org/x/term"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ColorsNone      = 0
+	Colors16        = 16
+	Colors256       = 256
+	ColorsTrueColor = 1 << 24
+)
+
+// Color modes of --color.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// Capabilities describes what the terminal on stdout can render.
+type Capabilities struct {
+	TTY        bool
+	Colors     int
+	Hyperlinks bool
+	Emoji      bool
+	Width      int
+}
+
+var (
+	detected Capabilities
+	once     sync.Once
+)
+
+// Get returns the capabilities of the current terminal, detected once.
+func Get() Capabilities {
+	once.Do(func() {
+		detected = Detect()
+		if detected.Colors == ColorsNone {
+			color.NoColor = true
+		}
+	})
+	return detected
+}
+
+// SetColorMode overrides the detected colors: always colors the output even
+// when stdout is not a terminal or NO_COLOR is set, never turns colors off
+// and auto keeps what was detected.
+func SetColorMode(mode string) error {
+	Get()
+	switch mode {
+	case "", ColorAuto:
+	case ColorAlways:
+		if detected.Colors == ColorsNone {
+			detected.Colors = Colors16
+		}
+		color.NoColor = false
+	case ColorNever:
+		detected.Colors = ColorsNone
+		color.NoColor = true
+	default:
+		return fmt.Errorf("invalid color mode %q, expected always, never or auto", mode)
+	}
+	return nil
+}
+
+// Detect inspects the environment and terminfo to find out what stdout supports.
+func Detect() Capabilities {
+	caps := Capabilities{TTY: isTerminal(os.Stdout)}
+	// consoles that cannot interpret escape sequences get plain output
+	if caps.TTY && !enableVirtualTerminal() {
+		caps.TTY = false
+	}
+	term := os.Getenv("TERM")
+	ci := os.Getenv("CI") != ""
+
+	caps.Colors = detectColors(caps.TTY, term)
+	caps.Width = detectWidth()
+	caps.Emoji = caps.TTY && !ci && term != "linux" && term != "dumb" && utf8Locale()
+	caps.Hyperlinks = caps.TTY && !ci && detectHyperlinks(term)
+
+	return caps
+}
+
+// Emoji returns the emoji when the terminal can show it, and the plain fallback otherwise.
+func Emoji(emoji, fallback string) string {
+	if Get().Emoji {
+		return emoji
+	}
+	return fallback
+}
+
+// Hyperlink wraps text in an OSC 8 hyperlink when the terminal supports it.
+func Hyperlink(url, text string) string {
+	if !Get().Hyperlinks {
+		return text
+	}
+	return fmt.Sprintf("\033]8;;%s\033\\%s\033]8;;\033\\", url, text)
+}
+
+// FileLink links text to a local file.
+func FileLink(path, text string) string {
+	return Hyperlink("file://"+path, text)
+}
+
+// Width returns the terminal width in columns.
+func Width() int {
+	return Get().Width
+}
+
+func detectColors(tty bool, term string) int {
+	// https://no-color.org
+	if !tty || term == "dumb" || os.Getenv("NO_COLOR") != "" {
+		return ColorsNone
+	}
+
+	colorTerm := strings.ToLower(os.Getenv("COLORTERM"))
+	if colorTerm == "truecolor" || colorTerm == "24bit" {
+		return ColorsTrueColor
+	}
+	if strings.Contains(term, "256color") {
+		return Colors256
+	}
+
+	// ask terminfo for everything else
+	if out, err := exec.Command("tput", "colors").Output(); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(out))); err == nil {
+			switch {
+			case n >= ColorsTrueColor:
+				return ColorsTrueColor
+			case n >= 256:
+				return Colors256
+			case n >= 8:
+				return Colors16
+			case n <= 0:
+				return ColorsNone
+			}
+		}
+	}
+
+	if term == "" {
+		// Windows consoles don't set TERM but, with virtual terminal
+		// processing enabled, support ANSI colors
+		if runtime.GOOS == "windows" || os.Getenv("WT_SESSION") != "" || os.Getenv("ConEmuANSI") == "ON" {
+			return ColorsTrueColor
+		}
+		return ColorsNone
+	}
+	return Colors16
+}
+
+func detectHyperlinks(term string) bool {
+	switch os.Getenv("TERM_PROGRAM") {
+	case "iTerm.app", "WezTerm", "vscode", "Hyper", "ghostty":
+		return true
+	}
+	if os.Getenv("KITTY_WINDOW_ID") != "" || os.Getenv("WT_SESSION") != "" || os.Getenv("KONSOLE_VERSION") != "" {
+		return true
+	}
+	if vte, err := strconv.Atoi(os.Getenv("VTE_VERSION")); err == nil && vte >= 5000 {
+		return true
+	}
+	return strings.Contains(term, "kitty") || strings.Contains(term, "alacritty") || strings.Contains(term, "foot")
+}
+
+func detectWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+
+	// works on Windows consoles too, where stty and tput are missing
+	if columns, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && columns > 0 {
+		return columns
+	}
+
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err == nil {
+		fields := strings.Fields(string(out))
+		if len(fields) == 2 {
+			if columns, err := strconv.Atoi(fields[1]); err == nil && columns > 0 {
+				return columns
+			}
+		}
+	}
+
+	if out, err := exec.Command("tput", "cols").Output(); err == nil {
+		if columns, err := strconv.Atoi(strings.TrimSpace(string(out))); err == nil && columns > 0 {
+			return columns
+		}
+	}
+
+	return 80
+}
+
+func utf8Locale() bool {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		value := strings.ToUpper(os.Getenv(name))
+		if value != "" {
+			return strings.Contains(value, "UTF-8") || strings.Contains(value, "UTF8")
+		}
+	}
+	// macOS terminals default to UTF-8 without setting a locale
+	return os.Getenv("TERM_PROGRAM") != ""
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,304 @@
+package testfix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/injector"
+	"github.com/rojolang/terminalgpt/patch"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	systemMessage = "You fix failing Go tests in {{dir}}. Find the cause of each failure in the test output and the files I send, and answer with the fix as a unified diff in a ```diff code block: a '--- a/<path>' and '+++ b/<path>' header per file with paths relative to {{dir}}, @@ hunk headers, and three lines of unchanged context around each change. Copy context lines exactly from the files I send, never abbreviate them. Fix the code under test, only change a test when the test itself is wrong. Keep explanations short."
+
+	// DefaultIterations is how many fixes are tried when no limit is given.
+	DefaultIterations = 5
+
+	// maxOutput is how much of the test output is sent.
+	maxOutput = 12000
+
+	// maxFiles is how many of the files the output points at are sent.
+	maxFiles = 10
+)
+
+// fileLine finds the file:line references of compiler errors, test logs and
+// stack traces.
+var fileLine = regexp.MustCompile(`([A-Za-z0-9_./\\-]+\.go):\d+`)
+
+type Options struct {
+	WorkingDirectory string
+	// Packages are the go test package patterns, ./... when empty.
+	Packages      []string
+	MaxIterations int
+	// Timeout limits each go test run, 0 for go test's own limit.
+	Timeout time.Duration
+	Yes     bool
+}
+
+// Report is the outcome of a go test run.
+type Report struct {
+	Passed bool
+	// Failed are the failing tests as "package.TestName", or the package
+	// alone when it failed to build or outside its tests.
+	Failed []string
+	// Output is the output of the failures.
+	Output string
+	// Files are the files the output points at, relative to the working
+	// directory, with the source file next to each test file.
+	Files []string
+}
+
+// event is a line of `go test -json`. Newer Go versions report build errors
+// as build-output events instead of on stderr.
+type event struct {
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// Run runs the tests, asks the model for a fix of the failures, applies it
+// once confirmed and runs the tests again, until they pass or
+// MaxIterations fixes were tried.
+func Run(cfg *config.Config, opts Options) error {
+	if len(opts.Packages) == 0 {
+		opts.Packages = []string{"./..."}
+	}
+	if opts.MaxIterations <= 0 {
+		opts.MaxIterations = DefaultIterations
+	}
+
+	// every attempt is a fresh request with the files as they are now
+	runCfg := *cfg
+	runCfg.History = false
+	runCfg.Cache = false
+	runCfg.SystemMessage = strings.ReplaceAll(systemMessage, "{{dir}}", opts.WorkingDirectory)
+
+	options := injector.ForMode(&runCfg, "")
+	options.Extensions = []string{".go"}
+
+	reader := bufio.NewReader(os.Stdin)
+	gray := color.New(color.FgHiBlack)
+	for attempt := 1; ; attempt++ {
+		gray.Printf("Running go test %s\n", strings.Join(opts.Packages, " "))
+		report, err := Test(opts.WorkingDirectory, opts.Packages, opts.Timeout)
+		if err != nil {
+			return err
+		}
+		if report.Passed {
+			color.Green("All tests pass after %d fix(es).\n", attempt-1)
+			return nil
+		}
+
+		color.Red("Failing: %s\n", strings.Join(report.Failed, ", "))
+		if attempt > opts.MaxIterations {
+			return fmt.Errorf("the tests still fail after %d fixes", opts.MaxIterations)
+		}
+
+		prompt, _ := injector.Inject(Prompt(report, attempt, opts.MaxIterations), opts.WorkingDirectory, options)
+		response, _, _, _, _, err := common.GenerateCompletion(&runCfg, prompt)
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+
+		diffs, err := patch.Parse(response)
+		if err != nil {
+			return err
+		}
+		if len(diffs) == 0 {
+			return fmt.Errorf("the answer has no changes to apply")
+		}
+		if opts.Yes {
+			fmt.Println()
+			patch.Preview(diffs)
+			changed, backup, err := patch.Apply(diffs, opts.WorkingDirectory)
+			if err != nil {
+				return err
+			}
+			color.Green("Applied changes to %d file(s), originals backed up in %s\n", len(changed), backup)
+			continue
+		}
+		changed, err := patch.Offer(response, opts.WorkingDirectory, reader)
+		if err != nil {
+			return err
+		}
+		if len(changed) == 0 {
+			return fmt.Errorf("stopped, the changes were not applied")
+		}
+	}
+}
+
+// Prompt asks for a fix of the failures in report, mentioning the files to
+// inject.
+func Prompt(report Report, attempt, maxIterations int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "`go test` fails:\n\n```\n%s\n```\n", report.Output)
+	if len(report.Files) > 0 {
+		sb.WriteString("\nThe failing tests and the code they point at are in:\n")
+		for _, file := range report.Files {
+			fmt.Fprintf(&sb, "- %s\n", file)
+		}
+	}
+	if attempt > 1 {
+		fmt.Fprintf(&sb, "\nThis is attempt %d of %d, the fixes of the earlier attempts are already applied.\n", attempt, maxIterations)
+	}
+	return sb.String()
+}
+
+// Test runs go test on packages in dir and collects the output of the
+// failures and the files it points at.
+func Test(dir string, packages []string, timeout time.Duration) (Report, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "go", append([]string{"test", "-json"}, packages...)...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return Report{}, fmt.Errorf("go test did not finish within %s", timeout)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return Report{}, fmt.Errorf("failed to run go test: %w", err)
+	}
+	if err == nil {
+		return Report{Passed: true}, nil
+	}
+
+	// the output of every test and package, and which of them failed
+	type key struct{ pkg, test string }
+	outputs := map[key]*strings.Builder{}
+	order := []key{}
+	failed := map[key]bool{}
+	failedTests := map[string]bool{}
+	build := stderr.String()
+	scanner := bufio.NewScanner(&stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e event
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		k := key{e.Package, e.Test}
+		switch e.Action {
+		case "build-output":
+			build += e.Output
+		case "output":
+			if outputs[k] == nil {
+				outputs[k] = &strings.Builder{}
+				order = append(order, k)
+			}
+			outputs[k].WriteString(e.Output)
+		case "fail":
+			failed[k] = true
+			if e.Test != "" {
+				failedTests[e.Package] = true
+			}
+		}
+	}
+
+	report := Report{Files: appendFiles(nil, build, dir, dir)}
+	var output strings.Builder
+	if text := strings.TrimSpace(build); text != "" {
+		output.WriteString(text + "\n")
+	}
+	packageDirs := map[string]string{}
+	for _, k := range order {
+		// a package's own output only matters when none of its tests failed
+		if !failed[k] || k.test == "" && failedTests[k.pkg] {
+			continue
+		}
+		name := k.pkg
+		if k.test != "" {
+			name += "." + k.test
+		}
+		report.Failed = append(report.Failed, name)
+		output.WriteString(outputs[k].String())
+		if _, ok := packageDirs[k.pkg]; !ok {
+			packageDirs[k.pkg] = packageDir(dir, k.pkg)
+		}
+		report.Files = appendFiles(report.Files, outputs[k].String(), dir, packageDirs[k.pkg])
+	}
+	if len(report.Failed) == 0 {
+		report.Failed = []string{"go test"}
+		output.WriteString(stdout.String())
+	}
+
+	report.Output = strings.TrimSpace(output.String())
+	if len(report.Output) > maxOutput {
+		report.Output = report.Output[:maxOutput] + "\n... output cut off"
+	}
+	return report, nil
+}
+
+// appendFiles adds the files that text points at to files, resolved against
+// base or dir and kept when they are inside dir.
+func appendFiles(files []string, text, dir, base string) []string {
+	for _, match := range fileLine.FindAllStringSubmatch(text, -1) {
+		if len(files) >= maxFiles {
+			break
+		}
+		name := filepath.FromSlash(match[1])
+		candidates := []string{name}
+		if !filepath.IsAbs(name) {
+			candidates = []string{filepath.Join(base, name), filepath.Join(dir, name)}
+		}
+		for _, path := range candidates {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			files = appendFile(files, filepath.ToSlash(rel))
+			// the code a test file tests is usually next to it
+			if source := strings.TrimSuffix(path, "_test.go") + ".go"; source != path {
+				if _, err := os.Stat(source); err == nil {
+					files = appendFile(files, filepath.ToSlash(strings.TrimSuffix(rel, "_test.go")+".go"))
+				}
+			}
+			break
+		}
+	}
+	return files
+}
+
+func appendFile(files []string, file string) []string {
+	for _, f := range files {
+		if f == file {
+			return files
+		}
+	}
+	return append(files, file)
+}
+
+// packageDir returns the directory of the package with import path pkg, or
+// dir when go list does not know it.
+func packageDir(dir, pkg string) string {
+	cmd := exec.Command("go", "list", "-e", "-f", "{{.Dir}}", pkg)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return dir
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,233 @@
+package trash
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var TrashDir = appdir.Path("trash")
+
+// DefaultRetention is how long trashed data is kept when the config does not say.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Item is something removed by a destructive command. Whole files are put
+// back in place on restore, Append items are appended to their file instead.
+type Item struct {
+	ID           string    `json:"id"`
+	Created      time.Time `json:"created"`
+	Description  string    `json:"description"`
+	OriginalPath string    `json:"original_path"`
+	Append       bool      `json:"append"`
+}
+
+// Move moves the file at path into the trash.
+func Move(path, description string) (string, error) {
+	item, dir, err := newItem(path, description, false)
+	if err != nil {
+		return "", err
+	}
+
+	err = move(path, DataFile(item.ID))
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to move %s to the trash: %w", path, err)
+	}
+	return item.ID, nil
+}
+
+// Keep stores data removed from the file at path, such as deleted history
+// entries, so that restoring appends it to the file again.
+func Keep(data []byte, path, description string) (string, error) {
+	item, dir, err := newItem(path, description, true)
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(DataFile(item.ID), data, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return item.ID, nil
+}
+
+// List returns the items in the trash, newest first.
+func List() ([]Item, error) {
+	entries, err := ioutil.ReadDir(TrashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Item{}, nil
+		}
+		return nil, err
+	}
+
+	items := []Item{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		item, err := load(entry.Name())
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.After(items[j].Created) })
+	return items, nil
+}
+
+// Restore puts an item back. A file that took the place of a whole-file item
+// is moved to the trash first, so restoring never loses data either.
+func Restore(id string) (Item, error) {
+	item, err := load(id)
+	if err != nil {
+		return item, fmt.Errorf("no trash item %q", id)
+	}
+	data := DataFile(id)
+
+	err = os.MkdirAll(filepath.Dir(item.OriginalPath), 0755)
+	if err != nil {
+		return item, err
+	}
+
+	if item.Append {
+		content, err := ioutil.ReadFile(data)
+		if err != nil {
+			return item, err
+		}
+		file, err := os.OpenFile(item.OriginalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return item, err
+		}
+		_, err = file.Write(content)
+		file.Close()
+		if err != nil {
+			return item, err
+		}
+	} else {
+		if _, err := os.Stat(item.OriginalPath); err == nil {
+			_, err = Move(item.OriginalPath, fmt.Sprintf("replaced by restoring %s", id))
+			if err != nil {
+				return item, err
+			}
+		}
+		err = move(data, item.OriginalPath)
+		if err != nil {
+			return item, err
+		}
+	}
+
+	return item, os.RemoveAll(filepath.Join(TrashDir, id))
+}
+
+// Prune permanently deletes items older than retention.
+func Prune(retention time.Duration) error {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	items, err := List()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if time.Since(item.Created) > retention {
+			os.RemoveAll(filepath.Join(TrashDir, item.ID))
+		}
+	}
+	return nil
+}
+
+// Empty permanently deletes everything in the trash.
+func Empty() error {
+	return os.RemoveAll(TrashDir)
+}
+
+// Retention returns the configured retention period in days as a duration.
+func Retention(days int) time.Duration {
+	if days <= 0 {
+		return DefaultRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func newItem(path, description string, appendOnRestore bool) (Item, string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return Item{}, "", err
+	}
+
+	now := time.Now()
+	id := now.Format("20060102-150405")
+	for n := 2; exists(filepath.Join(TrashDir, id)); n++ {
+		id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), n)
+	}
+	item := Item{ID: id, Created: now, Description: description, OriginalPath: absPath, Append: appendOnRestore}
+
+	dir := filepath.Join(TrashDir, id)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return item, "", err
+	}
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return item, "", err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "item.json"), data, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return item, "", err
+	}
+	return item, dir, nil
+}
+
+// DataFile returns the file holding the data of the item with id.
+func DataFile(id string) string {
+	return filepath.Join(TrashDir, id, "data")
+}
+
+func load(id string) (Item, error) {
+	var item Item
+	data, err := ioutil.ReadFile(filepath.Join(TrashDir, id, "item.json"))
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+// move renames src to dst, copying when they are on different filesystems.
+func move(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
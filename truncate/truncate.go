@@ -0,0 +1,204 @@
+package truncate
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/helpers"
+	"regexp"
+	"strings"
+)
+
+// Strategies for text over its token budget, see Fit.
+const (
+	StrategyHeadTail = "head_tail"
+	StrategyStrip    = "strip"
+	StrategyOutline  = "outline"
+	StrategyOff      = "off"
+)
+
+// Strategies are the accepted values of inject_truncation.
+var Strategies = []string{StrategyHeadTail, StrategyStrip, StrategyOutline, StrategyOff}
+
+// marker replaces the lines left out of the middle of a text.
+const marker = "\n... [%d lines omitted] ...\n"
+
+// Result is a text fitted to a budget.
+type Result struct {
+	Text string
+	// Omitted is the number of lines left out, 0 when the text already fit.
+	Omitted int
+	// Strategy is what was applied, e.g. "strip, then head_tail" when
+	// stripping alone was not enough.
+	Strategy string
+}
+
+// Fit cuts text to about budget tokens of modelName with strategy:
+//
+//   - head_tail keeps whole lines from the start and the end.
+//   - strip removes blank lines and comments, then falls back to head_tail.
+//   - outline keeps the start and the end and lists the declarations of the
+//     middle, such as func, class and def lines.
+//   - off leaves text as it is.
+func Fit(text string, budget int, strategy string, modelName string) Result {
+	count := Counter(modelName)
+	if strategy == StrategyOff || budget <= 0 || count(text) <= budget {
+		return Result{Text: text, Strategy: strategy}
+	}
+
+	switch strategy {
+	case StrategyStrip:
+		stripped, removed := stripComments(text)
+		if count(stripped) <= budget {
+			return Result{Text: stripped, Omitted: removed, Strategy: StrategyStrip}
+		}
+		fitted, omitted := HeadTail(stripped, budget, 0.5, modelName)
+		return Result{Text: fitted, Omitted: removed + omitted, Strategy: StrategyStrip + ", then " + StrategyHeadTail}
+	case StrategyOutline:
+		if fitted, omitted, ok := outline(text, budget, count); ok {
+			return Result{Text: fitted, Omitted: omitted, Strategy: StrategyOutline}
+		}
+	}
+	fitted, omitted := HeadTail(text, budget, 0.5, modelName)
+	return Result{Text: fitted, Omitted: omitted, Strategy: StrategyHeadTail}
+}
+
+// HeadTail truncates text to about budget tokens, keeping whole lines from
+// its start and end and marking what was left out. headShare is the part of
+// the budget given to the start. It returns the number of omitted lines, 0
+// when text already fits.
+func HeadTail(text string, budget int, headShare float64, modelName string) (string, int) {
+	count := Counter(modelName)
+	if budget <= 0 || count(text) <= budget {
+		return text, 0
+	}
+
+	lines := strings.Split(text, "\n")
+	budget = max(budget-count(marker), 1)
+	headBudget := int(float64(budget) * headShare)
+	head := takeHead(lines, headBudget, count)
+	tail := takeTail(lines, len(head), budget-headBudget, count)
+
+	// a few huge lines, e.g. minified files, are cut by characters instead
+	if len(head) == 0 && len(tail) == 0 {
+		keep := len(text) * budget / count(text)
+		headChars := int(float64(keep) * headShare)
+		omitted := strings.Count(text[headChars:len(text)-(keep-headChars)], "\n") + 1
+		return text[:headChars] + fmt.Sprintf(marker, omitted) + text[len(text)-(keep-headChars):], omitted
+	}
+
+	omitted := len(lines) - len(head) - len(tail)
+	return strings.Join(head, "\n") + fmt.Sprintf(marker, omitted) + strings.Join(tail, "\n"), omitted
+}
+
+// Counter returns a token counter for modelName, estimating the tokens when
+// its tokenizer is unavailable.
+func Counter(modelName string) func(string) int {
+	tokenize, err := helpers.LocalTokenizer(modelName)
+	if err != nil {
+		return func(text string) int {
+			return helpers.EstimateTokens(text, modelName)
+		}
+	}
+	return tokenize
+}
+
+// takeHead returns the lines from the start that fit in budget.
+func takeHead(lines []string, budget int, count func(string) int) []string {
+	used := 0
+	for i, line := range lines {
+		used += count(line) + 1
+		if used > budget {
+			return lines[:i]
+		}
+	}
+	return lines
+}
+
+// takeTail returns the lines from the end, but not before index from, that
+// fit in budget.
+func takeTail(lines []string, from int, budget int, count func(string) int) []string {
+	used := 0
+	for i := len(lines) - 1; i >= from; i-- {
+		used += count(lines[i]) + 1
+		if used > budget {
+			return lines[i+1:]
+		}
+	}
+	return lines[from:]
+}
+
+// declaration matches the lines outline keeps from the middle of a file.
+var declaration = regexp.MustCompile(`^\s*(export\s+|pub(\([a-z]+\))?\s+|public\s+|private\s+|protected\s+|internal\s+|static\s+|abstract\s+|async\s+|default\s+)*(func|type|class|def|interface|struct|enum|trait|impl|fn|function|module|namespace|object|record|CREATE|create)\b`)
+
+// outline keeps a third of the budget for the start and the end each and
+// fills the rest with the declarations in between. It fails when the text
+// has no declarations in the middle.
+func outline(text string, budget int, count func(string) int) (string, int, bool) {
+	lines := strings.Split(text, "\n")
+	header := "\n... [%d lines omitted, their declarations are:]\n"
+	footer := "... [end of the omitted lines] ...\n"
+	budget -= count(header) + count(footer)
+
+	head := takeHead(lines, budget/3, count)
+	tail := takeTail(lines, len(head), budget/3, count)
+	middle := lines[len(head) : len(lines)-len(tail)]
+
+	declarations := []string{}
+	for _, line := range middle {
+		if declaration.MatchString(line) {
+			declarations = append(declarations, strings.TrimRight(line, " \t{"))
+		}
+	}
+	declarations = takeHead(declarations, budget-budget/3*2, count)
+	if len(declarations) == 0 {
+		return "", 0, false
+	}
+
+	var sb strings.Builder
+	sb.WriteString(strings.Join(head, "\n"))
+	fmt.Fprintf(&sb, header, len(middle))
+	sb.WriteString(strings.Join(declarations, "\n"))
+	sb.WriteString("\n" + footer)
+	sb.WriteString(strings.Join(tail, "\n"))
+	return sb.String(), len(middle), true
+}
+
+// preprocessor lines start with # in C like languages but are not comments.
+var preprocessor = regexp.MustCompile(`^#(!|include|define|undef|if|ifdef|ifndef|elif|else|endif|pragma|import|error|line)\b`)
+
+// stripComments removes blank lines and lines that only hold a comment, in
+// the common //, #, --, /* */ and <!-- --> styles, and returns the number of
+// removed lines.
+func stripComments(text string) (string, int) {
+	lines := strings.Split(text, "\n")
+	kept := make([]string, 0, len(lines))
+	blockEnd := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if blockEnd != "" {
+			if strings.Contains(trimmed, blockEnd) {
+				blockEnd = ""
+			}
+			continue
+		}
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "/*"):
+			if !strings.Contains(trimmed[2:], "*/") {
+				blockEnd = "*/"
+			}
+			continue
+		case strings.HasPrefix(trimmed, "<!--"):
+			if !strings.Contains(trimmed[4:], "-->") {
+				blockEnd = "-->"
+			}
+			continue
+		case strings.HasPrefix(trimmed, "//"), strings.HasPrefix(trimmed, "--"):
+			continue
+		case strings.HasPrefix(trimmed, "#") && !preprocessor.MatchString(trimmed):
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n"), len(lines) - len(kept)
+}
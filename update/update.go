@@ -0,0 +1,306 @@
+package update
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/version"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LatestURL is the GitHub API endpoint of the latest release.
+var LatestURL = "https://api.github.com/repos/rojolang/terminalgpt/releases/latest"
+
+// maxDownload guards against downloading something that is not a binary.
+const maxDownload = 200 << 20
+
+// Release is a published GitHub release.
+type Release struct {
+	Tag    string  `json:"tag_name"`
+	URL    string  `json:"html_url"`
+	Assets []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release.
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+	Size int64  `json:"size"`
+}
+
+// osNames and archNames are what release file names call the platforms.
+var (
+	osNames = map[string][]string{
+		"darwin":  {"darwin", "macos", "mac"},
+		"linux":   {"linux"},
+		"windows": {"windows", "win"},
+		"freebsd": {"freebsd"},
+	}
+	archNames = map[string][]string{
+		"amd64": {"amd64", "x86_64", "x64"},
+		"arm64": {"arm64", "aarch64"},
+		"386":   {"386", "i386", "x86"},
+	}
+)
+
+// Latest fetches the latest release.
+func Latest() (Release, error) {
+	var release Release
+	data, err := get(LatestURL, true)
+	if err != nil {
+		return release, err
+	}
+	err = json.Unmarshal(data, &release)
+	if err != nil {
+		return release, fmt.Errorf("failed to read the release: %w", err)
+	}
+	if release.Tag == "" {
+		return release, fmt.Errorf("the latest release has no version tag")
+	}
+	return release, nil
+}
+
+// Newer reports whether version latest is newer than current, both like
+// v1.2.3 with an optional -prerelease suffix.
+func Newer(current, latest string) bool {
+	return compare(latest, current) > 0
+}
+
+func compare(a, b string) int {
+	aCore, aPre, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	bCore, bPre, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	aParts, bParts := strings.Split(aCore, "."), strings.Split(bCore, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		x, y := 0, 0
+		if i < len(aParts) {
+			x, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			y, _ = strconv.Atoi(bParts[i])
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	// a release is newer than its prereleases
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return strings.Compare(aPre, bPre)
+}
+
+// Binary finds the asset with the binary for goos and goarch: a plain
+// executable, a .tar.gz or a .zip.
+func (r Release) Binary(goos, goarch string) (Asset, bool) {
+	for _, asset := range r.Assets {
+		name := strings.ToLower(asset.Name)
+		if isChecksum(name) || strings.HasSuffix(name, ".sig") || strings.HasSuffix(name, ".pem") || strings.HasSuffix(name, ".sbom") {
+			continue
+		}
+		words := strings.FieldsFunc(strings.ReplaceAll(name, "x86_64", "amd64"), func(r rune) bool {
+			return r == '_' || r == '-' || r == '.'
+		})
+		if hasAny(words, osNames[goos]) && hasAny(words, archNames[goarch]) {
+			return asset, true
+		}
+	}
+	return Asset{}, false
+}
+
+// Checksum returns the SHA-256 of asset that the release publishes, from a
+// checksums file listing every asset or from <asset>.sha256.
+func (r Release) Checksum(asset Asset) (string, error) {
+	for _, candidate := range r.Assets {
+		name := strings.ToLower(candidate.Name)
+		if !isChecksum(name) {
+			continue
+		}
+		single := name == strings.ToLower(asset.Name)+".sha256"
+		if !single && strings.HasSuffix(name, ".sha256") {
+			continue
+		}
+		data, err := get(candidate.URL, false)
+		if err != nil {
+			return "", err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			if single || len(fields) >= 2 && strings.TrimPrefix(fields[len(fields)-1], "*") == asset.Name {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("the release publishes no checksum for %s", asset.Name)
+}
+
+// Download fetches asset, checks it against the SHA-256 checksum and returns
+// the binary in it.
+func Download(asset Asset, checksum string) ([]byte, error) {
+	data, err := get(asset.URL, false)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != checksum {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", asset.Name, checksum, got)
+	}
+
+	name := strings.ToLower(asset.Name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return fromTarGz(data)
+	case strings.HasSuffix(name, ".zip"):
+		return fromZip(data)
+	}
+	return data, nil
+}
+
+// Install replaces the running executable with binary and returns its path.
+func Install(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the running executable: %w", err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the running executable: %w", err)
+	}
+
+	// written next to it, so the rename stays on one file system
+	next := exe + ".new"
+	err = os.WriteFile(next, binary, 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %s, you may need to run the update with sudo: %w", next, err)
+	}
+	// Windows cannot replace a running executable, but it can rename it
+	if runtime.GOOS == "windows" {
+		os.Remove(exe + ".old")
+		err = os.Rename(exe, exe+".old")
+		if err != nil {
+			os.Remove(next)
+			return "", fmt.Errorf("failed to move %s aside: %w", exe, err)
+		}
+	}
+	err = os.Rename(next, exe)
+	if err != nil {
+		os.Remove(next)
+		return "", fmt.Errorf("failed to replace %s: %w", exe, err)
+	}
+	return exe, nil
+}
+
+func fromTarGz(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("the archive has no terminalgpt binary")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the archive: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg && isBinaryName(header.Name) {
+			return io.ReadAll(io.LimitReader(tr, maxDownload))
+		}
+	}
+}
+
+func fromZip(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the archive: %w", err)
+	}
+	for _, file := range zr.File {
+		if file.FileInfo().IsDir() || !isBinaryName(file.Name) {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the archive: %w", err)
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxDownload))
+	}
+	return nil, fmt.Errorf("the archive has no terminalgpt binary")
+}
+
+func isBinaryName(name string) bool {
+	base := path.Base(name)
+	return base == "terminalgpt" || base == "terminalgpt.exe"
+}
+
+func isChecksum(name string) bool {
+	return strings.HasSuffix(name, "checksums.txt") || strings.HasSuffix(name, ".sha256") || name == "sha256sums" || name == "sha256sums.txt"
+}
+
+func hasAny(words, names []string) bool {
+	for _, word := range words {
+		for _, name := range names {
+			if word == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// get downloads url, with the GitHub token of GITHUB_TOKEN for API requests
+// to raise the rate limit.
+func get(url string, api bool) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "terminalgpt/"+version.Get().Version)
+	if api {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	resp, err := httpclient.Client(5 * time.Minute).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDownload+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	if len(data) > maxDownload {
+		return nil, fmt.Errorf("%s is larger than %d MB", url, maxDownload>>20)
+	}
+	return data, nil
+}
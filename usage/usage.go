@@ -0,0 +1,124 @@
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/helpers"
+	"os"
+	"os/user"
+	"sort"
+	"time"
+)
+
+var UsageFile = appdir.Path("usage.jsonl")
+
+// DefaultUser is recorded for requests made with the default keys.
+const DefaultUser = "default"
+
+// Record is the usage of one request answered by a provider, cache hits are
+// not recorded.
+type Record struct {
+	Time time.Time `json:"time"`
+	// User is the user picked with --as, or DefaultUser.
+	User string `json:"user"`
+	// Account is the system account that ran terminalgpt.
+	Account        string `json:"account,omitempty"`
+	Provider       string `json:"provider"`
+	Model          string `json:"model"`
+	PromptTokens   int    `json:"prompt_tokens"`
+	ResponseTokens int    `json:"response_tokens"`
+	// Cost is the estimated USD cost, 0 for models without a known price.
+	Cost   float64 `json:"cost"`
+	Priced bool    `json:"priced"`
+}
+
+// Totals add up records.
+type Totals struct {
+	Requests       int
+	PromptTokens   int
+	ResponseTokens int
+	Cost           float64
+	// Unpriced counts the requests to models without a known price.
+	Unpriced int
+}
+
+func (t *Totals) Add(record Record) {
+	t.Requests++
+	t.PromptTokens += record.PromptTokens
+	t.ResponseTokens += record.ResponseTokens
+	t.Cost += record.Cost
+	if !record.Priced {
+		t.Unpriced++
+	}
+}
+
+// Append records a request of user, DefaultUser when empty, with its cost.
+func Append(userName, provider, model string, promptTokens, responseTokens int) error {
+	if userName == "" {
+		userName = DefaultUser
+	}
+	record := Record{
+		Time:           time.Now(),
+		User:           userName,
+		Provider:       provider,
+		Model:          model,
+		PromptTokens:   promptTokens,
+		ResponseTokens: responseTokens,
+	}
+	record.Cost, record.Priced = helpers.Cost(model, promptTokens, responseTokens)
+	if account, err := user.Current(); err == nil {
+		record.Account = account.Username
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(appdir.Dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	// one short write per line, so concurrent runs don't interleave lines
+	file, err := os.OpenFile(UsageFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %w", err)
+	}
+	return nil
+}
+
+// Read returns the records made since the given time, oldest first. Lines
+// that don't parse, like one cut short by a crash, are skipped.
+func Read(since time.Time) ([]Record, error) {
+	records := []Record{}
+	file, err := os.Open(UsageFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", UsageFile, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		if json.Unmarshal(scanner.Bytes(), &record) != nil || record.Time.Before(since) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", UsageFile, err)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
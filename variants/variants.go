@@ -0,0 +1,117 @@
+package variants
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/termcap"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	columnGap = " │ "
+	minColumn = 30
+)
+
+// Show prints the variants next to each other when they fit the terminal,
+// and one after another otherwise.
+func Show(variants []string) {
+	width := termcap.Width()
+	columnWidth := (width - (len(variants)-1)*utf8.RuneCountInString(columnGap)) / len(variants)
+
+	header := color.New(color.FgHiYellow, color.Bold).SprintFunc()
+
+	if columnWidth < minColumn {
+		for i, variant := range variants {
+			fmt.Printf("\n%s\n%s\n", header(fmt.Sprintf("── Variant %d ──", i+1)), variant)
+		}
+		return
+	}
+
+	columns := make([][]string, len(variants))
+	rows := 0
+	for i, variant := range variants {
+		columns[i] = wrap(variant, columnWidth)
+		if len(columns[i]) > rows {
+			rows = len(columns[i])
+		}
+	}
+
+	fmt.Println()
+	for i := range variants {
+		if i > 0 {
+			fmt.Print(columnGap)
+		}
+		fmt.Print(header(pad(fmt.Sprintf("Variant %d", i+1), columnWidth)))
+	}
+	fmt.Println()
+
+	for row := 0; row < rows; row++ {
+		for i := range columns {
+			if i > 0 {
+				fmt.Print(columnGap)
+			}
+			line := ""
+			if row < len(columns[i]) {
+				line = columns[i][row]
+			}
+			fmt.Print(pad(line, columnWidth))
+		}
+		fmt.Println()
+	}
+}
+
+// Pick asks which variant to keep. It returns -1 if the user discards all of them.
+func Pick(reader *bufio.Reader, count int) int {
+	for {
+		fmt.Printf("\nPick a variant to save to history [1-%d], or press enter to discard them: ", count)
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return -1
+		}
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			return -1
+		}
+		choice, err := strconv.Atoi(answer)
+		if err == nil && choice >= 1 && choice <= count {
+			return choice - 1
+		}
+		fmt.Println("Invalid choice.")
+	}
+}
+
+// wrap splits text into lines of at most width runes, breaking on spaces where possible.
+func wrap(text string, width int) []string {
+	lines := []string{}
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\t", "    "), "\n") {
+		runes := []rune(paragraph)
+		if len(runes) == 0 {
+			lines = append(lines, "")
+			continue
+		}
+		for len(runes) > width {
+			cut := width
+			for i := width; i > width/2; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			lines = append(lines, string(runes[:cut]))
+			runes = []rune(strings.TrimLeft(string(runes[cut:]), " "))
+		}
+		lines = append(lines, string(runes))
+	}
+	return lines
+}
+
+func pad(text string, width int) string {
+	n := utf8.RuneCountInString(text)
+	if n >= width {
+		return text
+	}
+	return text + strings.Repeat(" ", width-n)
+}
@@ -0,0 +1,421 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rojolang/terminalgpt/appdir"
+	"github.com/rojolang/terminalgpt/credentials"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Values of history_encryption.
+const (
+	ModeOff        = "off"
+	ModeKeychain   = "keychain"
+	ModePassphrase = "passphrase"
+)
+
+// Modes are the accepted values of history_encryption, empty means off.
+var Modes = []string{ModeOff, ModeKeychain, ModePassphrase}
+
+// KeyFile records how the history key is made, and for a passphrase the salt.
+var KeyFile = appdir.Path("history_key.json")
+
+// PassphraseEnv is read before asking for the passphrase on the terminal.
+const PassphraseEnv = "TERMINALGPT_HISTORY_PASSPHRASE"
+
+const (
+	// prefix marks an encrypted line, the rest is the base64 of the nonce and
+	// the sealed line
+	prefix = "enc1:"
+
+	// keychainName is the credential the random key of keychain mode is
+	// stored under.
+	keychainName = "history_encryption_key"
+
+	// iterations of PBKDF2-HMAC-SHA256 for passphrases
+	iterations = 600000
+
+	// check is sealed with the key so a wrong passphrase is told apart from
+	// damaged lines.
+	check = "terminalgpt history key"
+)
+
+// ErrNoKey is returned for encrypted lines when no history key exists.
+var ErrNoKey = errors.New("the history is encrypted but its key is gone")
+
+var (
+	mode   = ""
+	aead   cipher.AEAD
+	aeadMu sync.Mutex
+)
+
+type keyInfo struct {
+	Mode       string `json:"mode"`
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Check      []byte `json:"check"`
+}
+
+// IsMode reports whether m is one of Modes or empty.
+func IsMode(m string) bool {
+	if m == "" {
+		return true
+	}
+	for _, known := range Modes {
+		if m == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Configure sets whether new lines are encrypted, with the history_encryption
+// mode m. Encrypted lines are read in any mode.
+func Configure(m string) {
+	aeadMu.Lock()
+	defer aeadMu.Unlock()
+	mode = m
+}
+
+// Enabled reports whether Seal encrypts.
+func Enabled() bool {
+	aeadMu.Lock()
+	defer aeadMu.Unlock()
+	return mode == ModeKeychain || mode == ModePassphrase
+}
+
+// IsSealed reports whether line was encrypted by Seal.
+func IsSealed(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(prefix))
+}
+
+// Seal encrypts one line of a JSON lines file when encryption is enabled, and
+// returns it as it is otherwise. The line must not end with a newline.
+func Seal(line []byte) ([]byte, error) {
+	if !Enabled() {
+		return line, nil
+	}
+	return seal(line)
+}
+
+func seal(line []byte) ([]byte, error) {
+	gcm, err := key(true)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, line, nil)
+	out := make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(out, prefix)
+	base64.StdEncoding.Encode(out[len(prefix):], sealed)
+	return out, nil
+}
+
+// Open decrypts a line sealed by Seal and returns other lines as they are.
+func Open(line []byte) ([]byte, error) {
+	if !IsSealed(line) {
+		return line, nil
+	}
+	gcm, err := key(false)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line[len(prefix):]))
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("failed to decrypt history: damaged line")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt history: %w", err)
+	}
+	return plain, nil
+}
+
+// RewriteFile rewrites every line of the JSON lines file at path encrypted,
+// or in plain text when encrypt is false. It returns how many lines changed.
+// Callers hold whatever lock guards the file.
+func RewriteFile(path string, encrypt bool) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	changed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) > 0 && IsSealed(line) != encrypt {
+			if encrypt {
+				line, err = seal(line)
+			} else {
+				line, err = Open(line)
+			}
+			if err != nil {
+				file.Close()
+				return 0, fmt.Errorf("%s: %w", path, err)
+			}
+			changed++
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to rewrite %s: %w", path, err)
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, fmt.Errorf("failed to rewrite %s: %w", path, err)
+	}
+	return changed, nil
+}
+
+// KeyMode returns the mode the existing history key was made with, empty
+// when there is none yet.
+func KeyMode() string {
+	info, err := readKeyInfo()
+	if err != nil {
+		return ""
+	}
+	return info.Mode
+}
+
+// ForgetKey removes the history key, for after the history was decrypted.
+func ForgetKey() error {
+	aeadMu.Lock()
+	defer aeadMu.Unlock()
+	info, err := readKeyInfo()
+	if err != nil {
+		return nil
+	}
+	if info.Mode == ModeKeychain {
+		credentials.Delete(keychainName)
+	}
+	aead = nil
+	return os.Remove(KeyFile)
+}
+
+// key returns the cipher of the history key, creating the key in the
+// configured mode when there is none and create is set. An existing key is
+// used whatever the configured mode.
+func key(create bool) (cipher.AEAD, error) {
+	aeadMu.Lock()
+	defer aeadMu.Unlock()
+	if aead != nil {
+		return aead, nil
+	}
+
+	info, err := readKeyInfo()
+	if os.IsNotExist(err) {
+		if !create {
+			return nil, ErrNoKey
+		}
+		gcm, err := newKey(mode)
+		if err != nil {
+			return nil, err
+		}
+		aead = gcm
+		return aead, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var secret []byte
+	switch info.Mode {
+	case ModeKeychain:
+		encoded, err := credentials.Get(keychainName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the history key from the keychain: %w", err)
+		}
+		secret, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the history key: %w", err)
+		}
+	case ModePassphrase:
+		passphrase, err := readPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+		secret = pbkdf2.Key([]byte(passphrase), info.Salt, info.Iterations, 32, sha256.New)
+	default:
+		return nil, fmt.Errorf("unknown history key mode %q in %s", info.Mode, KeyFile)
+	}
+
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, info.Check[:gcm.NonceSize()], info.Check[gcm.NonceSize():], nil)
+	if err != nil || string(plain) != check {
+		if info.Mode == ModePassphrase {
+			return nil, fmt.Errorf("wrong history passphrase")
+		}
+		return nil, fmt.Errorf("the history key in the keychain does not match %s", KeyFile)
+	}
+	aead = gcm
+	return aead, nil
+}
+
+// newKey makes a history key in mode m and records it in KeyFile.
+func newKey(m string) (cipher.AEAD, error) {
+	info := keyInfo{Mode: m}
+	secret := make([]byte, 32)
+	switch m {
+	case ModeKeychain:
+		_, err := io.ReadFull(rand.Reader, secret)
+		if err != nil {
+			return nil, err
+		}
+		where, err := credentials.Set(keychainName, base64.StdEncoding.EncodeToString(secret))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store the history key: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Stored a new history encryption key in %s\n", where)
+	case ModePassphrase:
+		passphrase, err := readPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		info.Salt = make([]byte, 16)
+		_, err = io.ReadFull(rand.Reader, info.Salt)
+		if err != nil {
+			return nil, err
+		}
+		info.Iterations = iterations
+		secret = pbkdf2.Key([]byte(passphrase), info.Salt, info.Iterations, 32, sha256.New)
+	default:
+		return nil, fmt.Errorf("history encryption is off")
+	}
+
+	gcm, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	info.Check = gcm.Seal(nonce, nonce, []byte(check), nil)
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(KeyFile), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(KeyFile, data, 0600)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save %s: %w", KeyFile, err)
+	}
+	return gcm, nil
+}
+
+func readKeyInfo() (keyInfo, error) {
+	var info keyInfo
+	data, err := ioutil.ReadFile(KeyFile)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return info, fmt.Errorf("failed to parse %s: %w", KeyFile, err)
+	}
+	if len(info.Check) < 12 {
+		return info, fmt.Errorf("%s has no key check", KeyFile)
+	}
+	return info, nil
+}
+
+// readPassphrase reads the passphrase from PassphraseEnv or the terminal,
+// twice when it is new.
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("the history is encrypted with a passphrase, set %s", PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "History passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the passphrase: %w", err)
+	}
+	if strings.TrimSpace(string(passphrase)) == "" {
+		return "", fmt.Errorf("the history passphrase is empty")
+	}
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat the passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the passphrase: %w", err)
+		}
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("the passphrases differ")
+		}
+	}
+	return string(passphrase), nil
+}
+
+func newGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,89 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/rojolang/terminalgpt/version.Version=v1.2.0 \
+//	  -X github.com/rojolang/terminalgpt/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/rojolang/terminalgpt/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o terminalgpt ./cmd
+var (
+	Version = ""
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build metadata set with -ldflags. Fields left empty are
+// filled from what the Go toolchain embeds: the module version for
+// `go install ...@v1.2.0`, and the commit and its time for builds from a
+// git checkout.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if ok {
+		if info.Version == "" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+		modified := false
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+					if len(info.Commit) > 12 {
+						info.Commit = info.Commit[:12]
+					}
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if modified && Commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+func (i Info) String() string {
+	s := "terminalgpt " + i.Version
+	if i.Commit != "" {
+		s += " (" + i.Commit
+		if date, err := time.Parse(time.RFC3339, i.Date); err == nil {
+			s += ", " + date.UTC().Format("2006-01-02")
+		} else if i.Date != "" {
+			s += ", " + i.Date
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s %s %s", s, i.GoVersion, i.Platform)
+}
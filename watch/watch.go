@@ -0,0 +1,159 @@
+package watch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/codeindex"
+	"github.com/rojolang/terminalgpt/common"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/templates"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultInterval is how often the directory is checked for saved files.
+const DefaultInterval = 500 * time.Millisecond
+
+// filePlaceholder finds the {{file}} of a template.
+var filePlaceholder = regexp.MustCompile(`\{\{\s*file\s*\}\}`)
+
+// maxFileSize skips files too large to send, like generated code.
+const maxFileSize = 200 << 10
+
+type Options struct {
+	Dir      string
+	Glob     string
+	Template string
+	// Vars are the key=value variables of the template besides file.
+	Vars     []string
+	Interval time.Duration
+}
+
+// Run watches opts.Dir for saved files matching opts.Glob and sends each one
+// to the model with the template, until it is interrupted. A file is sent once
+// it stopped changing for an interval, and only when its content changed since
+// it was last sent or the watch started.
+func Run(cfg *config.Config, opts Options) error {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	// fail on a missing template or variable now rather than on the first save
+	body, err := templates.Load(opts.Template)
+	if err != nil {
+		return err
+	}
+	vars, err := templates.ParseVars(opts.Vars)
+	if err != nil {
+		return err
+	}
+
+	runCfg := *cfg
+	runCfg.History = false
+
+	files, err := scan(opts)
+	if err != nil {
+		return err
+	}
+	gray := color.New(color.FgHiBlack)
+	gray.Printf("Watching %d files matching %s in %s with the %s template, press Ctrl-C to stop.\n", len(files), opts.Glob, opts.Dir, opts.Template)
+
+	// saves that leave a file as it was, like touching it, are not sent
+	sent := map[string][32]byte{}
+	for rel, entry := range files {
+		if entry.Size <= maxFileSize {
+			if content, err := os.ReadFile(filepath.Join(opts.Dir, filepath.FromSlash(rel))); err == nil {
+				sent[rel] = sha256.Sum256(content)
+			}
+		}
+	}
+	pending := map[string]bool{}
+	for {
+		time.Sleep(opts.Interval)
+		current, err := scan(opts)
+		if err != nil {
+			return err
+		}
+
+		// files still changing wait for the next interval
+		ready := []string{}
+		for rel, entry := range current {
+			old, ok := files[rel]
+			if !ok || !old.ModTime.Equal(entry.ModTime) || old.Size != entry.Size {
+				pending[rel] = true
+			} else if pending[rel] {
+				ready = append(ready, rel)
+			}
+		}
+		for rel := range pending {
+			if _, ok := current[rel]; !ok {
+				delete(pending, rel)
+			}
+		}
+		files = current
+		sort.Strings(ready)
+
+		for _, rel := range ready {
+			delete(pending, rel)
+			content, err := os.ReadFile(filepath.Join(opts.Dir, filepath.FromSlash(rel)))
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(content)
+			if sent[rel] == sum || strings.TrimSpace(string(content)) == "" {
+				continue
+			}
+			sent[rel] = sum
+			if len(content) > maxFileSize {
+				color.Yellow("%s is larger than %d KB, skipped\n", rel, maxFileSize>>10)
+				continue
+			}
+
+			prompt, err := render(body, vars, rel, opts.Dir)
+			if err != nil {
+				color.Red("%s: %v\n", rel, err)
+				continue
+			}
+			gray.Printf("\n── %s saved at %s, running %s ──\n", rel, time.Now().Format("15:04:05"), opts.Template)
+			_, _, _, _, _, err = common.GenerateCompletion(&runCfg, prompt)
+			fmt.Println()
+			if err != nil {
+				color.Red("%s: %v\n", rel, err)
+			}
+		}
+		// saves made while the model answered are picked up by the next scan
+	}
+}
+
+// render expands the template for the file rel. Templates without {{file}}
+// get the file appended, so any template works for watching.
+func render(body string, vars map[string]string, rel, dir string) (string, error) {
+	fileVars := map[string]string{}
+	for key, value := range vars {
+		fileVars[key] = value
+	}
+	fileVars["file"], fileVars["path"] = rel, rel
+	if !filePlaceholder.MatchString(body) {
+		body += fmt.Sprintf("\n\n%s:\n\n```\n{{file}}\n```\n", rel)
+	}
+	return templates.Expand(body, fileVars, dir)
+}
+
+// scan lists the files of the directory that match the glob.
+func scan(opts Options) (map[string]codeindex.Entry, error) {
+	all, err := codeindex.Scan(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", opts.Dir, err)
+	}
+	files := map[string]codeindex.Entry{}
+	for rel, entry := range all {
+		if codeindex.MatchGlob(opts.Glob, rel) {
+			files[rel] = entry
+		}
+	}
+	return files, nil
+}
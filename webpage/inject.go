@@ -0,0 +1,86 @@
+package webpage
+
+import (
+	"fmt"
+	"github.com/rojolang/terminalgpt/helpers"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxTokens is used when fetch_url_tokens is 0.
+const DefaultMaxTokens = 2000
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// URLs returns the distinct http(s) URLs in message, without trailing
+// punctuation such as the period ending a sentence.
+func URLs(message string) []string {
+	seen := map[string]bool{}
+	urls := []string{}
+	for _, match := range urlPattern.FindAllString(message, -1) {
+		match = strings.TrimRight(match, ".,;:!?")
+		// a closing bracket belongs to the URL only if it opened in it
+		for _, pair := range []string{"()", "[]"} {
+			for strings.HasSuffix(match, pair[1:]) && strings.Count(match, pair[1:]) > strings.Count(match, pair[:1]) {
+				match = match[:len(match)-1]
+			}
+		}
+		if !seen[match] {
+			seen[match] = true
+			urls = append(urls, match)
+		}
+	}
+	return urls
+}
+
+// Inject appends the readable text of the pages linked in message to it,
+// each cut to maxTokens tokens of modelName. It returns the pages added and
+// the errors of those that could not be fetched.
+func Inject(message string, maxTokens int, modelName string) (string, []Page, []error) {
+	urls := URLs(message)
+	if len(urls) == 0 {
+		return message, nil, nil
+	}
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
+	}
+
+	pages := make([]Page, len(urls))
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			pages[i], errs[i] = Fetch(url)
+		}(i, url)
+	}
+	wg.Wait()
+
+	var sb strings.Builder
+	sb.WriteString(message)
+	added := []Page{}
+	failed := []error{}
+	for i, page := range pages {
+		if errs[i] != nil {
+			failed = append(failed, errs[i])
+			continue
+		}
+		if strings.TrimSpace(page.Text) == "" {
+			failed = append(failed, fmt.Errorf("%s has no readable text", page.URL))
+			continue
+		}
+		if cut := helpers.TruncateTokens(page.Text, maxTokens, modelName); cut != page.Text {
+			page.Text = cut + "\n[the rest of the page was cut]"
+		}
+		added = append(added, page)
+
+		title := ""
+		if page.Title != "" {
+			title = " (" + page.Title + ")"
+		}
+		fmt.Fprintf(&sb, "\n\nThe page %s%s reads:\n==\n%s\n==\n", page.URL, title, page.Text)
+	}
+	return sb.String(), added, failed
+}
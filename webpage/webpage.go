@@ -0,0 +1,150 @@
+package webpage
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"golang.org/x/net/html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxBodyBytes limits how much of a page is downloaded.
+const maxBodyBytes = 2 * 1024 * 1024
+
+// Page is the readable content of a web page.
+type Page struct {
+	URL   string
+	Title string
+	Text  string
+}
+
+// Fetch downloads url and extracts its readable text. HTML is stripped of
+// scripts, styles and navigation, plain text, JSON and markdown are kept as is.
+func Fetch(url string) (Page, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Page{}, err
+	}
+	req.Header.Set("User-Agent", "terminalgpt (+https://github.com/rojolang/terminalgpt)")
+	req.Header.Set("Accept", "text/html,text/plain,application/json;q=0.9,*/*;q=0.5")
+
+	resp, err := httpclient.Client(20 * time.Second).Do(req)
+	if err != nil {
+		return Page{}, fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Page{}, fmt.Errorf("failed to fetch %s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return Page{}, fmt.Errorf("failed to read %s: %w", url, err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "" || mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		title, text := Text(body)
+		return Page{URL: url, Title: title, Text: text}, nil
+	case strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml"):
+		return Page{URL: url, Text: strings.TrimSpace(string(body))}, nil
+	}
+	return Page{}, fmt.Errorf("%s is %s, not a readable page", url, mediaType)
+}
+
+// skipped are elements whose content is never part of the readable text.
+var skipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true, "svg": true, "iframe": true,
+	"head": true, "nav": true, "header": true, "footer": true, "aside": true, "form": true, "button": true,
+}
+
+// blocks are elements that start a new line.
+var blocks = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "main": true, "br": true, "li": true,
+	"ul": true, "ol": true, "tr": true, "table": true, "pre": true, "blockquote": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "dt": true, "dd": true,
+}
+
+var (
+	spaces     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLines = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// Text returns the title and readable text of an HTML document. When the
+// page marks its content with <article> or <main>, only that is used.
+func Text(document []byte) (string, string) {
+	root, err := html.Parse(bytes.NewReader(document))
+	if err != nil {
+		return "", string(document)
+	}
+
+	title := ""
+	var content *html.Node
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				if title == "" && n.FirstChild != nil {
+					title = strings.TrimSpace(n.FirstChild.Data)
+				}
+			case "article", "main":
+				if content == nil {
+					content = n
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(root)
+	if content == nil {
+		content = root
+	}
+
+	var sb strings.Builder
+	var walk func(*html.Node, bool)
+	walk = func(n *html.Node, pre bool) {
+		switch n.Type {
+		case html.TextNode:
+			if pre {
+				sb.WriteString(n.Data)
+			} else {
+				sb.WriteString(spaces.ReplaceAllString(strings.ReplaceAll(n.Data, "\n", " "), " "))
+			}
+			return
+		case html.ElementNode:
+			if skipped[n.Data] {
+				return
+			}
+			pre = pre || n.Data == "pre"
+			if blocks[n.Data] {
+				sb.WriteString("\n")
+			}
+			if n.Data == "li" {
+				sb.WriteString("- ")
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, pre)
+		}
+		if n.Type == html.ElementNode && blocks[n.Data] {
+			sb.WriteString("\n")
+		}
+	}
+	walk(content, false)
+
+	lines := strings.Split(sb.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	text := blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return title, strings.TrimSpace(text)
+}
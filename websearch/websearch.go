@@ -0,0 +1,208 @@
+package websearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rojolang/terminalgpt/config"
+	"github.com/rojolang/terminalgpt/helpers"
+	"github.com/rojolang/terminalgpt/httpclient"
+	"github.com/rojolang/terminalgpt/termcap"
+	"github.com/rojolang/terminalgpt/webpage"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix marks a prompt that is answered from a web search.
+const Prefix = "search:"
+
+// Providers are the supported values of web_search.
+var Providers = []string{"searxng", "bing", "brave"}
+
+// DefaultResults is used when web_search_results is 0.
+const DefaultResults = 3
+
+// maxResultTokens limits the page text of each result added to the prompt.
+const maxResultTokens = 1500
+
+// endpoints are the search APIs used when web_search_url is empty.
+var endpoints = map[string]string{
+	"bing":  "https://api.bing.microsoft.com/v7.0/search",
+	"brave": "https://api.search.brave.com/res/v1/web/search",
+}
+
+// Result is a search hit, Text is the readable content of its page, or the
+// snippet when the page could not be fetched.
+type Result struct {
+	Title   string
+	URL     string
+	Snippet string
+	Text    string
+}
+
+// Query returns the search query of a "search:" prompt.
+func Query(message string) (string, bool) {
+	trimmed := strings.TrimSpace(message)
+	if len(trimmed) < len(Prefix) || !strings.EqualFold(trimmed[:len(Prefix)], Prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(trimmed[len(Prefix):]), true
+}
+
+// Search queries the configured search API.
+func Search(cfg *config.Config, query string) ([]Result, error) {
+	count := cfg.WebSearchResults
+	if count <= 0 {
+		count = DefaultResults
+	}
+
+	endpoint := cfg.WebSearchURL
+	if endpoint == "" {
+		endpoint = endpoints[cfg.WebSearch]
+	}
+	if cfg.WebSearch == "searxng" && cfg.WebSearchURL != "" {
+		endpoint = strings.TrimRight(cfg.WebSearchURL, "/") + "/search"
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("set web_search_url to the address of the %s instance", cfg.WebSearch)
+	}
+
+	params := url.Values{"q": {query}}
+	switch cfg.WebSearch {
+	case "searxng":
+		params.Set("format", "json")
+	case "bing", "brave":
+		if cfg.WebSearchKey == "" {
+			return nil, fmt.Errorf("%s needs an API key, set web_search_key with --config", cfg.WebSearch)
+		}
+		params.Set("count", strconv.Itoa(count))
+	default:
+		return nil, fmt.Errorf("unknown web_search %q, expected one of %s", cfg.WebSearch, strings.Join(Providers, ", "))
+	}
+
+	req, err := http.NewRequest("GET", endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	switch cfg.WebSearch {
+	case "bing":
+		req.Header.Set("Ocp-Apim-Subscription-Key", cfg.WebSearchKey)
+	case "brave":
+		req.Header.Set("X-Subscription-Token", cfg.WebSearchKey)
+	}
+
+	resp, err := httpclient.Client(20 * time.Second).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("search request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("search request failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var parsed struct {
+		// searxng
+		Results []struct {
+			Title   string `json:"title"`
+			URL     string `json:"url"`
+			Content string `json:"content"`
+		} `json:"results"`
+		// bing
+		WebPages struct {
+			Value []struct {
+				Name    string `json:"name"`
+				URL     string `json:"url"`
+				Snippet string `json:"snippet"`
+			} `json:"value"`
+		} `json:"webPages"`
+		// brave
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode search results: %w", err)
+	}
+
+	results := []Result{}
+	for _, r := range parsed.Results {
+		results = append(results, Result{Title: r.Title, URL: r.URL, Snippet: r.Content})
+	}
+	for _, r := range parsed.WebPages.Value {
+		results = append(results, Result{Title: r.Name, URL: r.URL, Snippet: r.Snippet})
+	}
+	for _, r := range parsed.Web.Results {
+		results = append(results, Result{Title: r.Title, URL: r.URL, Snippet: stripTags(r.Description)})
+	}
+	if len(results) > count {
+		results = results[:count]
+	}
+	return results, nil
+}
+
+// Inject searches the web for query and returns a prompt asking it with the
+// text of the top results, and the results for Sources.
+func Inject(cfg *config.Config, query string) (string, []Result, error) {
+	results, err := Search(cfg, query)
+	if err != nil {
+		return query, nil, err
+	}
+	if len(results) == 0 {
+		return query, nil, fmt.Errorf("no search results for %q", query)
+	}
+
+	// fetch the pages in parallel, the snippet stands in for pages that fail
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(result *Result) {
+			defer wg.Done()
+			result.Text = result.Snippet
+			page, err := webpage.Fetch(result.URL)
+			if err == nil && page.Text != "" {
+				result.Text = helpers.TruncateTokens(page.Text, maxResultTokens, cfg.ModelName)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	var sb strings.Builder
+	sb.WriteString(query)
+	sb.WriteString("\n\nWeb search results for the question above. Answer from them and cite them by number, like [1]:\n")
+	for i, result := range results {
+		fmt.Fprintf(&sb, "\n[%d] %s (%s)\n==\n%s\n==\n", i+1, result.Title, result.URL, result.Text)
+	}
+	return sb.String(), results, nil
+}
+
+// Sources lists the results an answer cites, linked where the terminal
+// supports it.
+func Sources(results []Result) string {
+	var sb strings.Builder
+	sb.WriteString("Sources:\n")
+	for i, result := range results {
+		title := result.Title
+		if title == "" {
+			title = result.URL
+		}
+		fmt.Fprintf(&sb, "  [%d] %s %s\n", i+1, termcap.Hyperlink(result.URL, title), result.URL)
+	}
+	return sb.String()
+}
+
+// stripTags removes the <strong> highlights Brave puts in descriptions.
+func stripTags(text string) string {
+	_, stripped := webpage.Text([]byte(text))
+	return stripped
+}
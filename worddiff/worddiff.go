@@ -0,0 +1,131 @@
+package worddiff
+
+import (
+	"github.com/fatih/color"
+	"github.com/rojolang/terminalgpt/patch"
+	"strings"
+	"unicode"
+)
+
+// Part is a stretch of text both versions share (' '), only the old one has
+// ('-') or only the new one has ('+').
+type Part struct {
+	Op   byte
+	Text string
+}
+
+// Diff compares old and new word by word. The whitespace between changed
+// words belongs to the change, so a rewritten sentence is one removal and one
+// addition instead of alternating pieces.
+func Diff(old, new string) []Part {
+	ops := patch.DiffTokens(split(old), split(new))
+
+	parts := []Part{}
+	for i := 0; i < len(ops); {
+		if ops[i][0] == ' ' {
+			if len(parts) > 0 && parts[len(parts)-1].Op == ' ' {
+				parts[len(parts)-1].Text += ops[i][1:]
+			} else {
+				parts = append(parts, Part{Op: ' ', Text: ops[i][1:]})
+			}
+			i++
+			continue
+		}
+
+		var removed, added strings.Builder
+		for ; i < len(ops); i++ {
+			op, text := ops[i][0], ops[i][1:]
+			if op == ' ' {
+				if strings.TrimSpace(text) != "" || i+1 == len(ops) || ops[i+1][0] == ' ' {
+					break
+				}
+				removed.WriteString(text)
+				added.WriteString(text)
+				continue
+			}
+			if op == '-' {
+				removed.WriteString(text)
+			} else {
+				added.WriteString(text)
+			}
+		}
+		// whitespace that only one side changed is not worth showing
+		if strings.TrimSpace(removed.String()) != "" {
+			parts = append(parts, Part{Op: '-', Text: removed.String()})
+		}
+		if strings.TrimSpace(added.String()) != "" {
+			parts = append(parts, Part{Op: '+', Text: added.String()})
+		} else if added.Len() > 0 {
+			parts = append(parts, Part{Op: ' ', Text: added.String()})
+		}
+	}
+	return parts
+}
+
+// Count returns how many words were removed and added.
+func Count(parts []Part) (removed, added int) {
+	for _, part := range parts {
+		switch part.Op {
+		case '-':
+			removed += len(strings.Fields(part.Text))
+		case '+':
+			added += len(strings.Fields(part.Text))
+		}
+	}
+	return removed, added
+}
+
+// Format returns the new text with the removed words struck through in red
+// and the added words in green, or marked [-like this-] and {+like this+}
+// when colors are off.
+func Format(parts []Part) string {
+	removed := color.New(color.FgRed, color.CrossedOut).SprintFunc()
+	added := color.New(color.FgGreen).SprintFunc()
+
+	var sb strings.Builder
+	for _, part := range parts {
+		switch {
+		case part.Op == ' ':
+			sb.WriteString(part.Text)
+		case color.NoColor && part.Op == '-':
+			sb.WriteString("[-" + part.Text + "-]")
+		case color.NoColor:
+			sb.WriteString("{+" + part.Text + "+}")
+		case part.Op == '-':
+			sb.WriteString(colorLines(part.Text, removed))
+		default:
+			sb.WriteString(colorLines(part.Text, added))
+		}
+	}
+	return sb.String()
+}
+
+// colorLines colors every line of text on its own, so the color does not run
+// into the indentation of the next line.
+func colorLines(text string, paint func(a ...interface{}) string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = paint(line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// split returns the words of text with the whitespace between them as
+// separate tokens.
+func split(text string) []string {
+	tokens := []string{}
+	start, space := 0, false
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) != space {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}